@@ -3,11 +3,14 @@ package console
 import (
 	"fmt"
 	"log"
+	"strings"
 
 	alt "github.com/bakks/butterfish/bubbles/altscreenwrapper"
 	"github.com/bakks/butterfish/bubbles/util"
 	"github.com/bakks/butterfish/bubbles/viewport"
+	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/textarea"
+	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 )
@@ -18,6 +21,14 @@ import (
 // - A callback for when the user enters a command
 // - A callback for when the program exits
 // - An io.Writer implementation for printing to the console
+//
+// Keys:
+// - Enter sends the input, Alt-Enter or Ctrl-J inserts a newline
+// - PgUp/PgDn and the mouse wheel scroll the output
+// - Ctrl-F searches the output upwards from the bottom as the query is typed,
+//   Enter or Ctrl-F again jumps to the previous match, Ctrl-N to the next,
+//   Esc ends the search
+// - Ctrl-C or Esc quits
 
 type ConsolePrintMsg struct {
 	Text string
@@ -63,6 +74,9 @@ func NewConsoleProgram(configCallback func(ConsoleModel) ConsoleModel, commandCa
 	}
 }
 
+// The input box grows with its content up to this many lines
+const maxInputHeight = 10
+
 type ConsoleModel struct {
 	width           int
 	height          int
@@ -72,6 +86,12 @@ type ConsoleModel struct {
 	promptTextStyle lipgloss.Style
 	err             error
 	commandCallback func(string)
+	layout          [4]int // the last child sizes set by resize()
+
+	// search mode replaces the input box with a query input
+	searching    bool
+	search       textinput.Model
+	searchStatus string
 }
 
 func NewConsoleModel(callback func(string)) ConsoleModel {
@@ -80,7 +100,7 @@ func NewConsoleModel(callback func(string)) ConsoleModel {
 	ta.Focus()
 
 	ta.Prompt = "┃ "
-	ta.CharLimit = 280
+	ta.CharLimit = 0
 
 	// Remove cursor line styling
 	ta.FocusedStyle.CursorLine = lipgloss.NewStyle()
@@ -88,7 +108,11 @@ func NewConsoleModel(callback func(string)) ConsoleModel {
 
 	vp := viewport.New()
 
-	ta.KeyMap.InsertNewline.SetEnabled(false)
+	// Enter sends the input, so newlines need a modifier
+	ta.KeyMap.InsertNewline = key.NewBinding(key.WithKeys("alt+enter", "ctrl+j"))
+
+	search := textinput.New()
+	search.Prompt = "Search: "
 
 	return ConsoleModel{
 		width:           20,
@@ -99,6 +123,7 @@ func NewConsoleModel(callback func(string)) ConsoleModel {
 		promptTextStyle: lipgloss.NewStyle().Foreground(lipgloss.Color("12")),
 		err:             nil,
 		commandCallback: callback,
+		search:          search,
 	}
 }
 
@@ -111,15 +136,103 @@ func (this *ConsoleModel) SetStyles(promptOutStyle, promptTextStyle lipgloss.Sty
 	this.promptTextStyle = promptTextStyle
 }
 
-func consoleChildSizes(width, height int) (int, int, int, int) {
+func consoleChildSizes(width, height, inputLines int) (int, int, int, int) {
 	taWidth := width
-	taHeight := 3
+	taHeight := min(max(inputLines, 3), maxInputHeight)
 	vpWidth := width
 	vpHeight := height - taHeight
 
 	return vpWidth, vpHeight, taWidth, taHeight
 }
 
+// Lay out the viewport and input box, the input box height depends on the
+// number of lines entered
+func (this *ConsoleModel) resize() tea.Cmd {
+	layout := [4]int{}
+	layout[0], layout[1], layout[2], layout[3] = consoleChildSizes(
+		this.width, this.height, this.textarea.LineCount())
+	if layout == this.layout {
+		return nil
+	}
+	this.layout = layout
+	vpWidth, vpHeight, taWidth, taHeight := layout[0], layout[1], layout[2], layout[3]
+
+	atBottom := this.viewport.AtBottom()
+	var cmd tea.Cmd
+	this.viewport, cmd = this.viewport.Update(util.NewSetSizeMsg(vpWidth, vpHeight))
+	if atBottom {
+		this.viewport.GotoBottom()
+	}
+
+	this.textarea.SetWidth(taWidth)
+	this.textarea.SetHeight(taHeight)
+	this.search.Width = taWidth - len(this.search.Prompt) - 1
+	return cmd
+}
+
+func (this *ConsoleModel) startSearch() tea.Cmd {
+	this.searching = true
+	this.searchStatus = ""
+	this.search.Reset()
+	this.viewport.ClearSearch()
+	this.textarea.Blur()
+	return this.search.Focus()
+}
+
+func (this *ConsoleModel) endSearch() tea.Cmd {
+	this.searching = false
+	this.search.Blur()
+	this.viewport.ClearSearch()
+	this.viewport.GotoBottom()
+	return this.textarea.Focus()
+}
+
+// Describe the search next to the query input
+func (this *ConsoleModel) updateSearchStatus() {
+	current, total := this.viewport.SearchStatus()
+	switch {
+	case this.viewport.SearchQuery() == "":
+		this.searchStatus = ""
+	case total == 0:
+		this.searchStatus = "no match"
+	default:
+		this.searchStatus = fmt.Sprintf("%d of %d", total-current+1, total)
+	}
+}
+
+func (this ConsoleModel) updateSearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return this, tea.Quit
+
+	case tea.KeyEsc:
+		cmd := this.endSearch()
+		return this, tea.Batch(cmd, this.resize())
+
+	case tea.KeyEnter, tea.KeyCtrlF, tea.KeyCtrlP:
+		this.viewport.NextMatch()
+		this.updateSearchStatus()
+		return this, nil
+
+	case tea.KeyCtrlN:
+		this.viewport.PrevMatch()
+		this.updateSearchStatus()
+		return this, nil
+
+	case tea.KeyPgUp, tea.KeyPgDown:
+		var cmd tea.Cmd
+		this.viewport, cmd = this.viewport.Update(msg)
+		return this, cmd
+	}
+
+	var cmd tea.Cmd
+	this.search, cmd = this.search.Update(msg)
+	// search upwards from the bottom as the query is typed
+	this.viewport.SetSearch(this.search.Value(), true)
+	this.updateSearchStatus()
+	return this, cmd
+}
+
 func (this ConsoleModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var taCmd tea.Cmd
 	var vpCmd tea.Cmd
@@ -130,32 +243,47 @@ func (this ConsoleModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		passMsgOn = false
 		this.width = msg.Width
 		this.height = msg.Height
-
-		vpWidth, vpHeight, taWidth, taHeight := consoleChildSizes(this.width, this.height)
-		vpMsg := util.NewSetSizeMsg(vpWidth, vpHeight)
-		this.viewport, vpCmd = this.viewport.Update(vpMsg)
-
-		this.textarea.SetWidth(taWidth)
-		this.textarea.SetHeight(taHeight)
+		vpCmd = this.resize()
 
 	case ConsolePrintMsg:
+		following := this.viewport.AtBottom()
+		offset := this.viewport.YOffset
 		this.viewport.WriteString(msg.Text)
-		this.viewport.GotoBottom()
+		if !following || this.searching {
+			// don't yank the view away while reading back or searching
+			this.viewport.SetYOffset(offset)
+		}
+		return this, nil
 
 	case tea.KeyMsg:
+		if this.searching {
+			return this.updateSearch(msg)
+		}
+
 		switch msg.Type {
 		case tea.KeyCtrlC, tea.KeyEsc:
-			fmt.Println(this.textarea.Value())
 			return this, tea.Quit
 
+		case tea.KeyCtrlF:
+			cmd := this.startSearch()
+			return this, tea.Batch(cmd, this.resize())
+
 		case tea.KeyEnter:
-			cmd := this.textarea.Value()
+			if msg.Alt {
+				break
+			}
+
+			cmd := strings.TrimSpace(this.textarea.Value())
+			if cmd == "" {
+				return this, nil
+			}
 			newLine := fmt.Sprintf("\n\n%s %s\n", this.promptOutStyle.Render(">"), this.promptTextStyle.Render(cmd))
 
 			this.viewport.WriteString(newLine)
 			this.textarea.Reset()
 			this.viewport.GotoBottom()
 			this.commandCallback(cmd)
+			return this, this.resize()
 		}
 
 	// We handle errors just like any other message
@@ -169,13 +297,21 @@ func (this ConsoleModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		this.textarea, taCmd = this.textarea.Update(msg)
 	}
 
-	return this, tea.Batch(taCmd, vpCmd)
+	return this, tea.Batch(taCmd, vpCmd, this.resize())
 }
 
 func (this ConsoleModel) View() string {
+	input := this.textarea.View()
+	if this.searching {
+		input = this.search.View()
+		if this.searchStatus != "" {
+			input += "  " + this.promptOutStyle.Render(this.searchStatus)
+		}
+	}
+
 	return fmt.Sprintf(
 		"%s\n%s",
 		this.viewport.View(),
-		this.textarea.View(),
+		input,
 	)
 }
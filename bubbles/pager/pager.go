@@ -0,0 +1,223 @@
+package pager
+
+import (
+	"fmt"
+	"io"
+
+	alt "github.com/bakks/butterfish/bubbles/altscreenwrapper"
+	"github.com/bakks/butterfish/bubbles/util"
+	"github.com/bakks/butterfish/bubbles/viewport"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// This is a Charm BubbleTea model that shows a document full screen, like
+// less, with a status line at the bottom. It's used to re-open long answers
+// from the shell.
+// Keys:
+// - j/k or the arrows scroll a line, PgUp/PgDn, space and b scroll a page
+// - g/G go to the top and bottom
+// - / searches as the query is typed, highlighting matches, then n/N go to
+//   the next and previous match
+// - 1-9 call the copy callback with the block number
+// - q or Esc quits
+
+type Model struct {
+	width    int
+	height   int
+	title    string
+	viewport viewport.Model
+	// copy a numbered block, returns a message for the status line
+	copyCallback func(int) string
+
+	searching    bool
+	search       textinput.Model
+	searchOrigin int // where the view was when the search started
+	status       string
+	titleStyle   lipgloss.Style
+	helpStyle    lipgloss.Style
+}
+
+func New(content, title string, copyCallback func(int) string) Model {
+	vp := viewport.New()
+	vp.WriteString(content)
+	vp.GotoTop()
+
+	search := textinput.New()
+	search.Prompt = "/"
+
+	return Model{
+		width:        80,
+		height:       20,
+		title:        title,
+		viewport:     vp,
+		copyCallback: copyCallback,
+		search:       search,
+		titleStyle:   lipgloss.NewStyle().Reverse(true),
+		helpStyle:    lipgloss.NewStyle().Faint(true),
+	}
+}
+
+// A pager running as its own Bubble Tea program, showing content full screen
+// until the user quits. Keys are read from input rather than stdin, so the
+// caller can keep reading the terminal itself and forward what it reads.
+// Output may not be the terminal either, e.g. when it's also written to a
+// recording, so Bubble Tea can't get the size from it: the pager starts at
+// the given size and the caller passes on resizes.
+type Pager struct {
+	program *tea.Program
+}
+
+func NewPager(content, title string, copyCallback func(int) string, input io.Reader, output io.Writer, width, height int) *Pager {
+	model, _ := New(content, title, copyCallback).Update(util.NewSetSizeMsg(width, height))
+	program := tea.NewProgram(alt.NewAltScreenWrapper(model),
+		tea.WithAltScreen(),
+		tea.WithMouseCellMotion(),
+		tea.WithoutBracketedPaste(),
+		tea.WithInput(input),
+		tea.WithOutput(output))
+	return &Pager{program: program}
+}
+
+// Run blocks until the user quits
+func (this *Pager) Run() error {
+	_, err := this.program.Run()
+	return err
+}
+
+// Resize the pager, safe to call after it has quit
+func (this *Pager) Resize(width, height int) {
+	this.program.Send(tea.WindowSizeMsg{Width: width, Height: height})
+}
+
+func (this Model) Init() tea.Cmd {
+	return nil
+}
+
+// Describe the search for the status line
+func (this *Model) searchStatus() {
+	query := this.viewport.SearchQuery()
+	current, total := this.viewport.SearchStatus()
+	if total == 0 {
+		this.status = fmt.Sprintf("Pattern not found: %s", query)
+		return
+	}
+
+	this.status = fmt.Sprintf("/%s  match %d of %d", query, current, total)
+}
+
+func (this Model) updateSearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyCtrlC, tea.KeyEsc:
+		this.searching = false
+		this.search.Blur()
+		this.viewport.ClearSearch()
+		this.viewport.SetYOffset(this.searchOrigin)
+		return this, nil
+
+	case tea.KeyEnter:
+		this.searching = false
+		this.search.Blur()
+		if this.viewport.SearchQuery() != "" {
+			this.searchStatus()
+		}
+		return this, nil
+	}
+
+	var cmd tea.Cmd
+	this.search, cmd = this.search.Update(msg)
+	// search as the query is typed
+	this.viewport.SetSearch(this.search.Value(), false)
+	return this, cmd
+}
+
+func (this Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd
+
+	switch msg := msg.(type) {
+	case util.SetSizeMsg:
+		this.width = msg.Width
+		this.height = msg.Height
+		offset := this.viewport.YOffset
+		// leave a line for the status bar
+		this.viewport, cmd = this.viewport.Update(util.NewSetSizeMsg(msg.Width, msg.Height-1))
+		this.viewport.SetYOffset(offset)
+		return this, cmd
+
+	case tea.KeyMsg:
+		if this.searching {
+			return this.updateSearch(msg)
+		}
+		this.status = ""
+
+		switch msg.String() {
+		case "q", "esc", "ctrl+c":
+			return this, tea.Quit
+		case "j", "down", "enter", "ctrl+n":
+			this.viewport.LineDown(1)
+		case "k", "up", "ctrl+p":
+			this.viewport.LineUp(1)
+		case "pgdown", " ", "f", "ctrl+f":
+			this.viewport.ViewDown()
+		case "pgup", "b", "ctrl+b":
+			this.viewport.ViewUp()
+		case "d", "ctrl+d":
+			this.viewport.HalfViewDown()
+		case "u", "ctrl+u":
+			this.viewport.HalfViewUp()
+		case "g", "home":
+			this.viewport.GotoTop()
+		case "G", "end":
+			this.viewport.GotoBottom()
+		case "/":
+			this.searching = true
+			this.searchOrigin = this.viewport.YOffset
+			this.search.Reset()
+			this.viewport.ClearSearch()
+			return this, this.search.Focus()
+		case "n":
+			if this.viewport.NextMatch() {
+				this.searchStatus()
+			}
+		case "N":
+			if this.viewport.PrevMatch() {
+				this.searchStatus()
+			}
+		case "1", "2", "3", "4", "5", "6", "7", "8", "9":
+			if this.copyCallback != nil {
+				this.status = this.copyCallback(int(msg.Runes[0] - '0'))
+			}
+		}
+		return this, nil
+
+	case tea.MouseMsg:
+		this.viewport, cmd = this.viewport.Update(msg)
+		return this, cmd
+	}
+
+	return this, nil
+}
+
+// The bottom line shows the search input, a status message, or the title
+// and key help
+func (this Model) statusLine() string {
+	if this.searching {
+		return this.search.View()
+	}
+	if this.status != "" {
+		return this.status
+	}
+
+	percent := fmt.Sprintf(" %3.0f%% ", this.viewport.ScrollPercent()*100)
+	help := "  q quit  / search  n/N next/prev  1-9 copy block"
+	line := this.titleStyle.Render(" "+this.title+" ") + this.titleStyle.Render(percent)
+	if lipgloss.Width(line)+lipgloss.Width(help) <= this.width {
+		line += this.helpStyle.Render(help)
+	}
+	return line
+}
+
+func (this Model) View() string {
+	return fmt.Sprintf("%s\n%s", this.viewport.View(), this.statusLine())
+}
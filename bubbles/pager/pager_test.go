@@ -0,0 +1,102 @@
+package pager
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/bakks/butterfish/bubbles/util"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/stretchr/testify/assert"
+)
+
+func key(s string) tea.KeyMsg {
+	return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(s)}
+}
+
+func update(m Model, msgs ...tea.Msg) Model {
+	for _, msg := range msgs {
+		model, _ := m.Update(msg)
+		m = model.(Model)
+	}
+	return m
+}
+
+func TestPagerSearch(t *testing.T) {
+	lines := []string{}
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	lines[30] = "the needle"
+	lines[40] = "another needle"
+
+	m := New(strings.Join(lines, "\n"), "test", nil)
+	m = update(m, util.NewSetSizeMsg(40, 11))
+	assert.Equal(t, 0, m.viewport.YOffset)
+
+	// incremental, the view moves as the query is typed
+	m = update(m, key("/"), key("need"))
+	assert.True(t, m.searching)
+	assert.Contains(t, m.View(), "\x1b[7;4mneed\x1b[27;24mle")
+
+	m = update(m, key("le"), tea.KeyMsg{Type: tea.KeyEnter})
+	assert.False(t, m.searching)
+	assert.Equal(t, "/needle  match 1 of 2", m.statusLine())
+
+	m = update(m, key("n"))
+	assert.Equal(t, "/needle  match 2 of 2", m.statusLine())
+	m = update(m, key("N"))
+	assert.Equal(t, "/needle  match 1 of 2", m.statusLine())
+
+	m = update(m, key("/"), key("missing"), tea.KeyMsg{Type: tea.KeyEnter})
+	assert.Contains(t, m.statusLine(), "Pattern not found")
+
+	// escape goes back to where the search started
+	m = update(m, key("g"), key("/"), key("needle"))
+	assert.NotEqual(t, 0, m.viewport.YOffset)
+	m = update(m, tea.KeyMsg{Type: tea.KeyEsc})
+	assert.Equal(t, 0, m.viewport.YOffset)
+	assert.NotContains(t, m.View(), "\x1b[7")
+}
+
+func TestPagerCopy(t *testing.T) {
+	copied := 0
+	m := New("```\nls\n```", "test", func(n int) string {
+		copied = n
+		return "copied"
+	})
+
+	m = update(m, key("2"))
+	assert.Equal(t, 2, copied)
+	assert.Equal(t, "copied", m.statusLine())
+
+	_, cmd := m.Update(key("q"))
+	assert.NotNil(t, cmd)
+}
+
+func TestPagerResize(t *testing.T) {
+	lines := []string{}
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+
+	// the output isn't a terminal, so the size only comes from the caller
+	input, keys := io.Pipe()
+	output := &bytes.Buffer{}
+	pager := NewPager(strings.Join(lines, "\n"), "test", nil, input, output, 40, 11)
+	done := make(chan error)
+	go func() {
+		done <- pager.Run()
+	}()
+
+	pager.Resize(40, 31)
+	keys.Write([]byte("q"))
+	assert.NoError(t, <-done)
+	assert.Contains(t, output.String(), "line 29")
+	assert.NotContains(t, output.String(), "line 30")
+
+	// and quitting doesn't leave resizes blocked
+	pager.Resize(40, 20)
+}
@@ -0,0 +1,276 @@
+package viewport
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/x/ansi"
+)
+
+// Incremental search: SetSearch is called as the query is typed, it
+// highlights every match in the view and scrolls to the nearest matching
+// line, NextMatch and PrevMatch then move between matching lines. Matching
+// ignores case and any styling in the text.
+
+// Matches are shown in reverse video, and on the current line also
+// underlined. We only switch those attributes so the text keeps its colors.
+const (
+	matchStyle           = "\x1b[7m"
+	matchStyleOff        = "\x1b[27m"
+	currentMatchStyle    = "\x1b[7;4m"
+	currentMatchStyleOff = "\x1b[27;24m"
+)
+
+type searchState struct {
+	query    string
+	backward bool // the direction of the search started by SetSearch
+	origin   int  // line the search started from
+	line     int  // wrapped line of the current match, -1 for none
+}
+
+// Search returns the index of the next wrapped line containing query,
+// ignoring case and ANSI styling, starting at from and wrapping around. If
+// backward is set the search goes up instead. Returns -1 if there's no match.
+func (this Model) Search(query string, from int, backward bool) int {
+	numLines := this.buffer.NumLines()
+	if query == "" || numLines == 0 {
+		return -1
+	}
+	queryRunes := lowerRunes(query)
+
+	step := 1
+	if backward {
+		step = -1
+	}
+	for i := 0; i < numLines; i++ {
+		index := ((from+i*step)%numLines + numLines) % numLines
+		line := lowerRunes(ansi.Strip(this.buffer.wrappedLines[index]))
+		if len(findMatches(line, queryRunes)) > 0 {
+			return index
+		}
+	}
+	return -1
+}
+
+// ScrollTo scrolls so that the given line is visible, a third of the way
+// down the viewport.
+func (this *Model) ScrollTo(line int) {
+	this.SetYOffset(line - this.Height/3)
+}
+
+// SetSearch highlights the matches of query and scrolls to the first line
+// with a match, searching down from the top of the view or, if backward is
+// set, up from the bottom. Each call starts from where the first one did, so
+// it can be called on every keystroke. An empty query clears the search.
+// Returns false if there's no match.
+func (this *Model) SetSearch(query string, backward bool) bool {
+	if query == "" {
+		this.ClearSearch()
+		return false
+	}
+
+	if this.search.query == "" {
+		this.search.origin = this.YOffset
+		if backward {
+			this.search.origin = this.YOffset + this.Height - 1
+		}
+	}
+	this.search.query = query
+	this.search.backward = backward
+
+	return this.findMatch(this.search.origin, backward)
+}
+
+// ClearSearch removes the search highlighting.
+func (this *Model) ClearSearch() {
+	this.search = searchState{line: -1}
+}
+
+// SearchQuery returns the current search query, "" if not searching.
+func (this Model) SearchQuery() string {
+	return this.search.query
+}
+
+// NextMatch moves to the next matching line in the direction of the search,
+// wrapping around. Returns false if there's no match.
+func (this *Model) NextMatch() bool {
+	return this.stepMatch(this.search.backward)
+}
+
+// PrevMatch moves to the next matching line against the direction of the
+// search, wrapping around. Returns false if there's no match.
+func (this *Model) PrevMatch() bool {
+	return this.stepMatch(!this.search.backward)
+}
+
+func (this *Model) stepMatch(backward bool) bool {
+	if this.search.query == "" {
+		return false
+	}
+
+	from := this.YOffset
+	if this.search.line >= 0 {
+		from = this.search.line + 1
+		if backward {
+			from = this.search.line - 1
+		}
+	}
+	return this.findMatch(from, backward)
+}
+
+func (this *Model) findMatch(from int, backward bool) bool {
+	line := this.Search(this.search.query, from, backward)
+	this.search.line = line
+	if line < 0 {
+		return false
+	}
+
+	if line < this.YOffset || line >= this.YOffset+this.Height {
+		this.ScrollTo(line)
+	}
+	return true
+}
+
+// SearchStatus returns the position of the current matching line among all
+// matching lines, and the number of matching lines. Current is 0 if there's
+// no current match.
+func (this Model) SearchStatus() (current, total int) {
+	if this.search.query == "" {
+		return 0, 0
+	}
+
+	query := lowerRunes(this.search.query)
+	for i, line := range this.buffer.wrappedLines {
+		if len(findMatches(lowerRunes(ansi.Strip(line)), query)) == 0 {
+			continue
+		}
+		total++
+		if i == this.search.line {
+			current = total
+		}
+	}
+	return current, total
+}
+
+// Lowercase rune by rune, so the result has a rune for each rune of s
+func lowerRunes(s string) []rune {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+// Indexes of the runes where query starts in text, not overlapping
+func findMatches(text, query []rune) []int {
+	matches := []int{}
+	if len(query) == 0 {
+		return matches
+	}
+
+	for i := 0; i+len(query) <= len(text); i++ {
+		match := true
+		for j := range query {
+			if text[i+j] != query[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			matches = append(matches, i)
+			i += len(query) - 1
+		}
+	}
+	return matches
+}
+
+// Wrap the matches of query in line with the match style, leaving escape
+// sequences in the line as they are.
+func highlightMatches(line, query string, current bool) string {
+	// split the line into its visible runes and where they are in the line
+	text := []rune{}
+	offsets := []int{}
+	for i := 0; i < len(line); {
+		if line[i] == 0x1b {
+			i += escapeLength(line[i:])
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(line[i:])
+		text = append(text, unicode.ToLower(r))
+		offsets = append(offsets, i)
+		i += size
+	}
+	offsets = append(offsets, len(line))
+
+	queryRunes := lowerRunes(query)
+	matches := findMatches(text, queryRunes)
+	if len(matches) == 0 {
+		return line
+	}
+
+	on, off := matchStyle, matchStyleOff
+	if current {
+		on, off = currentMatchStyle, currentMatchStyleOff
+	}
+
+	var builder strings.Builder
+	last := 0
+	for _, match := range matches {
+		start := offsets[match]
+		// the end of the match is just after its last rune, before any
+		// escapes that follow it
+		end := offsets[match+len(queryRunes)-1]
+		_, size := utf8.DecodeRuneInString(line[end:])
+		end += size
+
+		builder.WriteString(line[last:start])
+		builder.WriteString(on)
+		// styling inside the match, e.g. a reset between highlighted tokens,
+		// would end the match style so we repeat it after each escape
+		for i := start; i < end; {
+			if line[i] == 0x1b {
+				length := escapeLength(line[i:])
+				builder.WriteString(line[i : i+length])
+				builder.WriteString(on)
+				i += length
+				continue
+			}
+			builder.WriteByte(line[i])
+			i++
+		}
+		builder.WriteString(off)
+		last = end
+	}
+	builder.WriteString(line[last:])
+	return builder.String()
+}
+
+// The length of the escape sequence at the start of s: CSI sequences like
+// colors, OSC sequences like hyperlinks, or a two byte escape.
+func escapeLength(s string) int {
+	if len(s) < 2 {
+		return len(s)
+	}
+
+	switch s[1] {
+	case '[':
+		for i := 2; i < len(s); i++ {
+			if s[i] >= 0x40 && s[i] <= 0x7e {
+				return i + 1
+			}
+		}
+	case ']':
+		for i := 2; i < len(s); i++ {
+			if s[i] == 0x07 {
+				return i + 1
+			}
+			if s[i] == 0x1b && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+		}
+	default:
+		return 2
+	}
+	return len(s)
+}
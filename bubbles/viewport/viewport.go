@@ -8,8 +8,7 @@ import (
 	"github.com/charmbracelet/bubbles/key"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
-	"github.com/muesli/reflow/wordwrap"
-	"github.com/muesli/reflow/wrap"
+	"github.com/charmbracelet/x/ansi"
 
 	"github.com/bakks/butterfish/bubbles/util"
 )
@@ -34,6 +33,10 @@ type KeyMap struct {
 	HalfPageDown key.Binding
 	Down         key.Binding
 	Up           key.Binding
+	// Move between matches of the search set with SetSearch, these aren't
+	// bound by default since the keys a search uses depend on the program
+	NextMatch key.Binding
+	PrevMatch key.Binding
 }
 
 // DefaultKeyMap returns a set of pager-like default keybindings.
@@ -79,14 +82,11 @@ func (this *viewportBuffer) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// Wrap a line at word boundaries, breaking words longer than the width.
+// Widths are measured in terminal cells, skipping escape sequences and
+// treating grapheme clusters like emoji or CJK characters as one unit.
 func (this *viewportBuffer) wrap(s string) string {
-	wrapper := wrap.NewWriter(this.width)
-	wrapper.PreserveSpace = true
-	wordWrapped := wordwrap.String(s, this.width)
-	wrapper.Write([]byte(wordWrapped))
-	wrapped := wrapper.String()
-
-	return wrapped
+	return ansi.Wrap(s, this.width, "")
 }
 
 // Expand slice X until it is of size l, if less than length l,
@@ -122,7 +122,7 @@ func (this *viewportBuffer) wrapRange(start int) {
 	for i, line := range this.rawLines[start:] {
 		var wrappedLines []string
 
-		if len(line) > this.width {
+		if ansi.StringWidth(line) > this.width {
 			w := this.wrap(line)
 			wrappedLines = strings.Split(w, "\n")
 		} else {
@@ -219,6 +219,7 @@ type Model struct {
 
 	initialized bool
 	buffer      *viewportBuffer
+	search      searchState
 }
 
 func (this *Model) WriteString(s string) {
@@ -238,6 +239,7 @@ func (this *Model) setInitialValues() {
 	this.MouseWheelDelta = 3
 	this.Width = 80
 	this.Height = 20
+	this.search.line = -1
 	this.initialized = true
 }
 
@@ -432,6 +434,8 @@ func (this Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 		this.Width = msg.Width
 		// this is a potentially expensive call
 		this.buffer.SetWidth(msg.Width)
+		// lines have moved, the next match is found from the view
+		this.search.line = -1
 
 	case tea.KeyMsg:
 		switch {
@@ -452,17 +456,26 @@ func (this Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 
 		case key.Matches(msg, this.KeyMap.Up):
 			this.LineUp(1)
+
+		case key.Matches(msg, this.KeyMap.NextMatch):
+			this.NextMatch()
+
+		case key.Matches(msg, this.KeyMap.PrevMatch):
+			this.PrevMatch()
 		}
 
 	case tea.MouseMsg:
 		if !this.MouseWheelEnabled {
 			break
 		}
-		switch msg.Type {
-		case tea.MouseWheelUp:
+		if msg.Action != tea.MouseActionPress {
+			break
+		}
+		switch msg.Button {
+		case tea.MouseButtonWheelUp:
 			this.LineUp(this.MouseWheelDelta)
 
-		case tea.MouseWheelDown:
+		case tea.MouseButtonWheelDown:
 			this.LineDown(this.MouseWheelDelta)
 		}
 	}
@@ -472,7 +485,17 @@ func (this Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 
 // View renders the viewport into a string.
 func (this Model) View() string {
-	content := strings.Join(this.visibleLines(), "\n")
+	lines := this.visibleLines()
+	if this.search.query != "" {
+		highlighted := make([]string, len(lines))
+		for i, line := range lines {
+			current := this.YOffset+i == this.search.line
+			highlighted[i] = highlightMatches(line, this.search.query, current)
+		}
+		lines = highlighted
+	}
+
+	content := strings.Join(lines, "\n")
 	rendered := lipgloss.NewStyle().
 		Width(this.Width).
 		Height(this.Height).    // pad to height.
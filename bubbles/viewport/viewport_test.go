@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	tea "github.com/charmbracelet/bubbletea"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -125,3 +126,111 @@ func TestViewportScrolling(t *testing.T) {
 	assert.Equal(t, "0   ", lines[0])
 
 }
+
+func TestViewportSearch(t *testing.T) {
+	vp := New()
+	vp.Height = 5
+	vp.buffer.SetWidth(20)
+	vp.WriteString("alpha\nbeta\n\x1b[1mGamma\x1b[0m\nalpha again\nend")
+
+	// upwards from the bottom, ignoring case and styling
+	assert.Equal(t, 3, vp.Search("ALPHA", 4, true))
+	assert.Equal(t, 0, vp.Search("alpha", 2, true))
+	assert.Equal(t, 2, vp.Search("gamma", 4, true))
+
+	// downwards, wrapping around
+	assert.Equal(t, 3, vp.Search("alpha", 1, false))
+	assert.Equal(t, 0, vp.Search("alpha", 4, false))
+	assert.Equal(t, 3, vp.Search("alpha", -1, true))
+	assert.Equal(t, -1, vp.Search("delta", 4, true))
+}
+
+func TestViewportBufferWrapWidth(t *testing.T) {
+	buf := newBuffer()
+	buf.SetWidth(10)
+
+	// escape sequences take no space, this fits on one line
+	buf.WriteString("\x1b[38;5;148mfmt\x1b[0m.Print\n")
+	assert.Equal(t, "\x1b[38;5;148mfmt\x1b[0m.Print", buf.wrappedLines[0])
+
+	// wide characters take two cells each
+	buf.WriteString("日本語のテキスト\n")
+	assert.Equal(t, "日本語のテ", buf.wrappedLines[1])
+	assert.Equal(t, "キスト", buf.wrappedLines[2])
+
+	// an emoji with a modifier is one grapheme and isn't split
+	buf.WriteString("aaaaaaaaa👍🏽\n")
+	assert.Equal(t, "aaaaaaaaa", buf.wrappedLines[3])
+	assert.Equal(t, "👍🏽", buf.wrappedLines[4])
+}
+
+func TestViewportSearchHighlight(t *testing.T) {
+	vp := New()
+	vp.Width = 20
+	vp.Height = 3
+	vp.buffer.SetWidth(20)
+	for i := 0; i < 10; i++ {
+		vp.WriteString(fmt.Sprintf("line %d\n", i))
+	}
+	vp.WriteString("\x1b[1mFoo\x1b[0mbar foobar")
+	vp.GotoTop()
+
+	// searching down from the top of the view
+	assert.True(t, vp.SetSearch("line 5", false))
+	assert.Equal(t, 5, vp.search.line)
+	current, total := vp.SearchStatus()
+	assert.Equal(t, 1, current)
+	assert.Equal(t, 1, total)
+
+	// typing more of the query searches again from the same place
+	assert.True(t, vp.SetSearch("foob", false))
+	assert.Equal(t, 10, vp.search.line)
+	view := vp.View()
+	// the match style is repeated after the escapes inside the match
+	assert.Contains(t, view, "\x1b[1m\x1b[7;4mFoo\x1b[0m\x1b[7;4mb\x1b[27;24m")
+	assert.Contains(t, view, "ar \x1b[7;4mfoob\x1b[27;24mar")
+
+	assert.False(t, vp.SetSearch("missing", false))
+	assert.Equal(t, -1, vp.search.line)
+
+	vp.ClearSearch()
+	assert.NotContains(t, vp.View(), "\x1b[7")
+}
+
+func TestViewportSearchNext(t *testing.T) {
+	vp := New()
+	vp.Height = 2
+	vp.buffer.SetWidth(20)
+	vp.WriteString("match a\nother\nmatch b\nother\nmatch c")
+
+	// upwards from the bottom of the view
+	assert.True(t, vp.SetSearch("match", true))
+	assert.Equal(t, 4, vp.search.line)
+
+	vp.NextMatch()
+	assert.Equal(t, 2, vp.search.line)
+	vp.NextMatch()
+	assert.Equal(t, 0, vp.search.line)
+	assert.Equal(t, 0, vp.YOffset)
+
+	// wraps around
+	vp.NextMatch()
+	assert.Equal(t, 4, vp.search.line)
+	vp.PrevMatch()
+	assert.Equal(t, 0, vp.search.line)
+}
+
+func TestViewportMouseWheel(t *testing.T) {
+	vp := New()
+	vp.Height = 5
+	vp.buffer.SetWidth(20)
+	for i := 0; i < 20; i++ {
+		vp.WriteString(fmt.Sprintf("%d\n", i))
+	}
+	bottom := vp.YOffset
+
+	vp, _ = vp.Update(tea.MouseMsg{Button: tea.MouseButtonWheelUp, Action: tea.MouseActionPress})
+	assert.Equal(t, bottom-3, vp.YOffset)
+	vp, _ = vp.Update(tea.MouseMsg{Button: tea.MouseButtonWheelDown, Action: tea.MouseActionPress})
+	assert.Equal(t, bottom, vp.YOffset)
+}
@@ -2,53 +2,105 @@ package butterfish
 
 import "fmt"
 
+// Names of CSI sequences by their final byte, the same byte means something
+// else with a private marker like ?, see privateCsiNames
+var csiNames = map[byte]string{
+	'@': "ICH",
+	'A': "CUU",
+	'B': "CUD",
+	'C': "CUF",
+	'D': "CUB",
+	'E': "CNL",
+	'F': "CPL",
+	'G': "CHA",
+	'H': "CUP",
+	'I': "CHT",
+	'J': "ED",
+	'K': "EL",
+	'L': "IL",
+	'M': "DL",
+	'P': "DCH",
+	'R': "CPR",
+	'S': "SU",
+	'T': "SD",
+	'X': "ECH",
+	'Z': "CBT",
+	'c': "DA",
+	'd': "VPA",
+	'f': "HVP",
+	'g': "TBC",
+	'h': "SM",
+	'l': "RM",
+	'm': "SGR",
+	'n': "DSR",
+	'r': "DECSTBM",
+	's': "SCOSC",
+	't': "XTWINOPS",
+	'u': "SCORC",
+	'~': "KEY",
+}
+
+var privateCsiNames = map[string]string{
+	"?h":  "DECSET",
+	"?l":  "DECRST",
+	"?u":  "KITTYKB",
+	">u":  "KITTYKB",
+	"<u":  "KITTYKB",
+	"=u":  "KITTYKB",
+	"<M":  "MOUSE",
+	"<m":  "MOUSE",
+	">c":  "DA2",
+	"?c":  "DA",
+	">q":  "XTVERSION",
+	"?n":  "DSR",
+	"?$p": "DECRQM",
+	"$p":  "DECRQM",
+	" q":  "DECSCUSR",
+}
+
+// A CSI sequence is ESC [, parameter bytes, intermediate bytes and a final
+// byte, see ECMA-48 5.4. Returns its length and name, unknown sequences are
+// named CSI.
 func prettyAnsiCsi(data []byte) (int, string) {
-	// eat digits
 	i := 2
-	for ; i < len(data); i++ {
-		if data[i] < '0' || data[i] > '9' {
-			break
-		}
+	for i < len(data) && data[i] >= 0x30 && data[i] <= 0x3f {
+		i++
 	}
-
-	if i == 2 {
-		return 2, "CSI"
-		//panic(fmt.Sprintf("Unknown CSI sequence, expected digits: %x", data))
+	paramsEnd := i
+	for i < len(data) && data[i] >= 0x20 && data[i] <= 0x2f {
+		i++
 	}
-	if i == len(data) {
+	if i == len(data) || data[i] < 0x40 || data[i] > 0x7e {
+		// incomplete or broken
 		return i, "CSI"
-		//panic(fmt.Sprintf("Unknown CSI sequence, expected command: %x", data))
 	}
 
-	switch data[i] {
-	case 'A':
-		return i + 1, "CUP"
-	case 'B':
-		return i + 1, "CUD"
-	case 'C':
-		return i + 1, "CUF"
-	case 'D':
-		return i + 1, "CUB"
-	case 'E':
-		return i + 1, "CNL"
-	case 'F':
-		return i + 1, "CPL"
-	case 'J':
-		return i + 1, "ED"
-	case 'K':
-		return i + 1, "EL"
-	case 'S':
-		return i + 1, "SU"
-	case 'm':
-		return i + 1, "SGR"
-	case 'n':
-		if data[2] == '6' {
-			return i + 2, "DSR"
-		}
-		panic("Unknown CSI sequence")
+	final := data[i]
+	private := ""
+	if paramsEnd > 2 && data[2] >= '<' && data[2] <= '?' {
+		private = string(data[2])
 	}
+	if name, ok := privateCsiNames[private+string(data[paramsEnd:i])+string(final)]; ok {
+		return i + 1, name
+	}
+	if name, ok := csiNames[final]; ok && private == "" && paramsEnd == i {
+		return i + 1, name
+	}
+	return i + 1, "CSI"
+}
 
-	panic("Unknown CSI sequence")
+// The length of a string sequence like OSC, ended by BEL or ST, or all of
+// data if it isn't ended
+func ansiStringLength(data []byte) int {
+	for i := 2; i < len(data); i++ {
+		if data[i] == 0x07 {
+			return i + 1
+		}
+		if data[i] == 0x1b && i+1 < len(data) && data[i+1] == '\\' {
+			return i + 2
+		}
+	}
+	return len(data)
 }
 
 func prettyAnsiC1(data []byte) (int, string) {
@@ -59,22 +111,57 @@ func prettyAnsiC1(data []byte) (int, string) {
 			return prettyAnsiCsi(data)
 		}
 		return 2, "CSI"
+	case ']', '\x9d':
+		n := ansiStringLength(data)
+		// name OSC sequences by their number, e.g. OSC 7 for the directory
+		end := 2
+		for end < n && data[end] >= '0' && data[end] <= '9' {
+			end++
+		}
+		if end > 2 {
+			return n, "OSC " + string(data[2:end])
+		}
+		return n, "OSC"
+	case 'P', '\x90':
+		return ansiStringLength(data), "DCS"
+	case '_', '\x9f':
+		return ansiStringLength(data), "APC"
+	case '^', '\x9e':
+		return ansiStringLength(data), "PM"
+	case 'X', '\x98':
+		return ansiStringLength(data), "SOS"
+	case 'O':
+		if len(data) >= 3 {
+			return 3, "SS3"
+		}
+		return 2, "SS3"
+	case '(', ')', '*', '+':
+		if len(data) >= 3 {
+			return 3, "SCS"
+		}
+		return 2, "SCS"
+	case '7':
+		return 2, "DECSC"
+	case '8':
+		return 2, "DECRC"
+	case '=':
+		return 2, "DECKPAM"
+	case '>':
+		return 2, "DECKPNM"
+	case 'D':
+		return 2, "IND"
+	case 'E':
+		return 2, "NEL"
+	case 'M':
+		return 2, "RI"
+	case 'c':
+		return 2, "RIS"
+	case '\\', '\x9c':
+		return 2, "ST"
 	case '\x8e':
 		return 2, "SSA"
 	case '\x8f':
 		return 2, "ESA"
-	case '\x90':
-		return 2, "DCS"
-	case '\x9c':
-		return 2, "ST"
-	case '\x9d':
-		return 2, "OSC"
-	case '\x98':
-		return 2, "SOS"
-	case '\x9e':
-		return 2, "PM"
-	case '\x9f':
-		return 2, "APC"
 	case 'Q':
 		return 2, "PU1"
 	case 'R':
@@ -82,7 +169,6 @@ func prettyAnsiC1(data []byte) (int, string) {
 	}
 
 	return 2, "C1"
-	//panic(fmt.Sprintf("Unknown C1 sequence: %x", data))
 }
 
 // Given a byte array, check if the beginning of the byte array is an ANSI
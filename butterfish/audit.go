@@ -0,0 +1,290 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// The audit log records every LLM request as one JSON object per line, so it
+// can be grepped, diffed or shipped to a log pipeline, unlike the verbose
+// logging boxes. Messages are recorded as sent, i.e. after secret redaction.
+// When the file grows past the size limit it's rotated to audit.jsonl.1,
+// audit.jsonl.2, etc.
+
+type AuditMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type AuditRecord struct {
+	Timestamp    time.Time        `json:"timestamp"`
+	SessionId    string           `json:"session_id"`
+	Cwd          string           `json:"cwd,omitempty"`
+	Model        string           `json:"model"`
+	Messages     []AuditMessage   `json:"messages"`
+	ToolCalls    []*util.ToolCall `json:"tool_calls,omitempty"`
+	Response     string           `json:"response"`
+	FinishReason string           `json:"finish_reason,omitempty"`
+	FirstTokenMs int64            `json:"first_token_ms,omitempty"`
+	LatencyMs    int64            `json:"latency_ms"`
+	Usage        *util.Usage      `json:"usage,omitempty"`
+	Error        string           `json:"error,omitempty"`
+}
+
+// The user's prompt, i.e. the content of the last user message
+func (this *AuditRecord) Prompt() string {
+	for i := len(this.Messages) - 1; i >= 0; i-- {
+		if this.Messages[i].Role == "user" {
+			return this.Messages[i].Content
+		}
+	}
+	return ""
+}
+
+// Number of rotated files we keep in addition to the current one
+const auditLogBackups = 5
+
+type AuditLog struct {
+	file *util.RotatingFile
+}
+
+// Open the audit log at path for appending, creating its directory if needed
+func OpenAuditLog(path string, maxBytes int64) (*AuditLog, error) {
+	file, err := util.OpenRotatingFile(path, maxBytes, 0, auditLogBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file: file}, nil
+}
+
+func (this *AuditLog) Write(record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	_, err = this.file.Write(data)
+	return err
+}
+
+func (this *AuditLog) Close() error {
+	return this.file.Close()
+}
+
+// A random id identifying this Butterfish session in logs
+func NewSessionId() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+type auditCwdKey struct{}
+
+// Attach the shell's working directory to a request context so it's recorded
+// in the audit log
+func WithAuditCwd(ctx context.Context, cwd string) context.Context {
+	return context.WithValue(ctx, auditCwdKey{}, cwd)
+}
+
+// An LLM wrapper that writes each request and its result to the audit log
+type AuditLLM struct {
+	Client    LLM
+	Log       *AuditLog
+	SessionId string
+	// Ask for usage in streaming responses, which some OpenAI-compatible
+	// servers reject
+	IncludeUsage bool
+}
+
+func (this *AuditLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	request.IncludeUsage = request.IncludeUsage || this.IncludeUsage
+	start := time.Now()
+	response, err := this.Client.CompletionStream(request, writer)
+	this.record(request, response, err, start)
+	return response, err
+}
+
+func (this *AuditLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	start := time.Now()
+	response, err := this.Client.Completion(request)
+	this.record(request, response, err, start)
+	return response, err
+}
+
+func (this *AuditLLM) record(
+	request *util.CompletionRequest,
+	response *util.CompletionResponse,
+	err error,
+	start time.Time) {
+
+	record := &AuditRecord{
+		Timestamp: start,
+		SessionId: this.SessionId,
+		Model:     request.Model,
+		Messages:  auditMessages(request),
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	if request.Ctx != nil {
+		if cwd, ok := request.Ctx.Value(auditCwdKey{}).(string); ok {
+			record.Cwd = cwd
+		}
+	}
+
+	if response != nil {
+		record.Response = response.Completion
+		record.ToolCalls = response.ToolCalls
+		record.FinishReason = response.FinishReason
+		record.FirstTokenMs = response.FirstTokenLatency.Milliseconds()
+		record.Usage = response.Usage
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	writeErr := this.Log.Write(record)
+	if writeErr != nil {
+		log.Printf("Error writing audit log: %s", writeErr)
+	}
+}
+
+func auditMessages(request *util.CompletionRequest) []AuditMessage {
+	messages := []AuditMessage{}
+	if request.SystemMessage != "" {
+		messages = append(messages, AuditMessage{"system", request.SystemMessage})
+	}
+	for _, block := range request.HistoryBlocks {
+		messages = append(messages, AuditMessage{ShellHistoryTypeToRole(block.Type), block.Content})
+	}
+	if request.Prompt != "" {
+		messages = append(messages, AuditMessage{"user", request.Prompt})
+	}
+	return messages
+}
+
+// Criteria for querying the audit log, zero values match everything
+type AuditFilter struct {
+	Since     time.Time
+	SessionId string
+	Model     string
+	Contains  string // case-insensitive match against the prompt and response
+	Errors    bool   // only records with an error
+}
+
+func (this *AuditFilter) Match(record *AuditRecord) bool {
+	if !this.Since.IsZero() && record.Timestamp.Before(this.Since) {
+		return false
+	}
+	if this.SessionId != "" && !strings.HasPrefix(record.SessionId, this.SessionId) {
+		return false
+	}
+	if this.Model != "" && record.Model != this.Model {
+		return false
+	}
+	if this.Errors && record.Error == "" {
+		return false
+	}
+	if this.Contains != "" {
+		needle := strings.ToLower(this.Contains)
+		if !strings.Contains(strings.ToLower(record.Prompt()), needle) &&
+			!strings.Contains(strings.ToLower(record.Response), needle) {
+			return false
+		}
+	}
+	return true
+}
+
+// Read matching records from the audit log and its rotated files, oldest
+// first.
+func ReadAuditLog(path string, filter *AuditFilter) ([]*AuditRecord, error) {
+	paths := []string{}
+	for i := auditLogBackups; i >= 1; i-- {
+		paths = append(paths, fmt.Sprintf("%s.%d", path, i))
+	}
+	paths = append(paths, path)
+
+	records := []*AuditRecord{}
+	found := false
+
+	for _, p := range paths {
+		file, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			record := &AuditRecord{}
+			err := json.Unmarshal(scanner.Bytes(), record)
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: %s", p, line, err)
+			}
+			if filter == nil || filter.Match(record) {
+				records = append(records, record)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("No audit log found at %s, enable it with --audit", path)
+	}
+
+	return records, nil
+}
+
+// Print a short human readable summary of a record
+func PrintAuditRecord(w io.Writer, record *AuditRecord) {
+	fmt.Fprintf(w, "%s  %s  %s  %dms",
+		record.Timestamp.Local().Format("2006-01-02 15:04:05"),
+		record.SessionId, record.Model, record.LatencyMs)
+	if record.Usage != nil {
+		fmt.Fprintf(w, "  %d+%d tokens", record.Usage.PromptTokens, record.Usage.CompletionTokens)
+	}
+	if record.FinishReason != "" {
+		fmt.Fprintf(w, "  %s", record.FinishReason)
+	}
+	fmt.Fprintf(w, "\n")
+
+	if record.Cwd != "" {
+		fmt.Fprintf(w, "  cwd: %s\n", record.Cwd)
+	}
+	fmt.Fprintf(w, "  > %s\n", firstLine(record.Prompt()))
+	if record.Error != "" {
+		fmt.Fprintf(w, "  ! %s\n", firstLine(record.Error))
+	} else {
+		fmt.Fprintf(w, "  < %s\n", firstLine(record.Response))
+	}
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	line, _, cut := strings.Cut(s, "\n")
+	if cut {
+		return line + " ..."
+	}
+	return line
+}
@@ -0,0 +1,96 @@
+package butterfish
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeLLM struct {
+	response *util.CompletionResponse
+	err      error
+}
+
+func (this *fakeLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	return this.response, this.err
+}
+
+func (this *fakeLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return this.response, this.err
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "audit.jsonl")
+	auditLog, err := OpenAuditLog(path, 600)
+	assert.Nil(t, err)
+	defer auditLog.Close()
+
+	client := &AuditLLM{
+		Client: &fakeLLM{response: &util.CompletionResponse{
+			Completion:   "Use ls -la",
+			FinishReason: "stop",
+			Usage:        &util.Usage{PromptTokens: 20, CompletionTokens: 4, TotalTokens: 24},
+		}},
+		Log:          auditLog,
+		SessionId:    "abc123",
+		IncludeUsage: true,
+	}
+
+	request := &util.CompletionRequest{
+		Ctx:           WithAuditCwd(context.Background(), "/home/user/src"),
+		Model:         "gpt-4.1-mini",
+		SystemMessage: "You are helpful",
+		HistoryBlocks: []util.HistoryBlock{{Type: historyTypeShellInput, Content: "ls"}},
+		Prompt:        "How do I list hidden files?",
+	}
+
+	// each record is a few hundred bytes, so writing three rotates the file
+	for i := 0; i < 3; i++ {
+		_, err = client.CompletionStream(request, io.Discard)
+		assert.Nil(t, err)
+	}
+	assert.True(t, request.IncludeUsage)
+
+	_, err = os.Stat(path + ".1")
+	assert.Nil(t, err)
+
+	records, err := ReadAuditLog(path, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(records))
+
+	record := records[0]
+	assert.Equal(t, "abc123", record.SessionId)
+	assert.Equal(t, "/home/user/src", record.Cwd)
+	assert.Equal(t, "How do I list hidden files?", record.Prompt())
+	assert.Equal(t, 3, len(record.Messages))
+	assert.Equal(t, "stop", record.FinishReason)
+	assert.Equal(t, 24, record.Usage.TotalTokens)
+
+	client.Client = &fakeLLM{err: context.DeadlineExceeded}
+	client.CompletionStream(request, io.Discard)
+
+	records, err = ReadAuditLog(path, &AuditFilter{Errors: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "context deadline exceeded", records[0].Error)
+
+	records, err = ReadAuditLog(path, &AuditFilter{Contains: "HIDDEN", Since: time.Now().Add(-time.Minute)})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(records))
+
+	records, err = ReadAuditLog(path, &AuditFilter{Model: "gpt-4o"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(records))
+
+	// servers that reject stream_options aren't asked for usage
+	client.IncludeUsage = false
+	request.IncludeUsage = false
+	client.CompletionStream(request, io.Discard)
+	assert.False(t, request.IncludeUsage)
+}
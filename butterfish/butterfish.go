@@ -1,12 +1,12 @@
 package butterfish
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -54,6 +54,16 @@ type ButterfishConfig struct {
 	// These are what should actually be used during rendering
 	Styles    *styles
 	ColorDark bool
+	// Ask the terminal for its background color and set ColorDark to match
+	ColorAuto bool
+	// Colors of the shell, DarkTheme or LightTheme if nil
+	Theme *Theme
+	// Color depth of the terminal, colors are downgraded to fit
+	ColorDepth util.ColorDepth
+
+	// Name of the config profile in use, "" if none. Project config files are
+	// read with this profile selected.
+	Profile string
 
 	// Path of yaml file from which to load LLM prompts
 	// Defaults to ~/.config/butterfish/prompts.yaml
@@ -69,6 +79,11 @@ type ButterfishConfig struct {
 	ShellBinary           string // path to the shell binary to use, e.g. /bin/zsh
 	ShellPromptModel      string // used when the user enters an explicit prompt
 	ShellLeavePromptAlone bool   // don't try to edit the shell prompt
+	// Settings set by a flag or env var, by config key, a project config
+	// doesn't override them
+	PinnedSettings map[string]bool
+	// The user config file, for the themes a project config can name
+	UserConfig *ConfigFile
 	// Removed autosuggest fields
 	// Maximum tokens in a prompt regardless of model capacity
 	ShellMaxPromptTokens int
@@ -76,6 +91,31 @@ type ButterfishConfig struct {
 	ShellMaxHistoryBlockTokens int
 	// Maximum tokens for the response, reserved when calculating history and passed as max_tokens during inference
 	ShellMaxResponseTokens int
+	// Names of the context providers to enable, see context.go
+	ShellContextProviders []string
+	// Maximum tokens of each context provider section
+	ShellContextTokens int
+	// Environment variables reported by the env context provider
+	ShellContextEnv []string
+	// Don't redact secrets from requests
+	ShellNoRedact bool
+	// Path of the JSONL audit log of LLM requests, "" to disable it
+	AuditLogPath string
+	// Size at which the audit log is rotated
+	AuditLogMaxBytes int64
+	// Ask for token usage in streaming responses to record it in the audit log
+	AuditLogUsage bool
+
+	// Regexes for secrets to redact in addition to the built-in detectors
+	ShellRedactPatterns []string
+	// Commands whose input and output are never added to history
+	ShellHistoryDenylist []string
+	// Answers longer than this many lines are opened in the pager, 0 for never
+	ShellPagerLines int
+	// Path to record a trace of the terminal streams to, "" to disable it
+	ShellTracePath string
+	// Path to record the session to in asciicast format, "" to disable it
+	ShellRecordPath string
 
 	// Removed other command model configs (Gencmd, Execcheck, Summarize)
 }
@@ -123,6 +163,25 @@ type ButterfishCtx struct {
 	PromptLibrary PromptLibrary
 	// GPT client
 	LLMClient LLM
+	// pid of the wrapped shell process, 0 if not known
+	ShellPid int
+	// the shell was started with our integration hooks, so we don't type
+	// in a prompt command
+	ShellHooks bool
+	// providers of environment context for the system message
+	ContextProviders []ContextProvider
+	// replaces secrets in requests with placeholders, nil if disabled
+	Redactor *Redactor
+	// random id for this session, used in logs
+	SessionId string
+	// records every LLM request, nil if disabled
+	AuditLog *AuditLog
+	// records the shell's terminal streams, nil if disabled
+	Trace *TraceWriter
+	// records the session as the user saw it, nil if disabled
+	Recording *CastRecorder
+	// the session's control socket, nil if it couldn't be opened
+	Control *ControlServer
 	// Removed CommandRegister
 	// Removed VectorIndex
 }
@@ -177,6 +236,7 @@ func MakeButterfishConfig() *ButterfishConfig {
 		Verbose:     0,
 		ColorScheme: colorScheme,
 		Styles:      ColorSchemeToStyles(colorScheme),
+		ColorDepth:  util.DetectColorDepth(),
 		// Removed Gencmd, Execcheck, Summarize defaults
 	}
 }
@@ -184,10 +244,6 @@ func MakeButterfishConfig() *ButterfishConfig {
 // For Control Sequence Introducer, or CSI, commands, the ESC [ (written as \e[ or \033[ in several programming and scripting languages) is followed by any number (including none) of "parameter bytes" in the range 0x30–0x3F (ASCII 0–9:;<=>?), then by any number of "intermediate bytes" in the range 0x20–0x2F (ASCII space and !"#$%&'()*+,-./), then finally by a single "final byte" in the range 0x40–0x7E (ASCII @A–Z[\]^_`a–z{|}~)
 var ansiCsiPattern = regexp.MustCompile("\x1b\\[[\x30-\x3f]*[\x20-\x2f]*[\x40-\x7e]")
 
-func incompleteAnsiSequence(buf []byte) bool {
-	return bytes.Index(buf, []byte{0x1b, 0x5b}) != -1 && !ansiCsiPattern.Match(buf)
-}
-
 // from https://github.com/acarl005/stripansi/blob/master/stripansi.go
 const ansiPattern = "[\u001B\u009B][[\\]()#;?]*(?:(?:(?:[a-zA-Z\\d]*(?:;[a-zA-Z\\d]*)*)?\u0007)|(?:(?:\\d{1,4}(?:;\\d{0,4})*)?[\\dA-PRZcf-ntqry=><~]))"
 
@@ -222,7 +278,7 @@ func sanitizeTTYString(data string) string {
 	return filterNonPrintable(stripANSI(data))
 }
 
-func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.File, func() error, error) {
+func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.File, *exec.Cmd, func() error, error) {
 	// Create arbitrary command.
 	var cmd *exec.Cmd
 
@@ -240,7 +296,7 @@ func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.Fi
 	// Start the command with a pty.
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	// Handle pty size.
@@ -261,7 +317,7 @@ func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.Fi
 		ptmx.Close()
 		signal.Stop(ch)
 		close(ch)
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	cleanup := func() error {
@@ -276,7 +332,7 @@ func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.Fi
 		return term.Restore(int(os.Stdin.Fd()), oldState)
 	}
 
-	return ptmx, cleanup, nil
+	return ptmx, cmd, cleanup, nil
 }
 
 // Removed CalculateEmbeddings method
@@ -397,7 +453,7 @@ func initPromptLibrary(config *ButterfishConfig) (PromptLibrary, error) {
 		return nil, err
 	}
 
-	return NewDiskPromptLibrary(promptPath, config.Verbose > 0, verboseWriter)
+	return NewDiskPromptLibrary(promptPath, util.LogEnabled(slog.LevelDebug), verboseWriter)
 }
 
 func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCtx, error) {
@@ -421,6 +477,7 @@ func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCt
 		Config:    config,
 		LLMClient: llmClient,
 		Out:       os.Stdout,
+		SessionId: NewSessionId(),
 	}
 
 	return butterfishCtx, nil
@@ -1,9 +1,16 @@
 package butterfish
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
 	"testing"
 
+	"github.com/bakks/tiktoken-go"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
 )
 
 // Removed TestFixCommandParse
@@ -69,12 +76,277 @@ func TestShellHistory(t *testing.T) {
 	assert.Greater(t, len(history.Blocks), 5)
 }
 
-// A test case for incompleteAnsiSequence()
-func TestIncompleteAnsiSequence(t *testing.T) {
-	// incomplete sequence
-	assert.True(t, incompleteAnsiSequence([]byte{0x1b, 0x5b, 0x30, 0x3b}))
-	assert.True(t, incompleteAnsiSequence([]byte{0x20, 0x1b, 0x5b, 0x30, 0x3b}))
-	// complete sequence
-	assert.False(t, incompleteAnsiSequence([]byte{0x1b, 0x5b, 0x30, 0x3b, 0x31, 0x3b, 0x32, 0x6d, 0x1b, 0x5b, 0x30, 0x6d}))
-	assert.False(t, incompleteAnsiSequence([]byte{0x20, 0x20, 0x1b, 0x5b, 0x30, 0x3b, 0x31, 0x3b, 0x32, 0x6d, 0x1b, 0x5b, 0x30, 0x6d}))
+func TestParsePS1(t *testing.T) {
+	// the prompt puts $PWD in the URL as it is, so a % isn't decoded
+	data := PROMPT_PREFIX + "\x1b]7;file:///home/user/my 100%20dir\x07user@host $ " +
+		EMOJI_DEFAULT + " 2" + PROMPT_SUFFIX
+	status, prompts, cwd, cleaned := ParsePS1(data, ps1FullRegex, EMOJI_DEFAULT)
+	assert.Equal(t, 2, status)
+	assert.Equal(t, 1, prompts)
+	assert.Equal(t, "/home/user/my 100%20dir", cwd)
+	assert.Equal(t, "\x1b]7;file:///home/user/my 100%20dir\x07user@host $ "+EMOJI_DEFAULT, cleaned)
+
+	// zsh style, with a hostname and ST terminator
+	cwd = ParseOSC7("\x1b]7;file://host/tmp\x1b\\ $ \x1b]7;file://host/var/log\x1b\\")
+	assert.Equal(t, "/var/log", cwd)
+
+	_, prompts, cwd, _ = ParsePS1("plain output", ps1FullRegex, EMOJI_DEFAULT)
+	assert.Equal(t, 0, prompts)
+	assert.Equal(t, "", cwd)
+}
+
+func TestParseBackgroundColor(t *testing.T) {
+	color, found := parseBackgroundColor([]byte("\x1b]11;rgb:ffff/ffff/ffff\x07"))
+	assert.True(t, found)
+	assert.True(t, color.IsLight())
+
+	// 2 digit components terminated by ST, e.g. a dark gruvbox background
+	color, found = parseBackgroundColor([]byte("ab\x1b]11;rgb:28/28/28\x1b\\cd"))
+	assert.True(t, found)
+	assert.False(t, color.IsLight())
+	assert.InDelta(t, 40.0/255, color.R, 0.001)
+
+	_, found = parseBackgroundColor([]byte("\x1b[4;14R"))
+	assert.False(t, found)
+}
+
+// Replies split across reads are still pulled out of the input, and an
+// escape that isn't followed by the rest of a reply is passed on
+func TestReaderToChannelSplitReplies(t *testing.T) {
+	reader, writer := io.Pipe()
+	input := make(chan *byteMsg, 8)
+	pos := make(chan *cursorPosition, 8)
+	bg := make(chan *backgroundColor, 1)
+	go readerToChannelWithPosition(reader, input, pos, bg)
+
+	writer.Write([]byte("a\x1b]11;rgb:28/2"))
+	assert.Equal(t, "a", string((<-input).Data))
+	writer.Write([]byte("8/28\x1b"))
+	writer.Write([]byte("\\b"))
+	assert.Equal(t, "b", string((<-input).Data))
+	assert.InDelta(t, 40.0/255, (<-bg).R, 0.001)
+
+	writer.Write([]byte("\x1b[4;"))
+	writer.Write([]byte("14Rc"))
+	assert.Equal(t, "c", string((<-input).Data))
+	assert.Equal(t, cursorPosition{Row: 4, Column: 14}, *<-pos)
+
+	writer.Write([]byte("\x1b"))
+	assert.Equal(t, "\x1b", string((<-input).Data))
+	writer.Write([]byte("\x1b[A"))
+	assert.Equal(t, "\x1b[A", string((<-input).Data))
+
+	writer.Close()
+	_, ok := <-input
+	assert.False(t, ok)
+}
+
+func TestExcludeFromHistory(t *testing.T) {
+	denylist := []string{"pass", "gpg", "vault read"}
+
+	assert.True(t, ExcludeFromHistory(" export TOKEN=abc", denylist))
+	assert.True(t, ExcludeFromHistory("pass show email", denylist))
+	assert.True(t, ExcludeFromHistory("sudo gpg --decrypt x.gpg", denylist))
+	assert.True(t, ExcludeFromHistory("VAULT_ADDR=x vault read secret/db", denylist))
+	assert.False(t, ExcludeFromHistory("vault status", denylist))
+	assert.False(t, ExcludeFromHistory("passwd", denylist))
+	assert.False(t, ExcludeFromHistory("ls -l", denylist))
+}
+
+func TestTrackBracketedPaste(t *testing.T) {
+	state := &ShellState{}
+
+	state.trackBracketedPaste([]byte("\x1b[?2004h$ "))
+	assert.True(t, state.bracketedPaste)
+
+	// unrelated output leaves it alone
+	state.trackBracketedPaste([]byte("total 0\r\n"))
+	assert.True(t, state.bracketedPaste)
+
+	// the last one in the output wins
+	state.trackBracketedPaste([]byte("\x1b[?2004hls\r\n\x1b[?2004l\r"))
+	assert.False(t, state.bracketedPaste)
+}
+
+func TestInsertAnswerBlock(t *testing.T) {
+	childIn := &bytes.Buffer{}
+	parentOut := &bytes.Buffer{}
+	state := &ShellState{
+		Butterfish: &ButterfishCtx{Ctx: context.Background()},
+		ChildIn:    childIn,
+		ParentOut:  parentOut,
+		Color:      &ShellColorScheme{},
+		AnswerBlocks: []string{
+			"rm -rf build\rmake\x1b[201~\x07\tall\n",
+			"cd build\r\nmake\x1b[201~\r\n",
+		},
+	}
+
+	// controls that would submit the command or end a paste are removed
+	assert.True(t, state.InsertAnswerBlock(1))
+	assert.Equal(t, "rm -rf buildmake[201~ all", childIn.String())
+	assert.Equal(t, "rm -rf buildmake[201~ all", state.Command.String())
+	assert.Equal(t, stateShell, state.State)
+
+	// without bracketed paste each line would run, so the block is copied
+	state.State = stateNormal
+	childIn.Reset()
+	assert.True(t, state.InsertAnswerBlock(2))
+	assert.Equal(t, "\r", childIn.String())
+	assert.Contains(t, parentOut.String(), "\x1b]52;c;")
+	assert.Contains(t, parentOut.String(), "copied it to the clipboard instead")
+	assert.Equal(t, stateNormal, state.State)
+
+	// with it the lines are pasted
+	state.bracketedPaste = true
+	childIn.Reset()
+	assert.True(t, state.InsertAnswerBlock(2))
+	assert.Equal(t, "\x1b[200~cd build\nmake[201~\x1b[201~", childIn.String())
+
+	assert.False(t, state.InsertAnswerBlock(3))
+}
+
+func TestParseChildOutputFullScreen(t *testing.T) {
+	state := &ShellState{
+		Butterfish:  &ButterfishCtx{Ctx: context.Background(), Config: &ButterfishConfig{}},
+		lastCommand: "vim main.go",
+	}
+
+	// the redraws aren't in history, or parsed for prompts
+	output, history, prompts := state.parseChildOutput(
+		"\r\n\x1b[?1049h\x1b[22;0;0t\x1b[H\x1b[2J~ 🤖 1\x1bR")
+	assert.Equal(t, "\r\n\x1b[?1049h\x1b[22;0;0t\x1b[H\x1b[2J~ 🤖 1\x1bR", output)
+	assert.Equal(t, "\r\nran vim main.go (full-screen)\r\n", history)
+	assert.Equal(t, 0, prompts)
+	assert.True(t, state.altScreen)
+
+	output, history, _ = state.parseChildOutput("\x1b[Hmore~")
+	assert.Equal(t, "\x1b[Hmore~", output)
+	assert.Equal(t, "", history)
+
+	// back on the normal screen we find the next prompt
+	output, history, prompts = state.parseChildOutput(
+		"\x1b[?1l\x1b[?1049l\x1b[23;0;0t$ 🤖 0\x1bR ")
+	assert.Equal(t, "\x1b[?1l\x1b[?1049l\x1b[23;0;0t$ 🤖 ", output)
+	assert.Equal(t, "\x1b[23;0;0t$ 🤖 ", history)
+	assert.Equal(t, 1, prompts)
+	assert.False(t, state.altScreen)
+
+	// a program switching back and forth is only noted once
+	output, history, _ = state.parseChildOutput("\x1b[?47h\x1b[?47l\x1b[?1047h")
+	assert.Equal(t, "", history)
+	assert.True(t, state.altScreen)
+
+	// a switch back split across reads is held until it's complete
+	output, _, _ = state.parseChildOutput("bye\x1b[?10")
+	assert.Equal(t, "bye", output)
+	assert.True(t, state.altScreen)
+	output, _, _ = state.parseChildOutput("47l$ ")
+	assert.Equal(t, "\x1b[?1047l$ ", output)
+	assert.False(t, state.altScreen)
+
+	// a program killed on the alternate screen doesn't leave it, the next
+	// prompt does
+	state.parseChildOutput("\x1b[?1049h\x1b[H~")
+	assert.True(t, state.altScreen)
+	output, history, prompts = state.parseChildOutput("Killed\r\n" + PROMPT_PREFIX + "$ 🤖 137\x1bR ")
+	assert.False(t, state.altScreen)
+	assert.Equal(t, "Killed\r\n$ 🤖 ", output)
+	assert.Equal(t, "$ 🤖 ", history)
+	assert.Equal(t, 1, prompts)
+	state.parseChildOutput("\x1b[?1049h")
+	state.parseChildOutput("\x1b]133;A\x07$ ")
+	assert.False(t, state.altScreen)
+}
+
+// With hooks the working directory only comes from the prompt, not from
+// command output
+func TestParseChildOutputCwd(t *testing.T) {
+	state := &ShellState{
+		Butterfish: &ButterfishCtx{Ctx: context.Background(), Config: &ButterfishConfig{}, ShellHooks: true},
+	}
+
+	state.parseChildOutput("\x1b]133;A\x07" + PROMPT_PREFIX + "\x1b]7;file:///home/user\x07$ ")
+	assert.Equal(t, "/home/user", state.cwd)
+	state.parseChildOutput("🤖 0\x1bR\x1b]133;B\x07")
+	assert.Equal(t, "/home/user", state.cwd)
+
+	// cat of a file reporting another directory
+	state.parseChildOutput("\x1b]133;C\x07\x1b]7;file:///etc\x07\x1b]133;D;0\x07")
+	assert.Equal(t, "/home/user", state.cwd)
+
+	// the next prompt, split across reads
+	state.parseChildOutput("\x1b]133;A\x07" + PROMPT_PREFIX + "\x1b]7;file:///t")
+	state.parseChildOutput("mp\x07$ 🤖 0\x1bR\x1b]133;B\x07\x1b]7;file:///etc\x07")
+	assert.Equal(t, "/tmp", state.cwd)
+}
+
+func TestFlushCommandOutput(t *testing.T) {
+	state := &ShellState{
+		Butterfish:    &ButterfishCtx{Ctx: context.Background()},
+		History:       NewShellHistory(),
+		commandScreen: util.NewTerminal(40, 10, 100),
+	}
+
+	// progress bars and redraws are recorded as they ended up on screen
+	state.commandScreen.Write([]byte("Downloading\r\n"))
+	for _, progress := range []string{"[=   ] 25%", "[==  ] 50%", "[====] 100%"} {
+		state.commandScreen.Write([]byte("\r\x1b[K" + progress))
+	}
+	state.commandScreen.Write([]byte("\r\nerror: checksum mismatch\r\n"))
+	state.commandFinished = true
+	state.LastExitCode = 2
+	state.flushCommandOutput()
+
+	assert.Equal(t, 1, len(state.History.Blocks))
+	assert.Equal(t, "Downloading\n[====] 100%\nerror: checksum mismatch\n[exit code 2]\n",
+		state.History.Blocks[0].Content.String())
+
+	// nothing more to add
+	state.flushCommandOutput()
+	assert.Equal(t, "Downloading\n[====] 100%\nerror: checksum mismatch\n[exit code 2]\n",
+		state.History.Blocks[0].Content.String())
+}
+
+func TestSendScreen(t *testing.T) {
+	// the encoder's data is downloaded on first use
+	encoder, err := tiktoken.EncodingForModel(DEFAULT_PROMPT_ENCODER)
+	if err != nil {
+		t.Skipf("Could not load encoder: %s", err)
+	}
+	library, err := NewDiskPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	assert.Nil(t, err)
+
+	state := &ShellState{
+		Butterfish: &ButterfishCtx{
+			Ctx:           context.Background(),
+			Config:        &ButterfishConfig{ShellMaxHistoryBlockTokens: 1024, ShellMaxResponseTokens: 256},
+			PromptLibrary: library,
+		},
+		ParentOut:       &bytes.Buffer{},
+		ChildIn:         &bytes.Buffer{},
+		Color:           &ShellColorScheme{},
+		History:         NewShellHistory(),
+		PromptModel:     DEFAULT_PROMPT_ENCODER,
+		PromptMaxTokens: 4096,
+		PromptEncoder:   encoder,
+		Screen:          util.NewTerminal(40, 10, 100),
+		commandScreen:   util.NewTerminal(40, 10, 100),
+		cwd:             t.TempDir(),
+	}
+	state.History.Append(historyTypeShellInput, "make\n")
+	state.History.Append(historyTypeShellOutput, "cc main.c\nmain.c:3: error: expected ;\n[exit code 2]\n")
+	state.Screen.Write([]byte("$ make\r\nmain.c:3: error: expected ;\r\n$ /screen"))
+
+	state.SendScreen()
+	request, err := state.PromptRequest(context.Background(), "What does this error mean?", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "What does this error mean?\n\nTerminal screen:\n```\n$ make\nmain.c:3: error: expected ;\n```",
+		request.Prompt)
+
+	// command output only goes as what we noted about it
+	assert.Equal(t, []util.HistoryBlock{
+		{Type: historyTypeShellInput, Content: "make\n"},
+		{Type: historyTypeShellOutput, Content: "[exit code 2]"},
+	}, request.HistoryBlocks)
 }
@@ -0,0 +1,380 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Sessions are recorded in asciinema's asciicast v2 format, so they can be
+// played with asciinema or uploaded as well as with 'butterfish play'. The
+// file is a JSON header line, then one event per line as [time, type, data]:
+// "o" for output to the terminal, "m" for markers and "r" for resizes. We
+// add a marker for each command run and each prompt sent, so the player can
+// jump between them.
+// See https://docs.asciinema.org/manual/asciicast/v2/
+
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+const (
+	CastOutput = "o"
+	CastInput  = "i"
+	CastMarker = "m"
+	CastResize = "r"
+)
+
+type CastEvent struct {
+	// Seconds since the recording started
+	Time float64
+	Type string
+	Data string
+}
+
+func (this CastEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{this.Time, this.Type, this.Data})
+}
+
+func (this *CastEvent) UnmarshalJSON(data []byte) error {
+	fields := []any{}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+
+	var ok1, ok2, ok3 bool
+	if len(fields) == 3 {
+		this.Time, ok1 = fields[0].(float64)
+		this.Type, ok2 = fields[1].(string)
+		this.Data, ok3 = fields[2].(string)
+	}
+	if !ok1 || !ok2 || !ok3 {
+		return fmt.Errorf("expected [time, type, data], got %s", data)
+	}
+	return nil
+}
+
+// CastRecorder writes a recording, output is recorded by writing to it
+type CastRecorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	start   time.Time
+	// the start of a character split across writes, JSON strings must be
+	// UTF-8 so we write it with the rest
+	partial []byte
+	failed  bool
+}
+
+func CreateCast(path string, header CastHeader) (*CastRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &CastRecorder{
+		file:    file,
+		encoder: json.NewEncoder(file),
+		start:   time.Now(),
+	}
+	header.Version = 2
+	header.Timestamp = recorder.start.Unix()
+	err = recorder.encoder.Encode(&header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recorder, nil
+}
+
+func (this *CastRecorder) event(eventType, data string) {
+	elapsed := time.Since(this.start).Seconds()
+	err := this.encoder.Encode(CastEvent{Time: elapsed, Type: eventType, Data: data})
+	if err != nil && !this.failed {
+		// only say so once
+		log.Printf("Error writing session recording: %s", err)
+		this.failed = true
+	}
+}
+
+func (this *CastRecorder) Write(data []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	n := len(data)
+	data = append(this.partial, data...)
+	this.partial = nil
+	// hold back an incomplete character at the end
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				this.partial = append([]byte{}, data[i:]...)
+				data = data[:i]
+			}
+			break
+		}
+	}
+
+	if len(data) > 0 {
+		this.event(CastOutput, string(data))
+	}
+	return n, nil
+}
+
+func (this *CastRecorder) Marker(label string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.event(CastMarker, label)
+}
+
+func (this *CastRecorder) Resize(width, height int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.event(CastResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+func (this *CastRecorder) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if len(this.partial) > 0 {
+		this.event(CastOutput, string(this.partial))
+	}
+	return this.file.Close()
+}
+
+func ReadCast(path string) (*CastHeader, []CastEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	header := &CastHeader{}
+	events := []CastEvent{}
+	line := 0
+	for scanner.Scan() {
+		line++
+		if line == 1 {
+			err = json.Unmarshal(scanner.Bytes(), header)
+			if err == nil && header.Version != 2 {
+				err = fmt.Errorf("asciicast version %d isn't supported, only 2", header.Version)
+			}
+		} else if len(scanner.Bytes()) > 0 {
+			event := CastEvent{}
+			err = json.Unmarshal(scanner.Bytes(), &event)
+			events = append(events, event)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if line == 0 {
+		return nil, nil, fmt.Errorf("%s: empty recording", path)
+	}
+	return header, events, nil
+}
+
+// CastPlayer replays a recording's output with its timing. Markers can be
+// jumped to, going forward the output up to the marker is written at once,
+// going back the terminal is reset and everything up to it is written.
+type CastPlayer struct {
+	Events []CastEvent
+	Out    io.Writer
+	// Playback speed, 1 for as recorded
+	Speed float64
+	// Pauses are shortened to this many seconds, 0 to keep them
+	IdleLimit float64
+
+	// the next event to play, and the time of the last one played
+	next  int
+	clock float64
+}
+
+// Indexes of the marker events
+func (this *CastPlayer) Markers() []int {
+	markers := []int{}
+	for i, event := range this.Events {
+		if event.Type == CastMarker {
+			markers = append(markers, i)
+		}
+	}
+	return markers
+}
+
+// Write everything before index at once
+func (this *CastPlayer) seek(index int) {
+	if index < this.next {
+		// reset the terminal and start over
+		this.Out.Write([]byte("\x1bc"))
+		this.next = 0
+	}
+	for ; this.next < index; this.next++ {
+		if this.Events[this.next].Type == CastOutput {
+			this.Out.Write([]byte(this.Events[this.next].Data))
+		}
+	}
+	if index > 0 {
+		this.clock = this.Events[index-1].Time
+	} else {
+		this.clock = 0
+	}
+}
+
+// Jump to just after the next marker, returns its label, false if there
+// isn't one
+func (this *CastPlayer) NextMarker() (string, bool) {
+	for _, marker := range this.Markers() {
+		if marker >= this.next {
+			this.seek(marker + 1)
+			return this.Events[marker].Data, true
+		}
+	}
+	return "", false
+}
+
+// Jump back to just after the last marker we passed, or if we're right
+// after it, the one before, so pressing it repeatedly keeps going back.
+// Before the first marker we go to the start.
+func (this *CastPlayer) PrevMarker() string {
+	markers := this.Markers()
+	passed := -1
+	for i, marker := range markers {
+		if marker < this.next {
+			passed = i
+		}
+	}
+	if passed >= 0 && markers[passed] == this.next-1 {
+		passed--
+	}
+
+	if passed < 0 {
+		this.seek(0)
+		return ""
+	}
+	marker := markers[passed]
+	this.seek(marker + 1)
+	return this.Events[marker].Data
+}
+
+// How long to wait before playing the next event
+func (this *CastPlayer) delay() time.Duration {
+	seconds := this.Events[this.next].Time - this.clock
+	if this.IdleLimit > 0 && seconds > this.IdleLimit {
+		seconds = this.IdleLimit
+	}
+	if this.Speed > 0 {
+		seconds /= this.Speed
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Play until the end or until q is pressed, reading keys from input: space
+// pauses, n or ] jumps to the next marker, p or [ to the previous one, and
+// + or - change the speed
+func (this *CastPlayer) Play(ctx context.Context, input io.Reader) error {
+	keys := make(chan InputEvent, 16)
+	go func() {
+		parser := &InputParser{}
+		buf := make([]byte, 1024)
+		for {
+			n, err := input.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			for _, event := range parser.Parse(buf[:n]) {
+				keys <- event
+			}
+		}
+	}()
+
+	if this.Speed <= 0 {
+		this.Speed = 1
+	}
+	this.Out.Write([]byte("\x1bc"))
+	// leave the terminal usable if we stop part way through
+	defer this.Out.Write([]byte("\x1b[0m\x1b[?1049l\x1b[?25h\r\n"))
+
+	paused := false
+	var due time.Time
+	for this.next < len(this.Events) {
+		if due.IsZero() {
+			due = time.Now().Add(this.delay())
+		}
+		var timer <-chan time.Time
+		if !paused {
+			timer = time.After(time.Until(due))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-timer:
+			event := this.Events[this.next]
+			if event.Type == CastOutput {
+				this.Out.Write([]byte(event.Data))
+			}
+			this.clock = event.Time
+			this.next++
+			due = time.Time{}
+
+		case key, ok := <-keys:
+			if !ok {
+				// no more input, play to the end
+				keys = nil
+				continue
+			}
+			switch {
+			case key.IsCtrl('c') || key.IsText() && key.Rune == 'q':
+				return nil
+			case key.IsText() && key.Rune == ' ':
+				paused = !paused
+			case key.IsText() && (key.Rune == 'n' || key.Rune == ']'):
+				this.NextMarker()
+			case key.IsText() && (key.Rune == 'p' || key.Rune == '['):
+				this.PrevMarker()
+			case key.IsText() && key.Rune == '+':
+				this.Speed *= 2
+			case key.IsText() && key.Rune == '-':
+				this.Speed /= 2
+			default:
+				continue
+			}
+			due = time.Time{}
+		}
+	}
+	return nil
+}
+
+// Print the markers of a recording with their times
+func PrintCastMarkers(w io.Writer, events []CastEvent) {
+	number := 0
+	for _, event := range events {
+		if event.Type != CastMarker {
+			continue
+		}
+		number++
+		minutes := int(event.Time) / 60
+		seconds := event.Time - float64(minutes*60)
+		fmt.Fprintf(w, "%3d  %d:%04.1f  %s\n", number, minutes, seconds, event.Data)
+	}
+}
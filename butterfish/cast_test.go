@@ -0,0 +1,88 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCastRecording(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	recorder, err := CreateCast(path, CastHeader{Width: 80, Height: 24, Title: "test"})
+	assert.NoError(t, err)
+
+	recorder.Write([]byte("$ "))
+	recorder.Marker("$ echo hé")
+	// a character split across writes is kept whole
+	accent := []byte("é")
+	n, err := recorder.Write(append([]byte("h"), accent[0]))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	recorder.Write(append(accent[1:], "\r\n"...))
+	recorder.Resize(100, 30)
+	assert.NoError(t, recorder.Close())
+
+	header, events, err := ReadCast(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, header.Version)
+	assert.Equal(t, 80, header.Width)
+	assert.Equal(t, "test", header.Title)
+	assert.Equal(t, 5, len(events))
+	assert.Equal(t, CastEvent{Time: events[1].Time, Type: CastMarker, Data: "$ echo hé"}, events[1])
+	assert.Equal(t, "h", events[2].Data)
+	assert.Equal(t, "é\r\n", events[3].Data)
+	assert.Equal(t, "100x30", events[4].Data)
+	assert.True(t, events[1].Time <= events[4].Time)
+
+	out := &bytes.Buffer{}
+	PrintCastMarkers(out, events)
+	assert.Equal(t, "  1  0:00.0  $ echo hé\n", out.String())
+}
+
+func TestCastPlayer(t *testing.T) {
+	events := []CastEvent{
+		{0.1, CastOutput, "$ "},
+		{1, CastMarker, "$ ls"},
+		{1.1, CastOutput, "ls\r\nfile\r\n$ "},
+		{5, CastMarker, "> What is this?"},
+		{5.1, CastOutput, "An answer"},
+		{100, CastOutput, "\r\n$ "},
+	}
+	out := &bytes.Buffer{}
+	player := &CastPlayer{Events: events, Out: out, Speed: 1, IdleLimit: 2}
+
+	assert.Equal(t, []int{1, 3}, player.Markers())
+	label, ok := player.NextMarker()
+	assert.True(t, ok)
+	assert.Equal(t, "$ ls", label)
+	assert.Equal(t, "$ ", out.String())
+	label, _ = player.NextMarker()
+	assert.Equal(t, "> What is this?", label)
+	assert.Equal(t, "$ ls\r\nfile\r\n$ ", out.String())
+	_, ok = player.NextMarker()
+	assert.False(t, ok)
+
+	// right after a marker going back goes to the one before, replaying
+	// from a reset terminal
+	out.Reset()
+	assert.Equal(t, "$ ls", player.PrevMarker())
+	assert.Equal(t, "\x1bc$ ", out.String())
+	assert.Equal(t, "", player.PrevMarker())
+	assert.Equal(t, 0, player.next)
+
+	// pauses are shortened to the idle limit
+	player.seek(5)
+	assert.Equal(t, float64(5.1), player.clock)
+	assert.Equal(t, 2*1e9, float64(player.delay()))
+
+	// play jumping straight to the last marker and quit
+	out.Reset()
+	player = &CastPlayer{Events: events, Out: out, Speed: 1000}
+	err := player.Play(context.Background(), strings.NewReader("]]q"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.String(), "\x1bc$ ls\r\nfile\r\n$ "))
+}
@@ -5,12 +5,18 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"os"
 	"os/exec"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mattn/go-runewidth"
+
+	"github.com/bakks/butterfish/util"
 )
 
 // See https://platform.openai.com/docs/models/overview
@@ -203,49 +209,137 @@ func parseCursorPos(data []byte) (int, int, bool) {
 	return row, col, true
 }
 
+// The terminal's reply to an OSC 11 background color query, e.g.
+// \x1b]11;rgb:ffff/ffff/ffff\x07. Each component has 1-4 hex digits and the
+// reply is terminated by BEL or ST.
+var backgroundColorRegex = regexp.MustCompile(`\x1b\]11;rgb:([0-9a-fA-F]{1,4})/([0-9a-fA-F]{1,4})/([0-9a-fA-F]{1,4})(?:\x07|\x1b\\)`)
+
+// A background color with components from 0 to 1
+type backgroundColor struct {
+	R, G, B float64
+}
+
+// Light backgrounds have a relative luminance above the midpoint
+func (this *backgroundColor) IsLight() bool {
+	return 0.2126*this.R+0.7152*this.G+0.0722*this.B > 0.5
+}
+
+func parseBackgroundColor(data []byte) (*backgroundColor, bool) {
+	matches := backgroundColorRegex.FindSubmatch(data)
+	if len(matches) != 4 {
+		return nil, false
+	}
+
+	components := [3]float64{}
+	for i, hex := range matches[1:] {
+		value, err := strconv.ParseUint(string(hex), 16, 16)
+		if err != nil {
+			return nil, false
+		}
+		// scale by the number of digits, e.g. ff and ffff are both full
+		components[i] = float64(value) / float64(uint64(1)<<(4*len(hex))-1)
+	}
+
+	return &backgroundColor{components[0], components[1], components[2]}, true
+}
+
+// How long we hold back what may be the start of a terminal reply split
+// across reads before passing it on as input
+const partialReplyTimeout = 50 * time.Millisecond
+
+// The start of a cursor position or OSC 11 reply at the end of a read, e.g.
+// \x1b[4; or \x1b]11;rgb:28
+var partialReplyRegex = regexp.MustCompile(`\x1b(\[[0-9;]*|\](1(1(;[^\x07\x1b]{0,32}\x1b?)?)?)?)?$`)
+
 // Given an io.Reader we write byte chunks to a channel
-// This is a modified version with a separate channel for cursor position
-func readerToChannelWithPosition(input io.Reader, c chan<- *byteMsg, pos chan<- *cursorPosition) {
-	buf := make([]byte, 1024*16)
+// This is a modified version with separate channels for cursor position and
+// background color replies. A reply can be split across reads, so a partial
+// one at the end of a read is held back until the rest arrives or
+// partialReplyTimeout passes, otherwise it would be typed into the shell.
+func readerToChannelWithPosition(input io.Reader, c chan<- *byteMsg, pos chan<- *cursorPosition, bg chan<- *backgroundColor) {
+	chunks := make(chan []byte)
+	go func() {
+		buf := make([]byte, 1024*16)
+		for {
+			n, err := input.Read(buf)
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("Error reading from file: %s\n", err)
+				}
+				break
+			}
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			chunks <- chunk
+		}
+		close(chunks)
+	}()
+
+	var partial []byte
+	var timeout <-chan time.Time
 
 	// Loop indefinitely
 	for {
-		// Read from stream
-		n, err := input.Read(buf)
-
-		// Check for error
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading from file: %s\n", err)
+		var data []byte
+		hold := true
+
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				if len(partial) > 0 {
+					c <- NewByteMsg(partial)
+				}
+				// Close the channel
+				close(c)
+				return
 			}
-			break
+			data = append(partial, chunk...)
+		case <-timeout:
+			// the rest never came, so it wasn't a reply
+			data = partial
+			hold = false
 		}
+		partial = nil
+		timeout = nil
 
 		// if we find a cursor position, extract it from data and write it to the pos chan
-		row, col, found := parseCursorPos(buf[:n])
+		row, col, found := parseCursorPos(data)
 		if found {
 			pos <- &cursorPosition{
 				Row:    row,
 				Column: col,
 			}
+			data = cursorPosRegex.ReplaceAll(data, []byte{})
+		}
 
-			cleaned := cursorPosRegex.ReplaceAll(buf[:n], []byte{})
-			copy(buf, cleaned)
-			n = len(cleaned)
-			if n == 0 {
-				continue
+		color, found := parseBackgroundColor(data)
+		if found {
+			// nobody may be waiting if the reply came after the timeout
+			select {
+			case bg <- color:
+			default:
 			}
+			data = backgroundColorRegex.ReplaceAll(data, []byte{})
 		}
 
-		if n >= 2 && buf[0] == '\x1b' && buf[1] == '[' && !ansiCsiPattern.Match(buf[:n]) {
-			log.Printf("Got incomplete escape sequence: %x, this may not be handled correctly and could indicate something weird going on with the child shell", buf)
+		if hold {
+			if loc := partialReplyRegex.FindIndex(data); loc != nil {
+				partial = append([]byte{}, data[loc[0]:]...)
+				data = data[:loc[0]]
+				timeout = time.After(partialReplyTimeout)
+			}
 		}
 
-		c <- NewByteMsg(buf[:n])
-	}
+		if len(data) == 0 {
+			continue
+		}
 
-	// Close the channel
-	close(c)
+		if len(data) >= 2 && data[0] == '\x1b' && data[1] == '[' && !ansiCsiPattern.Match(data) {
+			log.Printf("Got incomplete escape sequence: %x, this may not be handled correctly and could indicate something weird going on with the child shell", data)
+		}
+
+		c <- NewByteMsg(data)
+	}
 }
 
 func max(a, b int) int {
@@ -291,7 +385,7 @@ func PrintLoggingBox(box LoggingBox) {
 	buf.WriteString("\n")
 	printLoggingBox(box, buf, 0, []string{})
 	buf.WriteString("\033[0m")
-	log.Println(buf.String())
+	util.LogRaw(slog.LevelDebug, buf.String())
 }
 
 // wrap a string based on a rune array, don't worry about spacing or word wrapping
@@ -417,3 +511,37 @@ func GetSystemInfo() string {
 	sysInfo = string(out)
 	return sysInfo
 }
+
+// Find the working directory of a process. On Linux we read it from /proc, on
+// macOS we ask lsof. Returns "" if it can't be determined.
+func GetProcessCwd(pid int) string {
+	if pid == 0 {
+		return ""
+	}
+
+	switch runtime.GOOS {
+	case "linux":
+		cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+		if err != nil {
+			log.Printf("Error reading cwd of pid %d: %s", pid, err)
+			return ""
+		}
+		return cwd
+
+	case "darwin":
+		// -Fn prints fields prefixed by their type, we want the n (name) line
+		cmd := exec.Command("lsof", "-a", "-p", strconv.Itoa(pid), "-d", "cwd", "-Fn")
+		out, err := cmd.Output()
+		if err != nil {
+			log.Printf("Error running lsof for cwd of pid %d: %s", pid, err)
+			return ""
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "n") {
+				return line[1:]
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,447 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Butterfish settings can be stored in yaml files so they don't have to be
+// passed as flags on every run. There are two file layers:
+//   - The user config, usually ~/.config/butterfish/config.yaml
+//   - A project config, the nearest .butterfish.yaml found by walking up from
+//     the working directory
+//
+// Each file holds top-level settings plus optional named profiles, e.g.
+//
+//	profile: work-gateway
+//	model: gpt-4.1-mini
+//	profiles:
+//	  work-gateway:
+//	    base_url: https://llm.example.com/v1
+//	    api_key: sk-...
+//	  local-ollama:
+//	    base_url: http://localhost:11434/v1
+//	    model: llama3
+//	    max_prompt_tokens: 8192
+//
+// The project file overrides the user file, and within each file the selected
+// profile overrides that file's top-level settings. Flags and environment
+// variables are applied on top of this by the CLI. A project file comes with
+// whatever repository was cloned, so it can only set the keys in
+// ProjectAllowedConfigKeys, the rest could run a program as the shell, send
+// prompts or secrets elsewhere, or write files anywhere.
+//
+// Files can also define color themes under a themes key, see theme.go.
+
+const ProjectConfigName = ".butterfish.yaml"
+
+// The setting keys recognized in config files. These match the CLI flag names
+// with dashes replaced by underscores.
+var ConfigKeys = []string{
+	"verbose",
+	"base_url",
+	"api_key",
+	"token_timeout",
+	"light_color",
+	"theme",
+	"prompt_library",
+	"log_file",
+	"log_max_size",
+	"log_max_age",
+	"audit",
+	"audit_file",
+	"audit_max_size",
+	"audit_no_usage",
+	"bin",
+	"model",
+	"no_command_prompt",
+	"max_prompt_tokens",
+	"max_history_block_tokens",
+	"max_response_tokens",
+	"context",
+	"context_tokens",
+	"context_env",
+	"no_redact",
+	"redact_patterns",
+	"history_denylist",
+	"pager_lines",
+}
+
+// The only keys a project file may set, others are ignored with a warning
+var ProjectAllowedConfigKeys = []string{
+	"model",
+	"instructions",
+	"context_files",
+	"context",
+	"context_tokens",
+	"max_prompt_tokens",
+	"max_history_block_tokens",
+	"max_response_tokens",
+	"theme",
+	"pager_lines",
+}
+
+// Keys that don't correspond to a flag, see project.go
+var ProjectConfigKeys = []string{
+	"instructions",
+	"context_files",
+}
+
+func isConfigKey(key string) bool {
+	for _, k := range ConfigKeys {
+		if k == key {
+			return true
+		}
+	}
+	for _, k := range ProjectConfigKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// A single config file, top-level settings plus named profiles
+type ConfigFile struct {
+	Path     string
+	Profile  string
+	Settings map[string]interface{}
+	Profiles map[string]map[string]interface{}
+	Themes   map[string]*Theme
+}
+
+// Load and validate a config file, returns nil without error if the file
+// doesn't exist.
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	file := &ConfigFile{
+		Path:     path,
+		Settings: map[string]interface{}{},
+		Profiles: map[string]map[string]interface{}{},
+		Themes:   map[string]*Theme{},
+	}
+
+	for key, value := range raw {
+		switch key {
+		case "profile":
+			profile, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: profile must be a string", path)
+			}
+			file.Profile = profile
+
+		case "profiles":
+			profiles, ok := value.(map[interface{}]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: profiles must be a map of profile names to settings", path)
+			}
+			for name, settings := range profiles {
+				parsed, err := parseConfigSettings(path, settings)
+				if err != nil {
+					return nil, err
+				}
+				file.Profiles[fmt.Sprint(name)] = parsed
+			}
+
+		case "themes":
+			themes, ok := value.(map[interface{}]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: themes must be a map of theme names to colors", path)
+			}
+			for name, colors := range themes {
+				theme, err := parseTheme(path, fmt.Sprint(name), colors)
+				if err != nil {
+					return nil, err
+				}
+				file.Themes[fmt.Sprint(name)] = theme
+			}
+
+		default:
+			if !isConfigKey(key) {
+				return nil, unknownSettingError(path, key)
+			}
+			file.Settings[key] = value
+		}
+	}
+
+	return file, nil
+}
+
+func parseConfigSettings(path string, value interface{}) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	if value == nil {
+		return out, nil
+	}
+
+	settings, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: profile settings must be a map", path)
+	}
+
+	for k, v := range settings {
+		key := fmt.Sprint(k)
+		if !isConfigKey(key) {
+			return nil, unknownSettingError(path, key)
+		}
+		out[key] = v
+	}
+
+	return out, nil
+}
+
+func unknownSettingError(path, key string) error {
+	keys := append(append([]string{}, ConfigKeys...), ProjectConfigKeys...)
+	return fmt.Errorf("%s: unknown setting %s, expected one of (%s)",
+		path, key, strings.Join(keys, ", "))
+}
+
+// Get a setting from this file, the named profile takes precedence over the
+// top-level settings. Returns the value, a description of its source, and
+// whether it was found.
+func (this *ConfigFile) Get(profile, key string) (interface{}, string, bool) {
+	if profile != "" {
+		if value, ok := this.Profiles[profile][key]; ok {
+			return value, fmt.Sprintf("profile %s in %s", profile, this.Path), true
+		}
+	}
+
+	if value, ok := this.Settings[key]; ok {
+		return value, this.Path, true
+	}
+
+	return nil, "", false
+}
+
+// Remove settings a project file isn't allowed to set, returns a warning for
+// each one removed
+func (this *ConfigFile) dropUserOnlyKeys() []string {
+	warnings := []string{}
+	for _, key := range sortedKeys(this.Settings) {
+		if !isProjectAllowedKey(key) {
+			delete(this.Settings, key)
+			warnings = append(warnings, fmt.Sprintf("Ignoring %s in %s, it can only be set in the user config", key, this.Path))
+		}
+	}
+	for _, name := range this.ProfileNames() {
+		for _, key := range sortedKeys(this.Profiles[name]) {
+			if !isProjectAllowedKey(key) {
+				delete(this.Profiles[name], key)
+				warnings = append(warnings, fmt.Sprintf("Ignoring %s in profile %s in %s, it can only be set in the user config", key, name, this.Path))
+			}
+		}
+	}
+	return warnings
+}
+
+func isProjectAllowedKey(key string) bool {
+	for _, k := range ProjectAllowedConfigKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(settings map[string]interface{}) []string {
+	keys := []string{}
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (this *ConfigFile) ProfileNames() []string {
+	names := []string{}
+	for name := range this.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Search upward from dir for a file with the given name, returns the path
+// of the first one found or "" if we reach the filesystem root.
+func FindUpward(dir, name string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+
+	for {
+		candidate := filepath.Join(dir, name)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// The user and project config files merged together, with a selected profile
+type LayeredConfig struct {
+	User     *ConfigFile
+	Project  *ConfigFile
+	Profile  string
+	Warnings []string // settings in the project file that were ignored
+}
+
+// Load the user config at userPath and the nearest project config above
+// projectDir, if it's not empty. The CLI only loads the user config, the
+// shell applies a project's settings itself while it's in the project. If
+// profile is empty we fall back to a profile named in the config files,
+// project first.
+func LoadLayeredConfig(userPath, projectDir, profile string) (*LayeredConfig, error) {
+	user, err := LoadConfigFile(userPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var project *ConfigFile
+	var warnings []string
+	if projectDir != "" {
+		projectPath := FindUpward(projectDir, ProjectConfigName)
+		if projectPath != "" {
+			project, err = LoadConfigFile(projectPath)
+			if err != nil {
+				return nil, err
+			}
+			if project != nil {
+				warnings = project.dropUserOnlyKeys()
+			}
+		}
+	}
+
+	config := &LayeredConfig{
+		User:     user,
+		Project:  project,
+		Warnings: warnings,
+	}
+
+	err = config.SetProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Select a profile, an empty name selects the default profile from the config
+// files if there is one.
+func (this *LayeredConfig) SetProfile(profile string) error {
+	if profile == "" {
+		if this.Project != nil && this.Project.Profile != "" {
+			profile = this.Project.Profile
+		} else if this.User != nil && this.User.Profile != "" {
+			profile = this.User.Profile
+		}
+	}
+
+	if profile != "" && !this.hasProfile(profile) {
+		return fmt.Errorf("Profile %s not found, available profiles: (%s)",
+			profile, strings.Join(this.ProfileNames(), ", "))
+	}
+
+	this.Profile = profile
+	return nil
+}
+
+func (this *LayeredConfig) hasProfile(name string) bool {
+	for _, file := range []*ConfigFile{this.Project, this.User} {
+		if file == nil {
+			continue
+		}
+		if _, ok := file.Profiles[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *LayeredConfig) ProfileNames() []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, file := range []*ConfigFile{this.User, this.Project} {
+		if file == nil {
+			continue
+		}
+		for _, name := range file.ProfileNames() {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Look up a setting, returns the value, a description of where the value came
+// from, and whether it was found at all.
+func (this *LayeredConfig) Lookup(key string) (interface{}, string, bool) {
+	for _, file := range []*ConfigFile{this.Project, this.User} {
+		if file == nil {
+			continue
+		}
+
+		if value, source, ok := file.Get(this.Profile, key); ok {
+			return value, source, true
+		}
+	}
+
+	return nil, "", false
+}
+
+// Find a theme defined in the config files, project first
+func (this *LayeredConfig) Theme(name string) (*Theme, bool) {
+	for _, file := range []*ConfigFile{this.Project, this.User} {
+		if file == nil {
+			continue
+		}
+		if theme, ok := file.Themes[name]; ok {
+			return theme, true
+		}
+	}
+	return nil, false
+}
+
+func (this *LayeredConfig) ThemeNames() []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, file := range []*ConfigFile{this.User, this.Project} {
+		if file == nil {
+			continue
+		}
+		for name := range file.Themes {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
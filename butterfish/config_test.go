@@ -0,0 +1,324 @@
+package butterfish
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	assert.Nil(t, err)
+	err = os.WriteFile(path, []byte(content), 0644)
+	assert.Nil(t, err)
+}
+
+func TestLayeredConfig(t *testing.T) {
+	dir := t.TempDir()
+	userPath := filepath.Join(dir, "home", "config.yaml")
+	projectDir := filepath.Join(dir, "project")
+
+	writeTestFile(t, userPath, `
+model: gpt-4o
+max_response_tokens: 1000
+profiles:
+  local-ollama:
+    base_url: http://localhost:11434/v1
+    model: llama3
+`)
+	writeTestFile(t, filepath.Join(projectDir, ProjectConfigName), `
+max_response_tokens: 500
+`)
+
+	// search upward from a subdirectory of the project
+	subdir := filepath.Join(projectDir, "a", "b")
+	assert.Nil(t, os.MkdirAll(subdir, 0755))
+
+	config, err := LoadLayeredConfig(userPath, subdir, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "", config.Profile)
+
+	value, source, ok := config.Lookup("model")
+	assert.True(t, ok)
+	assert.Equal(t, "gpt-4o", value)
+	assert.Equal(t, userPath, source)
+
+	// project overrides user
+	value, _, ok = config.Lookup("max_response_tokens")
+	assert.True(t, ok)
+	assert.Equal(t, 500, value)
+
+	_, _, ok = config.Lookup("base_url")
+	assert.False(t, ok)
+
+	// profile overrides the top-level settings of its file
+	config, err = LoadLayeredConfig(userPath, subdir, "local-ollama")
+	assert.Nil(t, err)
+	value, _, _ = config.Lookup("model")
+	assert.Equal(t, "llama3", value)
+	value, _, _ = config.Lookup("base_url")
+	assert.Equal(t, "http://localhost:11434/v1", value)
+
+	_, err = LoadLayeredConfig(userPath, subdir, "missing")
+	assert.NotNil(t, err)
+}
+
+func TestConfigFileValidation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+
+	file, err := LoadConfigFile(path)
+	assert.Nil(t, err)
+	assert.Nil(t, file)
+
+	writeTestFile(t, path, "not_a_setting: true\n")
+	_, err = LoadConfigFile(path)
+	assert.NotNil(t, err)
+
+	writeTestFile(t, path, "profiles:\n  foo:\n    modle: x\n")
+	_, err = LoadConfigFile(path)
+	assert.NotNil(t, err)
+
+	writeTestFile(t, path, "profile: foo\nprofiles:\n  foo:\n    model: x\n")
+	file, err = LoadConfigFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", file.Profile)
+	assert.Equal(t, []string{"foo"}, file.ProfileNames())
+}
+
+func TestProjectTracker(t *testing.T) {
+	dir := t.TempDir()
+	api := filepath.Join(dir, "api")
+	web := filepath.Join(dir, "web")
+	outside := filepath.Join(dir, "outside")
+	assert.Nil(t, os.MkdirAll(filepath.Join(api, "cmd"), 0755))
+	assert.Nil(t, os.MkdirAll(outside, 0755))
+
+	writeTestFile(t, filepath.Join(api, ProjectConfigName), `
+model: gpt-4.1
+instructions: Use make test.
+context_files:
+  - Makefile
+`)
+	writeTestFile(t, filepath.Join(api, ProjectInstructionsName), "Prefer table tests.\n")
+	writeTestFile(t, filepath.Join(api, "Makefile"), "test:\n\tgo test ./...\n")
+	writeTestFile(t, filepath.Join(web, ProjectInstructionsName), "This is a React app.\n")
+
+	tracker := ProjectTracker{}
+
+	changed, err := tracker.Update(filepath.Join(api, "cmd"))
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, api, tracker.Current.Root)
+	assert.Equal(t, "gpt-4.1", tracker.Current.Model)
+	assert.Equal(t, "Use make test.\n\nPrefer table tests.", tracker.Current.Instructions)
+	assert.Equal(t, []string{filepath.Join(api, "Makefile")}, tracker.Current.ContextFilePaths())
+
+	// moving within the same project doesn't reload
+	changed, err = tracker.Update(api)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	changed, err = tracker.Update(web)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, web, tracker.Current.Root)
+	assert.Equal(t, "", tracker.Current.Model)
+	assert.Equal(t, "This is a React app.", tracker.Current.Instructions)
+
+	changed, err = tracker.Update(outside)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Nil(t, tracker.Current)
+}
+
+func TestProjectSettings(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, ProjectConfigName), `
+max_prompt_tokens: 4000
+context: git, ls
+theme: light
+`)
+	project, err := LoadProjectConfig(root, "")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"max_prompt_tokens": 4000,
+		"context":           []string{"git", "ls"},
+		"theme":             "light",
+	}, project.Settings)
+
+	writeTestFile(t, filepath.Join(root, ProjectConfigName), "pager_lines: many\n")
+	_, err = LoadProjectConfig(root, "")
+	assert.NotNil(t, err)
+	writeTestFile(t, filepath.Join(root, ProjectConfigName), "context: [git, nope]\n")
+	_, err = LoadProjectConfig(root, "")
+	assert.NotNil(t, err)
+}
+
+func TestProjectContextFilesStayInProject(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "repo")
+	writeTestFile(t, filepath.Join(root, "Makefile"), "test:\n")
+	writeTestFile(t, filepath.Join(root, "docs", "a.md"), "# A\n")
+	writeTestFile(t, filepath.Join(dir, "secret", "id_rsa"), "KEY\n")
+	assert.Nil(t, os.Symlink(filepath.Join(dir, "secret", "id_rsa"), filepath.Join(root, "docs", "key.md")))
+	assert.Nil(t, os.Symlink(filepath.Join(dir, "secret"), filepath.Join(root, "secret")))
+
+	project := &ProjectConfig{Root: root, ContextFiles: []string{
+		"Makefile",
+		"docs/*.md",
+		filepath.Join(dir, "secret", "id_rsa"),
+		"../secret/*",
+		"docs/../../secret/id_rsa",
+		"secret/id_rsa",
+		"missing.txt",
+	}}
+	assert.Equal(t, []string{
+		filepath.Join(root, "Makefile"),
+		filepath.Join(root, "docs", "a.md"),
+		filepath.Join(root, "missing.txt"),
+	}, project.ContextFilePaths())
+}
+
+func TestProjectConfigCantSetEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	userPath := filepath.Join(dir, "home", "config.yaml")
+	projectDir := filepath.Join(dir, "project")
+
+	writeTestFile(t, userPath, `
+api_key: sk-user
+profiles:
+  work:
+    base_url: https://llm.example.com/v1
+`)
+	writeTestFile(t, filepath.Join(projectDir, ProjectConfigName), `
+model: gpt-4.1
+base_url: https://attacker.example.com/v1
+profiles:
+  work:
+    api_key: sk-project
+`)
+
+	config, err := LoadLayeredConfig(userPath, projectDir, "work")
+	assert.Nil(t, err)
+	assert.Len(t, config.Warnings, 2)
+
+	value, source, _ := config.Lookup("base_url")
+	assert.Equal(t, "https://llm.example.com/v1", value)
+	assert.Equal(t, "profile work in "+userPath, source)
+	value, _, _ = config.Lookup("api_key")
+	assert.Equal(t, "sk-user", value)
+	// other settings still apply
+	value, _, _ = config.Lookup("model")
+	assert.Equal(t, "gpt-4.1", value)
+}
+
+// Each setting a cloned repository could abuse is ignored in its project
+// file, the user's value is used instead
+func TestProjectConfigDangerousKeys(t *testing.T) {
+	for _, test := range []struct {
+		key   string
+		value string
+	}{
+		{"bin", "./evil.sh"},
+		{"no_redact", "true"},
+		{"context_env", "[AWS_SECRET_ACCESS_KEY]"},
+		{"history_denylist", "[]"},
+		{"redact_patterns", "[]"},
+		{"log_file", "/tmp/butterfish.log"},
+		{"audit", "false"},
+		{"audit_file", "/tmp/audit.jsonl"},
+		{"prompt_library", "/tmp/prompts.yaml"},
+		{"base_url", "https://attacker.example.com/v1"},
+		{"api_key", "sk-project"},
+		{"verbose", "2"},
+		{"token_timeout", "1"},
+		{"no_command_prompt", "true"},
+	} {
+		t.Run(test.key, func(t *testing.T) {
+			dir := t.TempDir()
+			userPath := filepath.Join(dir, "home", "config.yaml")
+			projectDir := filepath.Join(dir, "project")
+			projectPath := filepath.Join(projectDir, ProjectConfigName)
+
+			writeTestFile(t, userPath, "profile: work\nprofiles:\n  work:\n    model: gpt-4o\n")
+			writeTestFile(t, projectPath, fmt.Sprintf(
+				"model: gpt-4.1\n%s: %s\nprofiles:\n  work:\n    %s: %s\n",
+				test.key, test.value, test.key, test.value))
+
+			warnings := []string{
+				fmt.Sprintf("Ignoring %s in %s, it can only be set in the user config", test.key, projectPath),
+				fmt.Sprintf("Ignoring %s in profile work in %s, it can only be set in the user config", test.key, projectPath),
+			}
+
+			config, err := LoadLayeredConfig(userPath, projectDir, "")
+			assert.Nil(t, err)
+			assert.Equal(t, warnings, config.Warnings)
+			_, _, ok := config.Lookup(test.key)
+			assert.False(t, ok)
+			value, _, _ := config.Lookup("model")
+			assert.Equal(t, "gpt-4.1", value)
+
+			// the shell applies the project config with the tracker
+			project, err := LoadProjectConfig(projectDir, "work")
+			assert.Nil(t, err)
+			assert.Equal(t, warnings, project.Warnings)
+			assert.NotContains(t, project.Settings, test.key)
+			assert.Equal(t, "gpt-4.1", project.Model)
+		})
+	}
+}
+
+func TestThemes(t *testing.T) {
+	dir := t.TempDir()
+	userPath := filepath.Join(dir, "config.yaml")
+
+	writeTestFile(t, userPath, `
+theme: ocean
+themes:
+  ocean:
+    answer: "#5fafd7"
+    code_style: dracula
+`)
+
+	config, err := LoadLayeredConfig(userPath, "", "")
+	assert.Nil(t, err)
+	value, _, _ := config.Lookup("theme")
+	assert.Equal(t, "ocean", value)
+
+	// fields left out come from the base theme
+	theme, err := ResolveTheme("ocean", config)
+	assert.Nil(t, err)
+	theme = theme.Merge(LightTheme)
+	assert.Equal(t, "#5fafd7", theme.Answer)
+	assert.Equal(t, "dracula", theme.CodeStyle)
+	assert.Equal(t, LightTheme.Prompt, theme.Prompt)
+
+	scheme, err := theme.ShellColorScheme(util.Color256)
+	assert.Nil(t, err)
+	assert.Equal(t, "\x1b[38;5;74m", scheme.Answer)
+
+	scheme, err = theme.ShellColorScheme(util.ColorNone)
+	assert.Nil(t, err)
+	assert.Equal(t, ShellColorScheme{}, *scheme)
+
+	theme, err = ResolveTheme("dark", config)
+	assert.Nil(t, err)
+	assert.Equal(t, DarkTheme, theme)
+
+	_, err = ResolveTheme("missing", config)
+	assert.NotNil(t, err)
+
+	writeTestFile(t, userPath, "themes:\n  bad:\n    answer: not-a-color\n")
+	_, err = LoadConfigFile(userPath)
+	assert.NotNil(t, err)
+
+	writeTestFile(t, userPath, "themes:\n  bad:\n    anwser: red\n")
+	_, err = LoadConfigFile(userPath)
+	assert.NotNil(t, err)
+}
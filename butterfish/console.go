@@ -0,0 +1,106 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/charmbracelet/lipgloss"
+
+	"github.com/bakks/butterfish/bubbles/console"
+	"github.com/bakks/butterfish/util"
+)
+
+// The console is a full screen chat UI for longer conversations than fit
+// comfortably in the shell's inline prompt. Prompts are assembled the same
+// way as in shell mode, with the system message, context providers, project
+// instructions and redaction, and the conversation is kept in a ShellHistory
+// so earlier prompts and answers are sent as context.
+
+type consoleSession struct {
+	ctx     context.Context
+	state   *ShellState
+	program *console.ConsoleProgram
+	// held while an answer streams, prompts entered meanwhile wait their turn
+	mutex sync.Mutex
+}
+
+func RunConsole(ctx context.Context, config *ButterfishConfig) error {
+	bf, cleanup, err := newPromptingButterfish(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if config.ColorAuto && config.ColorDepth != util.ColorNone {
+		config.ColorDark = lipgloss.HasDarkBackground()
+	}
+	_, colorScheme := bf.shellTheme()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	session := &consoleSession{
+		ctx: ctx,
+		state: &ShellState{
+			Butterfish:  bf,
+			History:     NewShellHistory(),
+			Prompt:      NewShellBuffer(),
+			Color:       colorScheme,
+			PromptModel: config.ShellPromptModel,
+			PromptMaxTokens: min(
+				NumTokensForModel(config.ShellPromptModel),
+				config.ShellMaxPromptTokens),
+			Project: ProjectTracker{Profile: config.Profile},
+			Context: NewContextCache(bf.ContextProviders),
+		},
+	}
+
+	done := make(chan struct{})
+	session.program = console.NewConsoleProgram(nil,
+		func(prompt string) {
+			// called from the UI loop, which must not block on our writes
+			go session.answer(prompt)
+		},
+		func() { close(done) })
+
+	// project config errors are printed to ParentOut
+	session.state.ParentOut = util.NewReplaceWriter(session.program, "\r\n", "\n")
+
+	fmt.Fprintf(session.program, "Butterfish console, prompting %s. Enter sends, Alt-Enter or Ctrl-J inserts a newline, Ctrl-F searches, Ctrl-C quits.\n",
+		config.ShellPromptModel)
+
+	<-done
+	return nil
+}
+
+// Send a prompt with the conversation so far and stream the answer into the
+// console
+func (this *consoleSession) answer(prompt string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	state := this.state
+	// we're not on the UI loop, so we can wait for the context sections
+	state.refreshContext()
+	state.Context.Wait()
+	request, err := state.PromptRequest(this.ctx, prompt, "")
+	if err != nil {
+		log.Printf("%s", err)
+		fmt.Fprintf(this.program, "%s%s\n", state.Color.Error, err)
+		return
+	}
+
+	state.appendHistory(historyTypePrompt, prompt)
+
+	outputChan := make(chan *util.CompletionResponse, 1)
+	go CompletionRoutine(request, state.Butterfish.LLMClient, this.program,
+		outputChan, "", state.Color.Error, nil)
+	output := <-outputChan
+
+	if output != nil && output.Completion != "" {
+		state.AnswerBlocks = util.ExtractCodeBlocks(output.Completion)
+		state.appendHistory(historyTypeLLMOutput, output.Completion)
+	}
+}
@@ -0,0 +1,499 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/tiktoken-go"
+)
+
+// Context providers add sections describing the user's environment to the
+// system message, e.g. the git status of the working directory or the
+// installed toolchain versions. Each provider is enabled by name with the
+// --context flag or the context config key, so they can be turned on per
+// profile:
+//
+//	profiles:
+//	  dev:
+//	    context: [git, ls, toolchains]
+//	    context_tokens: 512
+//
+// Each section is truncated to the context_tokens budget.
+
+type ContextProvider interface {
+	// Name used to enable the provider in config
+	Name() string
+	// Label for the section in the system message
+	Label() string
+	// Collect the section content for the shell's working directory, returns
+	// "" if there's nothing to add, e.g. git outside a repository.
+	Collect(ctx context.Context, cwd string) (string, error)
+}
+
+// Maximum time we wait for a provider, see ContextCache for how we keep them
+// from holding up a prompt
+const contextProviderTimeout = 2 * time.Second
+
+var DefaultContextEnv = []string{
+	"VIRTUAL_ENV",
+	"CONDA_DEFAULT_ENV",
+	"NODE_ENV",
+	"AWS_PROFILE",
+	"AWS_REGION",
+	"KUBECONFIG",
+}
+
+// The names of the available providers, in the order their sections appear
+var ContextProviderNames = []string{"os", "toolchains", "env", "git", "ls"}
+
+// Build the providers with the given names. envVars is the list of variables
+// the env provider reports.
+func NewContextProviders(names []string, envVars []string) ([]ContextProvider, error) {
+	providers := []ContextProvider{}
+	seen := map[string]bool{}
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		var provider ContextProvider
+		switch name {
+		case "os":
+			provider = &OSContextProvider{}
+		case "toolchains":
+			provider = NewToolchainContextProvider()
+		case "env":
+			provider = &EnvContextProvider{Vars: envVars}
+		case "git":
+			provider = &GitContextProvider{}
+		case "ls":
+			provider = &ListingContextProvider{MaxEntries: 100}
+		default:
+			return nil, fmt.Errorf("Unknown context provider %s, expected one of (%s)",
+				name, strings.Join(ContextProviderNames, ", "))
+		}
+		providers = append(providers, provider)
+	}
+
+	// keep a stable order regardless of how they were listed in config
+	sort.SliceStable(providers, func(i, j int) bool {
+		return contextProviderIndex(providers[i].Name()) < contextProviderIndex(providers[j].Name())
+	})
+
+	return providers, nil
+}
+
+func contextProviderIndex(name string) int {
+	for i, n := range ContextProviderNames {
+		if n == name {
+			return i
+		}
+	}
+	return len(ContextProviderNames)
+}
+
+// A rendered provider section
+type ContextSection struct {
+	Name      string
+	Label     string
+	Content   string
+	Tokens    int
+	Truncated bool
+}
+
+func (this *ContextSection) String() string {
+	content := this.Content
+	if this.Truncated {
+		content += "\n(truncated)"
+	}
+	return fmt.Sprintf("%s:\n%s", this.Label, content)
+}
+
+// Run the providers concurrently and truncate each section to maxTokens.
+// Providers that fail or return nothing are left out.
+func CollectContext(
+	ctx context.Context,
+	providers []ContextProvider,
+	cwd string,
+	encoder *tiktoken.Tiktoken,
+	maxTokens int) []ContextSection {
+
+	results := make([]*ContextSection, len(providers))
+	wg := sync.WaitGroup{}
+
+	for i, provider := range providers {
+		wg.Add(1)
+		go func(i int, provider ContextProvider) {
+			defer wg.Done()
+
+			providerCtx, cancel := context.WithTimeout(ctx, contextProviderTimeout)
+			defer cancel()
+
+			content, err := provider.Collect(providerCtx, cwd)
+			if err != nil {
+				log.Printf("Error collecting %s context: %s", provider.Name(), err)
+				return
+			}
+			content = strings.TrimSpace(content)
+			if content == "" {
+				return
+			}
+
+			numTokens, content, truncated := countAndTruncate(content, encoder, maxTokens)
+			results[i] = &ContextSection{
+				Name:      provider.Name(),
+				Label:     provider.Label(),
+				Content:   content,
+				Tokens:    numTokens,
+				Truncated: truncated,
+			}
+		}(i, provider)
+	}
+
+	wg.Wait()
+
+	sections := []ContextSection{}
+	for _, section := range results {
+		if section != nil {
+			sections = append(sections, *section)
+		}
+	}
+	return sections
+}
+
+// Runs the context providers in the background so a prompt never waits on a
+// slow git or kubectl. The shell refreshes the sections whenever it shows a
+// prompt, which is the state the next question starts from, and a prompt
+// uses the latest sections collected for its working directory.
+type ContextCache struct {
+	Providers []ContextProvider
+
+	mutex     sync.Mutex
+	collected bool
+	cwd       string // where the sections were collected
+	sections  []ContextSection
+	// closed when the refresh in progress is done, nil if there isn't one
+	done chan struct{}
+	// a refresh asked for while another was running
+	queued *contextRefresh
+}
+
+type contextRefresh struct {
+	ctx       context.Context
+	cwd       string
+	encoder   *tiktoken.Tiktoken
+	maxTokens int
+}
+
+func NewContextCache(providers []ContextProvider) *ContextCache {
+	return &ContextCache{Providers: providers}
+}
+
+// Start collecting the sections for cwd, if a refresh is already running
+// this one starts when it's done.
+func (this *ContextCache) Refresh(ctx context.Context, cwd string, encoder *tiktoken.Tiktoken, maxTokens int) {
+	if this == nil || len(this.Providers) == 0 {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	refresh := &contextRefresh{ctx, cwd, encoder, maxTokens}
+	if this.done != nil {
+		this.queued = refresh
+		return
+	}
+	this.done = make(chan struct{})
+	go this.collect(refresh)
+}
+
+func (this *ContextCache) collect(refresh *contextRefresh) {
+	for refresh != nil {
+		sections := CollectContext(refresh.ctx, this.Providers, refresh.cwd,
+			refresh.encoder, refresh.maxTokens)
+
+		this.mutex.Lock()
+		this.collected = true
+		this.cwd = refresh.cwd
+		this.sections = sections
+		refresh = this.queued
+		this.queued = nil
+		if refresh == nil {
+			close(this.done)
+			this.done = nil
+		}
+		this.mutex.Unlock()
+	}
+}
+
+// The latest sections collected for cwd, false if there aren't any yet
+func (this *ContextCache) Sections(cwd string) ([]ContextSection, bool) {
+	if this == nil {
+		return nil, true
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.collected || this.cwd != cwd {
+		return nil, len(this.Providers) == 0
+	}
+	return this.sections, true
+}
+
+// Wait until the refreshes asked for so far are done
+func (this *ContextCache) Wait() {
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	done := this.done
+	this.mutex.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// Run a command in dir and return its trimmed output
+func runContextCommand(ctx context.Context, dir string, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Git branch, short status and a diff summary of the working directory
+type GitContextProvider struct{}
+
+func (this *GitContextProvider) Name() string  { return "git" }
+func (this *GitContextProvider) Label() string { return "Git status" }
+
+func (this *GitContextProvider) Collect(ctx context.Context, cwd string) (string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", nil
+	}
+
+	// outside a repository, nothing to report
+	if _, err := runContextCommand(ctx, cwd, "git", "rev-parse", "--git-dir"); err != nil {
+		return "", nil
+	}
+
+	status, err := runContextCommand(ctx, cwd, "git", "status", "--short", "--branch")
+	if err != nil {
+		return "", err
+	}
+
+	diff, err := runContextCommand(ctx, cwd, "git", "diff", "--stat", "HEAD")
+	if err != nil {
+		// a repository without commits has no HEAD
+		diff = ""
+	}
+
+	if diff == "" {
+		return status, nil
+	}
+	return status + "\n\nDiff against HEAD:\n" + diff, nil
+}
+
+// The entries of the working directory
+type ListingContextProvider struct {
+	MaxEntries int
+}
+
+func (this *ListingContextProvider) Name() string  { return "ls" }
+func (this *ListingContextProvider) Label() string { return "Working directory contents" }
+
+func (this *ListingContextProvider) Collect(ctx context.Context, cwd string) (string, error) {
+	entries, err := os.ReadDir(cwd)
+	if err != nil {
+		return "", err
+	}
+
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "%s\n", cwd)
+	for i, entry := range entries {
+		if i >= this.MaxEntries {
+			fmt.Fprintf(&builder, "... and %d more\n", len(entries)-i)
+			break
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		builder.WriteString(name)
+		builder.WriteString("\n")
+	}
+
+	return builder.String(), nil
+}
+
+// Selected environment variables. We read our own environment, which the
+// shell inherited at startup, so later exports in the shell aren't seen.
+type EnvContextProvider struct {
+	Vars []string
+}
+
+func (this *EnvContextProvider) Name() string  { return "env" }
+func (this *EnvContextProvider) Label() string { return "Environment variables" }
+
+func (this *EnvContextProvider) Collect(ctx context.Context, cwd string) (string, error) {
+	builder := strings.Builder{}
+	for _, name := range this.Vars {
+		if value, ok := os.LookupEnv(name); ok {
+			fmt.Fprintf(&builder, "%s=%s\n", name, value)
+		}
+	}
+	return builder.String(), nil
+}
+
+// The OS distribution and which package managers are installed
+type OSContextProvider struct{}
+
+func (this *OSContextProvider) Name() string  { return "os" }
+func (this *OSContextProvider) Label() string { return "Operating system" }
+
+var packageManagers = []string{
+	"apt", "dnf", "yum", "pacman", "apk", "zypper", "nix", "brew", "port",
+}
+
+func (this *OSContextProvider) Collect(ctx context.Context, cwd string) (string, error) {
+	distro := ""
+	switch runtime.GOOS {
+	case "linux":
+		distro = linuxDistro()
+	case "darwin":
+		version, err := runContextCommand(ctx, "", "sw_vers", "-productVersion")
+		if err == nil {
+			distro = "macOS " + version
+		}
+	}
+	if distro == "" {
+		distro = runtime.GOOS
+	}
+
+	found := []string{}
+	for _, manager := range packageManagers {
+		if _, err := exec.LookPath(manager); err == nil {
+			found = append(found, manager)
+		}
+	}
+
+	out := "Distribution: " + distro
+	if len(found) > 0 {
+		out += "\nPackage managers: " + strings.Join(found, ", ")
+	}
+	return out, nil
+}
+
+// Read PRETTY_NAME from /etc/os-release
+func linuxDistro() string {
+	file, err := os.Open("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "PRETTY_NAME=") {
+			return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), `"`)
+		}
+	}
+	return ""
+}
+
+// A language toolchain, detected by marker files in the working directory
+// or one of its parents
+type toolchain struct {
+	Name    string
+	Markers []string
+	Command []string
+}
+
+var toolchains = []toolchain{
+	{"Go", []string{"go.mod"}, []string{"go", "version"}},
+	{"Python", []string{"pyproject.toml", "requirements.txt", "setup.py", "Pipfile"}, []string{"python3", "--version"}},
+	{"Node", []string{"package.json"}, []string{"node", "--version"}},
+	{"Rust", []string{"Cargo.toml"}, []string{"rustc", "--version"}},
+	{"Ruby", []string{"Gemfile"}, []string{"ruby", "--version"}},
+	{"Java", []string{"pom.xml", "build.gradle", "build.gradle.kts"}, []string{"java", "-version"}},
+}
+
+// Versions of the toolchains used by the project in the working directory
+type ToolchainContextProvider struct {
+	mutex    sync.Mutex
+	versions map[string]string // cached version output by toolchain name
+}
+
+func NewToolchainContextProvider() *ToolchainContextProvider {
+	return &ToolchainContextProvider{
+		versions: map[string]string{},
+	}
+}
+
+func (this *ToolchainContextProvider) Name() string  { return "toolchains" }
+func (this *ToolchainContextProvider) Label() string { return "Toolchains" }
+
+func (this *ToolchainContextProvider) Collect(ctx context.Context, cwd string) (string, error) {
+	builder := strings.Builder{}
+
+	for _, tc := range toolchains {
+		if !hasMarkerUpward(cwd, tc.Markers) {
+			continue
+		}
+
+		version := this.version(ctx, tc)
+		if version == "" {
+			version = "not installed"
+		}
+		fmt.Fprintf(&builder, "%s: %s\n", tc.Name, version)
+	}
+
+	return builder.String(), nil
+}
+
+func (this *ToolchainContextProvider) version(ctx context.Context, tc toolchain) string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if version, ok := this.versions[tc.Name]; ok {
+		return version
+	}
+
+	cmd := exec.CommandContext(ctx, tc.Command[0], tc.Command[1:]...)
+	// java prints its version to stderr
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return ""
+	}
+
+	version := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	this.versions[tc.Name] = version
+	return version
+}
+
+func hasMarkerUpward(dir string, markers []string) bool {
+	for _, marker := range markers {
+		if FindUpward(dir, marker) != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package butterfish
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bakks/tiktoken-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextProviders(t *testing.T) {
+	_, err := NewContextProviders([]string{"git", "bogus"}, nil)
+	assert.NotNil(t, err)
+
+	// listed order doesn't matter, and duplicates are dropped
+	providers, err := NewContextProviders([]string{"ls", "env", "ls", "toolchains"}, []string{"BUTTERFISH_TEST_VAR"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(providers))
+	assert.Equal(t, "toolchains", providers[0].Name())
+	assert.Equal(t, "env", providers[1].Name())
+	assert.Equal(t, "ls", providers[2].Name())
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "main.txt"), "hello")
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	t.Setenv("BUTTERFISH_TEST_VAR", "foo")
+
+	content, err := providers[2].Collect(context.Background(), dir)
+	assert.Nil(t, err)
+	assert.Equal(t, dir+"\nmain.txt\nsub/\n", content)
+
+	// the encoder's data is downloaded on first use
+	encoder, err := tiktoken.EncodingForModel(DEFAULT_PROMPT_ENCODER)
+	if err != nil {
+		t.Skipf("Could not load encoder: %s", err)
+	}
+
+	// the toolchains provider has nothing to report without marker files
+	sections := CollectContext(context.Background(), providers, dir, encoder, 256)
+	assert.Equal(t, 2, len(sections))
+	assert.Equal(t, "env", sections[0].Name)
+	assert.Equal(t, "BUTTERFISH_TEST_VAR=foo", sections[0].Content)
+	assert.Equal(t, dir+"\nmain.txt\nsub/", sections[1].Content)
+	assert.False(t, sections[1].Truncated)
+
+	sections = CollectContext(context.Background(), providers[2:], dir, encoder, 2)
+	assert.Equal(t, 2, sections[0].Tokens)
+	assert.True(t, sections[0].Truncated)
+}
+
+// A provider that reports the directory once it's let go
+type blockingContextProvider struct {
+	release chan struct{}
+}
+
+func (this *blockingContextProvider) Name() string  { return "blocking" }
+func (this *blockingContextProvider) Label() string { return "Blocking" }
+
+func (this *blockingContextProvider) Collect(ctx context.Context, cwd string) (string, error) {
+	<-this.release
+	return cwd, nil
+}
+
+func TestContextCache(t *testing.T) {
+	encoder, err := tiktoken.EncodingForModel(DEFAULT_PROMPT_ENCODER)
+	if err != nil {
+		t.Skipf("Could not load encoder: %s", err)
+	}
+	provider := &blockingContextProvider{release: make(chan struct{})}
+	cache := NewContextCache([]ContextProvider{provider})
+
+	// collecting doesn't hold up the caller
+	cache.Refresh(context.Background(), "/a", encoder, 256)
+	cache.Refresh(context.Background(), "/b", encoder, 256)
+	_, ok := cache.Sections("/a")
+	assert.False(t, ok)
+
+	close(provider.release)
+	cache.Wait()
+
+	// the refresh asked for during the first one ran after it
+	_, ok = cache.Sections("/a")
+	assert.False(t, ok)
+	sections, ok := cache.Sections("/b")
+	assert.True(t, ok)
+	assert.Equal(t, "/b", sections[0].Content)
+
+	// without providers there's nothing to wait for
+	_, ok = NewContextCache(nil).Sections("/a")
+	assert.True(t, ok)
+}
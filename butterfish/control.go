@@ -0,0 +1,653 @@
+package butterfish
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Each shell session listens on a Unix socket so editors and scripts can talk
+// to it, the path is in the BUTTERFISH_SOCKET env var inside the shell. The
+// protocol is JSON-RPC 2.0 with one message per line. Methods:
+//
+//	prompt {"text",            send a prompt as if it was typed, the answer is
+//	  "attachment"}            streamed as "answer" notifications with the
+//	                           request id, the result is the whole answer.
+//	                           The attachment is input piped to butterfish
+//	                           ask, sent and recorded with the prompt.
+//	history {"limit"}          the last limit history blocks, all if 0
+//	inject {"text", "run"}     type text into the command line, and press
+//	                           Enter if run is set
+//	subscribe {"events"}       get "event" notifications, for
+//	                           command_finished and answer_finished, all if
+//	                           none are given
+//
+// Calls are handled by the shell's mux so they see a consistent state, a
+// prompt or inject while the user is typing or an answer is printing fails
+// with the busy error.
+
+const ControlSocketEnv = "BUTTERFISH_SOCKET"
+
+const (
+	ControlEventCommandFinished = "command_finished"
+	ControlEventAnswerFinished  = "answer_finished"
+)
+
+// JSON-RPC error codes, the standard ones and ours
+const (
+	controlParseError     = -32700
+	controlInvalidRequest = -32600
+	controlMethodNotFound = -32601
+	controlInvalidParams  = -32602
+	controlBusy           = -32000
+	controlFailed         = -32001
+)
+
+type ControlRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type ControlError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (this *ControlError) Error() string {
+	return this.Message
+}
+
+// A response or notification, responses have an ID and a result or error
+type ControlMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  any             `json:"params,omitempty"`
+	Result  any             `json:"result,omitempty"`
+	Error   *ControlError   `json:"error,omitempty"`
+}
+
+type ControlPromptParams struct {
+	Text       string `json:"text"`
+	Attachment string `json:"attachment,omitempty"`
+}
+
+type ControlHistoryParams struct {
+	Limit int `json:"limit"`
+}
+
+type ControlInjectParams struct {
+	Text string `json:"text"`
+	Run  bool   `json:"run"`
+}
+
+type ControlSubscribeParams struct {
+	Events []string `json:"events"`
+}
+
+type ControlHistoryBlock struct {
+	Type    string `json:"type"`
+	Content string `json:"content"`
+}
+
+var controlHistoryTypes = map[int]string{
+	historyTypePrompt:      "prompt",
+	historyTypeShellInput:  "shell_input",
+	historyTypeShellOutput: "shell_output",
+	historyTypeLLMOutput:   "llm_output",
+}
+
+// Messages queued for a client before we give up on it, answers are sent a
+// notification per chunk so this allows for a long one
+const controlQueueSize = 1024
+
+// How long a write to a client can block before we give up on it
+const controlWriteTimeout = 5 * time.Second
+
+// A client connection. Messages are sent from the mux and from a streaming
+// answer, so they're queued and written by the connection's own goroutine,
+// a client that stops reading can't block the shell.
+type ControlConn struct {
+	mutex sync.Mutex
+	conn  net.Conn
+	queue chan []byte
+	// set once the queue is closed
+	closed bool
+	// the events subscribed to, nil if not subscribed
+	events map[string]bool
+	// calls not replied to yet
+	pending sync.WaitGroup
+	// closed when the queue is written out
+	flushed chan struct{}
+}
+
+func newControlConn(conn net.Conn) *ControlConn {
+	client := &ControlConn{
+		conn:    conn,
+		queue:   make(chan []byte, controlQueueSize),
+		flushed: make(chan struct{}),
+	}
+	go client.write()
+	return client
+}
+
+func (this *ControlConn) write() {
+	defer close(this.flushed)
+	for data := range this.queue {
+		this.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+		_, err := this.conn.Write(data)
+		if err != nil {
+			// the client went away or stopped reading, closing the
+			// connection ends its reader which cleans up
+			log.Printf("Error writing to control client: %s", err)
+			this.conn.Close()
+		}
+	}
+}
+
+func (this *ControlConn) send(message *ControlMessage) {
+	message.JSONRPC = "2.0"
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error encoding control message: %s", err)
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return
+	}
+	select {
+	case this.queue <- append(data, '\n'):
+	default:
+		log.Printf("Control client isn't reading, disconnecting it")
+		this.conn.Close()
+	}
+}
+
+// Stop sending and close the connection once the queued messages are written
+func (this *ControlConn) Close() {
+	this.mutex.Lock()
+	if !this.closed {
+		this.closed = true
+		close(this.queue)
+	}
+	this.mutex.Unlock()
+	<-this.flushed
+	this.conn.Close()
+}
+
+func (this *ControlConn) Reply(id json.RawMessage, result any) {
+	if id == nil {
+		// a notification from the client, no reply
+		return
+	}
+	if result == nil {
+		result = struct{}{}
+	}
+	this.send(&ControlMessage{ID: id, Result: result})
+}
+
+func (this *ControlConn) ReplyError(id json.RawMessage, err error) {
+	controlErr := &ControlError{Code: controlFailed, Message: err.Error()}
+	errors.As(err, &controlErr)
+	if id == nil {
+		// notifications get no reply, even when they fail
+		return
+	}
+	this.send(&ControlMessage{ID: id, Error: controlErr})
+}
+
+func (this *ControlConn) Notify(method string, params any) {
+	this.send(&ControlMessage{Method: method, Params: params})
+}
+
+func (this *ControlConn) Subscribe(events []string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.events = map[string]bool{}
+	for _, event := range events {
+		this.events[event] = true
+	}
+}
+
+func (this *ControlConn) subscribed(event string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.events != nil && (len(this.events) == 0 || this.events[event])
+}
+
+// A request waiting to be handled by the mux
+type ControlCall struct {
+	Conn    *ControlConn
+	Request *ControlRequest
+}
+
+func newControlCall(conn *ControlConn, request *ControlRequest) *ControlCall {
+	conn.pending.Add(1)
+	return &ControlCall{Conn: conn, Request: request}
+}
+
+// Each call is replied to once
+func (this *ControlCall) Reply(result any) {
+	this.Conn.Reply(this.Request.ID, result)
+	this.Conn.pending.Done()
+}
+
+func (this *ControlCall) ReplyError(err error) {
+	this.Conn.ReplyError(this.Request.ID, err)
+	this.Conn.pending.Done()
+}
+
+// Decode the params into v, an error to reply with if they don't fit
+func (this *ControlCall) Params(v any) error {
+	if len(this.Request.Params) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(this.Request.Params, v)
+	if err != nil {
+		return &ControlError{Code: controlInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+type ControlServer struct {
+	Path     string
+	Calls    chan *ControlCall
+	listener net.Listener
+	done     chan struct{}
+	mutex    sync.Mutex
+	conns    map[*ControlConn]bool
+}
+
+func ListenControl(path string) (*ControlServer, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// only we can connect
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &ControlServer{
+		Path:     path,
+		Calls:    make(chan *ControlCall, 8),
+		listener: listener,
+		done:     make(chan struct{}),
+		conns:    map[*ControlConn]bool{},
+	}, nil
+}
+
+// Accept connections until the server is closed
+func (this *ControlServer) Serve() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			select {
+			case <-this.done:
+			default:
+				log.Printf("Error accepting control connection: %s", err)
+			}
+			return
+		}
+
+		client := newControlConn(conn)
+		this.mutex.Lock()
+		this.conns[client] = true
+		this.mutex.Unlock()
+		go this.read(client)
+	}
+}
+
+func (this *ControlServer) read(client *ControlConn) {
+	defer func() {
+		// a client may close its side once it's sent its requests, so the
+		// replies are sent before we close ours
+		replied := make(chan struct{})
+		go func() {
+			client.pending.Wait()
+			close(replied)
+		}()
+		select {
+		case <-replied:
+		case <-this.done:
+		}
+
+		this.mutex.Lock()
+		delete(this.conns, client)
+		this.mutex.Unlock()
+		client.Close()
+	}()
+
+	reader := bufio.NewReader(client.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			// only a parse error is answered with a null id, an invalid request
+			// without an id is a notification and gets no reply
+			request := &ControlRequest{}
+			jsonErr := json.Unmarshal(line, request)
+			syntaxErr := &json.SyntaxError{}
+			if errors.As(jsonErr, &syntaxErr) {
+				client.ReplyError(json.RawMessage("null"), &ControlError{Code: controlParseError,
+					Message: jsonErr.Error()})
+			} else if jsonErr != nil || request.JSONRPC != "2.0" || request.Method == "" {
+				client.ReplyError(request.ID, &ControlError{Code: controlInvalidRequest,
+					Message: "expected a JSON-RPC 2.0 request with a method"})
+			} else {
+				select {
+				case this.Calls <- newControlCall(client, request):
+				case <-this.done:
+					return
+				}
+			}
+		}
+		if err != nil {
+			select {
+			case <-this.done:
+			default:
+				if err != io.EOF {
+					log.Printf("Error reading from control client: %s", err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// Send an event notification to the clients subscribed to it
+func (this *ControlServer) Broadcast(event string, params map[string]any) {
+	this.mutex.Lock()
+	conns := []*ControlConn{}
+	for conn := range this.conns {
+		if conn.subscribed(event) {
+			conns = append(conns, conn)
+		}
+	}
+	this.mutex.Unlock()
+
+	params["type"] = event
+	for _, conn := range conns {
+		conn.Notify("event", params)
+	}
+}
+
+func (this *ControlServer) Close() error {
+	close(this.done)
+	err := this.listener.Close()
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for conn := range this.conns {
+		conn.conn.Close()
+	}
+	return err
+}
+
+// Streams an answer to the client that sent the prompt as it's written
+type controlAnswerWriter struct {
+	call *ControlCall
+}
+
+func (this controlAnswerWriter) Write(data []byte) (int, error) {
+	this.call.Conn.Notify("answer", map[string]any{
+		"id":   this.call.Request.ID,
+		"text": string(data),
+	})
+	return len(data), nil
+}
+
+// Wraps the LLM for a prompt sent over the socket, the answer's tokens are
+// streamed to the client and the error is kept for the reply
+type ControlLLM struct {
+	Client LLM
+	Call   *ControlCall
+	Err    error
+}
+
+func (this *ControlLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	response, err := this.Client.CompletionStream(request,
+		io.MultiWriter(writer, controlAnswerWriter{call: this.Call}))
+	this.Err = err
+	return response, err
+}
+
+func (this *ControlLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return this.Client.Completion(request)
+}
+
+var errControlBusy = &ControlError{Code: controlBusy,
+	Message: "the shell is busy, e.g. a command is being typed or an answer is printing"}
+
+// Handle a call from the control socket, called from the mux
+func (this *ShellState) HandleControl(call *ControlCall) {
+	switch call.Request.Method {
+	case "prompt":
+		params := &ControlPromptParams{}
+		if err := call.Params(params); err != nil {
+			call.ReplyError(err)
+			return
+		}
+		if params.Text == "" {
+			call.ReplyError(&ControlError{Code: controlInvalidParams, Message: "text is required"})
+			return
+		}
+		if this.State != stateNormal || this.altScreen || this.controlPrompt != nil {
+			call.ReplyError(errControlBusy)
+			return
+		}
+		this.ControlPrompt(call, params.Text, params.Attachment)
+
+	case "history":
+		params := &ControlHistoryParams{}
+		if err := call.Params(params); err != nil {
+			call.ReplyError(err)
+			return
+		}
+		blocks := this.historyBlocks()
+		if params.Limit > 0 && params.Limit < len(blocks) {
+			blocks = blocks[len(blocks)-params.Limit:]
+		}
+		result := []ControlHistoryBlock{}
+		for _, block := range blocks {
+			result = append(result, ControlHistoryBlock{
+				Type:    controlHistoryTypes[block.Type],
+				Content: block.Content,
+			})
+		}
+		call.Reply(map[string]any{"blocks": result})
+
+	case "inject":
+		params := &ControlInjectParams{}
+		if err := call.Params(params); err != nil {
+			call.ReplyError(err)
+			return
+		}
+		if this.State != stateNormal || this.altScreen {
+			call.ReplyError(errControlBusy)
+			return
+		}
+		// the text is typed without control characters, so run is the only
+		// way to submit it
+		if params.Text != "" {
+			if err := this.typeCommand(params.Text); err != nil {
+				call.ReplyError(&ControlError{Code: controlInvalidParams, Message: "text has more than one line and " + err.Error()})
+				return
+			}
+		}
+		if params.Run {
+			this.ParentInput(this.Butterfish.Ctx, InputEvent{Type: KeyEvent, Key: KeyEnter, Raw: []byte("\r")})
+		}
+		call.Reply(nil)
+
+	case "subscribe":
+		params := &ControlSubscribeParams{}
+		if err := call.Params(params); err != nil {
+			call.ReplyError(err)
+			return
+		}
+		call.Conn.Subscribe(params.Events)
+		call.Reply(nil)
+
+	default:
+		call.ReplyError(&ControlError{Code: controlMethodNotFound,
+			Message: fmt.Sprintf("unknown method %s", call.Request.Method)})
+	}
+}
+
+// Send a prompt from the socket, shown on the terminal as if it was typed.
+// An attachment isn't shown, just how long it is.
+func (this *ShellState) ControlPrompt(call *ControlCall, prompt, attachment string) {
+	log.Printf("Prompt from the control socket")
+	this.controlPrompt = &ControlLLM{Client: this.Butterfish.LLMClient, Call: call}
+	fmt.Fprintf(this.ParentOut, "%s%s\r\n", this.Color.Prompt,
+		strings.ReplaceAll(prompt, "\n", "\r\n"))
+
+	attachment = strings.TrimRight(sanitizeTTYString(attachment), "\n")
+	if attachment != "" {
+		lines := strings.Count(attachment, "\n") + 1
+		fmt.Fprintf(this.ParentOut, "%s(%d lines of input attached)\r\n", this.Color.Command, lines)
+	}
+	this.sendPrompt(prompt, attachment)
+}
+
+// Reply to the prompt sent over the socket, if there is one, once the answer
+// is done
+func (this *ShellState) finishControlPrompt(answer string, err error) {
+	if this.controlPrompt == nil {
+		return
+	}
+	call := this.controlPrompt.Call
+	if err == nil {
+		err = this.controlPrompt.Err
+	}
+	this.controlPrompt = nil
+
+	if err != nil {
+		call.ReplyError(err)
+	} else {
+		call.Reply(map[string]any{"answer": answer})
+	}
+}
+
+// Tell subscribed clients about an event
+func (this *ShellState) controlEvent(event string, params map[string]any) {
+	if this.Butterfish.Control == nil || this.Incognito {
+		return
+	}
+	this.Butterfish.Control.Broadcast(event, params)
+}
+
+// A client for the control socket, used by butterfish ask
+type ControlClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	nextID int
+}
+
+func DialControl(path string) (*ControlClient, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &ControlClient{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// Make a call and wait for its result, notifications that come meanwhile are
+// passed to notify if it's set
+func (this *ControlClient) Call(method string, params any, result any,
+	notify func(method string, params json.RawMessage)) error {
+
+	this.nextID++
+	id := json.RawMessage(fmt.Sprint(this.nextID))
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(this.conn).Encode(&ControlRequest{
+		JSONRPC: "2.0",
+		ID:      id,
+		Method:  method,
+		Params:  data,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, err := this.reader.ReadBytes('\n')
+		if err != nil {
+			return fmt.Errorf("the shell closed the connection: %w", err)
+		}
+		message := &struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			Result json.RawMessage `json:"result"`
+			Error  *ControlError   `json:"error"`
+		}{}
+		err = json.Unmarshal(line, message)
+		if err != nil {
+			return err
+		}
+
+		if message.Method != "" {
+			if notify != nil {
+				notify(message.Method, message.Params)
+			}
+			continue
+		}
+		if !bytes.Equal(message.ID, id) {
+			continue
+		}
+		if message.Error != nil {
+			return message.Error
+		}
+		if result != nil {
+			return json.Unmarshal(message.Result, result)
+		}
+		return nil
+	}
+}
+
+// Send a prompt with an optional attachment and wait for the answer, which
+// is written to out as it streams in if out is set
+func (this *ControlClient) Prompt(text, attachment string, out io.Writer) (string, error) {
+	result := &struct {
+		Answer string `json:"answer"`
+	}{}
+	err := this.Call("prompt", &ControlPromptParams{Text: text, Attachment: attachment}, result,
+		func(method string, params json.RawMessage) {
+			chunk := &struct {
+				ID   json.RawMessage `json:"id"`
+				Text string          `json:"text"`
+			}{}
+			// the chunks of this call's answer
+			id := fmt.Sprint(this.nextID)
+			if out != nil && method == "answer" &&
+				json.Unmarshal(params, chunk) == nil && string(chunk.ID) == id {
+				io.WriteString(out, chunk.Text)
+			}
+		})
+	return result.Answer, err
+}
+
+func (this *ControlClient) Close() error {
+	return this.conn.Close()
+}
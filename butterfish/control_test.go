@@ -0,0 +1,250 @@
+package butterfish
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func readControlMessage(t *testing.T, reader *bufio.Reader) map[string]any {
+	line, err := reader.ReadBytes('\n')
+	assert.NoError(t, err)
+	message := map[string]any{}
+	assert.NoError(t, json.Unmarshal(line, &message))
+	return message
+}
+
+// A connection to a client at the other end of a pipe, and a reader for it
+func pipeControlConn(t *testing.T) (*ControlConn, *bufio.Reader) {
+	server, client := net.Pipe()
+	conn := newControlConn(server)
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+	return conn, bufio.NewReader(client)
+}
+
+func TestControlServer(t *testing.T) {
+	server, err := ListenControl(filepath.Join(t.TempDir(), "control.sock"))
+	assert.NoError(t, err)
+	defer server.Close()
+	go server.Serve()
+
+	conn, err := net.Dial("unix", server.Path)
+	assert.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// bad requests are answered by the server, blank lines are skipped, and
+	// invalid requests without an id are notifications so get no reply
+	conn.Write([]byte("{nope\n\n{\"method\":1}\n{\"method\":\"history\"}\n{\"id\":1,\"method\":\"history\"}\n"))
+	message := readControlMessage(t, reader)
+	assert.Equal(t, float64(controlParseError), message["error"].(map[string]any)["code"])
+	assert.Contains(t, message, "id")
+	assert.Nil(t, message["id"])
+	message = readControlMessage(t, reader)
+	assert.Equal(t, float64(controlInvalidRequest), message["error"].(map[string]any)["code"])
+	assert.Equal(t, float64(1), message["id"])
+
+	// good ones go to the mux
+	conn.Write([]byte(`{"jsonrpc":"2.0","id":"a","method":"subscribe","params":{"events":["answer_finished"]}}` + "\n"))
+	call := <-server.Calls
+	assert.Equal(t, "subscribe", call.Request.Method)
+	params := &ControlSubscribeParams{}
+	assert.NoError(t, call.Params(params))
+	call.Conn.Subscribe(params.Events)
+	call.Reply(nil)
+	assert.Equal(t, map[string]any{"jsonrpc": "2.0", "id": "a", "result": map[string]any{}},
+		readControlMessage(t, reader))
+
+	// only subscribed events are sent
+	server.Broadcast(ControlEventCommandFinished, map[string]any{"command": "ls", "exit_code": 0})
+	server.Broadcast(ControlEventAnswerFinished, map[string]any{"prompt": "Hi", "answer": "Hello"})
+	message = readControlMessage(t, reader)
+	assert.Equal(t, "event", message["method"])
+	assert.Equal(t, map[string]any{"type": "answer_finished", "prompt": "Hi", "answer": "Hello"},
+		message["params"])
+
+	// a client that closes its side after asking still gets its reply
+	conn.Write([]byte(`{"jsonrpc":"2.0","id":2,"method":"history"}` + "\n"))
+	conn.(*net.UnixConn).CloseWrite()
+	call = <-server.Calls
+	call.Reply(map[string]any{"blocks": []any{}})
+	message = readControlMessage(t, reader)
+	assert.Equal(t, float64(2), message["id"])
+	_, err = reader.ReadByte()
+	assert.Error(t, err)
+}
+
+func TestHandleControl(t *testing.T) {
+	childIn := &bytes.Buffer{}
+	state := &ShellState{
+		Butterfish: &ButterfishCtx{Ctx: context.Background()},
+		History:    NewShellHistory(),
+		ParentOut:  &bytes.Buffer{},
+		ChildIn:    childIn,
+		Color:      &ShellColorScheme{},
+		State:      stateNormal,
+	}
+	state.History.Append(historyTypeShellInput, "ls\n")
+	state.History.Append(historyTypeShellOutput, "main.go\n")
+	state.History.Append(historyTypePrompt, "What is main.go?")
+
+	conn, reader := pipeControlConn(t)
+	call := func(method, params string) map[string]any {
+		state.HandleControl(newControlCall(conn, &ControlRequest{
+			JSONRPC: "2.0", ID: json.RawMessage("7"), Method: method, Params: json.RawMessage(params)}))
+		return readControlMessage(t, reader)
+	}
+
+	message := call("history", `{"limit":2}`)
+	assert.Equal(t, []any{
+		map[string]any{"type": "shell_output", "content": "main.go\n"},
+		map[string]any{"type": "prompt", "content": "What is main.go?"},
+	}, message["result"].(map[string]any)["blocks"])
+
+	message = call("inject", `{"text":"make test"}`)
+	assert.Equal(t, map[string]any{}, message["result"])
+	assert.Equal(t, "make test", childIn.String())
+	assert.Equal(t, stateShell, state.State)
+
+	// text can't run itself by pressing Enter or ending a paste, and more
+	// than one line needs the shell to accept a paste
+	state.State = stateNormal
+	childIn.Reset()
+	message = call("inject", `{"text":"rm -rf /tmp/x\r\u001b[201~\r"}`)
+	assert.Equal(t, map[string]any{}, message["result"])
+	assert.Equal(t, "rm -rf /tmp/x[201~", childIn.String())
+	state.State = stateNormal
+	childIn.Reset()
+	message = call("inject", `{"text":"cd /\nls"}`)
+	assert.Equal(t, float64(controlInvalidParams), message["error"].(map[string]any)["code"])
+	assert.Equal(t, "", childIn.String())
+	state.bracketedPaste = true
+	message = call("inject", `{"text":"cd /\nls"}`)
+	assert.Equal(t, "\x1b[200~cd /\nls\x1b[201~", childIn.String())
+	assert.Equal(t, stateShell, state.State)
+
+	// nothing can be typed or sent while the user is typing
+	message = call("prompt", `{"text":"Why?"}`)
+	assert.Equal(t, float64(controlBusy), message["error"].(map[string]any)["code"])
+	message = call("prompt", `{"text":1}`)
+	assert.Equal(t, float64(controlInvalidParams), message["error"].(map[string]any)["code"])
+	message = call("launch", "")
+	assert.Equal(t, float64(controlMethodNotFound), message["error"].(map[string]any)["code"])
+}
+
+func TestControlLLM(t *testing.T) {
+	conn, reader := pipeControlConn(t)
+	call := newControlCall(conn, &ControlRequest{ID: json.RawMessage("3")})
+
+	// the answer is streamed to the client as it's written
+	controlAnswerWriter{call: call}.Write([]byte("Use "))
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","method":"answer","params":{"id":3,"text":"Use "}}`+"\n", line)
+
+	// and the error is kept for the reply
+	client := &ControlLLM{Client: &fakeLLM{err: errors.New("timed out")}, Call: call}
+	client.CompletionStream(&util.CompletionRequest{}, &bytes.Buffer{})
+	state := &ShellState{controlPrompt: client}
+	state.finishControlPrompt("", nil)
+	assert.Nil(t, state.controlPrompt)
+	line, err = reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","id":3,"error":{"code":-32001,"message":"timed out"}}`+"\n", line)
+}
+
+// A subscribed client that never reads can't block the shell, it's
+// disconnected once its queue fills
+func TestControlSlowClient(t *testing.T) {
+	server, err := ListenControl(filepath.Join(t.TempDir(), "control.sock"))
+	assert.NoError(t, err)
+	defer server.Close()
+	go server.Serve()
+
+	conn, err := net.Dial("unix", server.Path)
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"subscribe"}` + "\n"))
+	call := <-server.Calls
+	call.Conn.Subscribe(nil)
+	call.Reply(nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		output := strings.Repeat("x", 4096)
+		for i := 0; i < 4*controlQueueSize; i++ {
+			server.Broadcast(ControlEventCommandFinished, map[string]any{"output": output})
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcasting to a client that isn't reading blocked")
+	}
+
+	// it's dropped from the server's clients
+	assert.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return len(server.conns) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestControlClient(t *testing.T) {
+	server, err := ListenControl(filepath.Join(t.TempDir(), "control.sock"))
+	assert.NoError(t, err)
+	defer server.Close()
+	go server.Serve()
+
+	// answer the first prompt, streaming it between another call's chunks and
+	// an event, and fail the second
+	go func() {
+		call := <-server.Calls
+		params := &ControlPromptParams{}
+		call.Params(params)
+		assert.Equal(t, ControlPromptParams{Text: "Why?", Attachment: "FAIL\n"}, *params)
+		call.Conn.Notify("answer", map[string]any{"id": 99, "text": "nope"})
+		controlAnswerWriter{call: call}.Write([]byte("It "))
+		call.Conn.Notify("event", map[string]any{"type": ControlEventCommandFinished})
+		controlAnswerWriter{call: call}.Write([]byte("failed."))
+		call.Reply(map[string]any{"answer": "It failed."})
+
+		call = <-server.Calls
+		call.ReplyError(errControlBusy)
+	}()
+
+	client, err := DialControl(server.Path)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	out := &bytes.Buffer{}
+	answer, err := client.Prompt("Why?", "FAIL\n", out)
+	assert.NoError(t, err)
+	assert.Equal(t, "It failed.", answer)
+	assert.Equal(t, "It failed.", out.String())
+
+	_, err = client.Prompt("Why?", "", nil)
+	assert.Equal(t, errControlBusy.Message, err.Error())
+}
+
+func TestPromptWithAttachment(t *testing.T) {
+	assert.Equal(t, "Why?", PromptWithAttachment("Why?", ""))
+	// a fence in the input doesn't end the block
+	assert.Equal(t, "Why?\n\nPiped input:\n````\n```\nFAIL\n````",
+		PromptWithAttachment("Why?", "```\nFAIL\n"))
+}
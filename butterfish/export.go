@@ -0,0 +1,304 @@
+package butterfish
+
+import (
+	"fmt"
+	"html"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// A session can be exported from the shell's history with /export, to keep
+// an exploratory debugging session as documentation: a Markdown runbook, a
+// self-contained HTML page, or a shell script of the commands that were run
+// with the prompts and answers as comments.
+
+const (
+	ExportMarkdown = "md"
+	ExportHTML     = "html"
+	ExportScript   = "sh"
+)
+
+// Long command output is cut down to its first and last lines, the end is
+// usually where the error is so we keep more of it
+const (
+	exportOutputHead = 10
+	exportOutputTail = 30
+)
+
+var exitCodeRegex = regexp.MustCompile(`(?m)^\[exit code (\d+)\]\n?\z`)
+
+type SessionExport struct {
+	Blocks []util.HistoryBlock
+	Shell  string
+	Cwd    string
+	Time   time.Time
+}
+
+// The export format for a file name, from its extension
+func ExportFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown":
+		return ExportMarkdown, nil
+	case ".html", ".htm":
+		return ExportHTML, nil
+	case ".sh":
+		return ExportScript, nil
+	}
+	return "", fmt.Errorf("can't tell the export format of %s, use a .md, .html or .sh file", path)
+}
+
+func (this *SessionExport) Render(format string) string {
+	switch format {
+	case ExportHTML:
+		return this.HTML()
+	case ExportScript:
+		return this.Script()
+	default:
+		return this.Markdown()
+	}
+}
+
+func (this *SessionExport) description() string {
+	return fmt.Sprintf("Exported %s from %s, shell %s",
+		this.Time.Format("2006-01-02 15:04"), this.Cwd, this.Shell)
+}
+
+// Split command output from the exit code we note after it, 0 if none
+func splitExitCode(output string) (string, string) {
+	match := exitCodeRegex.FindStringSubmatchIndex(output)
+	if match == nil {
+		return output, ""
+	}
+	return output[:match[0]], output[match[2]:match[3]]
+}
+
+// Split a prompt into its question, which makes a heading, and the input piped
+// to butterfish ask attached after it if there is any, shortened like output
+func splitPrompt(prompt string) (string, string) {
+	question, attachment, _ := strings.Cut(prompt, "\n\n")
+	return strings.Join(strings.Fields(question), " "), truncateOutput(strings.TrimSpace(attachment))
+}
+
+func truncateOutput(output string) string {
+	lines := strings.Split(output, "\n")
+	if len(lines) <= exportOutputHead+exportOutputTail {
+		return output
+	}
+	omitted := len(lines) - exportOutputHead - exportOutputTail
+	kept := append(lines[:exportOutputHead:exportOutputHead],
+		fmt.Sprintf("[... %d lines omitted ...]", omitted))
+	return strings.Join(append(kept, lines[len(lines)-exportOutputTail:]...), "\n")
+}
+
+// A code fence for content, longer than any run of backticks in it
+func fence(content string) string {
+	longest := 0
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimLeft(line, " \t")
+		n := len(line) - len(strings.TrimLeft(line, "`"))
+		if n > longest {
+			longest = n
+		}
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+func codeBlock(content, lang string) string {
+	content = strings.TrimRight(content, "\n")
+	f := fence(content)
+	return f + lang + "\n" + content + "\n" + f + "\n\n"
+}
+
+// A Markdown runbook, prompts are headings followed by their answers, and
+// commands and their output are in code blocks
+func (this *SessionExport) Markdown() string {
+	var builder strings.Builder
+	builder.WriteString("# Butterfish session\n\n")
+	builder.WriteString(this.description() + "\n\n")
+
+	for _, block := range this.Blocks {
+		content := strings.TrimSpace(block.Content)
+		if content == "" {
+			continue
+		}
+
+		switch block.Type {
+		case historyTypePrompt:
+			question, attachment := splitPrompt(content)
+			builder.WriteString("## " + question + "\n\n")
+			if attachment != "" {
+				builder.WriteString(attachment + "\n\n")
+			}
+		case historyTypeLLMOutput:
+			builder.WriteString(content + "\n\n")
+		case historyTypeShellInput:
+			builder.WriteString(codeBlock(content, "sh"))
+		case historyTypeShellOutput:
+			output, code := splitExitCode(content)
+			if output = strings.TrimRight(output, "\n"); output != "" {
+				builder.WriteString(codeBlock(truncateOutput(output), "text"))
+			}
+			if code != "" {
+				builder.WriteString(fmt.Sprintf("Exited with code %s.\n\n", code))
+			}
+		}
+	}
+
+	return strings.TrimRight(builder.String(), "\n") + "\n"
+}
+
+var inlineCodeRegex = regexp.MustCompile("`([^`\n]+)`")
+
+// Answers are Markdown, we keep the HTML self-contained rather than pull in
+// a renderer, so code blocks become <pre> and the rest keeps its line breaks
+// with inline code marked up
+func answerHTML(answer string) string {
+	var builder strings.Builder
+	var text, code []string
+	inCode := false
+	indent := ""
+
+	flushText := func() {
+		paragraph := strings.TrimSpace(strings.Join(text, "\n"))
+		if paragraph != "" {
+			escaped := inlineCodeRegex.ReplaceAllString(html.EscapeString(paragraph), "<code>$1</code>")
+			builder.WriteString("<div class=\"answer\">" + escaped + "</div>\n")
+		}
+		text = nil
+	}
+
+	for _, line := range strings.Split(answer, "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(trimmed, "```") {
+			if inCode {
+				builder.WriteString("<pre class=\"code\">" + html.EscapeString(strings.Join(code, "\n")) + "</pre>\n")
+				code = nil
+			} else {
+				flushText()
+				indent = line[:len(line)-len(trimmed)]
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			code = append(code, strings.TrimPrefix(line, indent))
+		} else {
+			text = append(text, line)
+		}
+	}
+	if inCode {
+		builder.WriteString("<pre class=\"code\">" + html.EscapeString(strings.Join(code, "\n")) + "</pre>\n")
+	}
+	flushText()
+	return builder.String()
+}
+
+const exportStyle = `body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; max-width: 60em; margin: 2em auto; padding: 0 1em; color: #222; line-height: 1.5; }
+h2 { font-size: 1.15em; margin-top: 2em; border-bottom: 1px solid #ddd; }
+pre { padding: 0.6em 0.8em; border-radius: 4px; overflow-x: auto; white-space: pre-wrap; }
+pre.command { background: #1e1e1e; color: #9cdcfe; }
+pre.output { background: #f4f4f4; color: #333; }
+pre.code { background: #f0f4f8; }
+.answer { white-space: pre-wrap; margin: 0.8em 0; }
+.exit { color: #b00; }
+code { background: #f0f0f0; padding: 0 0.2em; }
+`
+
+// A single HTML page with its styles inline, so it can be attached or
+// checked in as is
+func (this *SessionExport) HTML() string {
+	var builder strings.Builder
+	builder.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	builder.WriteString("<title>Butterfish session</title>\n<style>\n" + exportStyle + "</style>\n</head>\n<body>\n")
+	builder.WriteString("<h1>Butterfish session</h1>\n")
+	builder.WriteString("<p>" + html.EscapeString(this.description()) + "</p>\n")
+
+	for _, block := range this.Blocks {
+		content := strings.TrimSpace(block.Content)
+		if content == "" {
+			continue
+		}
+
+		switch block.Type {
+		case historyTypePrompt:
+			question, attachment := splitPrompt(content)
+			builder.WriteString("<h2>" + html.EscapeString(question) + "</h2>\n")
+			if attachment != "" {
+				builder.WriteString(answerHTML(attachment))
+			}
+		case historyTypeLLMOutput:
+			builder.WriteString(answerHTML(content))
+		case historyTypeShellInput:
+			lines := strings.Split(content, "\n")
+			for i, line := range lines {
+				lines[i] = "$ " + html.EscapeString(line)
+			}
+			builder.WriteString("<pre class=\"command\">" + strings.Join(lines, "\n") + "</pre>\n")
+		case historyTypeShellOutput:
+			output, code := splitExitCode(content)
+			if output = strings.TrimRight(output, "\n"); output != "" {
+				builder.WriteString("<pre class=\"output\">" + html.EscapeString(truncateOutput(output)) + "</pre>\n")
+			}
+			if code != "" {
+				builder.WriteString("<p class=\"exit\">Exited with code " + code + "</p>\n")
+			}
+		}
+	}
+
+	builder.WriteString("</body>\n</html>\n")
+	return builder.String()
+}
+
+func commentLines(builder *strings.Builder, text string) {
+	for _, line := range strings.Split(text, "\n") {
+		builder.WriteString(strings.TrimRight("# "+line, " ") + "\n")
+	}
+}
+
+// A script of the commands that were run, in order, with the prompts and
+// answers as comments. Output is left out, except that failed commands are
+// noted. History is redacted, so a command with a secret replaced by a
+// placeholder would run with the placeholder, we comment it out instead.
+func (this *SessionExport) Script() string {
+	var builder strings.Builder
+	builder.WriteString("#!/usr/bin/env " + this.Shell + "\n")
+	commentLines(&builder, "Butterfish session\n"+this.description())
+
+	for _, block := range this.Blocks {
+		content := strings.TrimSpace(block.Content)
+		if content == "" {
+			continue
+		}
+
+		switch block.Type {
+		case historyTypePrompt:
+			question, attachment := splitPrompt(content)
+			builder.WriteString("\n")
+			commentLines(&builder, "> "+question)
+			if attachment != "" {
+				commentLines(&builder, attachment)
+			}
+		case historyTypeLLMOutput:
+			commentLines(&builder, content)
+			builder.WriteString("\n")
+		case historyTypeShellInput:
+			for _, line := range strings.Split(content, "\n") {
+				if HasRedactedSecret(line) {
+					builder.WriteString("# redacted, put the secret back in before running:\n# " + line + "\n")
+				} else {
+					builder.WriteString(line + "\n")
+				}
+			}
+		case historyTypeShellOutput:
+			if _, code := splitExitCode(content); code != "" {
+				builder.WriteString("# exited with code " + code + "\n")
+			}
+		}
+	}
+
+	return builder.String()
+}
@@ -0,0 +1,110 @@
+package butterfish
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func testExport() *SessionExport {
+	return &SessionExport{
+		Blocks: []util.HistoryBlock{
+			{Type: historyTypeShellInput, Content: "cd /srv\nmake test\n"},
+			{Type: historyTypeShellOutput, Content: "go test ./...\nFAIL\tapp 0.1s\n[exit code 2]\n"},
+			{Type: historyTypePrompt, Content: "Why did\nmake fail?"},
+			{Type: historyTypeLLMOutput, Content: "The `app` tests <failed>, run:\n```sh\ngo test -v ./app\n```\n"},
+		},
+		Shell: "bash",
+		Cwd:   "/srv",
+		Time:  time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC),
+	}
+}
+
+func TestExportMarkdown(t *testing.T) {
+	assert.Equal(t, "# Butterfish session\n\n"+
+		"Exported 2026-10-18 09:30 from /srv, shell bash\n\n"+
+		"```sh\ncd /srv\nmake test\n```\n\n"+
+		"```text\ngo test ./...\nFAIL\tapp 0.1s\n```\n\n"+
+		"Exited with code 2.\n\n"+
+		"## Why did make fail?\n\n"+
+		"The `app` tests <failed>, run:\n```sh\ngo test -v ./app\n```\n",
+		testExport().Markdown())
+
+	// input piped to butterfish ask follows the question
+	export := &SessionExport{Blocks: []util.HistoryBlock{
+		{Type: historyTypePrompt, Content: PromptWithAttachment("Why is\nthis failing?", "FAIL\tapp\n")},
+	}}
+	assert.Contains(t, export.Markdown(), "## Why is this failing?\n\nPiped input:\n```\nFAIL\tapp\n```\n")
+	assert.Contains(t, export.Script(), "# > Why is this failing?\n# Piped input:\n# ```\n# FAIL\tapp\n")
+
+	// fences are longer than any in the content
+	assert.Equal(t, "````text\n```\n````\n\n", codeBlock("```", "text"))
+
+	// long output keeps its start and end
+	lines := []string{}
+	for i := 1; i <= 100; i++ {
+		lines = append(lines, fmt.Sprint(i))
+	}
+	truncated := strings.Split(truncateOutput(strings.Join(lines, "\n")), "\n")
+	assert.Equal(t, exportOutputHead+exportOutputTail+1, len(truncated))
+	assert.Equal(t, "[... 60 lines omitted ...]", truncated[exportOutputHead])
+	assert.Equal(t, "100", truncated[len(truncated)-1])
+}
+
+func TestExportHTMLAndScript(t *testing.T) {
+	page := testExport().HTML()
+	assert.Contains(t, page, "<pre class=\"command\">$ cd /srv\n$ make test</pre>")
+	assert.Contains(t, page, "<p class=\"exit\">Exited with code 2</p>")
+	assert.Contains(t, page, "<h2>Why did make fail?</h2>")
+	assert.Contains(t, page, "<div class=\"answer\">The <code>app</code> tests &lt;failed&gt;, run:</div>\n"+
+		"<pre class=\"code\">go test -v ./app</pre>")
+
+	assert.Equal(t, "#!/usr/bin/env bash\n"+
+		"# Butterfish session\n"+
+		"# Exported 2026-10-18 09:30 from /srv, shell bash\n"+
+		"cd /srv\nmake test\n"+
+		"# exited with code 2\n"+
+		"\n# > Why did make fail?\n"+
+		"# The `app` tests <failed>, run:\n# ```sh\n# go test -v ./app\n# ```\n\n",
+		testExport().Script())
+
+	// commands with a redacted secret would run with the placeholder
+	export := &SessionExport{Shell: "bash", Blocks: []util.HistoryBlock{
+		{Type: historyTypeShellInput, Content: "export AWS_ACCESS_KEY_ID=[REDACTED_AWS_ACCESS_KEY_1]\naws s3 ls\n"},
+	}}
+	assert.Contains(t, export.Script(), "\n# redacted, put the secret back in before running:\n"+
+		"# export AWS_ACCESS_KEY_ID=[REDACTED_AWS_ACCESS_KEY_1]\naws s3 ls\n")
+
+	format, err := ExportFormat("notes/Session.HTML")
+	assert.NoError(t, err)
+	assert.Equal(t, ExportHTML, format)
+	_, err = ExportFormat("session.txt")
+	assert.Error(t, err)
+}
+
+func TestExportSessionKeepsExistingFiles(t *testing.T) {
+	state := &ShellState{
+		Butterfish: &ButterfishCtx{Config: &ButterfishConfig{ShellBinary: "/bin/bash"}},
+		History:    NewShellHistory(),
+		cwd:        t.TempDir(),
+	}
+	state.History.Append(historyTypeShellInput, "make test\n")
+
+	path := filepath.Join(state.cwd, "README.md")
+	assert.Nil(t, os.WriteFile(path, []byte("# My project\n"), 0644))
+	err := state.exportSession(path, time.Now())
+	assert.ErrorContains(t, err, "already exists")
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, "# My project\n", string(data))
+
+	path = filepath.Join(state.cwd, "fix.sh")
+	assert.Nil(t, state.exportSession(path, time.Now()))
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+}
@@ -384,12 +384,23 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 	}
 
 	strBuilder := strings.Builder{}
+	var finishReason string
+	var firstTokenLatency time.Duration
+	start := time.Now()
 
 	callback := func(resp openai.CompletionResponse) {
+		if firstTokenLatency == 0 {
+			firstTokenLatency = time.Since(start)
+		}
+
 		if resp.Choices == nil || len(resp.Choices) == 0 {
 			return
 		}
 
+		if resp.Choices[0].FinishReason != "" {
+			finishReason = resp.Choices[0].FinishReason
+		}
+
 		text := resp.Choices[0].Text
 		writer.Write([]byte(text))
 		strBuilder.WriteString(text)
@@ -417,7 +428,9 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 	fmt.Fprintf(writer, "\n") // GPT doesn't finish with a newline
 
 	response := util.CompletionResponse{
-		Completion: strBuilder.String(),
+		Completion:        strBuilder.String(),
+		FinishReason:      finishReason,
+		FirstTokenLatency: firstTokenLatency,
 	}
 
 	if request.Verbose {
@@ -450,6 +463,9 @@ func (this *GPT) SimpleChatCompletionStream(request *util.CompletionRequest, wri
 		Functions:   convertToOpenaiFunctions(request.Functions),
 		Tools:       convertToOpenaiTools(request.Tools),
 	}
+	if request.IncludeUsage {
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
 
 	return this.doChatStreamCompletion(request.Ctx, req, writer, request.TokenTimeout, request.Verbose)
 }
@@ -514,6 +530,9 @@ func (this *GPT) FullChatCompletionStream(request *util.CompletionRequest, write
 		Functions:   convertToOpenaiFunctions(request.Functions),
 		Tools:       convertToOpenaiTools(request.Tools),
 	}
+	if request.IncludeUsage {
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
 
 	return this.doChatStreamCompletion(
 		request.Ctx, req, writer, request.TokenTimeout, request.Verbose)
@@ -530,6 +549,10 @@ func (this *GPT) doChatStreamCompletion(
 	var functionName string
 	var functionArgs strings.Builder
 	var toolCalls []*util.ToolCall
+	var finishReason string
+	var usage *util.Usage
+	var firstTokenLatency time.Duration
+	start := time.Now()
 
 	// We already have a context that sets an overall timeout, but we also
 	// want to timeout if we don't get a chunk back for a while.
@@ -567,10 +590,27 @@ func (this *GPT) doChatStreamCompletion(
 			go timeoutRoutine()
 		}
 
+		if firstTokenLatency == 0 {
+			firstTokenLatency = time.Since(start)
+		}
+
+		// with include_usage the last chunk has usage and no choices
+		if resp.Usage != nil {
+			usage = &util.Usage{
+				PromptTokens:     resp.Usage.PromptTokens,
+				CompletionTokens: resp.Usage.CompletionTokens,
+				TotalTokens:      resp.Usage.TotalTokens,
+			}
+		}
+
 		if resp.Choices == nil || len(resp.Choices) == 0 {
 			return
 		}
 
+		if resp.Choices[0].FinishReason != "" {
+			finishReason = string(resp.Choices[0].FinishReason)
+		}
+
 		text := resp.Choices[0].Delta.Content
 		functionCall := resp.Choices[0].Delta.FunctionCall
 		chunkToolCalls := resp.Choices[0].Delta.ToolCalls
@@ -681,6 +721,9 @@ func (this *GPT) doChatStreamCompletion(
 		FunctionName:       functionName,
 		ToolCalls:          toolCalls,
 		FunctionParameters: functionArgs.String(),
+		FinishReason:       finishReason,
+		Usage:              usage,
+		FirstTokenLatency:  firstTokenLatency,
 	}
 
 	if verbose {
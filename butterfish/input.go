@@ -0,0 +1,728 @@
+package butterfish
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// InputParser turns the bytes we read from the terminal into events: key
+// presses, bracketed pastes, focus and mouse reports, and other escape
+// sequences, which are passed on to the shell untouched. Keys come in the
+// legacy xterm encodings or the kitty keyboard protocol's CSI u, which the
+// terminal uses if a program in the shell asks for it.
+//
+// A sequence can be split across reads, so an incomplete one at the end of
+// the data is kept until the next call to Parse. A lone ESC looks like the
+// start of a sequence, if nothing follows it for a moment Flush should be
+// called to take it as the Escape key.
+
+type InputEventType int
+
+const (
+	KeyEvent InputEventType = iota
+	PasteEvent
+	FocusEvent
+	MouseEvent
+	// An escape sequence we don't interpret, e.g. a reply to a query
+	UnknownEvent
+)
+
+type Key int
+
+const (
+	KeyRune Key = iota
+	KeyEnter
+	KeyTab
+	KeyBackspace
+	KeyEscape
+	KeyUp
+	KeyDown
+	KeyRight
+	KeyLeft
+	KeyHome
+	KeyEnd
+	KeyInsert
+	KeyDelete
+	KeyPageUp
+	KeyPageDown
+	// F1 to F12 are KeyF1 + n - 1
+	KeyF1
+)
+
+// Modifiers, these are the bits of the modifier parameter in xterm and kitty
+// sequences, which is sent plus 1
+type KeyMod int
+
+const (
+	ModShift KeyMod = 1 << iota
+	ModAlt
+	ModCtrl
+	ModSuper
+)
+
+const modMask = ModShift | ModAlt | ModCtrl | ModSuper
+
+type InputEvent struct {
+	Type InputEventType
+	Key  Key
+	// For KeyRune the character, with shift applied. Control characters are
+	// the letter with ModCtrl, e.g. 'c' for Ctrl-C.
+	Rune rune
+	Mod  KeyMod
+	// Key or mouse button released, we only get key releases if a program
+	// asks for them with the kitty protocol
+	Release bool
+	// PasteEvent: the pasted text, without the brackets
+	Text string
+	// FocusEvent: whether the terminal gained focus
+	Focus bool
+	// MouseEvent: the button as reported, without the modifier bits, and the
+	// cell, from 1
+	Button int
+	X, Y   int
+	// The bytes of the event as they were read
+	Raw []byte
+}
+
+// Whether this is Ctrl plus the given lower case character, e.g. 'c'
+func (this InputEvent) IsCtrl(r rune) bool {
+	return this.Type == KeyEvent && this.Key == KeyRune && this.Mod == ModCtrl && this.Rune == r
+}
+
+// Whether this is Alt plus the given character
+func (this InputEvent) IsAlt(r rune) bool {
+	return this.Type == KeyEvent && this.Key == KeyRune && this.Mod == ModAlt && this.Rune == r
+}
+
+// A key typed without modifiers
+func (this InputEvent) IsKey(key Key) bool {
+	return this.Type == KeyEvent && this.Key == key && this.Mod == 0
+}
+
+// A printable character typed without Ctrl or Alt
+func (this InputEvent) IsText() bool {
+	return this.Type == KeyEvent && this.Key == KeyRune &&
+		this.Mod&(ModCtrl|ModAlt|ModSuper) == 0 && unicode.IsPrint(this.Rune)
+}
+
+var keyNames = map[Key]string{
+	KeyEnter:     "Enter",
+	KeyTab:       "Tab",
+	KeyBackspace: "Backspace",
+	KeyEscape:    "Esc",
+	KeyUp:        "Up",
+	KeyDown:      "Down",
+	KeyRight:     "Right",
+	KeyLeft:      "Left",
+	KeyHome:      "Home",
+	KeyEnd:       "End",
+	KeyInsert:    "Insert",
+	KeyDelete:    "Delete",
+	KeyPageUp:    "PgUp",
+	KeyPageDown:  "PgDn",
+}
+
+// Describe the event, e.g. Ctrl-C, Alt-Up or paste(12 bytes)
+func (this InputEvent) String() string {
+	switch this.Type {
+	case PasteEvent:
+		return fmt.Sprintf("paste(%d bytes)", len(this.Text))
+	case FocusEvent:
+		if this.Focus {
+			return "focus-in"
+		}
+		return "focus-out"
+	case MouseEvent:
+		name := fmt.Sprintf("mouse(%d %d,%d)", this.Button, this.X, this.Y)
+		if this.Release {
+			name += "-release"
+		}
+		return name
+	case UnknownEvent:
+		return fmt.Sprintf("unknown(%q)", this.Raw)
+	}
+
+	name := keyNames[this.Key]
+	switch {
+	case this.Key == KeyRune && this.Rune == ' ':
+		name = "Space"
+	case this.Key == KeyRune && this.Mod&ModCtrl != 0:
+		// written Ctrl-C, by convention
+		name = string(unicode.ToUpper(this.Rune))
+	case this.Key == KeyRune:
+		name = string(this.Rune)
+	case this.Key >= KeyF1:
+		name = fmt.Sprintf("F%d", this.Key-KeyF1+1)
+	}
+
+	for _, mod := range []struct {
+		mod  KeyMod
+		name string
+	}{{ModSuper, "Super-"}, {ModShift, "Shift-"}, {ModAlt, "Alt-"}, {ModCtrl, "Ctrl-"}} {
+		if this.Mod&mod.mod != 0 {
+			name = mod.name + name
+		}
+	}
+	if this.Release {
+		name += "-release"
+	}
+	return name
+}
+
+// The event in the legacy encoding that ShellBuffer and line editors
+// understand, whatever encoding the terminal used. Pastes are their text,
+// events that aren't keys are empty.
+func (this InputEvent) Bytes() []byte {
+	switch this.Type {
+	case PasteEvent:
+		return []byte(this.Text)
+	case KeyEvent:
+	default:
+		return []byte{}
+	}
+	if this.Release {
+		return []byte{}
+	}
+
+	prefix := []byte{}
+	mod := this.Mod
+	// Alt is sent as an ESC before keys that are a single character
+	if mod&ModAlt != 0 && this.Key <= KeyEscape {
+		prefix = []byte{0x1b}
+		mod &^= ModAlt
+	}
+
+	var key []byte
+	switch this.Key {
+	case KeyRune:
+		key = []byte(string(this.Rune))
+		if mod&ModCtrl != 0 {
+			if c, ok := ctrlByte(this.Rune); ok {
+				key = []byte{c}
+			}
+		}
+	case KeyEnter:
+		key = []byte{'\r'}
+	case KeyTab:
+		key = []byte{'\t'}
+		if mod&ModShift != 0 {
+			key = []byte("\x1b[Z")
+		}
+	case KeyBackspace:
+		key = []byte{0x7f}
+		if mod&ModCtrl != 0 {
+			key = []byte{0x08}
+		}
+	case KeyEscape:
+		key = []byte{0x1b}
+	default:
+		key = []byte(legacyKeySequence(this.Key, mod))
+	}
+	return append(prefix, key...)
+}
+
+// The control character for Ctrl plus r
+func ctrlByte(r rune) (byte, bool) {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return byte(r-'a') + 1, true
+	case r == ' ' || r == '@' || r == '2':
+		return 0, true
+	case r >= '[' && r <= '_':
+		return byte(r-'[') + 0x1b, true
+	case r == '?':
+		return 0x7f, true
+	}
+	return 0, false
+}
+
+var legacyKeyFinals = map[Key]byte{
+	KeyUp:     'A',
+	KeyDown:   'B',
+	KeyRight:  'C',
+	KeyLeft:   'D',
+	KeyHome:   'H',
+	KeyEnd:    'F',
+	KeyF1:     'P',
+	KeyF1 + 1: 'Q',
+	KeyF1 + 2: 'R',
+	KeyF1 + 3: 'S',
+}
+
+var legacyKeyNumbers = map[Key]int{
+	KeyInsert:   2,
+	KeyDelete:   3,
+	KeyPageUp:   5,
+	KeyPageDown: 6,
+	KeyF1 + 4:   15,
+	KeyF1 + 5:   17,
+	KeyF1 + 6:   18,
+	KeyF1 + 7:   19,
+	KeyF1 + 8:   20,
+	KeyF1 + 9:   21,
+	KeyF1 + 10:  23,
+	KeyF1 + 11:  24,
+}
+
+func legacyKeySequence(key Key, mod KeyMod) string {
+	if final, ok := legacyKeyFinals[key]; ok {
+		if mod != 0 {
+			return "\x1b[1;" + strconv.Itoa(int(mod)+1) + string(final)
+		}
+		if key >= KeyF1 {
+			return "\x1bO" + string(final)
+		}
+		return "\x1b[" + string(final)
+	}
+	if number, ok := legacyKeyNumbers[key]; ok {
+		if mod != 0 {
+			return "\x1b[" + strconv.Itoa(number) + ";" + strconv.Itoa(int(mod)+1) + "~"
+		}
+		return "\x1b[" + strconv.Itoa(number) + "~"
+	}
+	return ""
+}
+
+type InputParser struct {
+	buf []byte
+}
+
+// Parse adds data to what's buffered and returns the complete events in it
+func (this *InputParser) Parse(data []byte) []InputEvent {
+	this.buf = append(this.buf, data...)
+	return this.parse(false)
+}
+
+// Pending is true when the buffer ends in what may be the start of an escape
+// sequence or may be keys, e.g. a lone ESC. It's false while a paste is
+// incomplete, see Pasting.
+func (this *InputParser) Pending() bool {
+	return len(this.buf) > 0 && !this.Pasting()
+}
+
+// Flush takes what's buffered as keys when nothing more came, e.g. a lone
+// ESC is the Escape key and ESC [ is Alt-[. An incomplete paste is kept.
+func (this *InputParser) Flush() []InputEvent {
+	return this.parse(true)
+}
+
+// Pasting is true while a paste is incomplete. The terminal normally ends it
+// however long it is, but if the end is lost, e.g. the paste was cut off,
+// everything after it would be held as part of the paste.
+func (this *InputParser) Pasting() bool {
+	return bytes.HasPrefix(this.buf, []byte(pasteStart))
+}
+
+// EndPaste takes an incomplete paste as typed, for when its end hasn't come
+// for a while. Without the paste start the shell sees plain input.
+func (this *InputParser) EndPaste() []InputEvent {
+	if this.Pasting() {
+		this.buf = this.buf[len(pasteStart):]
+	}
+	return this.parse(true)
+}
+
+const (
+	pasteStart = "\x1b[200~"
+	pasteEnd   = "\x1b[201~"
+)
+
+func (this *InputParser) parse(flush bool) []InputEvent {
+	events := []InputEvent{}
+	for len(this.buf) > 0 {
+		event, n := parseInputEvent(this.buf, flush)
+		if n == 0 {
+			break
+		}
+		event.Raw = append([]byte{}, this.buf[:n]...)
+		events = append(events, event)
+		this.buf = this.buf[n:]
+	}
+	if len(this.buf) == 0 {
+		this.buf = nil
+	}
+	return events
+}
+
+// Parse the event at the start of data, returns it and its length, or 0 if
+// it's incomplete. If flush is set an incomplete sequence is taken as keys.
+func parseInputEvent(data []byte, flush bool) (InputEvent, int) {
+	c := data[0]
+	if c != 0x1b {
+		return parseKey(data, flush)
+	}
+
+	if len(data) == 1 {
+		if flush {
+			return InputEvent{Type: KeyEvent, Key: KeyEscape}, 1
+		}
+		return InputEvent{}, 0
+	}
+
+	var event InputEvent
+	n := 0
+	switch data[1] {
+	case '[':
+		event, n = parseCSI(data)
+	case 'O':
+		event, n = parseSS3(data)
+	case ']', 'P', '_':
+		// OSC, DCS and APC strings, ended by BEL or ST
+		n = stringSequenceLength(data)
+		event = InputEvent{Type: UnknownEvent}
+	case 0x1b:
+		// ESC ESC [ A is Alt-Up in some terminals
+		if len(data) > 2 && (data[2] == '[' || data[2] == 'O') {
+			event, n = parseInputEvent(data[1:], flush)
+			if n > 0 && event.Type == KeyEvent {
+				event.Mod |= ModAlt
+				return event, n + 1
+			}
+			if n == 0 && !flush {
+				return InputEvent{}, 0
+			}
+		}
+		return InputEvent{Type: KeyEvent, Key: KeyEscape, Mod: ModAlt}, 2
+	default:
+		// Alt plus a key
+		event, n = parseKey(data[1:], flush)
+		if n == 0 {
+			return event, 0
+		}
+		event.Mod |= ModAlt
+		return event, n + 1
+	}
+
+	if n > 0 {
+		return event, n
+	}
+	if !flush || bytes.HasPrefix(data, []byte(pasteStart)) {
+		return InputEvent{}, 0
+	}
+	if len(data) == 2 || data[1] == ']' || data[1] == 'P' || data[1] == '_' {
+		// the sequence never came, it's Alt plus the key
+		event, n = parseKey(data[1:], true)
+		event.Mod |= ModAlt
+		return event, n + 1
+	}
+	return InputEvent{Type: UnknownEvent}, len(data)
+}
+
+// A single key that isn't an escape sequence, a control character or UTF-8
+func parseKey(data []byte, flush bool) (InputEvent, int) {
+	c := data[0]
+	switch {
+	case c == '\r':
+		return InputEvent{Type: KeyEvent, Key: KeyEnter}, 1
+	case c == '\t':
+		return InputEvent{Type: KeyEvent, Key: KeyTab}, 1
+	case c == 0x7f:
+		return InputEvent{Type: KeyEvent, Key: KeyBackspace}, 1
+	case c == 0x08:
+		return InputEvent{Type: KeyEvent, Key: KeyBackspace, Mod: ModCtrl}, 1
+	case c == 0x1b:
+		return InputEvent{Type: KeyEvent, Key: KeyEscape}, 1
+	case c == 0:
+		return InputEvent{Type: KeyEvent, Key: KeyRune, Rune: ' ', Mod: ModCtrl}, 1
+	case c < 0x1b:
+		return InputEvent{Type: KeyEvent, Key: KeyRune, Rune: rune(c-1) + 'a', Mod: ModCtrl}, 1
+	case c < 0x20:
+		return InputEvent{Type: KeyEvent, Key: KeyRune, Rune: rune(c-0x1b) + '[', Mod: ModCtrl}, 1
+	}
+
+	if !utf8.FullRune(data) && !flush {
+		return InputEvent{}, 0
+	}
+	r, size := utf8.DecodeRune(data)
+	return InputEvent{Type: KeyEvent, Key: KeyRune, Rune: r}, size
+}
+
+// The length of an OSC, DCS or APC string at the start of data, 0 if it
+// isn't ended yet
+func stringSequenceLength(data []byte) int {
+	for i := 2; i < len(data); i++ {
+		if data[i] == 0x07 && data[1] == ']' {
+			return i + 1
+		}
+		if data[i] == 0x1b && i+1 < len(data) && data[i+1] == '\\' {
+			return i + 2
+		}
+	}
+	return 0
+}
+
+// SS3 sequences are sent for arrows, Home and End in application cursor
+// mode, F1 to F4, and keypad keys in application keypad mode
+func parseSS3(data []byte) (InputEvent, int) {
+	if len(data) < 3 {
+		return InputEvent{}, 0
+	}
+
+	event := InputEvent{Type: KeyEvent}
+	final := data[2]
+	if key, ok := csiFinalKeys[final]; ok {
+		event.Key = key
+	} else if final == 'M' {
+		event.Key = KeyEnter
+	} else if r, ok := keypadRunes[final]; ok {
+		event.Key = KeyRune
+		event.Rune = r
+	} else {
+		event.Type = UnknownEvent
+	}
+	return event, 3
+}
+
+var csiFinalKeys = map[byte]Key{
+	'A': KeyUp,
+	'B': KeyDown,
+	'C': KeyRight,
+	'D': KeyLeft,
+	'H': KeyHome,
+	'F': KeyEnd,
+	'P': KeyF1,
+	'Q': KeyF1 + 1,
+	'R': KeyF1 + 2,
+	'S': KeyF1 + 3,
+}
+
+var keypadRunes = map[byte]rune{
+	'j': '*', 'k': '+', 'l': ',', 'm': '-', 'n': '.', 'o': '/',
+	'p': '0', 'q': '1', 'r': '2', 's': '3', 't': '4',
+	'u': '5', 'v': '6', 'w': '7', 'x': '8', 'y': '9', 'X': '=',
+}
+
+var tildeKeys = map[int]Key{
+	1:  KeyHome,
+	2:  KeyInsert,
+	3:  KeyDelete,
+	4:  KeyEnd,
+	5:  KeyPageUp,
+	6:  KeyPageDown,
+	7:  KeyHome,
+	8:  KeyEnd,
+	11: KeyF1,
+	12: KeyF1 + 1,
+	13: KeyF1 + 2,
+	14: KeyF1 + 3,
+	15: KeyF1 + 4,
+	17: KeyF1 + 5,
+	18: KeyF1 + 6,
+	19: KeyF1 + 7,
+	20: KeyF1 + 8,
+	21: KeyF1 + 9,
+	23: KeyF1 + 10,
+	24: KeyF1 + 11,
+}
+
+// A CSI sequence is ESC [, parameter bytes, intermediate bytes and a final
+// byte, see ECMA-48 5.4
+func parseCSI(data []byte) (InputEvent, int) {
+	i := 2
+	for i < len(data) && data[i] >= 0x30 && data[i] <= 0x3f {
+		i++
+	}
+	paramsEnd := i
+	for i < len(data) && data[i] >= 0x20 && data[i] <= 0x2f {
+		i++
+	}
+	if i == len(data) {
+		return InputEvent{}, 0
+	}
+	final := data[i]
+	n := i + 1
+	if final < 0x40 || final > 0x7e {
+		// not a valid sequence, take what we have as unknown
+		return InputEvent{Type: UnknownEvent}, i
+	}
+
+	params := string(data[2:paramsEnd])
+	if paramsEnd != i {
+		return InputEvent{Type: UnknownEvent}, n
+	}
+
+	switch {
+	case params == "200" && final == '~':
+		end := bytes.Index(data[n:], []byte(pasteEnd))
+		if end < 0 {
+			return InputEvent{}, 0
+		}
+		text := string(data[n : n+end])
+		return InputEvent{Type: PasteEvent, Text: text}, n + end + len(pasteEnd)
+
+	case params == "" && final == 'I':
+		return InputEvent{Type: FocusEvent, Focus: true}, n
+	case params == "" && final == 'O':
+		return InputEvent{Type: FocusEvent, Focus: false}, n
+
+	case params == "" && final == 'M':
+		// X10 mouse, three bytes follow
+		if len(data) < n+3 {
+			return InputEvent{}, 0
+		}
+		return x10Mouse(data[n : n+3]), n + 3
+
+	case strings.HasPrefix(params, "<") && (final == 'M' || final == 'm'):
+		// SGR mouse
+		values := csiParams(params[1:])
+		if len(values) != 3 {
+			return InputEvent{Type: UnknownEvent}, n
+		}
+		event := mouseEvent(values[0][0], values[1][0], values[2][0])
+		event.Release = final == 'm'
+		return event, n
+
+	case params == "" && final == 'Z':
+		return InputEvent{Type: KeyEvent, Key: KeyTab, Mod: ModShift}, n
+	}
+
+	if params != "" && (params[0] < '0' || params[0] > ';') {
+		// private sequences like replies to queries
+		return InputEvent{Type: UnknownEvent}, n
+	}
+
+	values := csiParams(params)
+	event := InputEvent{Type: KeyEvent}
+	if len(values) > 1 {
+		event.Mod = KeyMod(max(values[1][0]-1, 0)) & modMask
+		if len(values[1]) > 1 {
+			// kitty event type, 3 is release
+			event.Release = values[1][1] == 3
+		}
+	}
+
+	switch final {
+	case '~':
+		code := values[0][0]
+		if code == 27 && len(values) == 3 {
+			// xterm modifyOtherKeys, CSI 27 ; mod ; code ~
+			return keyFromCode(values[2][0], event.Mod), n
+		}
+		key, ok := tildeKeys[code]
+		if !ok {
+			return InputEvent{Type: UnknownEvent}, n
+		}
+		event.Key = key
+		return event, n
+
+	case 'u':
+		// kitty keyboard protocol, CSI code:shifted ; mod:event ; text u
+		code := values[0]
+		result := keyFromCode(code[0], event.Mod)
+		result.Release = event.Release
+		if result.Type == KeyEvent && result.Key == KeyRune {
+			if len(code) > 1 && code[1] > 0 && event.Mod&ModShift != 0 {
+				result.Rune = rune(code[1])
+				result.Mod &^= ModShift
+			}
+			if len(values) > 2 && values[2][0] > 0 && result.Mod&(ModCtrl|ModAlt) == 0 {
+				result.Rune = rune(values[2][0])
+			}
+		}
+		return result, n
+	}
+
+	key, ok := csiFinalKeys[final]
+	if !ok {
+		if len(values) == 3 && final == 'M' {
+			// urxvt mouse, CSI button ; x ; y M
+			return mouseEvent(values[0][0]-32, values[1][0], values[2][0]), n
+		}
+		return InputEvent{Type: UnknownEvent}, n
+	}
+	event.Key = key
+	return event, n
+}
+
+// Split CSI parameters, each can have sub-parameters separated by colons.
+// Missing values are 0.
+func csiParams(params string) [][]int {
+	values := [][]int{}
+	for _, param := range strings.Split(params, ";") {
+		subs := []int{}
+		for _, sub := range strings.Split(param, ":") {
+			value, _ := strconv.Atoi(sub)
+			subs = append(subs, value)
+		}
+		values = append(values, subs)
+	}
+	return values
+}
+
+// kitty key codes for keys that aren't characters, keypad keys are in the
+// private use area
+var kittyKeys = map[int]Key{
+	9:     KeyTab,
+	13:    KeyEnter,
+	27:    KeyEscape,
+	127:   KeyBackspace,
+	57414: KeyEnter,
+	57417: KeyLeft,
+	57418: KeyRight,
+	57419: KeyUp,
+	57420: KeyDown,
+	57421: KeyPageUp,
+	57422: KeyPageDown,
+	57423: KeyHome,
+	57424: KeyEnd,
+	57425: KeyInsert,
+	57426: KeyDelete,
+}
+
+var kittyKeypadRunes = "0123456789./*-+"
+
+func keyFromCode(code int, mod KeyMod) InputEvent {
+	event := InputEvent{Type: KeyEvent, Mod: mod}
+	if key, ok := kittyKeys[code]; ok {
+		event.Key = key
+		return event
+	}
+	if code >= 57399 && code < 57399+len(kittyKeypadRunes) {
+		event.Rune = rune(kittyKeypadRunes[code-57399])
+		return event
+	}
+	if code >= 57344 && code <= 63743 || code <= 0 || code > unicode.MaxRune {
+		// other keys in the private use area, like modifiers on their own
+		return InputEvent{Type: UnknownEvent}
+	}
+
+	event.Rune = rune(code)
+	if mod&ModShift != 0 && unicode.IsLower(event.Rune) {
+		event.Rune = unicode.ToUpper(event.Rune)
+		event.Mod &^= ModShift
+	}
+	return event
+}
+
+func x10Mouse(data []byte) InputEvent {
+	event := mouseEvent(int(data[0])-32, int(data[1])-32, int(data[2])-32)
+	if event.Button&3 == 3 && event.Button&64 == 0 {
+		event.Release = true
+	}
+	return event
+}
+
+// Mouse button codes have shift, alt and ctrl in bits 2 to 4
+func mouseEvent(button, x, y int) InputEvent {
+	mod := KeyMod(0)
+	if button&4 != 0 {
+		mod |= ModShift
+	}
+	if button&8 != 0 {
+		mod |= ModAlt
+	}
+	if button&16 != 0 {
+		mod |= ModCtrl
+	}
+	return InputEvent{
+		Type:   MouseEvent,
+		Button: button &^ 28,
+		Mod:    mod,
+		X:      x,
+		Y:      y,
+	}
+}
@@ -0,0 +1,161 @@
+package butterfish
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseAll(data string) []InputEvent {
+	parser := &InputParser{}
+	events := parser.Parse([]byte(data))
+	return append(events, parser.Flush()...)
+}
+
+func TestInputParserKeys(t *testing.T) {
+	events := parseAll("aÉ\r\t\x7f\x03\x1d\x1bo")
+	assert.Equal(t, 8, len(events))
+	assert.True(t, events[0].IsText())
+	assert.Equal(t, 'a', events[0].Rune)
+	assert.Equal(t, 'É', events[1].Rune)
+	assert.Equal(t, "É", string(events[1].Raw))
+	assert.True(t, events[2].IsKey(KeyEnter))
+	assert.True(t, events[3].IsKey(KeyTab))
+	assert.True(t, events[4].IsKey(KeyBackspace))
+	assert.True(t, events[5].IsCtrl('c'))
+	assert.True(t, events[6].IsCtrl(']'))
+	assert.Equal(t, ModAlt, events[7].Mod)
+	assert.Equal(t, 'o', events[7].Rune)
+
+	// arrows in normal and application mode, with modifiers, and others
+	events = parseAll("\x1b[A\x1bOB\x1b[1;5C\x1b[1;3D\x1b[3~\x1b[5;2~\x1bOP\x1b[24~\x1b[Z\x1b\x1b[A")
+	assert.Equal(t, 10, len(events))
+	assert.True(t, events[0].IsKey(KeyUp))
+	assert.True(t, events[1].IsKey(KeyDown))
+	assert.Equal(t, KeyRight, events[2].Key)
+	assert.Equal(t, ModCtrl, events[2].Mod)
+	assert.Equal(t, ModAlt, events[3].Mod)
+	assert.True(t, events[4].IsKey(KeyDelete))
+	assert.Equal(t, KeyPageUp, events[5].Key)
+	assert.Equal(t, ModShift, events[5].Mod)
+	assert.True(t, events[6].IsKey(KeyF1))
+	assert.True(t, events[7].IsKey(KeyF1+11))
+	assert.Equal(t, KeyTab, events[8].Key)
+	assert.Equal(t, ModShift, events[8].Mod)
+	assert.Equal(t, KeyUp, events[9].Key)
+	assert.Equal(t, ModAlt, events[9].Mod)
+}
+
+func TestInputParserSplit(t *testing.T) {
+	parser := &InputParser{}
+
+	// a sequence split across reads waits for the rest
+	assert.Equal(t, 0, len(parser.Parse([]byte{0x1b, 0x5b, 0x31, 0x3b})))
+	assert.True(t, parser.Pending())
+	events := parser.Parse([]byte("5Cx"))
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, KeyRight, events[0].Key)
+	assert.Equal(t, "\x1b[1;5C", string(events[0].Raw))
+	assert.False(t, parser.Pending())
+
+	// so does a character split across reads
+	assert.Equal(t, 0, len(parser.Parse([]byte("é")[:1])))
+	events = parser.Parse([]byte("é")[1:])
+	assert.Equal(t, 'é', events[0].Rune)
+
+	// a lone ESC is the Escape key once nothing follows it
+	assert.Equal(t, 0, len(parser.Parse([]byte{0x1b})))
+	assert.True(t, parser.Pending())
+	events = parser.Flush()
+	assert.Equal(t, 1, len(events))
+	assert.True(t, events[0].IsKey(KeyEscape))
+
+	// and ESC [ on its own is Alt-[
+	parser.Parse([]byte("\x1b["))
+	events = parser.Flush()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, '[', events[0].Rune)
+	assert.Equal(t, ModAlt, events[0].Mod)
+}
+
+func TestInputParserSequences(t *testing.T) {
+	parser := &InputParser{}
+
+	// a paste is one event however it's split, and isn't flushed early
+	assert.Equal(t, 0, len(parser.Parse([]byte("\x1b[200~echo \x1b"))))
+	assert.False(t, parser.Pending())
+	assert.Equal(t, 0, len(parser.Flush()))
+	events := parser.Parse([]byte("[Ahi\r\x1b[201~\r"))
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, PasteEvent, events[0].Type)
+	assert.Equal(t, "echo \x1b[Ahi\r", events[0].Text)
+	assert.Equal(t, "\x1b[200~echo \x1b[Ahi\r\x1b[201~", string(events[0].Raw))
+	assert.True(t, events[1].IsKey(KeyEnter))
+
+	// if the end of a paste never comes it can be taken as typed
+	parser.Parse([]byte("\x1b[200~ls\r\x1b"))
+	assert.True(t, parser.Pasting())
+	assert.Equal(t, 0, len(parser.Parse([]byte("[A"))))
+	events = parser.EndPaste()
+	assert.False(t, parser.Pasting())
+	assert.Equal(t, 4, len(events))
+	assert.Equal(t, 'l', events[0].Rune)
+	assert.Equal(t, 's', events[1].Rune)
+	assert.True(t, events[2].IsKey(KeyEnter))
+	assert.True(t, events[3].IsKey(KeyUp))
+
+	// focus, SGR and X10 mouse, OSC and DCS replies
+	events = parseAll("\x1b[I\x1b[O\x1b[<16;10;5M\x1b[<0;3;4m\x1b[M !\"" +
+		"\x1b]11;rgb:0000/0000/0000\x07\x1bP1+r544e\x1b\\\x1b[?1u")
+	assert.Equal(t, 8, len(events))
+	assert.Equal(t, FocusEvent, events[0].Type)
+	assert.True(t, events[0].Focus)
+	assert.False(t, events[1].Focus)
+	assert.Equal(t, MouseEvent, events[2].Type)
+	assert.Equal(t, ModCtrl, events[2].Mod)
+	assert.Equal(t, 10, events[2].X)
+	assert.Equal(t, 5, events[2].Y)
+	assert.True(t, events[3].Release)
+	assert.Equal(t, 1, events[4].X)
+	assert.Equal(t, 2, events[4].Y)
+	for _, event := range events[5:] {
+		assert.Equal(t, UnknownEvent, event.Type)
+	}
+	assert.Equal(t, "\x1bP1+r544e\x1b\\", string(events[6].Raw))
+}
+
+func TestInputParserKitty(t *testing.T) {
+	events := parseAll("\x1b[99;5u\x1b[97;2u\x1b[97:65;2u\x1b[13u\x1b[27u\x1b[127;3u" +
+		"\x1b[1;5:3A\x1b[57399u\x1b[57441;2u\x1b[97;1;97u\x1b[27;5;100~")
+	assert.Equal(t, 11, len(events))
+	assert.True(t, events[0].IsCtrl('c'))
+	assert.Equal(t, []byte{0x03}, events[0].Bytes())
+	assert.True(t, events[1].IsText())
+	assert.Equal(t, 'A', events[1].Rune)
+	assert.Equal(t, 'A', events[2].Rune)
+	assert.True(t, events[3].IsKey(KeyEnter))
+	assert.True(t, events[4].IsKey(KeyEscape))
+	assert.Equal(t, KeyBackspace, events[5].Key)
+	assert.Equal(t, "\x1b\x7f", string(events[5].Bytes()))
+	assert.True(t, events[6].Release)
+	assert.Equal(t, KeyUp, events[6].Key)
+	assert.Equal(t, '0', events[7].Rune)
+	// a modifier key on its own
+	assert.Equal(t, UnknownEvent, events[8].Type)
+	assert.Equal(t, 'a', events[9].Rune)
+	// xterm's modifyOtherKeys
+	assert.True(t, events[10].IsCtrl('d'))
+}
+
+func TestInputEventBytes(t *testing.T) {
+	for _, data := range []string{"a", "\r", "\t", "\x7f", "\x03", "\x1bb", "\x1b[A",
+		"\x1b[1;3D", "\x1b[3~", "\x1b[5;5~", "\x1bOP", "\x1b[1;2Q", "\x1b[Z", "\x1b"} {
+		events := parseAll(data)
+		assert.Equal(t, 1, len(events), "%q", data)
+		assert.Equal(t, data, string(events[0].Bytes()), "%q", data)
+	}
+
+	// SS3 arrows become CSI, which ShellBuffer understands
+	assert.Equal(t, "\x1b[C", string(parseAll("\x1bOC")[0].Bytes()))
+	assert.Equal(t, "", string(parseAll("\x1b[I")[0].Bytes()))
+}
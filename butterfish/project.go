@@ -0,0 +1,291 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Project configuration lets a repository carry its own instructions for the
+// LLM. When the wrapped shell is inside a directory tree containing a
+// .butterfish.yaml or BUTTERFISH.md, the instructions, pinned context files
+// and preferred model from those files are used for prompts issued there.
+//
+// Example .butterfish.yaml:
+//
+//	model: gpt-4.1
+//	instructions: |
+//	  This is a Go monorepo, use `make test` rather than `go test`.
+//	context_files:
+//	  - Makefile
+//	  - docs/architecture.md
+//
+// BUTTERFISH.md is read as free-form instructions, if both files exist in the
+// same directory the markdown is appended to the yaml instructions.
+//
+// The yaml file can also set the other keys in ProjectAllowedConfigKeys, e.g.
+// max_response_tokens or context. These apply while the shell is in the
+// project, on top of the settings butterfish was started with.
+
+const ProjectInstructionsName = "BUTTERFISH.md"
+
+type ProjectConfig struct {
+	Root         string   // directory containing the project files
+	Instructions string   // free-form instructions for the LLM
+	ContextFiles []string // paths of files always included, relative to Root
+	Model        string   // preferred model, "" to use the session model
+	// Other settings by key: ints, []string for context and a string for theme
+	Settings map[string]interface{}
+	Warnings []string // settings in the yaml file that were ignored
+
+	// the yaml file, for the themes it defines
+	file *ConfigFile
+	// files we loaded and their modification times, used to detect edits
+	sources map[string]time.Time
+}
+
+// Search upward from dir for a directory containing a project config file,
+// returns "" if none is found.
+func FindProjectRoot(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+
+	for {
+		for _, name := range []string{ProjectConfigName, ProjectInstructionsName} {
+			if info, err := os.Stat(filepath.Join(dir, name)); err == nil && !info.IsDir() {
+				return dir
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Load the project files in root, profile selects a profile section of the
+// yaml file if it has one.
+func LoadProjectConfig(root, profile string) (*ProjectConfig, error) {
+	project := &ProjectConfig{
+		Root:     root,
+		Settings: map[string]interface{}{},
+		sources:  map[string]time.Time{},
+	}
+
+	yamlPath := filepath.Join(root, ProjectConfigName)
+	file, err := LoadConfigFile(yamlPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if file != nil {
+		project.track(yamlPath)
+		project.file = file
+		project.Warnings = file.dropUserOnlyKeys()
+
+		if value, _, ok := file.Get(profile, "instructions"); ok {
+			instructions, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: instructions must be a string", yamlPath)
+			}
+			project.Instructions = strings.TrimSpace(instructions)
+		}
+
+		if value, _, ok := file.Get(profile, "context_files"); ok {
+			files, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: context_files must be a list of paths", yamlPath)
+			}
+			for _, f := range files {
+				project.ContextFiles = append(project.ContextFiles, fmt.Sprint(f))
+			}
+		}
+
+		if value, _, ok := file.Get(profile, "model"); ok {
+			project.Model = fmt.Sprint(value)
+		}
+
+		for _, key := range ProjectAllowedConfigKeys {
+			value, _, ok := file.Get(profile, key)
+			if !ok {
+				continue
+			}
+			switch key {
+			case "instructions", "context_files", "model":
+				continue
+			case "theme":
+				project.Settings[key] = fmt.Sprint(value)
+			case "context":
+				names, err := projectContextNames(value)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", yamlPath, err)
+				}
+				project.Settings[key] = names
+			default:
+				n, ok := value.(int)
+				if !ok {
+					return nil, fmt.Errorf("%s: %s must be a number", yamlPath, key)
+				}
+				project.Settings[key] = n
+			}
+		}
+	}
+
+	mdPath := filepath.Join(root, ProjectInstructionsName)
+	md, err := os.ReadFile(mdPath)
+	if err == nil {
+		project.track(mdPath)
+		if project.Instructions != "" {
+			project.Instructions += "\n\n"
+		}
+		project.Instructions += strings.TrimSpace(string(md))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return project, nil
+}
+
+// The context providers to enable, as a list or comma separated like the flag
+func projectContextNames(value interface{}) ([]string, error) {
+	names := []string{}
+	switch value := value.(type) {
+	case string:
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	case []interface{}:
+		for _, name := range value {
+			names = append(names, fmt.Sprint(name))
+		}
+	default:
+		return nil, fmt.Errorf("context must be a list of context providers")
+	}
+
+	_, err := NewContextProviders(names, nil)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (this *ProjectConfig) track(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	this.sources[path] = info.ModTime()
+}
+
+// Returns true if a project file has been edited, created or deleted since
+// we loaded it.
+func (this *ProjectConfig) Stale() bool {
+	for _, name := range []string{ProjectConfigName, ProjectInstructionsName} {
+		path := filepath.Join(this.Root, name)
+		loadedTime, loaded := this.sources[path]
+		info, err := os.Stat(path)
+
+		if loaded != (err == nil) {
+			return true
+		}
+		if loaded && !info.ModTime().Equal(loadedTime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expand the context file globs relative to the project root. Patterns that
+// don't match anything are returned as is so the caller can report them.
+// The project file comes with the repository, so files outside the root are
+// left out, whether by an absolute path, .. or a symlink, they could be keys
+// or other secrets that would then be sent with every prompt.
+func (this *ProjectConfig) ContextFilePaths() []string {
+	root, err := filepath.EvalSymlinks(this.Root)
+	if err != nil {
+		root = this.Root
+	}
+
+	paths := []string{}
+	for _, pattern := range this.ContextFiles {
+		if filepath.IsAbs(pattern) || !withinDir(this.Root, filepath.Join(this.Root, pattern)) {
+			log.Printf("Skipping project context file %s, it's outside %s", pattern, this.Root)
+			continue
+		}
+		pattern = filepath.Join(this.Root, pattern)
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			paths = append(paths, pattern)
+			continue
+		}
+
+		for _, match := range matches {
+			resolved, err := filepath.EvalSymlinks(match)
+			if err != nil || !withinDir(root, resolved) {
+				log.Printf("Skipping project context file %s, it's outside %s", match, this.Root)
+				continue
+			}
+			paths = append(paths, match)
+		}
+	}
+	return paths
+}
+
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Tracks the project the shell is in, reloading the project files when the
+// working directory moves to a different project or the files change.
+type ProjectTracker struct {
+	Profile string
+	Current *ProjectConfig
+	lastDir string
+}
+
+// Update the tracker for the shell's working directory, returns true if the
+// current project changed. A load error clears the current project.
+func (this *ProjectTracker) Update(dir string) (bool, error) {
+	if dir == "" {
+		return false, nil
+	}
+
+	if dir == this.lastDir && (this.Current == nil || !this.Current.Stale()) {
+		// Cheap path: nothing moved. When outside a project we don't rescan for
+		// newly created project files until the directory changes.
+		return false, nil
+	}
+	this.lastDir = dir
+
+	root := FindProjectRoot(dir)
+	if root == "" {
+		changed := this.Current != nil
+		this.Current = nil
+		return changed, nil
+	}
+
+	if this.Current != nil && this.Current.Root == root && !this.Current.Stale() {
+		return false, nil
+	}
+
+	project, err := LoadProjectConfig(root, this.Profile)
+	if err != nil {
+		this.Current = nil
+		return true, err
+	}
+
+	this.Current = project
+	return true, nil
+}
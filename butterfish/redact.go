@@ -0,0 +1,238 @@
+package butterfish
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Shell history often contains secrets, e.g. an exported AWS key or a pasted
+// .env file. Before a request is sent we replace anything that looks like a
+// secret with a placeholder such as [REDACTED_AWS_ACCESS_KEY_1]. The same
+// secret always gets the same placeholder within a session, so the LLM can
+// still tell that two commands used the same credential.
+
+type secretDetector struct {
+	Name  string
+	Regex *regexp.Regexp
+	// Optional extra check on a match, used to filter high entropy candidates
+	Check func(string) bool
+}
+
+// If a detector regex has a capture group only the group is redacted, this
+// lets us keep e.g. the variable name in `password=hunter22`.
+var builtinSecretDetectors = []secretDetector{
+	{
+		Name:  "private_key",
+		Regex: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY( BLOCK)?-----(?s:.*?)(?:-----END [A-Z ]*PRIVATE KEY( BLOCK)?-----|$)`),
+	},
+	{
+		Name:  "aws_access_key",
+		Regex: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	{
+		Name:  "aws_secret_key",
+		Regex: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`),
+	},
+	{
+		Name:  "github_token",
+		Regex: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{22,255})\b`),
+	},
+	{
+		Name:  "openai_key",
+		Regex: regexp.MustCompile(`\bsk-(?:proj-|svcacct-|admin-)?[A-Za-z0-9_-]{20,}`),
+	},
+	{
+		Name:  "jwt",
+		Regex: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]{10,}`),
+	},
+	{
+		Name:  "bearer_token",
+		Regex: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9._~+/-]{16,}=*)`),
+	},
+	{
+		Name:  "secret",
+		Regex: regexp.MustCompile(`(?i)(?:secret|token|passwd|password|api_?key)[A-Za-z0-9_]*["']?\s*[:=]\s*["']?([^\s"']{8,})`),
+	},
+	{
+		Name:  "high_entropy",
+		Regex: regexp.MustCompile(`[A-Za-z0-9+/=_-]{24,}`),
+		Check: looksRandom,
+	},
+}
+
+// Returns true for strings mixing upper case, lower case and digits with
+// high Shannon entropy, i.e. they look like generated keys rather than words
+// or paths.
+func looksRandom(s string) bool {
+	var upper, lower, digit bool
+	for _, r := range s {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !upper || !lower || !digit {
+		return false
+	}
+
+	return shannonEntropy(s) >= 4.0
+}
+
+// Bits of entropy per character
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+type Redactor struct {
+	detectors []secretDetector
+
+	mutex        sync.Mutex
+	placeholders map[string]string // secret to placeholder
+	numbers      map[string]int    // number of distinct secrets seen per detector
+}
+
+// Create a redactor with the built-in detectors plus the given user regexes
+func NewRedactor(patterns []string) (*Redactor, error) {
+	detectors := append([]secretDetector{}, builtinSecretDetectors...)
+
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redact pattern %s: %s", pattern, err)
+		}
+		detectors = append(detectors, secretDetector{Name: "custom", Regex: regex})
+	}
+
+	return &Redactor{
+		detectors:    detectors,
+		placeholders: map[string]string{},
+		numbers:      map[string]int{},
+	}, nil
+}
+
+var placeholderRegex = regexp.MustCompile(`\[REDACTED_[A-Z0-9_]+_[0-9]+\]`)
+
+// Returns true if s has a secret replaced by a placeholder
+func HasRedactedSecret(s string) bool {
+	return placeholderRegex.MatchString(s)
+}
+
+func (this *Redactor) placeholder(name, secret string) string {
+	if placeholder, ok := this.placeholders[secret]; ok {
+		return placeholder
+	}
+
+	this.numbers[name]++
+	placeholder := fmt.Sprintf("[REDACTED_%s_%d]", strings.ToUpper(name), this.numbers[name])
+	this.placeholders[secret] = placeholder
+	return placeholder
+}
+
+// Replace secrets in s with placeholders, returns the redacted string and
+// the number of secrets replaced by each detector.
+func (this *Redactor) Redact(s string) (string, map[string]int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	counts := map[string]int{}
+
+	for _, detector := range this.detectors {
+		matches := detector.Regex.FindAllStringSubmatchIndex(s, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		builder := strings.Builder{}
+		last := 0
+		for _, match := range matches {
+			// redact the first capture group if the regex has one
+			start, end := match[0], match[1]
+			if len(match) >= 4 && match[2] >= 0 {
+				start, end = match[2], match[3]
+			}
+
+			secret := s[start:end]
+			if strings.HasPrefix(secret, "[REDACTED_") {
+				continue
+			}
+			if detector.Check != nil && !detector.Check(secret) {
+				continue
+			}
+
+			builder.WriteString(s[last:start])
+			builder.WriteString(this.placeholder(detector.Name, secret))
+			last = end
+			counts[detector.Name]++
+		}
+		builder.WriteString(s[last:])
+		s = builder.String()
+	}
+
+	return s, counts
+}
+
+// Redact a system message, prompt and history blocks in place of a request,
+// returns the combined counts.
+func (this *Redactor) RedactRequest(sysMsg, prompt *string, blocks []util.HistoryBlock) map[string]int {
+	total := map[string]int{}
+	add := func(counts map[string]int) {
+		for name, count := range counts {
+			total[name] += count
+		}
+	}
+
+	var counts map[string]int
+	*sysMsg, counts = this.Redact(*sysMsg)
+	add(counts)
+	*prompt, counts = this.Redact(*prompt)
+	add(counts)
+	for i := range blocks {
+		blocks[i].Content, counts = this.Redact(blocks[i].Content)
+		add(counts)
+	}
+
+	return total
+}
+
+// Summarize redaction counts for logging, e.g. "3 (aws_access_key: 1, jwt: 2)"
+func RedactionSummary(counts map[string]int) string {
+	total := 0
+	names := []string{}
+	for name, count := range counts {
+		total += count
+		names = append(names, name)
+	}
+	if total == 0 {
+		return "0"
+	}
+	sort.Strings(names)
+
+	parts := []string{}
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s: %d", name, counts[name]))
+	}
+	return fmt.Sprintf("%d (%s)", total, strings.Join(parts, ", "))
+}
@@ -3,14 +3,20 @@ package butterfish
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
 
 	// "encoding/json" // Removed
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,6 +24,7 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/bakks/butterfish/bubbles/pager"
 	"github.com/bakks/butterfish/prompt"
 	"github.com/bakks/butterfish/util"
 
@@ -31,12 +38,30 @@ import (
 // Default model encoder if the specified one isn't found
 const DEFAULT_PROMPT_ENCODER = "gpt-4-1106-preview"
 
-const ESC_CUP = "\x1b[6n" // Request the cursor position
+const ESC_CUP = "\x1b[6n"              // Request the cursor position
+const ESC_BACKGROUND = "\x1b]11;?\x07" // Request the background color (OSC 11)
+
+// How long we wait for a reply to ESC_BACKGROUND, terminals that don't support
+// it never reply
+const backgroundQueryTimeout = 300 * time.Millisecond
 const ESC_UP = "\x1b[%dA"
 const ESC_RIGHT = "\x1b[%dC"
 const ESC_LEFT = "\x1b[%dD"
 const ESC_CLEAR = "\x1b[0K"
 const CLEAR_COLOR = "\x1b[0m"
+const ESC_BRACKETED_PASTE_ON = "\x1b[?2004h"
+const ESC_BRACKETED_PASTE_OFF = "\x1b[?2004l"
+
+// Lines kept by the model of the terminal, and of a command's output
+const screenScrollback = 1000
+const commandScrollback = 2000
+
+// How long we wait for the rest of an escape sequence from the terminal
+// before taking what we have as keys, e.g. a lone ESC
+const escapeTimeout = 50 * time.Millisecond
+
+// How long we wait for more of a paste before taking what we have as typed
+const pasteTimeout = time.Second
 
 // Special characters that we wrap the shell's command prompt in (PS1) so
 // that we can detect where it starts and ends.
@@ -45,47 +70,176 @@ const PROMPT_SUFFIX = "\033R"
 const PROMPT_PREFIX_ESCAPED = "\\033Q"
 const PROMPT_SUFFIX_ESCAPED = "\\033R"
 const EMOJI_DEFAULT = "🤖"
+const EMOJI_INCOGNITO = "🥷"
 
 // Removed Goal Mode Emojis
 
 var ps1Regex = regexp.MustCompile(" ([0-9]+)" + PROMPT_SUFFIX)
 var ps1FullRegex = regexp.MustCompile(EMOJI_DEFAULT + " ([0-9]+)" + PROMPT_SUFFIX)
 
-// Simplified Color Scheme
-var DarkShellColorScheme = &ShellColorScheme{
-	Prompt:          "\x1b[38;5;154m",
-	Command:         "\x1b[0m",
-	Answer:          "\x1b[38;5;221m", // yellow
-	AnswerHighlight: "\x1b[38;5;204m", // orange
-	Error:           "\x1b[38;5;196m",
+// Switching to the alternate screen and back, with private modes 1049, 1047
+// or 47, possibly set along with other modes. A prompt or OSC 133 A mark also
+// means we're back on the normal screen, a program that was killed may not
+// have switched back.
+var altScreenRegex = regexp.MustCompile("\x1b\\[\\?([0-9;]+)([hl])|(\x1b\\]133;A|" + PROMPT_PREFIX + ")")
+
+// The start of a mode switch cut off at the end of a read
+var partialAltScreenRegex = regexp.MustCompile("\x1b(\\[(\\?[0-9;]*)?)?$")
+
+func isAltScreenMode(modes string) bool {
+	for _, mode := range strings.Split(modes, ";") {
+		if mode == "1049" || mode == "1047" || mode == "47" {
+			return true
+		}
+	}
+	return false
 }
 
-var LightShellColorScheme = &ShellColorScheme{
-	Prompt:          "\x1b[38;5;28m",
-	Command:         "\x1b[0m",
-	Answer:          "\x1b[38;5;18m", // Dark blue
-	AnswerHighlight: "\x1b[38;5;6m",
-	Error:           "\x1b[38;5;196m",
+type screenSegment struct {
+	text      string
+	altScreen bool
+	// the segment is where the output switched to the alternate screen
+	entered bool
 }
 
+// OSC 7 reports the shell's working directory as a file:// URL, we add it to
+// the PS1 so that it's emitted with every prompt. It's terminated by either
+// BEL or ST (ESC \).
+var osc7Regex = regexp.MustCompile("\x1b\\]7;file://([^/\x07\x1b]*)(/[^\x07\x1b]*)(?:\x07|\x1b\\\\)")
+
 func RunShell(ctx context.Context, config *ButterfishConfig) error {
 	envVars := []string{"BUTTERFISH_SHELL=1"}
+	command := []string{config.ShellBinary}
+
+	hooks, useHooks := config.ShellIntegration().(ShellHookIntegration)
+	if useHooks {
+		dir, err := os.MkdirTemp("", "butterfish-shell-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		args, env, err := hooks.InstallHooks(dir, config.PromptIcon())
+		if err != nil {
+			return err
+		}
+		log.Printf("Installed %s hooks in %s", hooks.Name(), dir)
+		command = append(command, args...)
+		envVars = append(envVars, env...)
+	}
+
+	// the control socket is opened first so its path can go in the shell's
+	// environment, the shell still starts if it can't be opened
+	controlDir, err := os.MkdirTemp("", "butterfish-control-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(controlDir)
+	control, err := ListenControl(filepath.Join(controlDir, "control.sock"))
+	if err != nil {
+		log.Printf("Error opening the control socket: %s", err)
+	} else {
+		defer control.Close()
+		envVars = append(envVars, ControlSocketEnv+"="+control.Path)
+	}
 
-	ptmx, ptyCleanup, err := ptyCommand(ctx, envVars, []string{config.ShellBinary})
+	ptmx, cmd, ptyCleanup, err := ptyCommand(ctx, envVars, command)
 	if err != nil {
 		return err
 	}
 	defer ptyCleanup()
 
-	bf, err := NewButterfish(ctx, config)
+	bf, cleanup, err := newPromptingButterfish(ctx, config)
 	if err != nil {
 		return err
 	}
+	defer cleanup()
+	bf.ShellPid = cmd.Process.Pid
+	bf.ShellHooks = useHooks
+	if control != nil {
+		log.Printf("Listening for control calls on %s", control.Path)
+		bf.Control = control
+		go control.Serve()
+	}
+
+	width, height, _ := term.GetSize(int(os.Stdout.Fd()))
+	if config.ShellTracePath != "" {
+		trace, err := CreateTrace(config.ShellTracePath, config.ShellBinary, width, height)
+		if err != nil {
+			return err
+		}
+		defer trace.Close()
+		log.Printf("Recording a trace to %s", config.ShellTracePath)
+		bf.Trace = trace
+	}
+
+	if config.ShellRecordPath != "" {
+		recording, err := CreateCast(config.ShellRecordPath, CastHeader{
+			Width:  width,
+			Height: height,
+			Title:  "butterfish " + config.ShellBinary,
+			Env: map[string]string{
+				"SHELL": config.ShellBinary,
+				"TERM":  os.Getenv("TERM"),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		defer recording.Close()
+		log.Printf("Recording the session to %s", config.ShellRecordPath)
+		bf.Recording = recording
+	}
 
 	bf.ShellMultiplexer(ptmx, ptmx, os.Stdin, os.Stdout)
 	return nil
 }
 
+// Set up a ButterfishCtx with the context providers, redaction and audit log
+// used when prompting, the returned cleanup closes the audit log.
+func newPromptingButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCtx, func(), error) {
+	contextProviders, err := NewContextProviders(
+		config.ShellContextProviders, config.ShellContextEnv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var redactor *Redactor
+	if !config.ShellNoRedact {
+		redactor, err = NewRedactor(config.ShellRedactPatterns)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	bf, err := NewButterfish(ctx, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	bf.ContextProviders = contextProviders
+	bf.Redactor = redactor
+
+	cleanup := func() {}
+	if config.AuditLogPath != "" {
+		auditLog, err := OpenAuditLog(config.AuditLogPath, config.AuditLogMaxBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { auditLog.Close() }
+
+		log.Printf("Writing audit log for session %s to %s", bf.SessionId, config.AuditLogPath)
+		bf.AuditLog = auditLog
+		bf.LLMClient = &AuditLLM{
+			Client:       bf.LLMClient,
+			Log:          auditLog,
+			SessionId:    bf.SessionId,
+			IncludeUsage: config.AuditLogUsage,
+		}
+	}
+
+	return bf, cleanup, nil
+}
+
 const (
 	historyTypePrompt = iota
 	historyTypeShellInput
@@ -265,6 +419,7 @@ const (
 	stateShell
 	statePrompting
 	statePromptResponse
+	statePager
 )
 
 var stateNames = []string{
@@ -272,6 +427,7 @@ var stateNames = []string{
 	"Shell",
 	"Prompting",
 	"PromptResponse",
+	"Pager",
 }
 
 // Removed AutosuggestResult
@@ -293,8 +449,74 @@ type ShellState struct {
 	Sigwinch   chan os.Signal
 
 	// set based on model
+	PromptModel     string
 	PromptMaxTokens int
 
+	// The project config for the shell's working directory, if any
+	Project ProjectTracker
+	// The config butterfish was started with, the project's settings are
+	// applied on top of it
+	baseConfig *ButterfishConfig
+
+	// The shell's working directory as last reported by the prompt
+	cwd string
+
+	// Context sections added to the system message, collected in the
+	// background
+	Context *ContextCache
+
+	// History capture is paused while in incognito mode
+	Incognito bool
+	// Set while an excluded command is running so we don't record its output
+	skipOutput bool
+
+	// With the hook integration the shell marks its prompts and commands
+	// with OSC 133. Once we've seen a command start we only record command
+	// output, between the C and D marks, in history.
+	semanticMarks  bool
+	commandRunning bool
+	// Between the A and B marks, where the prompt reports the working
+	// directory
+	inPrompt   bool
+	promptText string
+	// Exit code of the last command, from its D mark
+	LastExitCode int
+	// Set by a D mark, so we note the exit code with the command's output
+	commandFinished bool
+
+	// The last command entered, and whether we've noted in history that it
+	// ran full-screen
+	lastCommand        string
+	fullScreenRecorded bool
+	// A full-screen program has switched the terminal to the alternate
+	// screen, input goes straight to it
+	altScreen bool
+	// an unfinished mode switch at the end of the last output
+	altScreenPartial string
+
+	// The last answer and its fenced code blocks, numbered from 1 on screen
+	LastAnswer   string
+	AnswerBlocks []string
+
+	// While the pager is open keys are forwarded to it, and we go back to
+	// pagerReturnState when it sends on PagerDone
+	pager            *pager.Pager
+	pagerInput       *io.PipeWriter
+	pagerReturnState int
+	PagerDone        chan struct{}
+	// Whether the shell last turned bracketed paste on, Bubble Tea turns it
+	// off when the pager exits so we turn it back on
+	bracketedPaste bool
+
+	// A model of the terminal, fed with everything written to ParentOut, so
+	// we know what's on screen and where the cursor is
+	Screen *util.Terminal
+	// The screen captured by /screen, attached to the next prompt
+	pendingScreen string
+	// Renders the output of the current command, which is added to history
+	// as the user saw it rather than as the raw bytes
+	commandScreen *util.Terminal
+
 	// The current state of the shell
 	State                int
 	PromptSuffixCounter  int // Still needed for PS1 parsing
@@ -305,14 +527,25 @@ type ShellState struct {
 	PrintErrorChan       chan error
 	History              *ShellHistory
 	PromptAnswerWriter   io.Writer
-	StyleWriter          *util.StyleCodeblocksWriter
+	StyleWriter          *util.MarkdownWriter
 	Prompt               *ShellBuffer
 	PromptResponseCancel context.CancelFunc
 	Command              *ShellBuffer
 	TerminalWidth        int
 	Color                *ShellColorScheme
-	parentInBuffer       []byte
-	PromptEncoder        *tiktoken.Tiktoken
+	parentIn             InputParser
+	parentInEvents       []InputEvent
+	parentInTimeout      <-chan time.Time
+	// Input that came while an answer was printing
+	heldInput     []InputEvent
+	PromptEncoder *tiktoken.Tiktoken
+
+	// calls from the control socket, nil if there isn't one
+	ControlCalls <-chan *ControlCall
+	// the prompt being answered if it came from the control socket
+	controlPrompt *ControlLLM
+	// the last prompt sent, for the answer_finished event
+	lastPrompt string
 
 	// Removed Goal Mode fields
 	// Removed Autosuggest fields
@@ -323,8 +556,10 @@ func (this *ShellState) setState(state int) {
 		return
 	}
 
-	if this.Butterfish.Config.Verbose > 1 {
-		log.Printf("State change: %s -> %s", stateNames[this.State], stateNames[state])
+	slog.Log(this.Butterfish.Ctx, util.LevelTrace, "State change",
+		"from", stateNames[this.State], "to", stateNames[state])
+	if this.Butterfish.Trace != nil {
+		this.Butterfish.Trace.State(stateNames[this.State], stateNames[state])
 	}
 
 	this.State = state
@@ -383,40 +618,43 @@ Please submit an issue to https://github.com/bakks/butterfish.`)
 	}
 }
 
+// Ask the terminal for its background color, returns nil if it doesn't reply
+// within backgroundQueryTimeout
+func queryBackgroundColor(parentOut io.Writer, backgroundChan <-chan *backgroundColor) *backgroundColor {
+	parentOut.Write([]byte(ESC_BACKGROUND))
+
+	select {
+	case background := <-backgroundChan:
+		return background
+	case <-time.After(backgroundQueryTimeout):
+		return nil
+	}
+}
+
 // This sets the PS1 shell variable.
 func (this *ButterfishCtx) SetPS1(childIn io.Writer) {
-	shell := this.Config.ParseShell()
-	var ps1 string
-
-	switch shell {
-	case "bash", "sh":
-		ps1 = "PS1=$'\\[%s\\]'$PS1$'%s\\[ $?%s\\] '\n"
-	case "zsh":
-		ps1 = "PS1=$'%%{%s%%}'$PS1$'%s%%{ %%?%s%%} '\n"
-	default:
-		log.Printf("Unknown shell %s, Butterfish is going to leave the PS1 alone. This means that you won't get a custom prompt in Butterfish, and Butterfish won't be able to parse the exit code of the previous command. Create an issue at https://github.com/bakks/butterfish.", shell)
+	integration := this.Config.ShellIntegration()
+	command := integration.PromptCommand(this.Config.PromptIcon())
+	if command == "" {
+		log.Printf("Unknown shell %s, Butterfish is going to leave the PS1 alone. This means that you won't get a custom prompt in Butterfish, and Butterfish won't be able to parse the exit code of the previous command. Create an issue at https://github.com/bakks/butterfish.", integration.Name())
 		return
 	}
 
-	promptIcon := ""
-	if !this.Config.ShellLeavePromptAlone {
-		promptIcon = EMOJI_DEFAULT
-	}
-
-	fmt.Fprintf(childIn,
-		ps1,
-		PROMPT_PREFIX_ESCAPED,
-		promptIcon,
-		PROMPT_SUFFIX_ESCAPED)
+	log.Printf("Setting the prompt for %s", integration.Name())
+	childIn.Write([]byte(command))
 }
 
 // Given a string of terminal output, identify terminal prompts based on the
-// custom PS1 escape sequences we set.
-func ParsePS1(data string, regex *regexp.Regexp, currIcon string) (int, int, string) {
+// custom PS1 escape sequences we set. Returns the exit status of the last
+// command, the number of prompts found, the working directory reported by the
+// last OSC 7 sequence ("" if none), and the output with the prompt markers
+// removed.
+func ParsePS1(data string, regex *regexp.Regexp, currIcon string) (int, int, string, string) {
+	cwd := ParseOSC7(data)
 	matches := regex.FindAllStringSubmatch(data, -1)
 
 	if len(matches) == 0 {
-		return 0, 0, data
+		return 0, 0, cwd, data
 	}
 
 	lastStatus := 0
@@ -436,10 +674,21 @@ func ParsePS1(data string, regex *regexp.Regexp, currIcon string) (int, int, str
 	// Remove the prefix
 	cleaned = strings.ReplaceAll(cleaned, PROMPT_PREFIX, "")
 
-	return lastStatus, prompts, cleaned
+	return lastStatus, prompts, cwd, cleaned
+}
+
+// Returns the path from the last OSC 7 sequence in data, or "" if there
+// isn't one. Our prompts put $PWD in the URL as it is, without
+// percent-encoding, so the path isn't decoded.
+func ParseOSC7(data string) string {
+	matches := osc7Regex.FindAllStringSubmatch(data, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[len(matches)-1][2]
 }
 
-func (this *ShellState) ParsePS1(data string) (int, int, string) {
+func (this *ShellState) ParsePS1(data string) (int, int, string, string) {
 	var regex *regexp.Regexp
 	if this.Butterfish.Config.ShellLeavePromptAlone {
 		regex = ps1Regex
@@ -451,6 +700,9 @@ func (this *ShellState) ParsePS1(data string) (int, int, string) {
 	if !this.Butterfish.Config.ShellLeavePromptAlone {
 		// Removed Goal Mode icon logic
 		currIcon = EMOJI_DEFAULT
+		if this.Incognito {
+			currIcon = EMOJI_INCOGNITO
+		}
 	}
 
 	return ParsePS1(data, regex, currIcon)
@@ -475,39 +727,84 @@ func min(a, b int) int {
 	return b
 }
 
+// Pick the colors once we know whether the background is dark, the
+// configured theme is merged with the dark or light theme to fill it in.
+func (this *ButterfishCtx) shellTheme() (*Theme, *ShellColorScheme) {
+	base := DarkTheme
+	this.Config.ColorScheme = &GruvboxDark
+	if !this.Config.ColorDark {
+		base = LightTheme
+		this.Config.ColorScheme = &GruvboxLight
+	}
+	this.Config.Styles = ColorSchemeToStyles(this.Config.ColorScheme)
+
+	theme := base
+	if this.Config.Theme != nil {
+		theme = this.Config.Theme.Merge(base)
+	}
+	colorScheme, err := theme.ShellColorScheme(this.Config.ColorDepth)
+	if err != nil {
+		log.Printf("Error in theme, using the default colors: %s", err)
+		colorScheme, _ = DarkTheme.ShellColorScheme(this.Config.ColorDepth)
+	}
+
+	return theme, colorScheme
+}
+
 func (this *ButterfishCtx) ShellMultiplexer(
 	childIn io.Writer, childOut io.Reader,
 	parentIn io.Reader, parentOut io.Writer) {
 
-	this.SetPS1(childIn)
-
-	colorScheme := DarkShellColorScheme
-	if !this.Config.ColorDark {
-		colorScheme = LightShellColorScheme
+	if this.Trace != nil {
+		parentIn = io.TeeReader(parentIn, this.Trace.Stream(TraceParentIn))
+		childOut = io.TeeReader(childOut, this.Trace.Stream(TraceChildOut))
+		parentOut = io.MultiWriter(parentOut, this.Trace.Stream(TraceParentOut))
+	}
+	if this.Recording != nil {
+		parentOut = io.MultiWriter(parentOut, this.Recording)
 	}
 
-	log.Printf("Starting shell multiplexer")
+	if !this.ShellHooks {
+		this.SetPS1(childIn)
+	}
 
 	childOutReader := make(chan *byteMsg, 8)
 	parentInReader := make(chan *byteMsg, 8)
 	parentPositionChan := make(chan *cursorPosition, 128)
+	parentBackgroundChan := make(chan *backgroundColor, 1)
+	go readerToChannelWithPosition(parentIn, parentInReader, parentPositionChan, parentBackgroundChan)
+
+	if this.Config.ColorAuto && this.Config.ColorDepth != util.ColorNone {
+		background := queryBackgroundColor(parentOut, parentBackgroundChan)
+		if background != nil {
+			this.Config.ColorDark = !background.IsLight()
+			log.Printf("Terminal background is %v, dark mode: %t", *background, this.Config.ColorDark)
+		} else {
+			log.Printf("Terminal didn't report its background color, dark mode: %t", this.Config.ColorDark)
+		}
+	}
+
+	theme, colorScheme := this.shellTheme()
 
-	termWidth, _, err := term.GetSize(int(os.Stdout.Fd()))
+	log.Printf("Starting shell multiplexer")
+
+	termWidth, termHeight, err := term.GetSize(int(os.Stdout.Fd()))
 	if err != nil {
 		panic(err)
 	}
 
+	// everything we write to the terminal also goes to our model of it
+	screen := util.NewTerminal(termWidth, termHeight, screenScrollback)
+	parentOut = io.MultiWriter(parentOut, screen)
+
 	carriageReturnWriter := util.NewReplaceWriter(parentOut, "\n", "\r\n")
-	codeblocksColorScheme := "monokai"
-	if !this.Config.ColorDark {
-		codeblocksColorScheme = "monokailight"
-	}
-	styleCodeblocksWriter := util.NewStyleCodeblocksWriter(
+	markdownWriter := util.NewMarkdownWriter(
 		carriageReturnWriter,
 		termWidth,
 		colorScheme.Answer,
 		colorScheme.AnswerHighlight,
-		codeblocksColorScheme)
+		theme.CodeStyle)
+	markdownWriter.SetColorDepth(this.Config.ColorDepth)
 	// Removed Goal Mode writer
 
 	sigwinch := make(chan os.Signal, 1)
@@ -518,6 +815,11 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		this.Config.ShellMaxPromptTokens)
 	// Removed AutosuggestMaxTokens calculation
 
+	var controlCalls chan *ControlCall
+	if this.Control != nil {
+		controlCalls = this.Control.Calls
+	}
+
 	shellState := &ShellState{
 		Butterfish:         this,
 		ParentOut:          parentOut,
@@ -530,15 +832,21 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		PrintErrorChan:     make(chan error, 8),
 		History:            NewShellHistory(),
 		PromptOutputChan:   make(chan *util.CompletionResponse),
-		PromptAnswerWriter: styleCodeblocksWriter,
+		PagerDone:          make(chan struct{}),
+		ControlCalls:       controlCalls,
+		PromptAnswerWriter: markdownWriter,
 		// Removed PromptGoalAnswerWriter
-		StyleWriter:     styleCodeblocksWriter,
+		StyleWriter:     markdownWriter,
 		Command:         NewShellBuffer(),
 		Prompt:          NewShellBuffer(),
 		TerminalWidth:   termWidth,
+		Screen:          screen,
+		commandScreen:   util.NewTerminal(termWidth, termHeight, commandScrollback),
 		Color:           colorScheme,
-		parentInBuffer:  []byte{},
+		PromptModel:     this.Config.ShellPromptModel,
 		PromptMaxTokens: promptMaxTokens,
+		Project:         ProjectTracker{Profile: this.Config.Profile},
+		Context:         NewContextCache(this.ContextProviders),
 		// Removed AutosuggestMaxTokens
 		// Removed AutosuggestEnabled
 		// Removed AutosuggestChan
@@ -547,11 +855,17 @@ func (this *ButterfishCtx) ShellMultiplexer(
 	shellState.Prompt.SetTerminalWidth(termWidth)
 	shellState.Prompt.SetColor(colorScheme.Prompt)
 
+	// start the model with the cursor where it is on the real terminal, from
+	// then on we follow it from our output
+	row, col := shellState.GetCursorPosition()
+	screen.SetCursor(row-1, col-1)
+
 	go readerToChannel(childOut, childOutReader)
-	go readerToChannelWithPosition(parentIn, parentInReader, parentPositionChan)
 
-	// clear out any existing output to hide the PS1 export stuff
-	clearByteChan(childOutReader, 1000*time.Millisecond)
+	if !this.ShellHooks {
+		// clear out any existing output to hide the PS1 export stuff
+		clearByteChan(childOutReader, 1000*time.Millisecond)
+	}
 
 	// start
 	shellState.Mux()
@@ -561,6 +875,481 @@ func (this *ShellState) Errorf(format string, args ...any) {
 	this.PrintErrorChan <- fmt.Errorf(format, args...)
 }
 
+// Add to the history unless capture is paused
+func (this *ShellState) appendHistory(historyType int, data string) {
+	if this.Incognito {
+		return
+	}
+	this.History.Append(historyType, data)
+}
+
+// Turn incognito mode on or off, and ask the shell for a new prompt so the
+// prompt icon reflects the mode.
+func (this *ShellState) ToggleIncognito() {
+	this.flushCommandOutput()
+	this.Incognito = !this.Incognito
+	log.Printf("Incognito mode: %t", this.Incognito)
+
+	if this.Incognito {
+		fmt.Fprintf(this.ParentOut, "\r\n%sIncognito mode on, commands, output and prompts won't be added to history", this.Color.Command)
+	} else {
+		fmt.Fprintf(this.ParentOut, "\r\n%sIncognito mode off, history capture resumed", this.Color.Command)
+	}
+	this.ChildIn.Write([]byte("\r"))
+}
+
+// Type code block n of the last answer into the shell's command line without
+// running it, so it can be reviewed before pressing Enter. Multi-line blocks
+// are sent as a bracketed paste so the shell doesn't run each line, if the
+// shell isn't accepting a paste they're copied to the clipboard instead.
+// Returns false if there's no such block.
+func (this *ShellState) InsertAnswerBlock(n int) bool {
+	if n < 1 || n > len(this.AnswerBlocks) {
+		return false
+	}
+	log.Printf("Inserting code block %d", n)
+
+	block := strings.TrimRight(this.AnswerBlocks[n-1], "\n")
+	if err := this.typeCommand(block); err != nil {
+		this.copyToClipboard(block)
+		fmt.Fprintf(this.ParentOut, "\r\n%sCode block %d has more than one line and %s, copied it to the clipboard instead",
+			this.Color.Error, n, err)
+		this.ChildIn.Write([]byte("\r"))
+	}
+	return true
+}
+
+var errNoBracketedPaste = errors.New("the shell isn't accepting a bracketed paste, each line would run")
+
+// Type text into the shell's command line without running it. Control
+// characters are removed so the text can't end the paste or press Enter, and
+// text with more than one line is only sent as a bracketed paste.
+func (this *ShellState) typeCommand(block string) error {
+	block = stripControls(block)
+	if strings.Contains(block, "\n") {
+		if !this.bracketedPaste {
+			return errNoBracketedPaste
+		}
+		this.ChildIn.Write([]byte(pasteStart + block + pasteEnd))
+	} else {
+		this.ChildIn.Write([]byte(block))
+	}
+
+	this.Command = NewShellBuffer()
+	this.Command.Write(block)
+	this.ParentOut.Write([]byte(this.Color.Command))
+	this.setState(stateShell)
+	return nil
+}
+
+// Remove control characters, ESC included, from text typed into the shell.
+// Newlines are kept and tabs become spaces so they don't trigger completion.
+func stripControls(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' {
+			return r
+		}
+		if r == '\t' {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// Copy a code block of the last answer to the clipboard with OSC 52, which
+// works over ssh if the terminal supports it. args is the block number,
+// defaulting to the first block.
+func (this *ShellState) CopyAnswerBlock(args []string) {
+	arg := "1"
+	if len(args) > 0 {
+		arg = args[0]
+	}
+	n, err := strconv.Atoi(arg)
+
+	if err != nil || n < 1 || n > len(this.AnswerBlocks) {
+		fmt.Fprintf(this.ParentOut, "\r\n%sNo code block %s in the last answer", this.Color.Error, arg)
+	} else {
+		this.copyToClipboard(this.AnswerBlocks[n-1])
+		fmt.Fprintf(this.ParentOut, "\r\n%sCopied code block %d to the clipboard", this.Color.Command, n)
+	}
+	this.ChildIn.Write([]byte("\r"))
+}
+
+func (this *ShellState) copyToClipboard(text string) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(strings.TrimRight(text, "\n")))
+	fmt.Fprintf(this.ParentOut, "\x1b]52;c;%s\a", encoded)
+}
+
+// Write the session so far to a file, args is the file name, its extension
+// picking the format, or just the format (md, html or sh) for a file named
+// after the time. Relative paths are in the shell's working directory.
+func (this *ShellState) ExportSession(args []string) {
+	this.flushCommandOutput()
+	now := time.Now()
+	path := "butterfish-session-" + now.Format("20060102-150405") + ".md"
+	if len(args) > 0 {
+		path = args[0]
+		switch path {
+		case ExportMarkdown, ExportHTML, ExportScript:
+			path = "butterfish-session-" + now.Format("20060102-150405") + "." + args[0]
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(this.Cwd(), path)
+	}
+
+	err := this.exportSession(path, now)
+	if err != nil {
+		fmt.Fprintf(this.ParentOut, "\r\n%sCouldn't export the session: %s", this.Color.Error, err)
+	} else {
+		fmt.Fprintf(this.ParentOut, "\r\n%sExported the session to %s", this.Color.Command, path)
+	}
+	this.ChildIn.Write([]byte("\r"))
+}
+
+// All of the history, with secrets taken out as they are for requests since
+// it's leaving the shell
+func (this *ShellState) historyBlocks() []util.HistoryBlock {
+	blocks := this.History.GetLastNBytes(math.MaxInt, math.MaxInt)
+	if this.Butterfish.Redactor != nil {
+		for i := range blocks {
+			blocks[i].Content, _ = this.Butterfish.Redactor.Redact(blocks[i].Content)
+		}
+	}
+	return blocks
+}
+
+func (this *ShellState) exportSession(path string, now time.Time) error {
+	format, err := ExportFormat(path)
+	if err != nil {
+		return err
+	}
+
+	blocks := this.historyBlocks()
+	if len(blocks) == 0 {
+		return fmt.Errorf("there's nothing in the history yet")
+	}
+
+	export := &SessionExport{
+		Blocks: blocks,
+		Shell:  this.Butterfish.Config.ParseShell(),
+		Cwd:    this.Cwd(),
+		Time:   now,
+	}
+
+	// a typo shouldn't replace an existing file, e.g. /export README.md
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists, export to a new file", path)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(export.Render(format))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Note whether the shell's line editor turned bracketed paste on or off,
+// readline and zle turn it on for each prompt and off to run a command
+func (this *ShellState) trackBracketedPaste(data []byte) {
+	on := bytes.LastIndex(data, []byte(ESC_BRACKETED_PASTE_ON))
+	off := bytes.LastIndex(data, []byte(ESC_BRACKETED_PASTE_OFF))
+	if on != off {
+		this.bracketedPaste = on > off
+	}
+}
+
+// Mark where a command or prompt starts in the session recording
+func (this *ShellState) recordMarker(label string) {
+	if this.Butterfish.Recording != nil {
+		this.Butterfish.Recording.Marker(strings.TrimSpace(label))
+	}
+}
+
+// Add the output of the last command to history, rendered as it was shown,
+// with its exit code if it failed
+func (this *ShellState) flushCommandOutput() {
+	text := this.commandScreen.Text()
+	this.commandScreen.Reset()
+	if this.commandFinished && this.LastExitCode > 0 {
+		text = strings.TrimLeft(fmt.Sprintf("%s\n[exit code %d]", text, this.LastExitCode), "\n")
+	}
+	this.commandFinished = false
+
+	if text != "" {
+		this.appendHistory(historyTypeShellOutput, text+"\n")
+	}
+}
+
+// Capture what's on the terminal to attach to the next prompt, so it can ask
+// about it. The last line is the /screen command line itself, which we leave
+// out.
+func (this *ShellState) SendScreen() {
+	lines := strings.Split(this.Screen.Screen(), "\n")
+	screen := strings.TrimRight(strings.Join(lines[:len(lines)-1], "\n"), "\n")
+
+	if screen == "" {
+		fmt.Fprintf(this.ParentOut, "\r\n%sThe screen is empty", this.Color.Error)
+	} else {
+		this.flushCommandOutput()
+		this.pendingScreen = screen
+		fmt.Fprintf(this.ParentOut, "\r\n%sThe screen will be attached to your next prompt", this.Color.Command)
+	}
+	this.ChildIn.Write([]byte("\r"))
+}
+
+// Split child output where it switches between the normal and alternate
+// screen. Full-screen programs like vim or less draw on the alternate screen,
+// and we don't want their redraws in history or to look for prompts in them.
+func (this *ShellState) splitAltScreen(data string) []screenSegment {
+	// a switch may be split across reads, so an unfinished one is held back
+	// until the next
+	data = this.altScreenPartial + data
+	this.altScreenPartial = ""
+	if loc := partialAltScreenRegex.FindStringIndex(data); loc != nil {
+		this.altScreenPartial = data[loc[0]:]
+		data = data[:loc[0]]
+	}
+
+	segments := []screenSegment{}
+	last := 0
+	for _, match := range altScreenRegex.FindAllStringSubmatchIndex(data, -1) {
+		// the switches themselves go with the alternate screen output
+		var on bool
+		end := match[0]
+		if match[6] >= 0 {
+			if !this.altScreen {
+				continue
+			}
+			log.Printf("Prompt on the alternate screen, the program must have exited without leaving it")
+		} else {
+			if !isAltScreenMode(data[match[2]:match[3]]) {
+				continue
+			}
+			on = data[match[4]] == 'h'
+			if on == this.altScreen {
+				continue
+			}
+			if !on {
+				end = match[1]
+			}
+		}
+		if end > last {
+			segments = append(segments, screenSegment{data[last:end], this.altScreen, false})
+		}
+		last = end
+		this.altScreen = on
+		if on {
+			segments = append(segments, screenSegment{"", true, true})
+		}
+	}
+
+	if last < len(data) {
+		segments = append(segments, screenSegment{data[last:], this.altScreen, false})
+	}
+	return segments
+}
+
+// Parse child output for prompts, the working directory and command output.
+// Returns the output to show, with the prompt markers removed, the part of
+// it to add to history, and the number of prompts. Output on the alternate
+// screen is shown as it is, in history we only note the command that ran.
+func (this *ShellState) parseChildOutput(data string) (string, string, int) {
+	var output, history strings.Builder
+	prompts := 0
+
+	for _, segment := range this.splitAltScreen(data) {
+		if segment.altScreen {
+			output.WriteString(segment.text)
+			if segment.entered && !this.fullScreenRecorded {
+				this.fullScreenRecorded = true
+				command := strings.TrimSpace(this.lastCommand)
+				if command == "" {
+					command = "a program"
+				}
+				slog.Log(this.Butterfish.Ctx, util.LevelTrace, "Full-screen program started", "command", command)
+				fmt.Fprintf(&history, "ran %s (full-screen)\r\n", command)
+			}
+			continue
+		}
+
+		_, n, cwd, cleaned := this.ParsePS1(segment.text)
+		prompts += n
+		if this.Butterfish.ShellHooks {
+			cwd = this.promptCwd(segment.text)
+		}
+		if cwd != "" && cwd != this.cwd {
+			slog.Log(this.Butterfish.Ctx, util.LevelTrace, "Shell working directory", "cwd", cwd)
+			this.cwd = cwd
+		}
+		output.WriteString(cleaned)
+		history.WriteString(this.commandOutput(cleaned))
+	}
+
+	return output.String(), history.String(), prompts
+}
+
+// With the hook integration we only trust OSC 7 in the prompt, between the A
+// and B marks, otherwise a command could print one, e.g. cat of a crafted
+// file, and change the directory we think the shell is in. The prompt may
+// come over several reads so we collect it. Returns the path from the last
+// one, or "" if there isn't one.
+func (this *ShellState) promptCwd(data string) string {
+	cwd := ""
+	last := 0
+	for _, mark := range ParseOSC133(data) {
+		if this.inPrompt {
+			this.promptText += data[last:mark.Start]
+			if path := ParseOSC7(this.promptText); path != "" {
+				cwd = path
+			}
+		}
+		last = mark.End
+		this.inPrompt = mark.Kind == 'A'
+		this.promptText = ""
+	}
+	if this.inPrompt {
+		this.promptText += data[last:]
+		if path := ParseOSC7(this.promptText); path != "" {
+			cwd = path
+		}
+	}
+	return cwd
+}
+
+// Follow the OSC 133 marks in child output. Returns the part of data to add
+// to history: before we've seen a command start that's all of it, after
+// that only command output, between C and D marks.
+func (this *ShellState) commandOutput(data string) string {
+	marks := ParseOSC133(data)
+	if len(marks) == 0 && !this.semanticMarks {
+		return data
+	}
+
+	var output strings.Builder
+	last := 0
+	for _, mark := range marks {
+		if this.commandRunning {
+			output.WriteString(data[last:mark.Start])
+		}
+		last = mark.End
+
+		switch mark.Kind {
+		case 'C':
+			this.semanticMarks = true
+			this.commandRunning = true
+
+		case 'D':
+			// the shell may report an exit code without having run anything,
+			// e.g. for an empty command line
+			if !this.commandRunning {
+				continue
+			}
+			if !this.skipOutput {
+				this.controlEvent(ControlEventCommandFinished, map[string]any{
+					"command":   strings.TrimSpace(this.lastCommand),
+					"exit_code": mark.ExitCode,
+				})
+			}
+			this.commandRunning = false
+			this.skipOutput = false
+			this.LastExitCode = mark.ExitCode
+			this.commandFinished = true
+			slog.Log(this.Butterfish.Ctx, util.LevelTrace, "Command finished", "exit_code", mark.ExitCode)
+		}
+	}
+	if this.commandRunning {
+		output.WriteString(data[last:])
+	}
+
+	if !this.semanticMarks {
+		return data
+	}
+	return output.String()
+}
+
+// Show the last answer full screen in a pager, e.g. to read a long answer
+// without it mixing with command output in the scrollback. Keys are
+// forwarded to the pager and child output is held back until it's closed,
+// then we return to the state we were in. Returns false if there's no answer.
+func (this *ShellState) OpenPager() bool {
+	if this.LastAnswer == "" {
+		return false
+	}
+
+	content := this.StyleWriter.Render(this.LastAnswer, this.TerminalWidth)
+	blocks := this.AnswerBlocks
+	copyBlock := func(n int) string {
+		if n > len(blocks) {
+			return fmt.Sprintf("No code block %d in this answer", n)
+		}
+		this.copyToClipboard(blocks[n-1])
+		return fmt.Sprintf("Copied code block %d to the clipboard", n)
+	}
+
+	reader, writer := io.Pipe()
+	width, height := this.Screen.Size()
+	answerPager := pager.NewPager(content, "Last answer", copyBlock, reader, this.ParentOut, width, height)
+	this.pager = answerPager
+	this.pagerInput = writer
+	this.pagerReturnState = this.State
+	this.setState(statePager)
+
+	go func() {
+		err := answerPager.Run()
+		if err != nil {
+			log.Printf("Error running pager: %s", err)
+		}
+		// unblock any write of keys the pager won't read
+		reader.Close()
+		this.PagerDone <- struct{}{}
+	}()
+	return true
+}
+
+// Returns true if a command shouldn't be recorded in history, either because
+// it starts with a space (like HISTCONTROL=ignorespace) or it matches a
+// denylist pattern. A pattern matches if the command's leading words are the
+// pattern's words, e.g. "vault read" matches "vault read secret/db" but not
+// "vault status".
+func ExcludeFromHistory(command string, denylist []string) bool {
+	if strings.HasPrefix(command, " ") {
+		return true
+	}
+
+	words := strings.Fields(command)
+	// look past sudo and env var assignments for the actual command
+	for len(words) > 0 && (words[0] == "sudo" || strings.Contains(words[0], "=")) {
+		words = words[1:]
+	}
+
+	for _, pattern := range denylist {
+		patternWords := strings.Fields(pattern)
+		if len(patternWords) == 0 || len(patternWords) > len(words) {
+			continue
+		}
+
+		match := true
+		for i, word := range patternWords {
+			if words[i] != word {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (this *ShellState) PrintError(err error) {
 	this.PrintErrorChan <- err
 }
@@ -581,7 +1370,7 @@ func (this *ShellState) Mux() {
 
 		case err := <-this.PrintErrorChan:
 			log.Printf("Error: %s", err.Error())
-			this.History.Append(historyTypeShellOutput, err.Error())
+			this.appendHistory(historyTypeShellOutput, err.Error())
 			fmt.Fprintf(this.ParentOut, "%s%s", this.Color.Error, err.Error())
 			this.setState(stateNormal)
 			fmt.Fprintf(this.ChildIn, "\n")
@@ -590,16 +1379,22 @@ func (this *ShellState) Mux() {
 			fmt.Fprintf(this.ChildIn, "\x1b[%d;%dR", pos.Row, pos.Column)
 
 		case <-this.Sigwinch:
-			termWidth, _, err := term.GetSize(int(os.Stdout.Fd()))
+			termWidth, termHeight, err := term.GetSize(int(os.Stdout.Fd()))
 			if err != nil {
 				log.Printf("Error getting terminal size after SIGWINCH: %s", err)
 			}
-			if this.Butterfish.Config.Verbose > 0 {
-				log.Printf("Got SIGWINCH with new width %d", termWidth)
-			}
+			slog.Debug("Got SIGWINCH", "width", termWidth, "height", termHeight)
 			this.TerminalWidth = termWidth
+			this.Screen.Resize(termWidth, termHeight)
+			this.commandScreen.Resize(termWidth, termHeight)
+			if this.Butterfish.Recording != nil {
+				this.Butterfish.Recording.Resize(termWidth, termHeight)
+			}
 			this.Prompt.SetTerminalWidth(termWidth)
 			this.StyleWriter.SetTerminalWidth(termWidth)
+			if this.pager != nil {
+				this.pager.Resize(termWidth, termHeight)
+			}
 			// Removed AutosuggestBuffer width update
 			if this.Command != nil {
 				this.Command.SetTerminalWidth(termWidth)
@@ -608,25 +1403,54 @@ func (this *ShellState) Mux() {
 		// Removed AutosuggestChan case
 
 		case output := <-this.PromptOutputChan:
+			this.LastAnswer = output.Completion
+			this.AnswerBlocks = util.ExtractCodeBlocks(output.Completion)
 			historyData := output.Completion
 			if historyData != "" {
-				this.History.Append(historyTypeLLMOutput, historyData)
+				this.appendHistory(historyTypeLLMOutput, historyData)
 			}
+			this.finishControlPrompt(output.Completion, nil)
+			this.controlEvent(ControlEventAnswerFinished, map[string]any{
+				"prompt": this.lastPrompt,
+				"answer": output.Completion,
+			})
 			// Removed function call history logging
 
 			// If there is child output waiting to be printed, print that now
 			if len(childOutBuffer) > 0 {
 				this.ParentOut.Write(childOutBuffer)
-				this.History.Append(historyTypeShellOutput, string(childOutBuffer))
 				childOutBuffer = []byte{}
 			}
 
-			// Get a new prompt
-			this.ChildIn.Write([]byte("\n"))
+			// Get a new prompt, unless a command is running, e.g. butterfish
+			// ask, as the shell prints one when it finishes
+			if !this.commandRunning {
+				this.ChildIn.Write([]byte("\n"))
+			}
 
 			// Removed Goal Mode handling
 			this.setState(stateNormal)
-			this.ParentInputLoop([]byte{}) // Process any buffered input
+
+			pagerLines := this.Butterfish.Config.ShellPagerLines
+			if pagerLines > 0 && output.Completion != "" &&
+				strings.Count(this.StyleWriter.Render(output.Completion, this.TerminalWidth), "\n") > pagerLines {
+				this.OpenPager()
+			}
+			this.handleInput(nil) // Process any held input
+
+		case <-this.PagerDone:
+			this.pager = nil
+			this.pagerInput = nil
+			this.setState(this.pagerReturnState)
+			if this.bracketedPaste {
+				this.ParentOut.Write([]byte(ESC_BRACKETED_PASTE_ON))
+			}
+
+			if len(childOutBuffer) > 0 {
+				this.ParentOut.Write(childOutBuffer)
+				childOutBuffer = []byte{}
+			}
+			this.handleInput(nil) // Process any held input
 
 		case childOutMsg := <-this.ChildOutReader:
 			if childOutMsg == nil {
@@ -635,17 +1459,34 @@ func (this *ShellState) Mux() {
 				return
 			}
 
-			if this.Butterfish.Config.Verbose > 2 {
-				log.Printf("Child out: %x", string(childOutMsg.Data))
-			}
+			slog.Log(this.Butterfish.Ctx, util.LevelDump, "Child out", "data", childOutMsg.Data)
+			this.trackBracketedPaste(childOutMsg.Data)
 
-			_, prompts, childOutStr := this.ParsePS1(string(childOutMsg.Data))
+			skipOutput := this.skipOutput
+			childOutStr, historyStr, prompts := this.parseChildOutput(string(childOutMsg.Data))
 			this.PromptSuffixCounter += prompts // Still needed to detect prompt end
+			if prompts > 0 {
+				// the excluded command has finished
+				this.skipOutput = false
+			}
 
 			// Removed autosuggest request on new prompt
 
-			// If we're actively printing a response we buffer child output
-			if this.State == statePromptResponse {
+			// If we're getting child output while typing in a shell command, this
+			// could mean the user is paging through old commands, or doing a tab
+			// completion, or something unknown, so we don't want to add to history.
+			if this.State != stateShell && !skipOutput && !this.Incognito && !this.FilterChildOut(string(childOutMsg.Data)) {
+				// Removed ActiveFunction check
+				this.commandScreen.Write([]byte(historyStr))
+			}
+			if prompts > 0 {
+				this.flushCommandOutput()
+				this.refreshContext()
+			}
+
+			// If we're actively printing a response or showing the pager we
+			// buffer child output
+			if this.State == statePromptResponse || this.State == statePager {
 				// Removed Goal Mode check (always buffer if responding)
 				childOutBuffer = append(childOutBuffer, childOutStr...)
 				continue
@@ -653,20 +1494,23 @@ func (this *ShellState) Mux() {
 
 			// Removed Goal Mode function call end detection
 
-			// If we're getting child output while typing in a shell command, this
-			// could mean the user is paging through old commands, or doing a tab
-			// completion, or something unknown, so we don't want to add to history.
-			if this.State != stateShell && !this.FilterChildOut(string(childOutMsg.Data)) {
-				// Removed ActiveFunction check
-				this.History.Append(historyTypeShellOutput, childOutStr)
-			}
-
 			// Removed Tab completion handling for shell output
 
 			this.ParentOut.Write([]byte(childOutStr))
 
 			// Removed Goal Mode function response trigger
 
+		case call := <-this.ControlCalls:
+			this.HandleControl(call)
+
+		case <-this.parentInTimeout:
+			if this.parentIn.Pasting() {
+				log.Printf("The end of a paste didn't come, taking it as typed")
+				this.handleInput(this.parentIn.EndPaste())
+			} else {
+				this.handleInput(this.parentIn.Flush())
+			}
+
 		case parentInMsg := <-this.ParentInReader:
 			if parentInMsg == nil {
 				log.Println("Parent in reader closed")
@@ -680,50 +1524,48 @@ func (this *ShellState) Mux() {
 }
 
 func (this *ShellState) ParentInputLoop(data []byte) {
-	if this.Butterfish.Config.Verbose > 2 {
-		log.Printf("Parent in: %x", data)
-	}
-
-	// include any cached data
-	if len(this.parentInBuffer) > 0 {
-		data = append(this.parentInBuffer, data...)
-		this.parentInBuffer = []byte{}
-	}
-
-	if len(data) == 0 {
-		return
-	}
-
-	// If we've started an ANSI escape sequence, it might not be complete
-	// yet, so we need to cache it and wait for the next message
-	if incompleteAnsiSequence(data) {
-		this.parentInBuffer = append(this.parentInBuffer, data...)
-		return
-	}
+	slog.Log(this.Butterfish.Ctx, util.LevelDump, "Parent in", "data", data)
+	this.handleInput(this.parentIn.Parse(data))
+}
 
+// Handle input events in order. Input that comes while an answer is printing
+// is held until it's done.
+func (this *ShellState) handleInput(events []InputEvent) {
+	this.parentInEvents = append(this.parentInEvents, events...)
 	for {
-		leftover := this.ParentInput(this.Butterfish.Ctx, data)
-
-		if leftover == nil || len(leftover) == 0 {
-			break
+		if this.State != statePromptResponse && len(this.heldInput) > 0 {
+			this.parentInEvents = append(this.heldInput, this.parentInEvents...)
+			this.heldInput = nil
 		}
-		if len(leftover) == len(data) {
-			// nothing was consumed, we buffer and try again later
-			this.parentInBuffer = append(this.parentInBuffer, leftover...)
+		if len(this.parentInEvents) == 0 {
 			break
 		}
-		data = leftover
+
+		event := this.parentInEvents[0]
+		this.parentInEvents = this.parentInEvents[1:]
+		this.ParentInput(this.Butterfish.Ctx, event)
 	}
-}
 
-// Simplified ParentInput
-func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
-	hasCarriageReturn := bytes.Contains(data, []byte{'\r'})
+	// If the input ends in what may be the start of an escape sequence, like
+	// a lone ESC, we wait a moment for the rest before taking it as keys. A
+	// paste gets longer, in case it comes slowly over a remote connection.
+	this.parentInTimeout = nil
+	if this.parentIn.Pending() {
+		this.parentInTimeout = time.After(escapeTimeout)
+	} else if this.parentIn.Pasting() {
+		this.parentInTimeout = time.After(pasteTimeout)
+	}
+}
 
+// Handle a key press or other input event from the terminal
+func (this *ShellState) ParentInput(ctx context.Context, event InputEvent) {
 	switch this.State {
+	case statePager:
+		this.pagerInput.Write(event.Raw)
+
 	case statePromptResponse:
 		// Ctrl-C while receiving prompt
-		if data[0] == 0x03 || data[len(data)-1] == 0x03 {
+		if event.IsCtrl('c') {
 			log.Printf("Canceling prompt response")
 			if this.PromptResponseCancel != nil {
 				this.PromptResponseCancel()
@@ -731,19 +1573,22 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			}
 			// Removed GoalMode = false
 			this.setState(stateNormal)
-			if data[0] == 0x03 {
-				return data[1:]
-			} else {
-				return data[:len(data)-1]
-			}
+			return
 		}
-		// Ignore other input during response
-		return data
+		this.heldInput = append(this.heldInput, event)
 
 	case stateNormal:
 		// Removed HasRunningChildren check (simplification, assume shell is ready)
 
-		if data[0] == 0x03 { // Ctrl-C
+		if this.altScreen || event.Release ||
+			(event.Type != KeyEvent && event.Type != PasteEvent) {
+			// keys are for the full-screen program, not prompts or commands,
+			// and mouse and focus reports are for whoever asked for them
+			this.ChildIn.Write(event.Raw)
+			return
+		}
+
+		if event.IsCtrl('c') {
 			// Removed Goal Mode check
 			if this.Command != nil {
 				this.Command.Clear()
@@ -752,12 +1597,12 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 				this.Prompt.Clear()
 			}
 			this.setState(stateNormal)
-			this.ChildIn.Write([]byte{data[0]})
-			return data[1:]
+			this.ChildIn.Write(event.Raw)
+			return
 		}
 
 		// Handle Ctrl+L (Form Feed / Clear Screen)
-		if data[0] == '\f' { // ASCII 12
+		if event.IsCtrl('l') {
 			// Send ANSI codes to clear screen and move cursor to top-left
 			this.ParentOut.Write([]byte("\x1b[2J\x1b[H"))
 			// Clear internal buffers just in case
@@ -769,41 +1614,54 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			}
 			// Send a newline to the shell to force prompt redraw at the top
 			this.ChildIn.Write([]byte("\n"))
-			// Consume the Ctrl+L character
-			return data[1:]
+			return
+		}
+
+		if event.IsCtrl(']') {
+			this.ToggleIncognito()
+			return
+		}
+
+		// Alt-o, open the last answer in the pager
+		if event.IsAlt('o') && this.OpenPager() {
+			return
+		}
+
+		// Alt-1..9, insert a code block from the last answer
+		if event.Key == KeyRune && event.Mod == ModAlt && event.Rune >= '1' && event.Rune <= '9' {
+			if this.InsertAnswerBlock(int(event.Rune - '0')) {
+				return
+			}
 		}
 
 		// Check if the first character is uppercase
-		if unicode.IsUpper(rune(data[0])) { // Removed '!' check for Goal Mode
+		if event.IsText() && unicode.IsUpper(event.Rune) { // Removed '!' check for Goal Mode
 			this.setState(statePrompting)
 			// Removed ClearAutosuggest
 			this.Prompt.Clear()
-			this.Prompt.Write(string(data))
+			this.Prompt.Write(string(event.Bytes()))
 
 			// Write the actual prompt start
 			color := this.Color.Prompt
 			// Removed Goal Mode color check
 			this.Prompt.SetColor(color)
-			fmt.Fprintf(this.ParentOut, "%s%s", color, data)
+			fmt.Fprintf(this.ParentOut, "%s%s", color, event.Bytes())
 
-			// Get cursor position for prompt buffer
-			_, col := this.GetCursorPosition()
-			this.Prompt.SetPromptLength(col - 1 - this.Prompt.Size())
-			return data[1:]
+			// The prompt starts after the shell's prompt
+			_, col := this.Screen.Cursor()
+			this.Prompt.SetPromptLength(col - this.Prompt.Size())
 
-		} else if data[0] == '\t' { // Tab pressed
+		} else if event.IsKey(KeyTab) { // Tab pressed
 			// Removed autosuggest handling, just forward Tab
-			this.ChildIn.Write([]byte{data[0]})
-			return data[1:]
+			this.ChildIn.Write(event.Raw)
 
-		} else if data[0] == '\r' { // Enter pressed
+		} else if event.IsKey(KeyEnter) { // Enter pressed
 			// Removed ClearAutosuggest
-			this.ChildIn.Write(data)
-			return data[1:]
+			this.ChildIn.Write(event.Raw)
 
 		} else { // Regular shell command character
 			this.Command = NewShellBuffer()
-			this.Command.Write(string(data))
+			this.Command.Write(string(event.Bytes()))
 
 			if this.Command.Size() > 0 {
 				// Removed RefreshAutosuggest
@@ -813,30 +1671,28 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			}
 
 			this.ParentOut.Write([]byte(this.Color.Command))
-			this.ChildIn.Write(data)
-			return nil // Consumed all data
+			this.ChildIn.Write(event.Raw)
 		}
+
 	case statePrompting:
-		if hasCarriageReturn { // Enter pressed during prompt
-			// Removed ClearAutosuggest
-			index := bytes.Index(data, []byte{'\r'})
-			toAdd := data[:index]
-			toPrint := this.Prompt.Write(string(toAdd))
+		if event.Release || (event.Type != KeyEvent && event.Type != PasteEvent) {
+			// not for the prompt
+			return
+		}
 
-			this.ParentOut.Write(toPrint)
+		if event.IsKey(KeyEnter) { // Enter pressed during prompt
+			// Removed ClearAutosuggest
 			this.ParentOut.Write([]byte("\n\r"))
 
 			// Removed HandleLocalPrompt
 			// Removed GoalModeStart/GoalModeChat
 			this.SendPrompt() // Always send prompt now
-			return data[index+1:]
 
-		} else if data[0] == '\t' { // Tab pressed during prompt
+		} else if event.IsKey(KeyTab) { // Tab pressed during prompt
 			// Removed autosuggest handling, just echo Tab (or ignore?) - let's echo
-			this.ParentOut.Write(data)
-			return data[1:]
+			this.ParentOut.Write(event.Bytes())
 
-		} else if data[0] == 0x03 { // Ctrl-C during prompt
+		} else if event.IsCtrl('c') { // Ctrl-C during prompt
 			if this.PromptResponseCancel != nil {
 				this.PromptResponseCancel()
 				this.PromptResponseCancel = nil
@@ -846,19 +1702,24 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			this.ParentOut.Write(toPrint)
 			this.ParentOut.Write([]byte(this.Color.Command))
 			this.setState(stateNormal)
-			return data[1:]
 
-		} else if data[0] == '\f' { // Ctrl+L during prompt
+		} else if event.IsCtrl('p') { // Ctrl+P during prompt, preview the request
+			this.PreviewPrompt()
+
+		} else if event.IsCtrl('l') { // Ctrl+L during prompt
 			// Send ANSI codes to clear screen and move cursor to top-left
 			this.ParentOut.Write([]byte("\x1b[2J\x1b[H"))
 			// Redraw the prompt and current input
 			this.ParentOut.Write([]byte(this.Color.Prompt))
 			this.ParentOut.Write([]byte(this.Prompt.String()))
-			// Consume the Ctrl+L character
-			return data[1:]
 
 		} else { // Typing prompt character
-			toPrint := this.Prompt.Write(string(data))
+			text := string(event.Bytes())
+			if event.Type == PasteEvent {
+				// the prompt is a single line
+				text = strings.Join(strings.Fields(text), " ")
+			}
+			toPrint := this.Prompt.Write(text)
 			// Removed RefreshAutosuggest
 			this.ParentOut.Write(toPrint)
 
@@ -866,43 +1727,82 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 				this.ParentOut.Write([]byte(this.Color.Command)) // reset color
 				this.setState(stateNormal)
 			}
-			return nil // Consumed all data
 		}
 
 	case stateShell:
-		if hasCarriageReturn { // Enter pressed during shell command
+		if event.Release || (event.Type != KeyEvent && event.Type != PasteEvent) {
+			this.ChildIn.Write(event.Raw)
+			return
+		}
+
+		if event.IsKey(KeyEnter) { // Enter pressed during shell command
 			// Removed ClearAutosuggest
 			this.setState(stateNormal)
 
-			index := bytes.Index(data, []byte{'\r'})
-			this.ChildIn.Write(data[:index+1])
-			this.History.Append(historyTypeShellInput, this.Command.String())
+			command := this.Command.String()
 			this.Command = NewShellBuffer()
 
-			// Removed AutosuggestCancel
+			if strings.TrimSpace(command) == "/incognito" {
+				// clear the command from the shell's line and get a new prompt
+				this.ChildIn.Write([]byte{0x15})
+				this.ToggleIncognito()
+				return
+			}
+
+			if strings.TrimSpace(command) == "/screen" {
+				this.ChildIn.Write([]byte{0x15})
+				this.SendScreen()
+				return
+			}
+
+			if fields := strings.Fields(command); len(fields) > 0 && fields[0] == "/copy" {
+				this.ChildIn.Write([]byte{0x15})
+				this.CopyAnswerBlock(fields[1:])
+				return
+			}
+
+			if fields := strings.Fields(command); len(fields) > 0 && fields[0] == "/export" {
+				this.ChildIn.Write([]byte{0x15})
+				this.ExportSession(fields[1:])
+				return
+			}
 
-			return data[index+1:]
+			this.ChildIn.Write(event.Raw)
+			this.recordMarker("$ " + command)
+			this.lastCommand = command
+			this.fullScreenRecorded = false
+			if ExcludeFromHistory(command, this.Butterfish.Config.ShellHistoryDenylist) {
+				// leave out the command and everything it prints
+				this.skipOutput = true
+			} else {
+				// end each command with a newline so commands run one after
+				// another without output stay on separate lines
+				this.appendHistory(historyTypeShellInput, command+"\n")
+			}
+
+			// Removed AutosuggestCancel
 
-		} else if data[0] == 0x03 { // Ctrl-C during shell command
+		} else if event.IsCtrl('c') { // Ctrl-C during shell command
 			this.Command.Clear()
 			this.setState(stateNormal)
-			this.ChildIn.Write([]byte{data[0]})
+			this.ChildIn.Write(event.Raw)
 			// Removed AutosuggestCancel
-			return data[1:]
 
-		} else if data[0] == '\t' { // Tab pressed during shell command
+		} else if event.IsAlt('o') && this.OpenPager() {
+			// Alt-o, open the last answer in the pager, the command line is
+			// left as it was
+
+		} else if event.IsKey(KeyTab) { // Tab pressed during shell command
 			// Removed autosuggest handling, just forward Tab
-			this.ChildIn.Write([]byte{data[0]})
-			return data[1:]
+			this.ChildIn.Write(event.Raw)
 
 		} else { // Typing shell command character
-			this.Command.Write(string(data))
+			this.Command.Write(string(event.Bytes()))
 			// Removed RefreshAutosuggest
-			this.ChildIn.Write(data)
+			this.ChildIn.Write(event.Raw)
 			if this.Command.Size() == 0 {
 				this.setState(stateNormal)
 			}
-			return nil // Consumed all data
 		}
 
 	default:
@@ -915,14 +1815,27 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 // Removed GoalModeStart, GoalModeChat, GoalModeFunctionResponse, GoalModeFunction, goalModePrompt
 
 // Simplified AssembleChat - removed functions parameter
-func (this *ShellState) AssembleChat(prompt, sysMsg string, reserveForAnswer int) (string, []util.HistoryBlock, error) {
+func (this *ShellState) AssembleChat(prompt, attachment, sysMsg string, reserveForAnswer int) (string, []util.HistoryBlock, error) {
 	totalTokens := this.PromptMaxTokens
 	maxPromptTokens := 512
 	maxHistoryBlockTokens := this.Butterfish.Config.ShellMaxHistoryBlockTokens
 	maxCombinedPromptTokens := totalTokens - reserveForAnswer
 
+	// the screen from /screen and piped input are like a command's output so
+	// they each get the same budget on top of the prompt's, keeping the end
+	// where errors usually are
+	encoder := this.getPromptEncoder()
+	withAttachments := PromptWithScreen(prompt,
+		truncateStart(this.pendingScreen, encoder, maxHistoryBlockTokens))
+	withAttachments = PromptWithAttachment(withAttachments,
+		truncateStart(attachment, encoder, maxHistoryBlockTokens))
+	if withAttachments != prompt {
+		maxPromptTokens += len(encoder.Encode(withAttachments[len(prompt):], nil, nil))
+		prompt = withAttachments
+	}
+
 	return assembleChat(prompt, sysMsg, "", this.History, // Pass empty string for functions
-		this.Butterfish.Config.ShellPromptModel, this.getPromptEncoder(),
+		this.PromptModel, this.getPromptEncoder(),
 		maxPromptTokens, maxHistoryBlockTokens, maxCombinedPromptTokens)
 }
 
@@ -978,6 +1891,18 @@ func assembleChat(
 	return prompt, blocks, nil
 }
 
+var outputNoteRegex = regexp.MustCompile(`(?m)^(\[exit code \d+\]|ran .* \(full-screen\))\r?$`)
+
+// Command output isn't sent to the LLM, only what we noted about it: that a
+// command failed, or ran full-screen
+func outputNotes(output string) string {
+	notes := []string{}
+	for _, match := range outputNoteRegex.FindAllStringSubmatch(output, -1) {
+		notes = append(notes, match[1])
+	}
+	return strings.Join(notes, "\n")
+}
+
 // Simplified getHistoryBlocksByTokens - removed function call handling
 func getHistoryBlocksByTokens(
 	history *ShellHistory,
@@ -991,12 +1916,6 @@ func getHistoryBlocksByTokens(
 	usedTokens := 0
 
 	history.IterateBlocks(func(block *HistoryBuffer) bool {
-		// --- Filter out shell command output ---
-		if block.Type == historyTypeShellOutput {
-			return true // Skip shell output blocks
-		}
-		// --- End Filter ---
-
 		if block.Content.Size() == 0 { // Removed FunctionName check
 			return true // empty block, skip
 		}
@@ -1014,14 +1933,20 @@ func getHistoryBlocksByTokens(
 
 		if !ok { // cache miss
 			contentStr := block.Content.String()
+			if block.Type == historyTypeShellOutput {
+				contentStr = outputNotes(contentStr)
+			}
 			ceiling := maxHistoryBlockTokens * 4
-			if contentLen > ceiling {
+			if len(contentStr) > ceiling {
 				contentStr = contentStr[:ceiling]
 			}
 			historyContent := sanitizeTTYString(contentStr)
 			contentTokens, content, _ = countAndTruncate(historyContent, encoder, maxHistoryBlockTokens)
 			block.SetTokenization(encoder.EncoderName(), contentLen, contentTokens, content)
 		}
+		if content == "" {
+			return true // output with nothing noted about it
+		}
 		msgTokens += contentTokens
 
 		if usedTokens+msgTokens > maxTokens {
@@ -1044,47 +1969,419 @@ func getHistoryBlocksByTokens(
 
 // Simplified SendPrompt
 func (this *ShellState) SendPrompt() {
+	this.sendPrompt(this.Prompt.String(), "")
+	this.Prompt.Clear()
+}
+
+// Send a prompt, with input piped to butterfish ask as an attachment if
+// there is any
+func (this *ShellState) sendPrompt(prompt, attachment string) {
 	this.setState(statePromptResponse)
+	// a command may still be running, what it printed so far goes first
+	this.flushCommandOutput()
 
 	requestCtx, cancel := context.WithCancel(context.Background())
 	this.PromptResponseCancel = cancel
 
-	sysMsg, err := this.Butterfish.PromptLibrary.GetPrompt(
-		prompt.ShellSystemMessage, "sysinfo", GetSystemInfo())
+	request, err := this.PromptRequest(requestCtx, prompt, attachment)
 	if err != nil {
-		msg := fmt.Errorf("Could not retrieve prompting system message: %s", err)
-		this.PrintError(msg)
+		this.finishControlPrompt("", err)
+		this.PrintError(err)
+		return
+	}
+
+	this.appendHistory(historyTypePrompt,
+		PromptWithAttachment(PromptWithScreen(prompt, this.pendingScreen), attachment))
+	this.pendingScreen = ""
+	this.recordMarker("> " + prompt)
+	this.lastPrompt = prompt
+
+	var client LLM = this.Butterfish.LLMClient
+	if this.controlPrompt != nil {
+		client = this.controlPrompt
+	}
+	go CompletionRoutine(request, client,
+		this.PromptAnswerWriter, this.PromptOutputChan,
+		this.Color.Answer, this.Color.Error, this.StyleWriter)
+}
+
+// Collect the context sections in the background, so they're ready for the
+// next prompt
+func (this *ShellState) refreshContext() {
+	if this.Context == nil || len(this.Context.Providers) == 0 {
 		return
 	}
+	this.Context.Refresh(this.Butterfish.Ctx, this.Cwd(), this.getPromptEncoder(),
+		this.Butterfish.Config.ShellContextTokens)
+}
+
+// Build the request for a prompt: the system message with context and
+// project sections, the history that fits in the token budget, and secrets
+// redacted. Shared by shell mode and the console.
+func (this *ShellState) PromptRequest(ctx context.Context, promptStr, attachment string) (*util.CompletionRequest, error) {
+	this.UpdateProject()
+	ctx = WithAuditCwd(ctx, this.Cwd())
+
+	sysMsg, _, err := this.SystemMessage()
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve prompting system message: %s", err)
+	}
 
-	promptStr := this.Prompt.String()
 	tokensReservedForAnswer := this.Butterfish.Config.ShellMaxResponseTokens
-	promptStr, historyBlocks, err := this.AssembleChat(promptStr, sysMsg, tokensReservedForAnswer)
+	promptStr, historyBlocks, err := this.AssembleChat(promptStr, attachment, sysMsg, tokensReservedForAnswer)
 	if err != nil {
-		this.PrintError(err)
-		return
+		return nil, err
+	}
+
+	if this.Butterfish.Redactor != nil {
+		counts := this.Butterfish.Redactor.RedactRequest(&sysMsg, &promptStr, historyBlocks)
+		if len(counts) > 0 {
+			log.Printf("Redacted secrets from request: %s", RedactionSummary(counts))
+		}
 	}
 
-	request := &util.CompletionRequest{
-		Ctx:           requestCtx,
+	return &util.CompletionRequest{
+		Ctx:           ctx,
 		Prompt:        promptStr,
-		Model:         this.Butterfish.Config.ShellPromptModel,
+		Model:         this.PromptModel,
 		MaxTokens:     tokensReservedForAnswer,
 		Temperature:   0.7,
 		HistoryBlocks: historyBlocks,
 		SystemMessage: sysMsg,
-		Verbose:       this.Butterfish.Config.Verbose > 0,
+		Verbose:       util.LogEnabled(slog.LevelDebug),
 		TokenTimeout:  this.Butterfish.Config.TokenTimeout,
 		// Removed Functions
+	}, nil
+}
+
+// The working directory of the wrapped shell, falls back to our own cwd if
+// it can't be determined.
+func (this *ShellState) Cwd() string {
+	if this.cwd != "" {
+		return this.cwd
 	}
 
-	this.History.Append(historyTypePrompt, this.Prompt.String())
+	// The shell hasn't reported a directory, e.g. it's one we can't set the
+	// PS1 for, so ask the OS instead
+	cwd := GetProcessCwd(this.Butterfish.ShellPid)
+	if cwd == "" {
+		cwd, _ = os.Getwd()
+	}
+	return cwd
+}
 
-	go CompletionRoutine(request, this.Butterfish.LLMClient,
-		this.PromptAnswerWriter, this.PromptOutputChan,
-		this.Color.Answer, this.Color.Error, this.StyleWriter)
+// Check whether the shell has moved into a different project, or the project
+// files have been edited, and reload the project config if so.
+func (this *ShellState) UpdateProject() {
+	changed, err := this.Project.Update(this.Cwd())
+	if err != nil {
+		log.Printf("Error loading project config: %s", err)
+		fmt.Fprintf(this.ParentOut, "%sError loading project config: %s\r\n", this.Color.Error, err)
+	}
+	if !changed {
+		return
+	}
 
-	this.Prompt.Clear()
+	project := this.Project.Current
+	if project != nil {
+		log.Printf("Loaded project config at %s", project.Root)
+		for _, warning := range project.Warnings {
+			log.Print(warning)
+			fmt.Fprintf(this.ParentOut, "%s%s\r\n", this.Color.Error, warning)
+		}
+	} else {
+		log.Printf("Left project, using global config")
+	}
+
+	this.applyProjectSettings(project)
+}
+
+// Apply a project's settings on top of the config butterfish was started
+// with, or restore that config if project is nil. Settings given by a flag
+// or env var aren't overridden.
+func (this *ShellState) applyProjectSettings(project *ProjectConfig) {
+	config := this.Butterfish.Config
+	if this.baseConfig == nil {
+		base := *config
+		this.baseConfig = &base
+	}
+	base := this.baseConfig
+
+	settings := map[string]interface{}{}
+	if project != nil {
+		for key, value := range project.Settings {
+			settings[key] = value
+		}
+		if project.Model != "" {
+			settings["model"] = project.Model
+		}
+	}
+	for key := range config.PinnedSettings {
+		delete(settings, key)
+	}
+
+	for _, setting := range []struct {
+		key   string
+		value *int
+		base  int
+	}{
+		{"max_prompt_tokens", &config.ShellMaxPromptTokens, base.ShellMaxPromptTokens},
+		{"max_history_block_tokens", &config.ShellMaxHistoryBlockTokens, base.ShellMaxHistoryBlockTokens},
+		{"max_response_tokens", &config.ShellMaxResponseTokens, base.ShellMaxResponseTokens},
+		{"context_tokens", &config.ShellContextTokens, base.ShellContextTokens},
+		{"pager_lines", &config.ShellPagerLines, base.ShellPagerLines},
+	} {
+		*setting.value = setting.base
+		if value, ok := settings[setting.key].(int); ok {
+			*setting.value = value
+		}
+	}
+
+	contextNames := base.ShellContextProviders
+	if value, ok := settings["context"].([]string); ok {
+		contextNames = value
+	}
+	if !slices.Equal(contextNames, config.ShellContextProviders) {
+		providers, err := NewContextProviders(contextNames, config.ShellContextEnv)
+		if err != nil {
+			fmt.Fprintf(this.ParentOut, "%sError in project context providers: %s\r\n", this.Color.Error, err)
+		} else {
+			config.ShellContextProviders = contextNames
+			this.Butterfish.ContextProviders = providers
+			this.Context = NewContextCache(providers)
+		}
+	}
+
+	theme := base.Theme
+	if name, ok := settings["theme"].(string); ok {
+		resolved, err := ResolveTheme(name, &LayeredConfig{User: config.UserConfig, Project: project.file})
+		if err != nil {
+			fmt.Fprintf(this.ParentOut, "%s%s\r\n", this.Color.Error, err)
+		} else {
+			theme = resolved
+		}
+	}
+	if theme != config.Theme {
+		config.Theme = theme
+		this.applyTheme()
+	}
+
+	model := base.ShellPromptModel
+	if value, ok := settings["model"].(string); ok {
+		model = value
+	}
+	this.SetPromptModel(model)
+}
+
+// Recolor the shell's output for the configured theme
+func (this *ShellState) applyTheme() {
+	theme, colorScheme := this.Butterfish.shellTheme()
+	if this.Color != nil {
+		*this.Color = *colorScheme
+	}
+	if this.Prompt != nil {
+		this.Prompt.SetColor(colorScheme.Prompt)
+	}
+	if this.StyleWriter != nil {
+		this.StyleWriter.SetColors(colorScheme.Answer, colorScheme.AnswerHighlight, theme.CodeStyle)
+	}
+}
+
+// Switch the model used for prompts, updating the token limits and encoder
+func (this *ShellState) SetPromptModel(model string) {
+	if model != this.PromptModel {
+		log.Printf("Switching prompt model from %s to %s", this.PromptModel, model)
+		this.PromptModel = model
+		this.PromptEncoder = nil
+	}
+	this.PromptMaxTokens = min(
+		NumTokensForModel(model),
+		this.Butterfish.Config.ShellMaxPromptTokens)
+}
+
+// Fetch a prompt from the library, adding the shell's location as {cwd}.
+// Fields the prompt doesn't use are dropped so that custom prompts written
+// before a field existed still work.
+func (this *ShellState) GetShellPrompt(name string, args ...string) (string, error) {
+	library := this.Butterfish.PromptLibrary
+	uninterpolated, err := library.GetUninterpolatedPrompt(name)
+	if err != nil {
+		return "", err
+	}
+
+	args = append(args, "cwd", this.DisplayCwd())
+	used := []string{}
+	for i := 0; i+1 < len(args); i += 2 {
+		if strings.Contains(uninterpolated, "{"+args[i]+"}") {
+			used = append(used, args[i], args[i+1])
+		}
+	}
+
+	return library.InterpolatePrompt(uninterpolated, used...)
+}
+
+// The working directory with the home directory abbreviated to ~
+func (this *ShellState) DisplayCwd() string {
+	cwd := this.Cwd()
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return cwd
+	}
+	if cwd == home {
+		return "~"
+	}
+	if strings.HasPrefix(cwd, home+string(os.PathSeparator)) {
+		return "~" + cwd[len(home):]
+	}
+	return cwd
+}
+
+// Build the system message, adding the enabled context provider sections,
+// and the current project's instructions and pinned context files if we're
+// inside a project. Returns the message and the sections it includes.
+func (this *ShellState) SystemMessage() (string, []ContextSection, error) {
+	sysMsg, err := this.GetShellPrompt(prompt.ShellSystemMessage,
+		"sysinfo", GetSystemInfo())
+	if err != nil {
+		return "", nil, err
+	}
+
+	sections, ok := this.Context.Sections(this.Cwd())
+	if !ok {
+		// nothing collected here yet, the next prompt will have them
+		this.refreshContext()
+	}
+	if len(sections) > 0 {
+		rendered := []string{}
+		for _, section := range sections {
+			rendered = append(rendered, section.String())
+		}
+
+		contextMsg, err := this.GetShellPrompt(prompt.ShellContextMessage,
+			"context", strings.Join(rendered, "\n\n"))
+		if err != nil {
+			return "", nil, err
+		}
+		sysMsg += "\n\n" + contextMsg
+	}
+
+	project := this.Project.Current
+	if project == nil {
+		return sysMsg, sections, nil
+	}
+
+	projectMsg, err := this.GetShellPrompt(prompt.ShellProjectMessage,
+		"root", project.Root,
+		"context", this.projectContext(project))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return sysMsg + "\n\n" + projectMsg, sections, nil
+}
+
+// Print a breakdown of what would be sent if the current prompt were
+// submitted, with the token cost of each part, without sending it.
+func (this *ShellState) PreviewPrompt() {
+	this.UpdateProject()
+
+	sysMsg, sections, err := this.SystemMessage()
+	if err != nil {
+		this.PrintError(fmt.Errorf("Could not retrieve prompting system message: %s", err))
+		return
+	}
+
+	reserved := this.Butterfish.Config.ShellMaxResponseTokens
+	promptStr, historyBlocks, err := this.AssembleChat(this.Prompt.String(), "", sysMsg, reserved)
+	if err != nil {
+		this.PrintError(err)
+		return
+	}
+
+	redacted := map[string]int{}
+	if this.Butterfish.Redactor != nil {
+		redacted = this.Butterfish.Redactor.RedactRequest(&sysMsg, &promptStr, historyBlocks)
+	}
+
+	encoder := this.getPromptEncoder()
+	count := func(s string) int {
+		return len(encoder.Encode(s, nil, nil))
+	}
+
+	historyTokens := 0
+	for _, block := range historyBlocks {
+		historyTokens += count(block.Content)
+	}
+
+	contextTokens := 0
+	lines := []string{}
+	for _, section := range sections {
+		contextTokens += section.Tokens
+		line := fmt.Sprintf("  context %-12s %6d tokens", section.Name, section.Tokens)
+		if section.Truncated {
+			line += " (truncated)"
+		}
+		lines = append(lines, line)
+	}
+
+	promptTokens := count(promptStr)
+	systemTokens := count(sysMsg)
+	total := systemTokens + historyTokens + promptTokens
+
+	out := []string{
+		fmt.Sprintf("Request preview: model %s, %d of %d prompt tokens used, %d reserved for the answer",
+			this.PromptModel, total, this.PromptMaxTokens, reserved),
+		fmt.Sprintf("  system message       %6d tokens (%d from context)", systemTokens, contextTokens),
+	}
+	out = append(out, lines...)
+	out = append(out,
+		fmt.Sprintf("  history              %6d tokens in %d blocks", historyTokens, len(historyBlocks)),
+		fmt.Sprintf("  prompt               %6d tokens", promptTokens))
+	if this.Incognito {
+		out = append(out, "  incognito, this prompt and its answer won't be added to history")
+	}
+	if this.Butterfish.Redactor == nil {
+		out = append(out, "  redaction disabled")
+	} else {
+		out = append(out, fmt.Sprintf("  redacted secrets     %s", RedactionSummary(redacted)))
+	}
+
+	fmt.Fprintf(this.ParentOut, "\r\n%s%s\r\n", this.Color.Command, strings.Join(out, "\r\n"))
+
+	// redraw the prompt being edited
+	this.ParentOut.Write([]byte(this.Color.Prompt))
+	this.ParentOut.Write([]byte(this.Prompt.String()))
+}
+
+// Render the project instructions and context files, each file is truncated
+// to the history block token limit.
+func (this *ShellState) projectContext(project *ProjectConfig) string {
+	builder := strings.Builder{}
+	if project.Instructions != "" {
+		builder.WriteString(project.Instructions)
+		builder.WriteString("\n")
+	}
+
+	encoder := this.getPromptEncoder()
+	maxTokens := this.Butterfish.Config.ShellMaxHistoryBlockTokens
+
+	for _, path := range project.ContextFilePaths() {
+		relPath := strings.TrimPrefix(path, project.Root+string(os.PathSeparator))
+		content, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Error reading project context file: %s", err)
+			fmt.Fprintf(&builder, "\nFile %s: (could not be read)\n", relPath)
+			continue
+		}
+
+		_, truncated, wasTruncated := countAndTruncate(string(content), encoder, maxTokens)
+		if wasTruncated {
+			truncated += "\n(truncated)"
+		}
+		fmt.Fprintf(&builder, "\nFile %s:\n```\n%s\n```\n", relPath, truncated)
+	}
+
+	return builder.String()
 }
 
 // Simplified CompletionRoutine - removed goal mode color logic
@@ -1095,7 +2392,7 @@ func CompletionRoutine(
 	outputChan chan *util.CompletionResponse,
 	normalColor,
 	errorColor string,
-	styleWriter *util.StyleCodeblocksWriter,
+	styleWriter *util.MarkdownWriter,
 ) {
 	writer.Write([]byte(normalColor))
 	output, err := client.CompletionStream(request, writer)
@@ -1125,7 +2422,7 @@ func CompletionRoutine(
 
 func (this *ShellState) getPromptEncoder() *tiktoken.Tiktoken {
 	if this.PromptEncoder == nil {
-		modelName := this.Butterfish.Config.ShellPromptModel
+		modelName := this.PromptModel
 		encoder, err := tiktoken.EncodingForModel(modelName)
 		if err != nil {
 			log.Printf("Warning: Error getting encoder for prompt model %s: %s", modelName, err)
@@ -1157,4 +2454,30 @@ func countAndTruncate(data string,
 	return len(tokens), data, truncated
 }
 
+// Keep the last maxTokens of data, noting that the start was left out
+func truncateStart(data string, encoder *tiktoken.Tiktoken, maxTokens int) string {
+	tokens := encoder.Encode(data, nil, nil)
+	if len(tokens) <= maxTokens {
+		return data
+	}
+	return "[... earlier input omitted ...]\n" + encoder.Decode(tokens[len(tokens)-maxTokens:])
+}
+
+// A prompt with the input piped to butterfish ask, which follows the question
+// in a code block
+func PromptWithAttachment(prompt, attachment string) string {
+	if attachment == "" {
+		return prompt
+	}
+	return prompt + "\n\nPiped input:\n" + strings.TrimRight(codeBlock(attachment, ""), "\n")
+}
+
+// A prompt with the screen captured by /screen
+func PromptWithScreen(prompt, screen string) string {
+	if screen == "" {
+		return prompt
+	}
+	return prompt + "\n\nTerminal screen:\n" + strings.TrimRight(codeBlock(screen, ""), "\n")
+}
+
 // Removed countChildPids and HasRunningChildren (simplifying state management)
@@ -0,0 +1,298 @@
+package butterfish
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// To follow what the wrapped shell is doing we wrap its prompt in markers:
+// PROMPT_PREFIX, an OSC 7 sequence reporting the working directory, the
+// shell's own prompt, the prompt icon, the exit code of the last command, and
+// PROMPT_SUFFIX. ParsePS1 then finds the prompts in the shell's output. How
+// the prompt is wrapped depends on the shell, the integration is selected by
+// the name of the shell binary.
+//
+// For bash and zsh we go further and install hooks from the shell's startup
+// files, see ShellHookIntegration.
+
+type ShellIntegration interface {
+	Name() string
+	// The command typed into the shell at startup to wrap its prompt, or ""
+	// if we can't and leave the prompt alone
+	PromptCommand(icon string) string
+}
+
+// Integrations that install hooks when the shell starts instead of having
+// PromptCommand typed in. The hooks wrap the prompt again before each prompt
+// if it was replaced, so prompt themes like starship or powerlevel10k that
+// set PS1 every time don't break prompt detection, and they emit OSC 133
+// marks around the prompt and each command, see ParseOSC133.
+type ShellHookIntegration interface {
+	ShellIntegration
+	// Write the startup files to dir, returns the arguments and environment
+	// variables to start the shell with
+	InstallHooks(dir, icon string) ([]string, []string, error)
+}
+
+func GetShellIntegration(shell string) ShellIntegration {
+	switch shell {
+	case "bash":
+		return bashIntegration{}
+	case "zsh":
+		return zshIntegration{}
+	case "fish":
+		return fishIntegration{}
+	case "nu":
+		return nuIntegration{}
+	case "csh", "tcsh", "xonsh", "elvish", "pwsh", "powershell":
+		return noIntegration{shell}
+	default:
+		// sh, dash, ksh, etc
+		return posixIntegration{shell}
+	}
+}
+
+func (this *ButterfishConfig) ShellIntegration() ShellIntegration {
+	return GetShellIntegration(this.ParseShell())
+}
+
+// The icon shown at the end of the shell's prompt, none if we leave the
+// prompt alone
+func (this *ButterfishConfig) PromptIcon() string {
+	if this.ShellLeavePromptAlone {
+		return ""
+	}
+	return EMOJI_DEFAULT
+}
+
+type bashIntegration struct{}
+
+func (bashIntegration) Name() string { return "bash" }
+
+// \[ \] mark the non-printing parts so readline knows the prompt's width
+func (bashIntegration) PromptCommand(icon string) string {
+	return fmt.Sprintf("PS1=$'\\[%s\\e]7;file://$PWD\\a\\]'$PS1$'%s\\[ $?%s\\] '\n",
+		PROMPT_PREFIX_ESCAPED, icon, PROMPT_SUFFIX_ESCAPED)
+}
+
+// bash reads the rcfile instead of ~/.bashrc, so we read that first. The
+// precmd hook goes at the start of PROMPT_COMMAND to see the exit code, and
+// the hook that wraps PS1 at the end, after anything else that sets it. PS0
+// is printed when a command starts, it needs bash 4.4.
+const bashHooks = `# Butterfish shell integration, read by bash instead of ~/.bashrc
+if [ -f ~/.bashrc ]; then
+  . ~/.bashrc
+fi
+
+__butterfish_started=
+__butterfish_precmd() {
+  local status=$?
+  if [ -n "$__butterfish_started" ]; then
+    printf '\033]133;D;%s\007' "$status"
+  fi
+  __butterfish_started=1
+  printf '\033]133;A\007'
+  return $status
+}
+
+__butterfish_prompt() {
+  local status=$?
+  case "$PS1" in
+    *$'\033]133;B'*) ;;
+    *) PS1=$'\\[\033Q\033]7;file://$PWD\007\\]'"$PS1"$'{{icon}}\\[ $?\033R\033]133;B\007\\] ' ;;
+  esac
+  return $status
+}
+
+case "$PS0" in
+  *$'\033]133;C'*) ;;
+  *) PS0="$PS0"$'\033]133;C\007' ;;
+esac
+
+if [[ "$(declare -p PROMPT_COMMAND 2>/dev/null)" == "declare -a"* ]]; then
+  PROMPT_COMMAND=(__butterfish_precmd "${PROMPT_COMMAND[@]}" __butterfish_prompt)
+else
+  PROMPT_COMMAND="__butterfish_precmd"$'\n'"$PROMPT_COMMAND"$'\n'"__butterfish_prompt"
+fi
+`
+
+func (bashIntegration) InstallHooks(dir, icon string) ([]string, []string, error) {
+	path := filepath.Join(dir, "bashrc")
+	err := os.WriteFile(path, []byte(strings.ReplaceAll(bashHooks, "{{icon}}", icon)), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []string{"--rcfile", path}, nil, nil
+}
+
+type zshIntegration struct{}
+
+func (zshIntegration) Name() string { return "zsh" }
+
+// %{ %} mark the non-printing parts, %d is the directory and %? the exit code
+func (zshIntegration) PromptCommand(icon string) string {
+	return fmt.Sprintf("PS1=$'%%{%s\\e]7;file://%%d\\a%%}'$PS1$'%s%%{ %%?%s%%} '\n",
+		PROMPT_PREFIX_ESCAPED, icon, PROMPT_SUFFIX_ESCAPED)
+}
+
+// zsh reads its startup files from ZDOTDIR, which we point at our
+// directory. Ours load the user's from their own ZDOTDIR, passed in
+// BUTTERFISH_ZDOTDIR, and .zshrc then installs the hooks and restores
+// ZDOTDIR so that .zlogin and any zsh started later use the user's files.
+var zshHooks = map[string]string{
+	".zshenv": `# Butterfish shell integration
+__butterfish_dir=$ZDOTDIR
+__butterfish_zdotdir_set=${BUTTERFISH_ZDOTDIR+1}
+ZDOTDIR=${BUTTERFISH_ZDOTDIR:-$HOME}
+[[ -f $ZDOTDIR/.zshenv ]] && source $ZDOTDIR/.zshenv
+BUTTERFISH_ZDOTDIR=$ZDOTDIR
+ZDOTDIR=$__butterfish_dir
+`,
+	".zprofile": `# Butterfish shell integration
+ZDOTDIR=$BUTTERFISH_ZDOTDIR
+[[ -f $ZDOTDIR/.zprofile ]] && source $ZDOTDIR/.zprofile
+BUTTERFISH_ZDOTDIR=$ZDOTDIR
+ZDOTDIR=$__butterfish_dir
+`,
+	".zshrc": `# Butterfish shell integration
+ZDOTDIR=$BUTTERFISH_ZDOTDIR
+[[ -f $ZDOTDIR/.zshrc ]] && source $ZDOTDIR/.zshrc
+if [[ -z $__butterfish_zdotdir_set && $ZDOTDIR == $HOME ]]; then
+  unset ZDOTDIR
+else
+  export ZDOTDIR
+fi
+unset BUTTERFISH_ZDOTDIR __butterfish_dir __butterfish_zdotdir_set
+
+__butterfish_running=
+__butterfish_precmd() {
+  local exit_status=$?
+  if [[ -n $__butterfish_running ]]; then
+    printf '\e]133;D;%s\a' $exit_status
+    __butterfish_running=
+  fi
+  printf '\e]133;A\a'
+  if [[ $PS1 != *$'\e]133;B'* ]]; then
+    PS1=$'%{\033Q\e]7;file://%d\a%}'$PS1$'{{icon}}%{ %?\033R\e]133;B\a%} '
+  fi
+  return $exit_status
+}
+
+__butterfish_preexec() {
+  __butterfish_running=1
+  printf '\e]133;C\a'
+}
+
+autoload -Uz add-zsh-hook
+add-zsh-hook precmd __butterfish_precmd
+add-zsh-hook preexec __butterfish_preexec
+`,
+}
+
+func (zshIntegration) InstallHooks(dir, icon string) ([]string, []string, error) {
+	for name, script := range zshHooks {
+		err := os.WriteFile(filepath.Join(dir, name),
+			[]byte(strings.ReplaceAll(script, "{{icon}}", icon)), 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	env := []string{"ZDOTDIR=" + dir}
+	if zdotdir, ok := os.LookupEnv("ZDOTDIR"); ok {
+		env = append(env, "BUTTERFISH_ZDOTDIR="+zdotdir)
+	}
+	return nil, env, nil
+}
+
+type fishIntegration struct{}
+
+func (fishIntegration) Name() string { return "fish" }
+
+// fish builds its prompt with the fish_prompt function, so we copy it to
+// __butterfish_prompt and define a fish_prompt that wraps it. The exit code
+// is restored before calling the original so it can show it too.
+func (fishIntegration) PromptCommand(icon string) string {
+	return fmt.Sprintf("function __butterfish_status; return $argv[1]; end; "+
+		"functions -q __butterfish_prompt; or functions -c fish_prompt __butterfish_prompt; "+
+		"function fish_prompt; set -l butterfish_status $status; "+
+		"printf '%s\\033]7;file://%%s\\007' $PWD; "+
+		"__butterfish_status $butterfish_status; __butterfish_prompt; "+
+		"printf '%s %%s%s ' $butterfish_status; end\n",
+		PROMPT_PREFIX_ESCAPED, icon, PROMPT_SUFFIX_ESCAPED)
+}
+
+type nuIntegration struct{}
+
+func (nuIntegration) Name() string { return "nu" }
+
+// nushell's prompt is $env.PROMPT_COMMAND, a closure or a string, which we
+// keep in $env.__butterfish_prompt and wrap. nushell strings have no octal
+// escapes so the markers are written with \e, and OSC 7 is ended with ST.
+func (nuIntegration) PromptCommand(icon string) string {
+	prefix := strings.ReplaceAll(PROMPT_PREFIX, "\033", "\\e")
+	suffix := strings.ReplaceAll(PROMPT_SUFFIX, "\033", "\\e")
+
+	return fmt.Sprintf("$env.__butterfish_prompt = ($env.PROMPT_COMMAND? | default ''); "+
+		"$env.PROMPT_COMMAND = {|| "+
+		"let status = $env.LAST_EXIT_CODE; "+
+		"let prompt = if ($env.__butterfish_prompt | describe | str starts-with 'closure') { do $env.__butterfish_prompt } else { $env.__butterfish_prompt }; "+
+		"$\"%s\\e]7;file://($env.PWD)\\e\\\\($prompt)%s ($status)%s \" }\n",
+		prefix, icon, suffix)
+}
+
+type posixIntegration struct {
+	shell string
+}
+
+func (this posixIntegration) Name() string { return this.shell }
+
+// A generic PS1 for sh compatible shells, which expand parameters in PS1 but
+// may not understand bash's $'...' quoting, so the escapes are made with
+// printf
+func (posixIntegration) PromptCommand(icon string) string {
+	return fmt.Sprintf(`PS1="$(printf '%s\033]7;file://')"'$PWD'"$(printf '\007')$PS1%s "'$?'"$(printf '%s') "`+"\n",
+		PROMPT_PREFIX_ESCAPED, icon, PROMPT_SUFFIX_ESCAPED)
+}
+
+// Shells whose prompts we don't know how to wrap
+type noIntegration struct {
+	shell string
+}
+
+func (this noIntegration) Name() string { return this.shell }
+
+func (noIntegration) PromptCommand(icon string) string { return "" }
+
+// OSC 133 semantic prompt marks, emitted by the hooks: A where the prompt
+// starts, B where it ends and the command line starts, C when a command
+// starts running, and D with its exit code when it finishes.
+var osc133Regex = regexp.MustCompile("\x1b\\]133;([A-D])(?:;([0-9]+))?[^\x07\x1b]*(?:\x07|\x1b\\\\)")
+
+type SemanticMark struct {
+	Kind     byte
+	ExitCode int // for D marks, -1 if not given
+	// where the escape sequence is in the data
+	Start, End int
+}
+
+func ParseOSC133(data string) []SemanticMark {
+	marks := []SemanticMark{}
+	for _, match := range osc133Regex.FindAllStringSubmatchIndex(data, -1) {
+		mark := SemanticMark{
+			Kind:     data[match[2]],
+			ExitCode: -1,
+			Start:    match[0],
+			End:      match[1],
+		}
+		if match[4] >= 0 {
+			mark.ExitCode, _ = strconv.Atoi(data[match[4]:match[5]])
+		}
+		marks = append(marks, mark)
+	}
+	return marks
+}
@@ -0,0 +1,213 @@
+package butterfish
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetShellIntegration(t *testing.T) {
+	config := &ButterfishConfig{ShellBinary: "/usr/local/bin/fish"}
+	assert.Equal(t, "fish", config.ShellIntegration().Name())
+
+	for _, shell := range []string{"bash", "zsh", "fish", "nu", "sh", "dash", "ksh"} {
+		command := GetShellIntegration(shell).PromptCommand(EMOJI_DEFAULT)
+		assert.Contains(t, command, EMOJI_DEFAULT, shell)
+		assert.True(t, strings.HasSuffix(command, "\n"), shell)
+	}
+	assert.Equal(t, "", GetShellIntegration("tcsh").PromptCommand(EMOJI_DEFAULT))
+}
+
+// A shell running in a pty for tests, with a goroutine reading its output
+type testShell struct {
+	ptmx   *os.File
+	output chan string
+	done   chan struct{}
+}
+
+// Start a shell in a pty, it's killed and its reader stopped when the test
+// ends
+func startTestShell(t *testing.T, path string, args []string, env []string) *testShell {
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	cmd.Env = append(cmd.Env, env...)
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: 24, Cols: 200})
+	if err != nil {
+		t.Fatalf("starting %s: %s", path, err)
+	}
+
+	shell := &testShell{
+		ptmx:   ptmx,
+		output: make(chan string),
+		done:   make(chan struct{}),
+	}
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		defer close(shell.output)
+		buf := make([]byte, 4096)
+		for {
+			n, err := ptmx.Read(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case shell.output <- string(buf[:n]):
+			case <-shell.done:
+				return
+			}
+		}
+	}()
+
+	t.Cleanup(func() {
+		close(shell.done)
+		ptmx.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		<-stopped
+	})
+
+	return shell
+}
+
+func (this *testShell) Write(input string) {
+	this.ptmx.Write([]byte(input))
+}
+
+// Read output until there's a prompt with the given exit status in dir, and
+// return everything read
+func (this *testShell) waitForPrompt(t *testing.T, status int, dir string) string {
+	data := ""
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case chunk, ok := <-this.output:
+			if !ok {
+				t.Fatalf("shell exited, output: %q", data)
+			}
+			data += chunk
+		case <-timeout:
+			t.Fatalf("no prompt with status %d in %s, output: %q", status, dir, data)
+		}
+
+		lastStatus, prompts, cwd, _ := ParsePS1(data, ps1FullRegex, EMOJI_DEFAULT)
+		if prompts > 0 && lastStatus == status && cwd == dir {
+			return data
+		}
+	}
+}
+
+// Run each shell we can find without its config, wrap the prompt, and check
+// that we parse the exit code and directory from its prompts
+func TestShellIntegrationPrompts(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		args []string
+	}{
+		{"bash", []string{"--norc", "--noprofile"}},
+		{"zsh", []string{"-f"}},
+		{"fish", []string{"--no-config"}},
+		{"nu", []string{"--no-config-file"}},
+		{"dash", []string{"-i"}},
+		{"ksh", []string{"-i"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := exec.LookPath(test.name)
+			if err != nil {
+				t.Skipf("%s is not installed", test.name)
+			}
+
+			// a directory name that breaks the prompt if $PWD is used as a
+			// printf format or isn't quoted
+			home := t.TempDir()
+			root, err := filepath.EvalSymlinks(t.TempDir())
+			assert.NoError(t, err)
+			dir := filepath.Join(root, "it's 100%s here")
+			assert.NoError(t, os.Mkdir(dir, 0755))
+
+			shell := startTestShell(t, path, test.args,
+				[]string{"HOME=" + home, "XDG_CONFIG_HOME=" + home})
+			shell.Write(GetShellIntegration(test.name).PromptCommand(EMOJI_DEFAULT))
+			shell.Write("cd \"" + dir + "\"\n")
+			shell.Write("false\n")
+			shell.waitForPrompt(t, 1, dir)
+		})
+	}
+}
+
+func TestCommandOutput(t *testing.T) {
+	marks := ParseOSC133("\x1b]133;D;2\x07\x1b]133;A\x1b\\$ ")
+	assert.Equal(t, 2, len(marks))
+	assert.Equal(t, byte('D'), marks[0].Kind)
+	assert.Equal(t, 2, marks[0].ExitCode)
+	assert.Equal(t, byte('A'), marks[1].Kind)
+	assert.Equal(t, -1, marks[1].ExitCode)
+
+	state := &ShellState{Butterfish: &ButterfishCtx{Ctx: context.Background()}}
+	// without marks everything goes to history
+	assert.Equal(t, "motd\n$ ", state.commandOutput("motd\n$ "))
+	// a D mark before any command ran is ignored
+	assert.Equal(t, "\x1b]133;D;0\x07\x1b]133;A\x07$ ",
+		state.commandOutput("\x1b]133;D;0\x07\x1b]133;A\x07$ "))
+
+	// once a command has started only its output is kept
+	assert.Equal(t, "hello\r\n",
+		state.commandOutput("\x1b]133;B\x07echo hello\r\n\x1b]133;C\x07hello\r\n"))
+	assert.True(t, state.commandRunning)
+	assert.Equal(t, "more\r\n",
+		state.commandOutput("more\r\n\x1b]133;D;1\x07\x1b]133;A\x07$ \x1b]133;B\x07"))
+	assert.False(t, state.commandRunning)
+	assert.True(t, state.commandFinished)
+	assert.Equal(t, 1, state.LastExitCode)
+	assert.Equal(t, "", state.commandOutput("ls"))
+}
+
+// Start each shell we have hooks for with them installed, with a startup file
+// that replaces PS1 before every prompt like prompt themes do, and check that
+// we still find the prompts and get the marks
+func TestShellHooks(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// startup file in HOME and its contents
+		rcfile string
+		rc     string
+	}{
+		{"bash", ".bashrc", "PROMPT_COMMAND='PS1=\"themed$ \"'\n"},
+		{"zsh", ".zshrc", "precmd() { PS1='themed%# ' }\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := exec.LookPath(test.name)
+			if err != nil {
+				t.Skipf("%s is not installed", test.name)
+			}
+
+			home := t.TempDir()
+			hooksDir := t.TempDir()
+			dir, err := filepath.EvalSymlinks(t.TempDir())
+			assert.NoError(t, err)
+			err = os.WriteFile(filepath.Join(home, test.rcfile), []byte(test.rc), 0600)
+			assert.NoError(t, err)
+
+			integration := GetShellIntegration(test.name).(ShellHookIntegration)
+			args, env, err := integration.InstallHooks(hooksDir, EMOJI_DEFAULT)
+			assert.NoError(t, err)
+
+			shell := startTestShell(t, path, args, append(env, "HOME="+home))
+			shell.Write("cd " + dir + "\n")
+			shell.Write("false\n")
+			data := shell.waitForPrompt(t, 1, dir)
+
+			assert.Contains(t, data, "themed")
+			assert.Contains(t, data, "\x1b]133;C\x07")
+			assert.Contains(t, data, "\x1b]133;D;1\x07")
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package butterfish
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	chromastyles "github.com/alecthomas/chroma/styles"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Themes set the shell colors and are selected with the theme setting.
+// Besides the built-in dark and light themes, themes can be defined in the
+// config files:
+//
+//	theme: solarized
+//	themes:
+//	  solarized:
+//	    prompt: "#859900"
+//	    answer: "#b58900"
+//	    highlight: "#cb4b16"
+//	    error: red
+//	    code_style: solarized-dark
+//
+// Colors are #rrggbb, a 0-255 palette index, or a basic color name, see
+// util/color.go. Fields left out are taken from the dark or light theme,
+// depending on the terminal background. code_style is a chroma style name.
+
+type Theme struct {
+	Prompt    string `yaml:"prompt"`
+	Command   string `yaml:"command"`
+	Answer    string `yaml:"answer"`
+	Highlight string `yaml:"highlight"`
+	Error     string `yaml:"error"`
+	CodeStyle string `yaml:"code_style"`
+}
+
+var DarkTheme = &Theme{
+	Prompt:    "154",
+	Command:   "default",
+	Answer:    "221", // yellow
+	Highlight: "204", // orange
+	Error:     "196",
+	CodeStyle: "monokai",
+}
+
+var LightTheme = &Theme{
+	Prompt:    "28",
+	Command:   "default",
+	Answer:    "18", // dark blue
+	Highlight: "6",
+	Error:     "196",
+	CodeStyle: "monokailight",
+}
+
+var BuiltinThemes = map[string]*Theme{
+	"dark":  DarkTheme,
+	"light": LightTheme,
+}
+
+// Parse a theme definition from a config file, rejecting unknown fields
+func parseTheme(path, name string, value interface{}) (*Theme, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	theme := &Theme{}
+	err = yaml.UnmarshalStrict(data, theme)
+	if err != nil {
+		return nil, fmt.Errorf("%s: theme %s: %s", path, name, err)
+	}
+
+	_, err = theme.ShellColorScheme(util.ColorTrue)
+	if err != nil {
+		return nil, fmt.Errorf("%s: theme %s: %s", path, name, err)
+	}
+
+	return theme, nil
+}
+
+// Fill in the fields this theme leaves out from base
+func (this *Theme) Merge(base *Theme) *Theme {
+	merged := *base
+	for _, field := range []struct{ dst, src *string }{
+		{&merged.Prompt, &this.Prompt},
+		{&merged.Command, &this.Command},
+		{&merged.Answer, &this.Answer},
+		{&merged.Highlight, &this.Highlight},
+		{&merged.Error, &this.Error},
+		{&merged.CodeStyle, &this.CodeStyle},
+	} {
+		if *field.src != "" {
+			*field.dst = *field.src
+		}
+	}
+	return &merged
+}
+
+// Select a theme by name from the config files or the built-in themes,
+// returns nil for an empty name. Custom themes may leave out fields, they're
+// merged with the dark or light theme once we know the terminal background.
+func ResolveTheme(name string, config *LayeredConfig) (*Theme, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	if config != nil {
+		if theme, ok := config.Theme(name); ok {
+			return theme, nil
+		}
+	}
+	if theme, ok := BuiltinThemes[name]; ok {
+		return theme, nil
+	}
+
+	names := []string{}
+	for n := range BuiltinThemes {
+		names = append(names, n)
+	}
+	if config != nil {
+		names = append(names, config.ThemeNames()...)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("Theme %s not found, available themes: (%s)",
+		name, strings.Join(names, ", "))
+}
+
+// Escape sequences for the theme's colors at the given color depth, all
+// empty for ColorNone
+func (this *Theme) ShellColorScheme(depth util.ColorDepth) (*ShellColorScheme, error) {
+	if this.CodeStyle != "" {
+		if _, ok := chromastyles.Registry[this.CodeStyle]; !ok {
+			return nil, fmt.Errorf("Unknown code_style %s, see https://xyproto.github.io/splash/docs/ for chroma styles", this.CodeStyle)
+		}
+	}
+
+	scheme := &ShellColorScheme{}
+	for _, field := range []struct {
+		name string
+		spec string
+		dst  *string
+	}{
+		{"prompt", this.Prompt, &scheme.Prompt},
+		{"command", this.Command, &scheme.Command},
+		{"answer", this.Answer, &scheme.Answer},
+		{"highlight", this.Highlight, &scheme.AnswerHighlight},
+		{"error", this.Error, &scheme.Error},
+	} {
+		if field.spec == "" {
+			continue
+		}
+		color, err := depth.Foreground(field.spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", field.name, err)
+		}
+		*field.dst = color
+	}
+
+	return scheme, nil
+}
@@ -0,0 +1,268 @@
+package butterfish
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A trace records the shell's raw terminal streams with timestamps: what we
+// read from the terminal (parentIn), what the wrapped shell wrote (childOut),
+// and what we wrote to the terminal (parentOut), along with our state
+// changes. It's for diagnosing problems like prompts not being detected on
+// someone else's terminal, they record a trace with --trace and we read it
+// with 'butterfish trace view', which decodes the escape sequences.
+//
+// The file is JSON lines, a TraceHeader and then TraceRecords. Everything
+// typed is recorded, including passwords.
+
+const (
+	TraceParentIn  = "parentIn"
+	TraceChildOut  = "childOut"
+	TraceParentOut = "parentOut"
+	TraceState     = "state"
+)
+
+type TraceHeader struct {
+	Started time.Time `json:"started"`
+	Shell   string    `json:"shell"`
+	Width   int       `json:"width"`
+	Height  int       `json:"height"`
+}
+
+type TraceRecord struct {
+	// Time since the trace started
+	Offset time.Duration `json:"t"`
+	Stream string        `json:"stream"`
+	Data   []byte        `json:"data,omitempty"`
+	// State changes
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+type TraceWriter struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	start   time.Time
+	failed  bool
+}
+
+func CreateTrace(path, shell string, width, height int) (*TraceWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	trace := &TraceWriter{
+		file:    file,
+		encoder: json.NewEncoder(file),
+		start:   time.Now(),
+	}
+	err = trace.encoder.Encode(&TraceHeader{
+		Started: trace.start,
+		Shell:   shell,
+		Width:   width,
+		Height:  height,
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return trace, nil
+}
+
+func (this *TraceWriter) write(record *TraceRecord) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	record.Offset = time.Since(this.start)
+	err := this.encoder.Encode(record)
+	if err != nil && !this.failed {
+		// only say so once
+		log.Printf("Error writing trace: %s", err)
+		this.failed = true
+	}
+}
+
+// Record data read or written on a stream
+func (this *TraceWriter) Record(stream string, data []byte) {
+	this.write(&TraceRecord{Stream: stream, Data: data})
+}
+
+func (this *TraceWriter) State(from, to string) {
+	this.write(&TraceRecord{Stream: TraceState, From: from, To: to})
+}
+
+// A writer that records everything written to it on the stream, for use
+// with io.TeeReader and io.MultiWriter
+func (this *TraceWriter) Stream(stream string) io.Writer {
+	return traceStream{trace: this, stream: stream}
+}
+
+func (this *TraceWriter) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.file.Close()
+}
+
+type traceStream struct {
+	trace  *TraceWriter
+	stream string
+}
+
+func (this traceStream) Write(data []byte) (int, error) {
+	this.trace.Record(this.stream, data)
+	return len(data), nil
+}
+
+func ReadTrace(path string) (*TraceHeader, []*TraceRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	header := &TraceHeader{}
+	records := []*TraceRecord{}
+	line := 0
+	for scanner.Scan() {
+		line++
+		if line == 1 {
+			err = json.Unmarshal(scanner.Bytes(), header)
+		} else {
+			record := &TraceRecord{}
+			err = json.Unmarshal(scanner.Bytes(), record)
+			records = append(records, record)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if line == 0 {
+		return nil, nil, fmt.Errorf("%s: empty trace", path)
+	}
+	return header, records, nil
+}
+
+// Print the trace with the escape sequences in each record decoded, the keys
+// read from the terminal, and the state changes. Only the given streams are
+// shown, all if none are given. If hex is set the bytes are shown too.
+func PrintTrace(w io.Writer, header *TraceHeader, records []*TraceRecord, streams []string, hex bool) {
+	fmt.Fprintf(w, "Trace of %s started %s, terminal %dx%d\n",
+		header.Shell, header.Started.Local().Format("2006-01-02 15:04:05"),
+		header.Width, header.Height)
+
+	show := map[string]bool{}
+	for _, stream := range streams {
+		show[stream] = true
+	}
+
+	// keys can be split across reads so we keep parsing state
+	parser := &InputParser{}
+	for _, record := range records {
+		if len(show) > 0 && !show[record.Stream] {
+			continue
+		}
+
+		offset := fmt.Sprintf("+%.3fs", record.Offset.Seconds())
+		if record.Stream == TraceState {
+			fmt.Fprintf(w, "\n%-10s %-9s  %s -> %s\n", offset, record.Stream, record.From, record.To)
+			continue
+		}
+
+		fmt.Fprintf(w, "\n%-10s %-9s  %d bytes\n", offset, record.Stream, len(record.Data))
+		if record.Stream == TraceParentIn {
+			// replies to our queries are taken out before parsing keys, as
+			// the shell does, a cursor position report looks like Shift-F3
+			data := cursorPosRegex.ReplaceAll(record.Data, nil)
+			data = backgroundColorRegex.ReplaceAll(data, nil)
+			keys := []string{}
+			for _, event := range parser.Parse(data) {
+				keys = append(keys, event.String())
+			}
+			if len(keys) > 0 {
+				fmt.Fprintf(w, "    keys: %s\n", strings.Join(keys, " "))
+			}
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(annotateANSI(record.Data), "\n"), "\n") {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+		if hex {
+			for _, line := range strings.Split(prettyHex(record.Data, 80), "\n") {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+	}
+}
+
+// Show data as text with control characters and escape sequences replaced by
+// their names and parameters, e.g. <SGR 1;31m> or <OSC 7 file:///tmp>, and a
+// line break after each line feed. Bytes that aren't UTF-8 are shown in hex.
+func annotateANSI(data []byte) string {
+	var builder strings.Builder
+	for i := 0; i < len(data); {
+		n, name := prettyAnsi(data[i:])
+		if n > 0 {
+			builder.WriteString("<" + name)
+			if body := sequenceBody(data[i:i+n], name); body != "" {
+				builder.WriteString(" " + body)
+			}
+			builder.WriteString(">")
+			if name == "LF" {
+				builder.WriteString("\n")
+			}
+			i += n
+			continue
+		}
+
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size <= 1 {
+			fmt.Fprintf(&builder, "\\x%02x", data[i])
+			i++
+			continue
+		}
+		builder.WriteRune(r)
+		i += size
+	}
+	return builder.String()
+}
+
+// The interesting part of an escape sequence, the parameters and final byte
+// of a CSI sequence or the text of a string sequence
+func sequenceBody(seq []byte, name string) string {
+	if len(seq) < 3 {
+		return ""
+	}
+
+	body := ""
+	switch {
+	case seq[1] == '[':
+		body = string(seq[2:])
+	case seq[1] == ']' || seq[1] == 'P' || seq[1] == '_' || seq[1] == '^' || seq[1] == 'X':
+		body = string(seq[2:])
+		body = strings.TrimSuffix(strings.TrimSuffix(body, "\x07"), "\x1b\\")
+		if number, ok := strings.CutPrefix(name, "OSC "); ok {
+			body = strings.TrimPrefix(strings.TrimPrefix(body, number), ";")
+		}
+	default:
+		body = string(seq[2:])
+	}
+
+	// keep the annotation on one line and readable
+	quoted := strconv.QuoteToGraphic(body)
+	return quoted[1 : len(quoted)-1]
+}
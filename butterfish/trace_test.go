@@ -0,0 +1,54 @@
+package butterfish
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	trace, err := CreateTrace(path, "/bin/bash", 100, 24)
+	assert.NoError(t, err)
+
+	childOut := io.TeeReader(strings.NewReader("\x1b]133;A\x07$ \x1b[1;32mok\x1b[0m\r\n"),
+		trace.Stream(TraceChildOut))
+	io.ReadAll(childOut)
+	// keys split across reads, and a cursor position report
+	trace.Record(TraceParentIn, []byte("\x1b[1;1R\x1b[1;5"))
+	trace.Record(TraceParentIn, []byte("C\x03"))
+	trace.State("Normal", "Prompting")
+	assert.NoError(t, trace.Close())
+
+	header, records, err := ReadTrace(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "/bin/bash", header.Shell)
+	assert.Equal(t, 100, header.Width)
+	assert.Equal(t, 4, len(records))
+	assert.Equal(t, TraceChildOut, records[0].Stream)
+	assert.True(t, records[1].Offset <= records[2].Offset)
+
+	out := &bytes.Buffer{}
+	PrintTrace(out, header, records, nil, false)
+	assert.Contains(t, out.String(), "<OSC 133 A>$ <SGR 1;32m>ok<SGR 0m><CR><LF>\n")
+	assert.Contains(t, out.String(), "<CPR 1;1R><CSI 1;5>")
+	assert.Contains(t, out.String(), "keys: Ctrl-Right Ctrl-C\n")
+	assert.Contains(t, out.String(), "Normal -> Prompting")
+
+	out.Reset()
+	PrintTrace(out, header, records, []string{TraceState}, false)
+	assert.NotContains(t, out.String(), TraceChildOut)
+	assert.Contains(t, out.String(), "Normal -> Prompting")
+}
+
+func TestAnnotateANSI(t *testing.T) {
+	// sequences the old decoder didn't know are named without panicking
+	assert.Equal(t, "<DECSET ?2004h><CUF 1;5C><DECSCUSR 2 q><CSI >4;1m><ESC>",
+		annotateANSI([]byte("\x1b[?2004h\x1b[1;5C\x1b[2 q\x1b[>4;1m\x1b")))
+	assert.Equal(t, "<OSC 7 file:///tmp><DCS 1+r544e><BEL>café\\xff",
+		annotateANSI([]byte("\x1b]7;file:///tmp\x1b\\\x1bP1+r544e\x1b\\\acafé\xff")))
+}
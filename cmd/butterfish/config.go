@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"github.com/mitchellh/go-homedir"
+
+	bf "github.com/bakks/butterfish/butterfish"
+)
+
+const defaultConfigPath = "~/.config/butterfish/config.yaml"
+
+// Kong resolver that fills in flags from the user config file. Kong only
+// calls resolvers for flags that weren't set on the command line, and we skip
+// flags whose environment variable is set, which gives us the precedence
+// flag > env > user > defaults. A project config isn't read here, the shell
+// applies it on top of these settings while it's in the project, see
+// ShellState.UpdateProject.
+type configResolver struct {
+	cli    *CliConfig
+	config *bf.LayeredConfig
+	err    error
+}
+
+func newConfigResolver(cli *CliConfig) *configResolver {
+	return &configResolver{cli: cli}
+}
+
+// The config files are loaded lazily on the first lookup, by then kong has
+// parsed the --profile flag so we know which profile to select.
+func (this *configResolver) load() (*bf.LayeredConfig, error) {
+	return this.loadWithProfile(this.cli.Profile)
+}
+
+func (this *configResolver) loadWithProfile(profile string) (*bf.LayeredConfig, error) {
+	if this.config != nil || this.err != nil {
+		return this.config, this.err
+	}
+
+	userPath, err := homedir.Expand(defaultConfigPath)
+	if err != nil {
+		this.err = err
+		return nil, err
+	}
+
+	this.config, this.err = bf.LoadLayeredConfig(userPath, "", profile)
+	return this.config, this.err
+}
+
+func configKey(flag *kong.Flag) string {
+	return strings.ReplaceAll(flag.Name, "-", "_")
+}
+
+func envIsSet(flag *kong.Flag) bool {
+	for _, env := range flag.Tag.Envs {
+		if _, ok := os.LookupEnv(env); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *configResolver) Validate(app *kong.Application) error {
+	return nil
+}
+
+func (this *configResolver) Resolve(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+	// verbose is a counted flag, it's handled in makeButterfishConfig
+	key := configKey(flag)
+	if key == "verbose" || !isSettingFlag(context, flag) || envIsSet(flag) {
+		return nil, nil
+	}
+
+	// flags aren't applied to the CliConfig struct until after resolution, so
+	// we read the profile from the parse context
+	profile := this.cli.Profile
+	for _, f := range context.Flags() {
+		if f.Name == "profile" {
+			profile = fmt.Sprint(context.FlagValue(f))
+		}
+	}
+
+	// kong would attribute a load error to whichever flag is being resolved,
+	// so we swallow it here and the caller checks load() after parsing
+	config, err := this.loadWithProfile(profile)
+	if err != nil {
+		return nil, nil
+	}
+
+	value, _, ok := config.Lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// Kong only resolves flags for commands on the parsed path, so when running
+// a command other than shell we apply the config files to the shell flags
+// ourselves. This lets `config show` print what the shell would use.
+func (this *configResolver) resolveCommandFlags(kctx *kong.Context, command string) error {
+	for _, node := range kctx.Model.Node.Children {
+		if node.Name != command {
+			continue
+		}
+
+		for _, flag := range node.Flags {
+			value, err := this.Resolve(kctx, nil, flag)
+			if err != nil {
+				return err
+			}
+			if value == nil {
+				continue
+			}
+
+			scan := kong.Scan().PushTyped(value, kong.FlagValueToken)
+			err = flag.Parse(scan, flag.Target)
+			if err != nil {
+				return fmt.Errorf("%s: %w", flag.ShortSummary(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Describe where the current value of a flag came from
+func (this *configResolver) source(kctx *kong.Context, flag *kong.Flag) string {
+	for _, path := range kctx.Path {
+		if path.Flag == flag && !path.Resolved {
+			return "flag"
+		}
+	}
+
+	for _, env := range flag.Tag.Envs {
+		if _, ok := os.LookupEnv(env); ok {
+			return "env $" + env
+		}
+	}
+
+	if this.config != nil {
+		if _, source, ok := this.config.Lookup(configKey(flag)); ok {
+			return source
+		}
+	}
+
+	return "default"
+}
+
+// Describe where the current value of the named flag came from, the shell
+// flags are found even when running another command
+func (this *configResolver) sourceOf(kctx *kong.Context, name string) string {
+	for _, flag := range kctx.Flags() {
+		if flag.Name == name {
+			return this.source(kctx, flag)
+		}
+	}
+	if shell := findCommand(kctx, "shell"); shell != nil {
+		for _, flag := range shell.Flags {
+			if flag.Name == name {
+				return this.source(kctx, flag)
+			}
+		}
+	}
+	return "default"
+}
+
+// Returns true if the named flag was set by a flag or env var rather than a
+// config file or default
+func (this *configResolver) explicitlySet(kctx *kong.Context, name string) bool {
+	source := this.sourceOf(kctx, name)
+	return source == "flag" || strings.HasPrefix(source, "env ")
+}
+
+// Print the effective configuration, one setting per line, along with the
+// layer it came from.
+func (this *configResolver) Show(w io.Writer, kctx *kong.Context, verbose int) error {
+	config, err := this.load()
+	if err != nil {
+		return err
+	}
+
+	if config.Profile != "" {
+		fmt.Fprintf(w, "# profile: %s\n", config.Profile)
+	}
+
+	for _, node := range []*kong.Node{kctx.Model.Node, findCommand(kctx, "shell")} {
+		if node == nil {
+			continue
+		}
+
+		for _, flag := range node.Flags {
+			key := configKey(flag)
+			if !isSettingKey(key) {
+				continue
+			}
+
+			var value interface{} = flag.Target.Interface()
+			source := this.source(kctx, flag)
+
+			switch key {
+			case "verbose":
+				value = verbose
+				if verbose == 0 {
+					if v, s, ok := config.Lookup(key); ok {
+						value, err = configVerbose(v, s)
+						if err != nil {
+							return err
+						}
+						source = s
+					}
+				}
+			case "api_key":
+				// the stored token is only used when nothing else sets a key
+				if value == "" {
+					if token := storedToken(); token != "" {
+						value, source = token, defaultEnvPath
+					}
+				}
+				value = maskSecret(fmt.Sprint(value))
+			}
+
+			fmt.Fprintf(w, "%s: %v  # %s\n", key, value, source)
+		}
+	}
+
+	return this.showProject(w, kctx, config.Profile)
+}
+
+// Print the settings the project config in the working directory changes,
+// the shell applies them while it's in the project
+func (this *configResolver) showProject(w io.Writer, kctx *kong.Context, profile string) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	root := bf.FindProjectRoot(cwd)
+	if root == "" {
+		return nil
+	}
+	project, err := bf.LoadProjectConfig(root, profile)
+	if err != nil {
+		return err
+	}
+
+	settings := map[string]interface{}{}
+	for key, value := range project.Settings {
+		settings[key] = value
+	}
+	if project.Model != "" {
+		settings["model"] = project.Model
+	}
+
+	fmt.Fprintf(w, "# in project %s\n", root)
+	for _, warning := range project.Warnings {
+		fmt.Fprintf(w, "# %s\n", warning)
+	}
+	source := filepath.Join(root, bf.ProjectConfigName)
+	for _, key := range bf.ProjectAllowedConfigKeys {
+		value, ok := settings[key]
+		if !ok {
+			continue
+		}
+		if this.explicitlySet(kctx, strings.ReplaceAll(key, "_", "-")) {
+			fmt.Fprintf(w, "%s: %v  # %s, overridden by %s\n", key, value, source,
+				this.sourceOf(kctx, strings.ReplaceAll(key, "_", "-")))
+			continue
+		}
+		fmt.Fprintf(w, "%s: %v  # %s\n", key, value, source)
+	}
+	return nil
+}
+
+func findCommand(kctx *kong.Context, name string) *kong.Node {
+	for _, node := range kctx.Model.Node.Children {
+		if node.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// Settings are the global flags and shell flags, other commands may have
+// flags with the same name that mean something else, e.g. logs --model
+func isSettingFlag(kctx *kong.Context, flag *kong.Flag) bool {
+	if !isSettingKey(configKey(flag)) {
+		return false
+	}
+
+	for _, node := range []*kong.Node{kctx.Model.Node, findCommand(kctx, "shell")} {
+		if node == nil {
+			continue
+		}
+		for _, f := range node.Flags {
+			if f == flag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isSettingKey(key string) bool {
+	for _, k := range bf.ConfigKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Show only enough of a secret to recognize which one is configured
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return secret[:3] + "..." + secret[len(secret)-4:]
+}
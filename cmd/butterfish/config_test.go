@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/kong"
+	"github.com/mitchellh/go-homedir"
+	"github.com/stretchr/testify/assert"
+
+	bf "github.com/bakks/butterfish/butterfish"
+)
+
+// Parse args with HOME pointed at a temp dir holding config.yaml and the
+// stored token, from a directory with no project config
+func parseTestArgs(t *testing.T, env map[string]string, args ...string) (*CliConfig, *configResolver, string) {
+	return parseTestArgsIn(t, t.TempDir(), env, args...)
+}
+
+// Parse args as above from dir
+func parseTestArgsIn(t *testing.T, dir string, env map[string]string, args ...string) (*CliConfig, *configResolver, string) {
+	home := t.TempDir()
+	configDir := filepath.Join(home, ".config", "butterfish")
+	assert.NoError(t, os.MkdirAll(configDir, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(configDir, "config.yaml"), []byte(`
+profiles:
+  work-gateway:
+    base_url: https://llm.example.com/v1
+    api_key: sk-gateway-5678
+`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(configDir, "butterfish.env"),
+		[]byte("OPENAI_TOKEN=sk-openai-1234\n"), 0600))
+
+	t.Setenv("HOME", home)
+	homedir.Reset()
+	t.Cleanup(homedir.Reset)
+	for _, name := range []string{"OPENAI_TOKEN", "OPENAI_API_KEY", "BUTTERFISH_PROFILE", "BUTTERFISH_BASE_URL"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+
+	cwd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(cwd) })
+
+	cli := &CliConfig{}
+	resolver := newConfigResolver(cli)
+	parser, err := newCliParser(cli, resolver, "")
+	assert.NoError(t, err)
+	kctx, err := parser.Parse(args)
+	assert.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, resolver.Show(out, kctx, 0))
+	return cli, resolver, out.String()
+}
+
+func TestStoredTokenPrecedence(t *testing.T) {
+	// a profile's key goes with its base URL, the stored OpenAI token is
+	// never sent there
+	cli, resolver, shown := parseTestArgs(t, nil, "--profile", "work-gateway", "config", "show")
+	config := makeButterfishConfig(cli, resolver)
+	assert.Equal(t, "https://llm.example.com/v1", config.BaseURL)
+	assert.Equal(t, "sk-gateway-5678", config.OpenAIToken)
+	assert.Contains(t, shown, "api_key: sk-...5678  # profile work-gateway in "+filepath.Join(os.Getenv("HOME"), ".config/butterfish/config.yaml"))
+
+	// the stored token is used when nothing else sets a key
+	cli, resolver, shown = parseTestArgs(t, nil, "config", "show")
+	config = makeButterfishConfig(cli, resolver)
+	assert.Equal(t, "https://api.openai.com/v1", config.BaseURL)
+	assert.Equal(t, "sk-openai-1234", config.OpenAIToken)
+	assert.Contains(t, shown, "api_key: sk-...1234  # "+defaultEnvPath)
+
+	// and real env vars still come first
+	cli, resolver, shown = parseTestArgs(t, map[string]string{"OPENAI_API_KEY": "sk-env-9999"},
+		"--profile", "work-gateway", "config", "show")
+	config = makeButterfishConfig(cli, resolver)
+	assert.Equal(t, "sk-env-9999", config.OpenAIToken)
+	assert.Contains(t, shown, "api_key: sk-...9999  # env $OPENAI_API_KEY")
+}
+
+// The project config butterfish was launched in only applies while the shell
+// is in that project
+func TestProjectConfigFollowsShell(t *testing.T) {
+	project := t.TempDir()
+	outside := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(project, bf.ProjectConfigName), []byte(`
+model: gpt-4.1
+max_response_tokens: 300
+context: [git, ls]
+`), 0644))
+
+	cli, resolver, shown := parseTestArgsIn(t, project, nil, "config", "show")
+	assert.Contains(t, shown, "model: gpt-4.1-mini  # default\n")
+	assert.Contains(t, shown, "model: gpt-4.1  # "+filepath.Join(project, bf.ProjectConfigName))
+	kctx, err := newTestParser(t, cli, resolver).Parse([]string{"shell"})
+	assert.NoError(t, err)
+	config, _ := makePromptingConfig(cli, kctx, resolver)
+	assert.Equal(t, "gpt-4.1-mini", config.ShellPromptModel)
+	assert.Equal(t, 2048, config.ShellMaxResponseTokens)
+
+	state := &bf.ShellState{
+		Butterfish:  &bf.ButterfishCtx{Ctx: context.Background(), Config: config},
+		ParentOut:   &bytes.Buffer{},
+		Color:       &bf.ShellColorScheme{},
+		PromptModel: config.ShellPromptModel,
+	}
+	state.UpdateProject()
+	assert.Equal(t, "gpt-4.1", state.PromptModel)
+	assert.Equal(t, 300, config.ShellMaxResponseTokens)
+	assert.Equal(t, []string{"git", "ls"}, config.ShellContextProviders)
+	assert.Len(t, state.Context.Providers, 2)
+
+	assert.NoError(t, os.Chdir(outside))
+	state.UpdateProject()
+	assert.Equal(t, "gpt-4.1-mini", state.PromptModel)
+	assert.Equal(t, 2048, config.ShellMaxResponseTokens)
+	assert.Empty(t, config.ShellContextProviders)
+	assert.Empty(t, state.Context.Providers)
+
+	// a model set by a flag stays
+	cli, resolver, _ = parseTestArgsIn(t, project, nil, "config", "show")
+	kctx, err = newTestParser(t, cli, resolver).Parse([]string{"shell", "--model", "gpt-4o"})
+	assert.NoError(t, err)
+	config, _ = makePromptingConfig(cli, kctx, resolver)
+	state = &bf.ShellState{
+		Butterfish:  &bf.ButterfishCtx{Ctx: context.Background(), Config: config},
+		ParentOut:   &bytes.Buffer{},
+		Color:       &bf.ShellColorScheme{},
+		PromptModel: config.ShellPromptModel,
+	}
+	state.UpdateProject()
+	assert.Equal(t, "gpt-4o", state.PromptModel)
+	assert.Equal(t, 300, config.ShellMaxResponseTokens)
+}
+
+func newTestParser(t *testing.T, cli *CliConfig, resolver *configResolver) *kong.Kong {
+	parser, err := newCliParser(cli, resolver, "")
+	assert.NoError(t, err)
+	return parser
+}
+
+// verbose in a config file can be a level or a bool, anything else is an
+// error naming the file
+func TestConfigVerbose(t *testing.T) {
+	for _, test := range []struct {
+		setting string
+		level   int
+		err     bool
+	}{
+		{"verbose: 2", 2, false},
+		{"verbose: true", 1, false},
+		{"verbose: false", 0, false},
+		{"verbose: lots", 0, true},
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte(test.setting+"\n"), 0644))
+		layered, err := bf.LoadLayeredConfig(path, "", "")
+		assert.NoError(t, err)
+
+		cli := &CliConfig{}
+		level, err := effectiveVerbose(cli, &configResolver{cli: cli, config: layered})
+		assert.Equal(t, test.level, level, test.setting)
+		if test.err {
+			assert.ErrorContains(t, err, path)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
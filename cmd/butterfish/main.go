@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -13,6 +15,7 @@ import (
 	"github.com/alecthomas/kong"
 	"github.com/joho/godotenv"
 	"github.com/mitchellh/go-homedir"
+	"golang.org/x/term"
 
 	//_ "net/http/pprof"
 
@@ -32,7 +35,9 @@ Butterfish wraps your local shell. Start a command with a capital letter to send
 
 Butterfish looks for an API key in OPENAI_API_KEY, or alternatively stores an OpenAI auth token at ~/.config/butterfish/butterfish.env.
 
-Prompts are stored in ~/.config/butterfish/prompts.yaml. Butterfish logs to the system temp dir, usually to /var/tmp/butterfish.log. To print the full prompts and responses from the OpenAI API, use the --verbose flag. Support can be found at https://github.com/bakks/butterfish.
+Any option can also be set in ~/.config/butterfish/config.yaml or in a .butterfish.yaml in the current directory or a parent, including named profiles selected with --profile. Run 'butterfish config show' to see the effective settings.
+
+Prompts are stored in ~/.config/butterfish/prompts.yaml. Butterfish logs to $XDG_STATE_HOME/butterfish/butterfish.log, usually ~/.local/state/butterfish/butterfish.log. To log the full prompts and responses from the OpenAI API, use the --verbose flag. Support can be found at https://github.com/bakks/butterfish.
 `
 const license = "MIT License - Copyright (c) 2023 Peter Bakkum"
 const defaultEnvPath = "~/.config/butterfish/butterfish.env"
@@ -44,6 +49,11 @@ Use:
   - Type a normal command, like 'ls -l' and press enter to execute it
   - Start a command with a capital letter to send it to GPT, like 'How do I recursively find local .py files?'
   - GPT will be able to see your shell history, so you can ask contextual questions like 'why didnt my last command work?'
+  - Code blocks in answers are numbered, press Alt-1..9 to type one into the command line or run '/copy 2' to copy one to the clipboard
+  - Press Alt-o to re-open the last answer full screen in a pager
+  - Run '/screen' to attach what's on your screen to your next prompt, then ask about it
+  - Pipe output into 'butterfish ask', e.g. 'make 2>&1 | butterfish ask why is this failing'
+  - Run '/export notes.md' to write the session to a Markdown runbook, or to .html or a .sh script of the commands
 `
 
 type VerboseFlag bool
@@ -59,42 +69,109 @@ func (v *VerboseFlag) BeforeResolve() error {
 
 // Kong configuration for shell arguments
 type CliConfig struct {
-	Verbose      VerboseFlag      `short:"v" default:"false" help:"Verbose mode, prints full LLM prompts (sometimes to log file). Use multiple times for more verbosity, e.g. -vv."`
-	Version      kong.VersionFlag `short:"V" help:"Print version information and exit."`
-	BaseURL      string           `short:"u" default:"https://api.openai.com/v1" help:"Base URL for OpenAI-compatible API. Enables local models with a compatible interface."`
-	TokenTimeout int              `short:"z" default:"10000" help:"Timeout before first prompt token is received and between individual tokens. In milliseconds."`
-	ApiKey       string           `short:"k" help:"OpenAI API key. Overrides environment variables and config file."`
-	LightColor   bool             `short:"l" default:"false" help:"Light color mode, appropriate for a terminal with a white(ish) background"`
+	Verbose       VerboseFlag      `short:"v" default:"false" help:"Verbose mode, logs full LLM prompts. Use multiple times for more verbosity, e.g. -vv logs state changes and -vvv raw terminal input and output."`
+	Version       kong.VersionFlag `short:"V" help:"Print version information and exit."`
+	Profile       string           `env:"BUTTERFISH_PROFILE" help:"Named profile from config.yaml or .butterfish.yaml, bundling settings like base URL, API key, model and token limits."`
+	BaseURL       string           `short:"u" default:"https://api.openai.com/v1" env:"BUTTERFISH_BASE_URL" help:"Base URL for OpenAI-compatible API. Enables local models with a compatible interface."`
+	TokenTimeout  int              `short:"z" default:"10000" env:"BUTTERFISH_TOKEN_TIMEOUT" help:"Timeout before first prompt token is received and between individual tokens. In milliseconds."`
+	ApiKey        string           `short:"k" env:"OPENAI_TOKEN,OPENAI_API_KEY" help:"OpenAI API key. Overrides config files."`
+	LightColor    bool             `short:"l" default:"false" env:"BUTTERFISH_LIGHT_COLOR" help:"Light color mode, appropriate for a terminal with a white(ish) background. By default the background is detected by asking the terminal for its color, set this to true or false to override."`
+	Theme         string           `env:"BUTTERFISH_THEME" help:"Color theme, dark, light, or one defined under themes in a config file. Colors are downgraded to the terminal's color depth, detected from COLORTERM and TERM, and NO_COLOR turns off all styling."`
+	PromptLibrary string           `default:"${default_prompt_path}" env:"BUTTERFISH_PROMPT_LIBRARY" help:"Path of the yaml file to load LLM prompts from."`
+	LogFile       string           `env:"BUTTERFISH_LOG_FILE" help:"Path of the log file, defaults to butterfish.log in $XDG_STATE_HOME/butterfish."`
+	LogMaxSize    int              `default:"10" env:"BUTTERFISH_LOG_MAX_SIZE" help:"Size in MB at which the log file is rotated, 3 rotated files are kept."`
+	LogMaxAge     time.Duration    `default:"168h" env:"BUTTERFISH_LOG_MAX_AGE" help:"Age at which the log file is rotated and old log files are deleted."`
+	Audit         bool             `default:"false" env:"BUTTERFISH_AUDIT" help:"Write every LLM request and response to a JSONL audit log, after secret redaction."`
+	AuditFile     string           `env:"BUTTERFISH_AUDIT_FILE" help:"Path of the audit log, defaults to audit.jsonl in $XDG_STATE_HOME/butterfish."`
+	AuditMaxSize  int              `default:"10" env:"BUTTERFISH_AUDIT_MAX_SIZE" help:"Size in MB at which the audit log is rotated, 5 rotated files are kept."`
+	AuditNoUsage  bool             `default:"false" env:"BUTTERFISH_AUDIT_NO_USAGE" help:"Don't ask for token usage in streaming responses for the audit log, for OpenAI-compatible servers that reject stream_options."`
 
 	Shell struct {
-		Bin                   string `short:"b" help:"Shell to use (e.g. /bin/zsh), defaults to $SHELL."`
-		Model                 string `short:"m" default:"gpt-4.1-mini" help:"Model for when the user manually enters a prompt."`
-		NoCommandPrompt       bool   `short:"p" default:"false" help:"Don't change command prompt (shell PS1 variable). If not set, an emoji will be added to the prompt as a reminder you're in Shell Mode."`
-		MaxPromptTokens       int    `short:"P" default:"16384" help:"Maximum number of tokens, we restrict calls to this size regardless of model capabilities."`
-		MaxHistoryBlockTokens int    `short:"H" default:"1024" help:"Maximum number of tokens of each block of history. For example, if a command has a very long output, it will be truncated to this length when sending the shell's history."`
-		MaxResponseTokens     int    `short:"R" default:"2048" help:"Maximum number of tokens in a response when prompting."`
+		Bin                   string   `short:"b" help:"Shell to use (e.g. /bin/zsh), defaults to $SHELL."`
+		Model                 string   `short:"m" default:"gpt-4.1-mini" env:"BUTTERFISH_MODEL" help:"Model for when the user manually enters a prompt."`
+		NoCommandPrompt       bool     `short:"p" default:"false" env:"BUTTERFISH_NO_COMMAND_PROMPT" help:"Don't change command prompt (shell PS1 variable). If not set, an emoji will be added to the prompt as a reminder you're in Shell Mode."`
+		MaxPromptTokens       int      `short:"P" default:"16384" env:"BUTTERFISH_MAX_PROMPT_TOKENS" help:"Maximum number of tokens, we restrict calls to this size regardless of model capabilities."`
+		MaxHistoryBlockTokens int      `short:"H" default:"1024" env:"BUTTERFISH_MAX_HISTORY_BLOCK_TOKENS" help:"Maximum number of tokens of each block of history. For example, if a command has a very long output, it will be truncated to this length when sending the shell's history."`
+		MaxResponseTokens     int      `short:"R" default:"2048" env:"BUTTERFISH_MAX_RESPONSE_TOKENS" help:"Maximum number of tokens in a response when prompting."`
+		Context               []string `sep:"," env:"BUTTERFISH_CONTEXT" help:"Context providers that add information about your environment to prompts, comma separated. Options: git (branch, status, diff summary), ls (working directory listing), env (selected environment variables), toolchains (go/python/node/etc versions), os (distribution and package managers)."`
+		ContextTokens         int      `default:"256" env:"BUTTERFISH_CONTEXT_TOKENS" help:"Maximum number of tokens of each context provider section."`
+		ContextEnv            []string `sep:"," default:"${default_context_env}" env:"BUTTERFISH_CONTEXT_ENV" help:"Environment variables reported by the env context provider."`
+		NoRedact              bool     `default:"false" env:"BUTTERFISH_NO_REDACT" help:"Don't replace secrets like API keys and tokens with placeholders before sending shell history to the LLM."`
+		RedactPatterns        []string `sep:"none" help:"Regex matching a secret to redact, in addition to the built-in detectors. Can be repeated. If the regex has a capture group only the group is redacted."`
+		HistoryDenylist       []string `sep:"," default:"pass,gpg,vault read" env:"BUTTERFISH_HISTORY_DENYLIST" help:"Commands whose input and output are never added to history, matched against the leading words of the command. Commands starting with a space are also skipped, and /incognito or Ctrl-] pauses history entirely."`
+		PagerLines            int      `default:"0" env:"BUTTERFISH_PAGER_LINES" help:"Open answers longer than this many lines full screen in a pager once they finish, 0 to never do it automatically. Alt-o opens the last answer in the pager at any time."`
+		Trace                 string   `help:"Record the raw terminal input and output and the shell's state changes to this file, for debugging. View it with 'butterfish trace view'. Everything typed is recorded, including passwords."`
+		Record                string   `help:"Record the session as you see it to this file in asciinema's .cast format, with a marker for each command and prompt. Replay it with 'butterfish play' or asciinema."`
 	} `cmd:"" help:"${shell_help}" default:"withargs"` // Make shell the default command
+
+	Logs struct {
+		Since   time.Duration `help:"Only show requests made within this duration, e.g. 1h or 30m."`
+		Session string        `help:"Only show requests from the session with this id (or id prefix)."`
+		Model   string        `help:"Only show requests to this model."`
+		Grep    string        `short:"g" help:"Only show requests whose prompt or response contains this text, case-insensitive."`
+		Errors  bool          `help:"Only show requests that failed."`
+		Json    bool          `help:"Print the full matching records as JSON lines."`
+		Limit   int           `short:"n" default:"20" help:"Show at most this many of the most recent matching requests, 0 for all."`
+	} `cmd:"" help:"Query the audit log of LLM requests written when --audit is set."`
+
+	Console struct {
+		Model string `short:"m" help:"Model for prompts, defaults to the shell's model setting."`
+	} `cmd:"" help:"Full screen chat console with scrollable, searchable history and a multi-line input box. Uses the shell's settings and prompt assembly. Enter sends, Alt-Enter or Ctrl-J inserts a newline, Ctrl-F searches the output, Ctrl-C quits."`
+
+	Trace struct {
+		View struct {
+			File   string   `arg:"" help:"Trace file recorded with --trace."`
+			Stream []string `sep:"," help:"Only show these streams, comma separated: parentIn (terminal input), childOut (shell output), parentOut (terminal output), state."`
+			Hex    bool     `help:"Also show the bytes in hex."`
+		} `cmd:"" help:"Print a trace with escape sequences decoded, keys read from the terminal, and state changes."`
+	} `cmd:"" help:"Inspect traces of the shell's terminal streams recorded with --trace."`
+
+	Play struct {
+		File      string        `arg:"" help:"Recording made with --record, or any asciicast v2 file."`
+		Speed     float64       `default:"1" help:"Playback speed, e.g. 2 for twice as fast."`
+		IdleLimit time.Duration `default:"2s" help:"Shorten pauses to at most this long, 0 to keep them."`
+		List      bool          `help:"List the markers, the commands and prompts, and exit."`
+	} `cmd:"" help:"Replay a session recorded with --record in the terminal. Space pauses, n or ] jumps to the next marker, p or [ back to the previous one, + and - change the speed, q quits."`
+
+	Ask struct {
+		Question []string `arg:"" help:"The question, e.g. why is this failing."`
+	} `cmd:"" help:"Ask the butterfish shell you're in a question, with anything piped in attached, e.g. make 2>&1 | butterfish ask why is this failing. The answer is shown and recorded in the shell like a prompt you typed."`
+
+	Config struct {
+		Show struct{} `cmd:"" help:"Print the effective configuration and which layer (flag, env, project, user, default) each value came from."`
+	} `cmd:"" help:"Inspect Butterfish configuration. Settings are read from ${default_config_path} and the nearest .butterfish.yaml."`
 }
 
-func getOpenAIToken() string {
+// The token stored by getOpenAIToken, read only as a last resort after flags,
+// env vars and config files. We don't load the file into the environment, that
+// would make the stored OpenAI key outrank a profile's api_key and send it to
+// the profile's base_url.
+func storedToken() string {
 	path, err := homedir.Expand(defaultEnvPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// We attempt to get a token from env vars plus an env file
-	godotenv.Load(path)
-
-	token := os.Getenv("OPENAI_TOKEN")
-	if token != "" {
+	env, err := godotenv.Read(path)
+	if err != nil {
+		return ""
+	}
+	if token := env["OPENAI_TOKEN"]; token != "" {
 		return token
 	}
+	return env["OPENAI_API_KEY"]
+}
 
-	token = os.Getenv("OPENAI_API_KEY")
-	if token != "" {
-		return token
+// Called when no API key was found in flags, env vars, config files, or the
+// env file
+func getOpenAIToken() string {
+	path, err := homedir.Expand(defaultEnvPath)
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	var token string
+
 	// If we don't have a token, we'll prompt the user to create one
 	fmt.Printf("Butterfish requires an OpenAI API key, please visit https://platform.openai.com/account/api-keys to create one and paste it below (it should start with sk-):\n")
 
@@ -134,22 +211,70 @@ func getOpenAIToken() string {
 	return token
 }
 
-func makeButterfishConfig(options *CliConfig) *bf.ButterfishConfig {
+func makeButterfishConfig(options *CliConfig, resolver *configResolver) *bf.ButterfishConfig {
 	config := bf.MakeButterfishConfig()
 	if options.ApiKey != "" {
 		config.OpenAIToken = options.ApiKey
+	} else if token := storedToken(); token != "" {
+		config.OpenAIToken = token
 	} else {
 		config.OpenAIToken = getOpenAIToken()
 	}
 	config.BaseURL = options.BaseURL
-	config.PromptLibraryPath = defaultPromptPath
+	config.PromptLibraryPath = options.PromptLibrary
 	config.TokenTimeout = time.Duration(options.TokenTimeout) * time.Millisecond
+	if options.Audit {
+		path, err := auditLogPath(options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.AuditLogPath = path
+		config.AuditLogMaxBytes = int64(options.AuditMaxSize) * 1024 * 1024
+		config.AuditLogUsage = !options.AuditNoUsage
+	}
+	if resolver != nil && resolver.config != nil {
+		config.Profile = resolver.config.Profile
+	}
+	verbose, err := effectiveVerbose(options, resolver)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Verbose = verbose
+
+	return config
+}
 
+// The verbose flag is counted (-vvv) so it can't be resolved by kong like
+// other flags, we fall back to the config files if it wasn't passed.
+func effectiveVerbose(options *CliConfig, resolver *configResolver) (int, error) {
 	if options.Verbose {
-		config.Verbose = verboseCount
+		return verboseCount, nil
 	}
 
-	return config
+	if resolver != nil {
+		config, err := resolver.load()
+		if err == nil {
+			if value, source, ok := config.Lookup("verbose"); ok {
+				return configVerbose(value, source)
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+// verbose in a config file is a level, or true for level 1 like -v
+func configVerbose(value interface{}, source string) (int, error) {
+	switch value := value.(type) {
+	case int:
+		return value, nil
+	case bool:
+		if value {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("%s: verbose must be a number or true/false", source)
 }
 
 func getBuildInfo() string {
@@ -166,33 +291,274 @@ func main() {
 
 	desc := fmt.Sprintf("%s\n%s", description, getBuildInfo())
 	cli := &CliConfig{}
+	resolver := newConfigResolver(cli)
+
+	cliParser, err := newCliParser(cli, resolver, desc)
+	if err != nil {
+		panic(err)
+	}
+
+	// Since 'shell' is the default command, we don't need to parse subcommands explicitly
+	kctx, err := cliParser.Parse(os.Args[1:])
+	cliParser.FatalIfErrorf(err)
+	_, err = resolver.load()
+	cliParser.FatalIfErrorf(err)
+
+	switch kctx.Command() {
+	case "logs":
+		err = showLogs(cli)
+		cliParser.FatalIfErrorf(err)
+
+	case "console":
+		err = runConsole(cli, kctx, resolver)
+		cliParser.FatalIfErrorf(err)
+
+	case "trace view <file>":
+		err = viewTrace(cli)
+		cliParser.FatalIfErrorf(err)
+
+	case "play <file>":
+		err = playCast(cli)
+		cliParser.FatalIfErrorf(err)
+
+	case "ask <question>":
+		err = askShell(cli)
+		cliParser.FatalIfErrorf(err)
+
+	case "config show":
+		err = resolver.resolveCommandFlags(kctx, "shell")
+		cliParser.FatalIfErrorf(err)
+		verbose, err := effectiveVerbose(cli, resolver)
+		cliParser.FatalIfErrorf(err)
+		err = resolver.Show(os.Stdout, kctx, verbose)
+		cliParser.FatalIfErrorf(err)
+
+	default:
+		runShell(cli, kctx, resolver)
+	}
+}
 
-	cliParser, err := kong.New(cli,
+func newCliParser(cli *CliConfig, resolver *configResolver, desc string) (*kong.Kong, error) {
+	return kong.New(cli,
 		kong.Name("butterfish"),
 		kong.Description(desc),
 		kong.UsageOnError(),
+		kong.Resolvers(resolver),
 		kong.Vars{
-			"shell_help": shell_help,
-			"version":    getBuildInfo(),
+			"shell_help":          shell_help,
+			"version":             getBuildInfo(),
+			"default_prompt_path": defaultPromptPath,
+			"default_config_path": defaultConfigPath,
+			"default_context_env": strings.Join(bf.DefaultContextEnv, ","),
 		})
+}
+
+func auditLogPath(cli *CliConfig) (string, error) {
+	if cli.AuditFile != "" {
+		return homedir.Expand(cli.AuditFile)
+	}
 
+	stateDir, err := util.StateDir()
 	if err != nil {
-		panic(err)
+		return "", err
 	}
+	return filepath.Join(stateDir, "audit.jsonl"), nil
+}
 
-	// Since 'shell' is the default command, we don't need to parse subcommands explicitly
-	_, err = cliParser.Parse(os.Args[1:])
-	cliParser.FatalIfErrorf(err)
+func showLogs(cli *CliConfig) error {
+	path, err := auditLogPath(cli)
+	if err != nil {
+		return err
+	}
+
+	filter := &bf.AuditFilter{
+		SessionId: cli.Logs.Session,
+		Model:     cli.Logs.Model,
+		Contains:  cli.Logs.Grep,
+		Errors:    cli.Logs.Errors,
+	}
+	if cli.Logs.Since > 0 {
+		filter.Since = time.Now().Add(-cli.Logs.Since)
+	}
+
+	records, err := bf.ReadAuditLog(path, filter)
+	if err != nil {
+		return err
+	}
+
+	if cli.Logs.Limit > 0 && len(records) > cli.Logs.Limit {
+		records = records[len(records)-cli.Logs.Limit:]
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, record := range records {
+		if cli.Logs.Json {
+			err = encoder.Encode(record)
+			if err != nil {
+				return err
+			}
+		} else {
+			bf.PrintAuditRecord(os.Stdout, record)
+		}
+	}
+
+	return nil
+}
 
-	config := makeButterfishConfig(cli)
+func viewTrace(cli *CliConfig) error {
+	path, err := homedir.Expand(cli.Trace.View.File)
+	if err != nil {
+		return err
+	}
+
+	header, records, err := bf.ReadTrace(path)
+	if err != nil {
+		return err
+	}
+	bf.PrintTrace(os.Stdout, header, records, cli.Trace.View.Stream, cli.Trace.View.Hex)
+	return nil
+}
+
+func playCast(cli *CliConfig) error {
+	path, err := homedir.Expand(cli.Play.File)
+	if err != nil {
+		return err
+	}
+
+	header, events, err := bf.ReadCast(path)
+	if err != nil {
+		return err
+	}
+	if cli.Play.List {
+		bf.PrintCastMarkers(os.Stdout, events)
+		return nil
+	}
+
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return fmt.Errorf("butterfish play needs a terminal: %s", err)
+	}
+	if width < header.Width || height < header.Height {
+		fmt.Printf("The recording is %dx%d but the terminal is %dx%d, it may not look right\n",
+			header.Width, header.Height, width, height)
+		time.Sleep(2 * time.Second)
+	}
+
+	// read keys as they're pressed
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	defer term.Restore(int(os.Stdin.Fd()), state)
+
+	player := &bf.CastPlayer{
+		Events:    events,
+		Out:       os.Stdout,
+		Speed:     cli.Play.Speed,
+		IdleLimit: cli.Play.IdleLimit.Seconds(),
+	}
+	return player.Play(context.Background(), os.Stdin)
+}
+
+// Piped input beyond this is cut from the start, the end is usually where
+// the errors are
+const maxAskInput = 1024 * 1024
+
+// Send a question and any piped input to the butterfish shell we're running
+// in, through its control socket
+func askShell(cli *CliConfig) error {
+	if os.Getenv("BUTTERFISH_SHELL") == "" {
+		return fmt.Errorf("butterfish ask works inside a butterfish shell, start one with 'butterfish'")
+	}
+	socket := os.Getenv(bf.ControlSocketEnv)
+	if socket == "" {
+		return fmt.Errorf("this butterfish shell has no control socket, see its log for why")
+	}
+
+	attachment := ""
+	if util.IsPipedStdin() {
+		input, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		if len(input) > maxAskInput {
+			input = input[len(input)-maxAskInput:]
+		}
+		attachment = string(input)
+	}
+
+	client, err := bf.DialControl(socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// the shell shows the answer, we only write it out if our output goes
+	// somewhere else, e.g. to a file
+	var out io.Writer
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		out = os.Stdout
+	}
+	_, err = client.Prompt(strings.Join(cli.Ask.Question, " "), attachment, out)
+	return err
+}
+
+// Build the config for prompting from the top level and shell flags, and
+// start logging. Shared by the shell and console commands.
+func makePromptingConfig(cli *CliConfig, kctx *kong.Context, resolver *configResolver) (*bf.ButterfishConfig, io.Writer) {
+	config := makeButterfishConfig(cli, resolver)
 	config.BuildInfo = getBuildInfo()
 	ctx := context.Background()
 
 	errorWriter := util.NewStyledWriter(os.Stderr, config.Styles.Error)
 
+	logfileName, err := util.InitLogging(ctx, util.LogConfig{
+		Path:     cli.LogFile,
+		Verbose:  config.Verbose,
+		MaxBytes: int64(cli.LogMaxSize) * 1024 * 1024,
+		MaxAge:   cli.LogMaxAge,
+	})
+	if err != nil {
+		// not fatal, we just won't have a log
+		fmt.Fprintf(errorWriter, "Could not open log file: %s\n", err)
+	} else {
+		fmt.Printf("Logging to %s\n", logfileName)
+	}
+
+	config.ShellPromptModel = cli.Shell.Model
+	config.PinnedSettings = map[string]bool{}
+	for _, key := range bf.ProjectAllowedConfigKeys {
+		if resolver.explicitlySet(kctx, strings.ReplaceAll(key, "_", "-")) {
+			config.PinnedSettings[key] = true
+		}
+	}
+	config.ColorDark = !cli.LightColor
+	// detect the background unless light_color was set anywhere
+	config.ColorAuto = resolver.sourceOf(kctx, "light-color") == "default"
+	layered, _ := resolver.load()
+	config.UserConfig = layered.User
+	config.Theme, err = bf.ResolveTheme(cli.Theme, layered)
+	if err != nil {
+		fmt.Fprintf(errorWriter, "%s\n", err)
+		os.Exit(1)
+	}
+	config.ShellMaxPromptTokens = cli.Shell.MaxPromptTokens
+	config.ShellMaxHistoryBlockTokens = cli.Shell.MaxHistoryBlockTokens
+	config.ShellMaxResponseTokens = cli.Shell.MaxResponseTokens
+	config.ShellContextProviders = cli.Shell.Context
+	config.ShellContextTokens = cli.Shell.ContextTokens
+	config.ShellContextEnv = cli.Shell.ContextEnv
+	config.ShellNoRedact = cli.Shell.NoRedact
+	config.ShellRedactPatterns = cli.Shell.RedactPatterns
+	config.ShellHistoryDenylist = cli.Shell.HistoryDenylist
+
+	return config, errorWriter
+}
+
+func runShell(cli *CliConfig, kctx *kong.Context, resolver *configResolver) {
 	// --- Start Shell Mode ---
-	logfileName := util.InitLogging(ctx)
-	fmt.Printf("Logging to %s\n", logfileName)
+	config, errorWriter := makePromptingConfig(cli, kctx, resolver)
+	ctx := context.Background()
 
 	alreadyRunning := os.Getenv("BUTTERFISH_SHELL")
 	if alreadyRunning != "" {
@@ -210,17 +576,49 @@ func main() {
 	}
 
 	config.ShellBinary = shell
-	config.ShellPromptModel = cli.Shell.Model
-	config.ColorDark = !cli.LightColor
 	config.ShellMode = true // Indicate we are running in shell mode
 	config.ShellLeavePromptAlone = cli.Shell.NoCommandPrompt
-	config.ShellMaxPromptTokens = cli.Shell.MaxPromptTokens
-	config.ShellMaxHistoryBlockTokens = cli.Shell.MaxHistoryBlockTokens
-	config.ShellMaxResponseTokens = cli.Shell.MaxResponseTokens
+	config.ShellPagerLines = cli.Shell.PagerLines
+	if cli.Shell.Record != "" {
+		path, err := homedir.Expand(cli.Shell.Record)
+		if err != nil {
+			fmt.Fprintf(errorWriter, "%s\n", err)
+			os.Exit(1)
+		}
+		config.ShellRecordPath = path
+	}
+	if cli.Shell.Trace != "" {
+		path, err := homedir.Expand(cli.Shell.Trace)
+		if err != nil {
+			fmt.Fprintf(errorWriter, "%s\n", err)
+			os.Exit(1)
+		}
+		config.ShellTracePath = path
+	}
 
 	// Removed autosuggest config assignments
 
-	bf.RunShell(ctx, config)
+	err := bf.RunShell(ctx, config)
+	if err != nil {
+		fmt.Fprintf(errorWriter, "%s\n", err)
+		os.Exit(1)
+	}
 	// --- End Shell Mode ---
+}
+
+// The console uses the shell settings from the config files and env vars,
+// only the model can be overridden on the command line.
+func runConsole(cli *CliConfig, kctx *kong.Context, resolver *configResolver) error {
+	err := resolver.resolveCommandFlags(kctx, "shell")
+	if err != nil {
+		return err
+	}
+
+	config, _ := makePromptingConfig(cli, kctx, resolver)
+	if cli.Console.Model != "" {
+		config.ShellPromptModel = cli.Console.Model
+		config.PinnedSettings["model"] = true
+	}
 
+	return bf.RunConsole(context.Background(), config)
 }
@@ -11,7 +11,9 @@ const (
 	// Removed ShellAutosuggestCommand
 	// Removed ShellAutosuggestNewCommand
 	// Removed ShellAutosuggestPrompt
-	ShellSystemMessage = "shell_system_message"
+	ShellSystemMessage  = "shell_system_message"
+	ShellProjectMessage = "shell_project_message"
+	ShellContextMessage = "shell_context_message"
 	// Removed GoalModeSystemMessage
 )
 
@@ -29,7 +31,19 @@ var DefaultPrompts []Prompt = []Prompt{
 
 	{
 		Name:        ShellSystemMessage,
-		Prompt:      "You are an helpful ssistant lives in a Unix shell. Your response should be accurate and concise. You don't need to explain in details unless asked so. System info about the local machine: '{sysinfo}'",
+		Prompt:      "You are an helpful ssistant lives in a Unix shell. Your response should be accurate and concise. You don't need to explain in details unless asked so. The user's shell is currently in the directory {cwd}. System info about the local machine: '{sysinfo}'",
+		OkToReplace: true,
+	},
+
+	{
+		Name:        ShellContextMessage,
+		Prompt:      "The following context about the user's environment was collected automatically, it may help answer questions about their machine and project.\n\n{context}",
+		OkToReplace: true,
+	},
+
+	{
+		Name:        ShellProjectMessage,
+		Prompt:      "The user is currently working inside the project at {root}. Follow these project-specific instructions, and use the pinned project files below as context.\n\n{context}",
 		OkToReplace: true,
 	},
 
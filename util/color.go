@@ -0,0 +1,243 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Colors are written as ANSI escapes for the color depth of the terminal.
+// Theme colors can be given as #rrggbb, a 256 color palette index, or one of
+// the 16 basic color names, and are downgraded to the nearest color the
+// terminal supports.
+
+type ColorDepth int
+
+const (
+	ColorNone ColorDepth = iota // NO_COLOR or a dumb terminal, no styling at all
+	Color16
+	Color256
+	ColorTrue
+)
+
+func (this ColorDepth) String() string {
+	switch this {
+	case ColorNone:
+		return "none"
+	case Color16:
+		return "16"
+	case Color256:
+		return "256"
+	default:
+		return "truecolor"
+	}
+}
+
+// Detect the terminal's color depth from the environment, following
+// https://no-color.org and the COLORTERM convention.
+func DetectColorDepth() ColorDepth {
+	if os.Getenv("NO_COLOR") != "" {
+		return ColorNone
+	}
+
+	colorTerm := strings.ToLower(os.Getenv("COLORTERM"))
+	if colorTerm == "truecolor" || colorTerm == "24bit" {
+		return ColorTrue
+	}
+
+	term := strings.ToLower(os.Getenv("TERM"))
+	switch {
+	case term == "" || term == "dumb":
+		return ColorNone
+	case strings.HasSuffix(term, "-direct"):
+		return ColorTrue
+	case strings.Contains(term, "256color"):
+		return Color256
+	default:
+		return Color16
+	}
+}
+
+// The chroma formatter for syntax highlighting at this depth, "" for none
+func (this ColorDepth) ChromaFormatter() string {
+	switch this {
+	case ColorNone:
+		return ""
+	case Color16:
+		return "terminal16"
+	case Color256:
+		return "terminal256"
+	default:
+		return "terminal16m"
+	}
+}
+
+var basicColorNames = []string{
+	"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white",
+}
+
+// RGB values of the 16 basic colors, using the xterm defaults
+var basicColors = [16][3]int{
+	{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+	{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+	{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+	{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+var cubeLevels = []int{0, 95, 135, 175, 215, 255}
+
+// A parsed color, either an RGB value or a palette index
+type color struct {
+	rgb   [3]int
+	index int // palette index, or -1 for an RGB color
+}
+
+func parseColor(spec string) (*color, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+
+	if strings.HasPrefix(spec, "#") {
+		hex := spec[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		value, err := strconv.ParseUint(hex, 16, 32)
+		if len(hex) != 6 || err != nil {
+			return nil, fmt.Errorf("Invalid color %s, expected #rrggbb", spec)
+		}
+		return &color{
+			rgb:   [3]int{int(value >> 16 & 0xff), int(value >> 8 & 0xff), int(value & 0xff)},
+			index: -1,
+		}, nil
+	}
+
+	if index, err := strconv.Atoi(spec); err == nil {
+		if index < 0 || index > 255 {
+			return nil, fmt.Errorf("Invalid color %s, palette indexes are 0-255", spec)
+		}
+		return &color{rgb: paletteRGB(index), index: index}, nil
+	}
+
+	name := strings.TrimPrefix(spec, "bright_")
+	for i, basic := range basicColorNames {
+		if name == basic {
+			if name != spec {
+				i += 8
+			}
+			return &color{rgb: basicColors[i], index: i}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Invalid color %s, expected #rrggbb, a 0-255 palette index or a color name like red or bright_blue", spec)
+}
+
+// The RGB value of a 256 color palette index
+func paletteRGB(index int) [3]int {
+	switch {
+	case index < 16:
+		return basicColors[index]
+	case index < 232:
+		index -= 16
+		return [3]int{cubeLevels[index/36], cubeLevels[index/6%6], cubeLevels[index%6]}
+	default:
+		gray := 8 + 10*(index-232)
+		return [3]int{gray, gray, gray}
+	}
+}
+
+func colorDistance(a, b [3]int) int {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dr*dr + dg*dg + db*db
+}
+
+func nearestCubeLevel(value int) int {
+	best := 0
+	for i, level := range cubeLevels {
+		if abs(level-value) < abs(cubeLevels[best]-value) {
+			best = i
+		}
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// The nearest color in the 6x6x6 cube or grayscale ramp of the 256 palette
+func nearest256(rgb [3]int) int {
+	r, g, b := nearestCubeLevel(rgb[0]), nearestCubeLevel(rgb[1]), nearestCubeLevel(rgb[2])
+	cube := 16 + 36*r + 6*g + b
+
+	average := (rgb[0] + rgb[1] + rgb[2]) / 3
+	grayIndex := min(max((average-8+5)/10, 0), 23)
+	gray := 232 + grayIndex
+
+	if colorDistance(rgb, paletteRGB(gray)) < colorDistance(rgb, paletteRGB(cube)) {
+		return gray
+	}
+	return cube
+}
+
+func nearest16(rgb [3]int) int {
+	best := 0
+	for i, basic := range basicColors {
+		if colorDistance(rgb, basic) < colorDistance(rgb, basicColors[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+func basicForeground(index int) string {
+	if index < 8 {
+		return fmt.Sprintf("\x1b[%dm", 30+index)
+	}
+	return fmt.Sprintf("\x1b[%dm", 90+index-8)
+}
+
+// The escape sequence setting the foreground to a color at this depth. The
+// special color "default" resets all attributes.
+func (this ColorDepth) Foreground(spec string) (string, error) {
+	if strings.TrimSpace(spec) == "default" {
+		if this == ColorNone {
+			return "", nil
+		}
+		return "\x1b[0m", nil
+	}
+
+	c, err := parseColor(spec)
+	if err != nil {
+		return "", err
+	}
+
+	switch this {
+	case ColorNone:
+		return "", nil
+
+	case Color16:
+		if c.index >= 0 && c.index < 16 {
+			return basicForeground(c.index), nil
+		}
+		return basicForeground(nearest16(c.rgb)), nil
+
+	case Color256:
+		if c.index >= 0 {
+			if c.index < 16 {
+				return basicForeground(c.index), nil
+			}
+			return fmt.Sprintf("\x1b[38;5;%dm", c.index), nil
+		}
+		return fmt.Sprintf("\x1b[38;5;%dm", nearest256(c.rgb)), nil
+
+	default:
+		if c.index >= 0 && c.index < 16 {
+			// keep basic colors so they follow the terminal's palette
+			return basicForeground(c.index), nil
+		}
+		return fmt.Sprintf("\x1b[38;2;%d;%d;%dm", c.rgb[0], c.rgb[1], c.rgb[2]), nil
+	}
+}
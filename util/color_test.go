@@ -0,0 +1,56 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectColorDepth(t *testing.T) {
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("COLORTERM", "")
+
+	t.Setenv("TERM", "xterm-256color")
+	assert.Equal(t, Color256, DetectColorDepth())
+	t.Setenv("TERM", "xterm")
+	assert.Equal(t, Color16, DetectColorDepth())
+	t.Setenv("TERM", "dumb")
+	assert.Equal(t, ColorNone, DetectColorDepth())
+
+	t.Setenv("TERM", "xterm-256color")
+	t.Setenv("COLORTERM", "truecolor")
+	assert.Equal(t, ColorTrue, DetectColorDepth())
+
+	t.Setenv("NO_COLOR", "1")
+	assert.Equal(t, ColorNone, DetectColorDepth())
+}
+
+func TestColorForeground(t *testing.T) {
+	cases := []struct {
+		depth    ColorDepth
+		spec     string
+		expected string
+	}{
+		{ColorTrue, "#ff8000", "\x1b[38;2;255;128;0m"},
+		{Color256, "#ff8000", "\x1b[38;5;208m"},
+		{Color16, "#ff8000", "\x1b[33m"},
+		{Color256, "221", "\x1b[38;5;221m"},
+		{Color16, "221", "\x1b[93m"},
+		{Color256, "#808080", "\x1b[38;5;244m"},
+		{ColorTrue, "red", "\x1b[31m"},
+		{Color16, "bright_blue", "\x1b[94m"},
+		{Color256, "default", "\x1b[0m"},
+		{ColorNone, "#ff8000", ""},
+	}
+
+	for _, c := range cases {
+		color, err := c.depth.Foreground(c.spec)
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, color, "%s at depth %s", c.spec, c.depth)
+	}
+
+	for _, spec := range []string{"#12345", "256", "purple"} {
+		_, err := Color256.Foreground(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
@@ -0,0 +1,257 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Butterfish logs through slog to a rotating file in the XDG state dir. Each
+// -v flag lowers the log level by one step:
+//
+//	(none)  INFO   normal operation
+//	-v      DEBUG  full LLM requests and responses
+//	-vv     TRACE  state machine transitions and similar detail
+//	-vvv    DUMP   raw terminal input and output
+//
+// Calls to the standard log package are routed to slog at INFO.
+
+const (
+	LevelTrace = slog.LevelDebug - 4
+	LevelDump  = slog.LevelDebug - 8
+)
+
+// The slog level for a -v count
+func VerbosityLevel(verbose int) slog.Level {
+	return slog.LevelInfo - slog.Level(4*verbose)
+}
+
+func levelName(level slog.Level) string {
+	switch {
+	case level <= LevelDump:
+		return "DUMP"
+	case level <= LevelTrace:
+		return "TRACE"
+	default:
+		return level.String()
+	}
+}
+
+// Returns true if messages at level are being logged
+func LogEnabled(level slog.Level) bool {
+	return slog.Default().Enabled(context.Background(), level)
+}
+
+// Raw log output for preformatted text like the verbose request boxes, which
+// would be unreadable as an escaped slog attribute. Nil before InitLogging.
+var rawLogWriter io.Writer
+
+// Write preformatted text directly to the log file if level is enabled
+func LogRaw(level slog.Level, text string) {
+	if rawLogWriter == nil || !LogEnabled(level) {
+		return
+	}
+	fmt.Fprintf(rawLogWriter, "%s %s\n%s\n",
+		time.Now().Format(time.RFC3339), levelName(level), text)
+}
+
+// The directory for Butterfish's logs and other state, following the XDG
+// base directory spec: $XDG_STATE_HOME/butterfish, or
+// ~/.local/state/butterfish if XDG_STATE_HOME isn't set.
+func StateDir() (string, error) {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateHome, "butterfish"), nil
+}
+
+type LogConfig struct {
+	Path     string        // log file path, "" for butterfish.log in the state dir
+	Verbose  int           // number of -v flags
+	MaxBytes int64         // rotate when the file reaches this size, 0 for no limit
+	MaxAge   time.Duration // rotate files older than this, 0 for no limit
+}
+
+// Open the log file and route log and slog output to it, returns the path
+// of the log file.
+func InitLogging(ctx context.Context, config LogConfig) (string, error) {
+	path := config.Path
+	if path == "" {
+		stateDir, err := StateDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(stateDir, "butterfish.log")
+	}
+
+	logFile, err := OpenRotatingFile(path, config.MaxBytes, config.MaxAge, 3)
+	if err != nil {
+		return "", err
+	}
+
+	handler := slog.NewTextHandler(logFile, &slog.HandlerOptions{
+		Level: VerbosityLevel(config.Verbose),
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.LevelKey {
+				attr.Value = slog.StringValue(levelName(attr.Value.Any().(slog.Level)))
+			}
+			return attr
+		},
+	})
+	slog.SetDefault(slog.New(handler))
+	rawLogWriter = logFile
+
+	// Best effort to close the log file when the program exits
+	go func() {
+		<-ctx.Done()
+		logFile.Close()
+	}()
+
+	return path, nil
+}
+
+// A file that's rotated to path.1, path.2, etc once it exceeds a size or
+// age limit, keeping a fixed number of old files.
+type RotatingFile struct {
+	Path       string
+	MaxBytes   int64
+	MaxAge     time.Duration
+	MaxBackups int
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// Open a rotating file for appending, creating its directory if needed. If
+// the existing file hasn't been written within MaxAge it's rotated first,
+// and old backups beyond MaxAge are deleted.
+func OpenRotatingFile(path string, maxBytes int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &RotatingFile{
+		Path:       path,
+		MaxBytes:   maxBytes,
+		MaxAge:     maxAge,
+		MaxBackups: maxBackups,
+	}
+
+	err = file.open()
+	if err != nil {
+		return nil, err
+	}
+
+	if file.MaxAge > 0 {
+		info, err := os.Stat(path)
+		if err == nil && file.size > 0 && time.Since(info.ModTime()) > file.MaxAge {
+			err = file.rotate()
+			if err != nil {
+				return nil, err
+			}
+		}
+		file.pruneOld()
+	}
+
+	return file, nil
+}
+
+func (this *RotatingFile) open() error {
+	file, err := os.OpenFile(this.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	this.file = file
+	this.size = info.Size()
+	this.opened = time.Now()
+	return nil
+}
+
+func (this *RotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", this.Path, n)
+}
+
+// Shift path.N to path.N+1, dropping the oldest, and start a new file
+func (this *RotatingFile) rotate() error {
+	this.file.Close()
+
+	os.Remove(this.backupPath(this.MaxBackups))
+	for i := this.MaxBackups - 1; i >= 1; i-- {
+		os.Rename(this.backupPath(i), this.backupPath(i+1))
+	}
+
+	if this.MaxBackups > 0 {
+		err := os.Rename(this.Path, this.backupPath(1))
+		if err != nil {
+			return err
+		}
+	} else {
+		os.Remove(this.Path)
+	}
+
+	return this.open()
+}
+
+// Delete backups that were last written more than MaxAge ago
+func (this *RotatingFile) pruneOld() {
+	matches, _ := filepath.Glob(this.Path + ".*")
+	sort.Strings(matches)
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, this.Path+".")
+		if strings.Trim(suffix, "0123456789") != "" {
+			continue
+		}
+		info, err := os.Stat(match)
+		if err == nil && time.Since(info.ModTime()) > this.MaxAge {
+			os.Remove(match)
+		}
+	}
+}
+
+// Write data, rotating first if it would exceed the size limit or the file
+// is older than the age limit. A single write is never split across files.
+func (this *RotatingFile) Write(data []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	overSize := this.MaxBytes > 0 && this.size > 0 && this.size+int64(len(data)) > this.MaxBytes
+	overAge := this.MaxAge > 0 && this.size > 0 && time.Since(this.opened) > this.MaxAge
+	if overSize || overAge {
+		err := this.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := this.file.Write(data)
+	this.size += int64(n)
+	return n, err
+}
+
+func (this *RotatingFile) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.file.Close()
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "test.log")
+	file, err := OpenRotatingFile(path, 10, 0, 2)
+	assert.Nil(t, err)
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		_, err = file.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+	file.Close()
+
+	// each pair of lines fits in 10 bytes, the oldest file was dropped
+	read := func(p string) string {
+		data, _ := os.ReadFile(p)
+		return string(data)
+	}
+	assert.Equal(t, "four\n", read(path))
+	assert.Equal(t, "three\n", read(path+".1"))
+	assert.Equal(t, "one\ntwo\n", read(path+".2"))
+
+	// a stale file is rotated when it's opened, and stale backups are deleted
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(path, old, old)
+	file, err = OpenRotatingFile(path, 0, time.Hour, 2)
+	assert.Nil(t, err)
+	file.Close()
+	assert.Equal(t, "", read(path))
+	_, err = os.Stat(path + ".1")
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "three\n", read(path+".2"))
+}
+
+func TestVerbosityLevel(t *testing.T) {
+	assert.Equal(t, slog.LevelInfo, VerbosityLevel(0))
+	assert.Equal(t, slog.LevelDebug, VerbosityLevel(1))
+	assert.Equal(t, LevelTrace, VerbosityLevel(2))
+	assert.Equal(t, LevelDump, VerbosityLevel(3))
+	assert.Equal(t, "TRACE", levelName(LevelTrace))
+}
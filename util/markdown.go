@@ -0,0 +1,740 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// MarkdownWriter renders a stream of Markdown, e.g. an LLM answer, for the
+// terminal as it arrives. Text is written a word at a time so it can be
+// wrapped to the terminal width, and headers, emphasis, lists, block quotes
+// and links are styled with ANSI escapes. Fenced code blocks are passed
+// through to a StyleCodeblocksWriter for syntax highlighting. Tables are
+// buffered until the last row arrives so their columns can be aligned.
+
+const (
+	mdLineStart = iota // buffering the start of a line until we know what it is
+	mdText             // inline text
+	mdCode             // inside a fenced code block
+	mdTable            // inside a table row
+)
+
+const (
+	ansiBold         = "\x1b[1m"
+	ansiDim          = "\x1b[2m"
+	ansiItalic       = "\x1b[3m"
+	ansiUnderline    = "\x1b[4m"
+	ansiBoldOff      = "\x1b[22m" // also ends dim
+	ansiItalicOff    = "\x1b[23m"
+	ansiUnderlineOff = "\x1b[24m"
+)
+
+// Longest link text or URL we buffer before giving up and printing it as is
+const maxLinkLength = 256
+
+var (
+	mdHeaderRegex         = regexp.MustCompile(`^#{1,6}$`)
+	mdOrderedRegex        = regexp.MustCompile(`^[0-9]{1,3}[.)]$`)
+	mdRuleRegex           = regexp.MustCompile(`^(-{3,}|\*{3,}|_{3,})$`)
+	mdTableSeparatorRegex = regexp.MustCompile(`^:?-+:?$`)
+	cursorUpRegex         = regexp.MustCompile("\x1b\\[[0-9]*A")
+)
+
+type MarkdownWriter struct {
+	Writer         io.Writer
+	terminalWidth  int
+	normalColor    string
+	highlightColor string
+	code           *StyleCodeblocksWriter
+	plain          bool // no styling, for NO_COLOR
+	lock           sync.Mutex
+
+	out bytes.Buffer // output of the current Write call
+
+	state       int
+	prefix      []byte // start of the current line while in mdLineStart
+	line        []byte // current code or table line
+	codeOpening bool   // the current code line is the opening fence
+	tableRows   [][]string
+	escape      []byte // partial ANSI escape sequence
+
+	col         int    // visible column of the cursor
+	indent      string // written after wrapping, e.g. to line up with a list item
+	indentWidth int
+	word        bytes.Buffer // current word including style escapes
+	wordPlain   bytes.Buffer // current word without escapes, for measuring
+	space       bool         // a space is pending before the next word
+
+	header     bool
+	bold       bool
+	italic     bool
+	inlineCode bool
+	stars      int // number of '*' seen but not yet interpreted
+	linkState  int // 0 not in a link, 1 in [text], 2 after ], 3 in (url)
+	linkText   []byte
+	linkURL    []byte
+}
+
+func NewMarkdownWriter(
+	writer io.Writer,
+	terminalWidth int,
+	normalColor string,
+	highlightColor string,
+	colorScheme string,
+) *MarkdownWriter {
+	if terminalWidth == 0 {
+		panic("terminal width must be > 0")
+	}
+
+	this := &MarkdownWriter{
+		Writer:         writer,
+		terminalWidth:  terminalWidth,
+		normalColor:    normalColor,
+		highlightColor: highlightColor,
+		state:          mdLineStart,
+	}
+	this.code = NewStyleCodeblocksWriter(
+		&this.out, terminalWidth, normalColor, highlightColor, colorScheme)
+	return this
+}
+
+func (this *MarkdownWriter) SetTerminalWidth(width int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.terminalWidth = width
+	this.code.SetTerminalWidth(width)
+}
+
+// Change the text colors and the code highlighting style
+func (this *MarkdownWriter) SetColors(normalColor, highlightColor, colorScheme string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.normalColor = normalColor
+	this.highlightColor = highlightColor
+	this.code.SetColors(normalColor, highlightColor, colorScheme)
+}
+
+// Style for the given color depth, ColorNone writes text without any escapes
+func (this *MarkdownWriter) SetColorDepth(depth ColorDepth) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.plain = depth == ColorNone
+	this.code.SetColorDepth(depth)
+}
+
+// Render a whole document with this writer's colors at the given width, for
+// showing outside the terminal's scrolling output, e.g. in a pager. Code
+// lines are highlighted in place by moving the cursor back over them, here
+// those moves are resolved so each line of the result is its final text.
+func (this *MarkdownWriter) Render(markdown string, width int) string {
+	this.lock.Lock()
+	buffer := new(bytes.Buffer)
+	writer := NewMarkdownWriter(buffer, width,
+		this.normalColor, this.highlightColor, this.code.colorScheme)
+	writer.plain = this.plain
+	writer.code.formatter = this.code.formatter
+	this.lock.Unlock()
+
+	writer.Write([]byte(markdown))
+	writer.Reset()
+
+	lines := strings.Split(buffer.String(), "\n")
+	for i, line := range lines {
+		line = cursorUpRegex.ReplaceAllString(line, "")
+		if j := strings.LastIndexByte(line, '\r'); j >= 0 {
+			line = line[j+1:]
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// An escape sequence to write, or "" when styling is disabled
+func (this *MarkdownWriter) style(escapes ...string) string {
+	if this.plain {
+		return ""
+	}
+	return strings.Join(escapes, "")
+}
+
+// Write out anything still buffered, e.g. an unfinished table, and reset to
+// the start of a new document.
+func (this *MarkdownWriter) Reset() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.finish()
+	this.flushOut()
+
+	this.state = mdLineStart
+	this.prefix = nil
+	this.line = nil
+	this.codeOpening = false
+	this.tableRows = nil
+	this.escape = nil
+	this.col = 0
+	this.indent = ""
+	this.indentWidth = 0
+	this.space = false
+	this.code.Reset()
+}
+
+func (this *MarkdownWriter) Write(p []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, char := range p {
+		this.writeByte(char)
+	}
+
+	return len(p), this.flushOut()
+}
+
+func (this *MarkdownWriter) flushOut() error {
+	if this.out.Len() == 0 {
+		return nil
+	}
+	_, err := this.Writer.Write(this.out.Bytes())
+	this.out.Reset()
+	return err
+}
+
+func (this *MarkdownWriter) writeByte(char byte) {
+	// pass ANSI escapes through untouched, e.g. the answer color that's
+	// written before the LLM output
+	if this.escape != nil || char == 0x1b {
+		this.escape = append(this.escape, char)
+		n := len(this.escape)
+		if (n == 2 && char != '[') || (n > 2 && char >= 0x40 && char <= 0x7e) {
+			this.writeEscape(this.escape)
+			this.escape = nil
+		}
+		return
+	}
+
+	switch this.state {
+	case mdLineStart:
+		this.writePrefix(char)
+	case mdText:
+		this.writeInline(char)
+	case mdCode:
+		this.writeCode(char)
+	case mdTable:
+		this.writeTable(char)
+	}
+}
+
+func (this *MarkdownWriter) writeEscape(escape []byte) {
+	switch {
+	case this.state == mdCode:
+		this.code.Write(escape)
+	case this.state == mdLineStart && len(this.prefix) == 0:
+		this.out.Write(escape)
+	default:
+		this.word.Write(escape)
+	}
+}
+
+// The color of the current line's text
+func (this *MarkdownWriter) lineColor() string {
+	if this.header {
+		return this.highlightColor
+	}
+	return this.normalColor
+}
+
+func leadingWhitespace(s []byte) int {
+	i := 0
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// At the start of a line we buffer the indentation and the first token so
+// we can tell whether it's a header, list item, quote, fence, etc.
+func (this *MarkdownWriter) writePrefix(char byte) {
+	indentLen := leadingWhitespace(this.prefix)
+	tokenLen := len(this.prefix) - indentLen
+	isSpace := char == ' ' || char == '\t'
+
+	if isSpace && tokenLen == 0 {
+		this.prefix = append(this.prefix, char)
+		return
+	}
+	if char == '\n' || isSpace || tokenLen >= 16 {
+		this.startLine(char)
+		return
+	}
+
+	this.prefix = append(this.prefix, char)
+	token := this.prefix[indentLen:]
+
+	if bytes.HasPrefix(token, []byte("```")) {
+		this.flushTable()
+		prefix := this.prefix
+		this.prefix = nil
+		this.state = mdCode
+		this.codeOpening = true
+		this.line = nil
+		for _, c := range prefix {
+			this.writeCode(c)
+		}
+	} else if token[0] == '|' {
+		this.prefix = nil
+		this.state = mdTable
+		this.line = append([]byte{}, token...)
+	}
+}
+
+// Interpret the buffered line prefix, term is the byte that ended it
+func (this *MarkdownWriter) startLine(term byte) {
+	indentLen := leadingWhitespace(this.prefix)
+	indent := string(this.prefix[:indentLen])
+	token := string(this.prefix[indentLen:])
+	this.prefix = nil
+
+	// any other line ends a table
+	this.flushTable()
+
+	indentWidth := runewidth.StringWidth(strings.ReplaceAll(indent, "\t", "    "))
+
+	switch {
+	case term == '\n' && token == "":
+		this.out.WriteString("\n")
+		this.col = 0
+		return
+
+	case term == '\n' && mdRuleRegex.MatchString(token):
+		this.out.WriteString(this.style(ansiDim) + strings.Repeat("─", this.terminalWidth) + this.style(ansiBoldOff) + "\n")
+		this.col = 0
+		return
+
+	case term == ' ' && mdHeaderRegex.MatchString(token):
+		this.header = true
+		this.out.WriteString(this.highlightColor + this.style(ansiBold))
+		this.setIndent("", 0)
+
+	case term == ' ' && token == ">":
+		bar := indent + this.style(ansiDim) + "│" + this.style(ansiBoldOff) + " "
+		this.out.WriteString(bar)
+		this.setIndent(bar, indentWidth+2)
+
+	case term == ' ' && (token == "-" || token == "*" || token == "+"):
+		this.out.WriteString(indent + "• ")
+		this.setIndent(strings.Repeat(" ", indentWidth+2), indentWidth+2)
+
+	case term == ' ' && mdOrderedRegex.MatchString(token):
+		this.out.WriteString(indent + token + " ")
+		width := indentWidth + len(token) + 1
+		this.setIndent(strings.Repeat(" ", width), width)
+
+	default:
+		// plain text, keep its indentation for wrapped lines
+		this.out.WriteString(indent)
+		this.setIndent(indent, indentWidth)
+		this.state = mdText
+		for i := 0; i < len(token); i++ {
+			this.writeInline(token[i])
+		}
+		this.writeByte(term)
+		return
+	}
+
+	this.state = mdText
+}
+
+func (this *MarkdownWriter) setIndent(indent string, width int) {
+	this.indent = indent
+	this.indentWidth = width
+	this.col = width
+}
+
+func (this *MarkdownWriter) writeInline(char byte) {
+	if this.stars > 0 && char != '*' {
+		this.resolveStars(char)
+	}
+
+	if this.linkState != 0 && this.writeLink(char) {
+		return
+	}
+
+	if this.inlineCode {
+		switch char {
+		case '`':
+			this.inlineCode = false
+			this.word.WriteString(this.lineColor())
+		case '\n':
+			this.endLine()
+		case ' ', '\t':
+			this.emitWord()
+			this.space = true
+		default:
+			this.addChar(char)
+		}
+		return
+	}
+
+	switch char {
+	case '\n':
+		this.endLine()
+	case ' ', '\t':
+		this.emitWord()
+		this.space = true
+	case '*':
+		this.stars++
+	case '`':
+		this.inlineCode = true
+		this.word.WriteString(this.highlightColor)
+	case '[':
+		this.linkState = 1
+		this.linkText = nil
+		this.linkURL = nil
+	default:
+		this.addChar(char)
+	}
+}
+
+// Interpret a run of '*' now that we know the following byte. A run that
+// opens emphasis must be followed by a non-space, so `2 * 3` is left alone.
+func (this *MarkdownWriter) resolveStars(next byte) {
+	n := this.stars
+	this.stars = 0
+	opening := next != ' ' && next != '\t' && next != '\n'
+
+	if n >= 2 && (this.bold || opening) {
+		this.bold = !this.bold
+		n -= 2
+		if !this.header {
+			if this.bold {
+				this.word.WriteString(this.style(ansiBold))
+			} else {
+				this.word.WriteString(this.style(ansiBoldOff))
+			}
+		}
+	}
+	if n >= 1 && (this.italic || opening) {
+		this.italic = !this.italic
+		n--
+		if this.italic {
+			this.word.WriteString(this.style(ansiItalic))
+		} else {
+			this.word.WriteString(this.style(ansiItalicOff))
+		}
+	}
+	for ; n > 0; n-- {
+		this.addChar('*')
+	}
+}
+
+// Buffer a [text](url) link, returns false if char should be handled as
+// regular text.
+func (this *MarkdownWriter) writeLink(char byte) bool {
+	switch this.linkState {
+	case 1:
+		if char == ']' {
+			this.linkState = 2
+			return true
+		}
+		if char == '\n' || len(this.linkText) >= maxLinkLength {
+			this.abortLink()
+			return false
+		}
+		this.linkText = append(this.linkText, char)
+		return true
+
+	case 2:
+		if char == '(' {
+			this.linkState = 3
+			return true
+		}
+		this.abortLink()
+		return false
+
+	case 3:
+		if char == ')' {
+			this.renderLink()
+			return true
+		}
+		if char == '\n' || char == ' ' || len(this.linkURL) >= maxLinkLength {
+			this.abortLink()
+			return false
+		}
+		this.linkURL = append(this.linkURL, char)
+		return true
+	}
+
+	return false
+}
+
+// Not a link after all, write what we buffered as text
+func (this *MarkdownWriter) abortLink() {
+	text := string(this.linkText)
+	if this.linkState >= 2 {
+		text += "]"
+	}
+	if this.linkState == 3 {
+		text += "(" + string(this.linkURL)
+	}
+	this.linkState = 0
+
+	// the text may contain another link
+	this.addChar('[')
+	for i := 0; i < len(text); i++ {
+		this.writeInline(text[i])
+	}
+}
+
+// Write the link text underlined, followed by the URL unless it's the same
+func (this *MarkdownWriter) renderLink() {
+	text := string(this.linkText)
+	url := string(this.linkURL)
+	this.linkState = 0
+
+	this.word.WriteString(this.style(ansiUnderline))
+	for i := 0; i < len(text); i++ {
+		this.writeInline(text[i])
+	}
+	this.word.WriteString(this.style(ansiUnderlineOff))
+
+	if url != "" && url != text {
+		this.emitWord()
+		this.space = true
+		this.addChar('(')
+		for i := 0; i < len(url); i++ {
+			this.addChar(url[i])
+		}
+		this.addChar(')')
+	}
+}
+
+func (this *MarkdownWriter) addChar(char byte) {
+	this.word.WriteByte(char)
+	this.wordPlain.WriteByte(char)
+}
+
+// Write the current word, wrapping first if it doesn't fit on the line
+func (this *MarkdownWriter) emitWord() {
+	if this.word.Len() == 0 {
+		return
+	}
+
+	width := runewidth.StringWidth(this.wordPlain.String())
+	if width > 0 {
+		space := 0
+		if this.space && this.col > this.indentWidth {
+			space = 1
+		}
+
+		if this.col > this.indentWidth && this.col+space+width > this.terminalWidth {
+			this.out.WriteString("\n")
+			this.out.WriteString(this.indent)
+			this.col = this.indentWidth
+		} else if space == 1 {
+			this.out.WriteByte(' ')
+			this.col++
+		}
+		this.space = false
+	}
+
+	this.out.Write(this.word.Bytes())
+	this.col += width
+	if this.col > this.terminalWidth {
+		// a word longer than the line, the terminal wrapped it
+		this.col %= this.terminalWidth
+	}
+
+	this.word.Reset()
+	this.wordPlain.Reset()
+}
+
+// End the current text line, styles don't carry over to the next line
+func (this *MarkdownWriter) endLine() {
+	this.finishText()
+	this.out.WriteString("\n")
+	this.col = 0
+	this.space = false
+	this.state = mdLineStart
+}
+
+func (this *MarkdownWriter) finishText() {
+	if this.stars > 0 {
+		this.resolveStars('\n')
+	}
+	if this.linkState != 0 {
+		this.abortLink()
+	}
+	this.emitWord()
+
+	if this.header || this.bold || this.italic || this.inlineCode {
+		this.out.WriteString(this.style(ansiBoldOff, ansiItalicOff, ansiUnderlineOff) + this.normalColor)
+	}
+	this.header = false
+	this.bold = false
+	this.italic = false
+	this.inlineCode = false
+}
+
+func (this *MarkdownWriter) writeCode(char byte) {
+	this.code.Write([]byte{char})
+
+	if char != '\n' {
+		this.line = append(this.line, char)
+		return
+	}
+
+	line := strings.TrimSpace(string(this.line))
+	if !this.codeOpening && strings.HasPrefix(line, "```") {
+		this.state = mdLineStart
+		this.col = 0
+	}
+	this.codeOpening = false
+	this.line = nil
+}
+
+func (this *MarkdownWriter) writeTable(char byte) {
+	if char != '\n' {
+		this.line = append(this.line, char)
+		return
+	}
+
+	this.tableRows = append(this.tableRows, splitTableRow(string(this.line)))
+	this.line = nil
+	this.state = mdLineStart
+}
+
+// Write out whatever is buffered at the end of the document
+func (this *MarkdownWriter) finish() {
+	if this.escape != nil {
+		this.writeEscape(this.escape)
+		this.escape = nil
+	}
+
+	switch this.state {
+	case mdLineStart:
+		if len(this.prefix) > 0 {
+			prefix := this.prefix
+			this.prefix = nil
+			this.flushTable()
+			this.state = mdText
+			for _, char := range prefix {
+				this.writeInline(char)
+			}
+			this.finishText()
+		}
+	case mdText:
+		this.finishText()
+	case mdTable:
+		this.tableRows = append(this.tableRows, splitTableRow(string(this.line)))
+	}
+
+	this.flushTable()
+}
+
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	line = strings.TrimSuffix(line, "|")
+
+	cells := strings.Split(line, "|")
+	for i := range cells {
+		cells[i] = strings.TrimSpace(cells[i])
+	}
+	return cells
+}
+
+func isTableSeparator(row []string) bool {
+	for _, cell := range row {
+		if !mdTableSeparatorRegex.MatchString(cell) {
+			return false
+		}
+	}
+	return len(row) > 0
+}
+
+// Table cells are printed without inline styling so they can be measured
+func stripInlineMarkdown(s string) string {
+	s = strings.ReplaceAll(s, "**", "")
+	s = strings.ReplaceAll(s, "`", "")
+	return s
+}
+
+// Write the buffered table rows with aligned columns, or one row per line if
+// the table is too wide for the terminal.
+func (this *MarkdownWriter) flushTable() {
+	if len(this.tableRows) == 0 {
+		return
+	}
+
+	rows := [][]string{}
+	header := false
+	numCols := 0
+	for i, row := range this.tableRows {
+		if i == 1 && isTableSeparator(row) {
+			header = true
+			continue
+		}
+		for j := range row {
+			row[j] = stripInlineMarkdown(row[j])
+		}
+		rows = append(rows, row)
+		numCols = max(numCols, len(row))
+	}
+	this.tableRows = nil
+
+	widths := make([]int, numCols)
+	for _, row := range rows {
+		for j, cell := range row {
+			widths[j] = max(widths[j], runewidth.StringWidth(cell))
+		}
+	}
+
+	total := 3 * (numCols - 1)
+	for _, width := range widths {
+		total += width
+	}
+
+	if total > this.terminalWidth {
+		for _, row := range rows {
+			this.out.WriteString(strings.Join(row, " | ") + "\n")
+		}
+		this.col = 0
+		return
+	}
+
+	for i, row := range rows {
+		for j := 0; j < numCols; j++ {
+			cell := ""
+			if j < len(row) {
+				cell = row[j]
+			}
+			padding := widths[j] - runewidth.StringWidth(cell)
+			if i == 0 && header {
+				cell = this.style(ansiBold) + cell + this.style(ansiBoldOff)
+			}
+			this.out.WriteString(cell)
+			if j < numCols-1 {
+				this.out.WriteString(strings.Repeat(" ", padding))
+				this.out.WriteString(" │ ")
+			}
+		}
+		this.out.WriteString("\n")
+
+		if i == 0 && header {
+			parts := []string{}
+			for _, width := range widths {
+				parts = append(parts, strings.Repeat("─", width))
+			}
+			this.out.WriteString(strings.Join(parts, "─┼─") + "\n")
+		}
+	}
+	this.col = 0
+}
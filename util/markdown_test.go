@@ -0,0 +1,108 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Write s to a MarkdownWriter a few bytes at a time, like a token stream
+func renderMarkdown(s string, width int) string {
+	buffer := new(bytes.Buffer)
+	writer := NewMarkdownWriter(buffer, width, "NORMAL", "HIGHLIGHT", "")
+
+	for i := 0; i < len(s); i += 3 {
+		writer.Write([]byte(s[i:min(i+3, len(s))]))
+	}
+	writer.Reset()
+	return buffer.String()
+}
+
+func TestMarkdownWriterInline(t *testing.T) {
+	assert.Equal(t,
+		"Some \x1b[1mbold\x1b[22m and \x1b[3mitalic\x1b[23m text\n",
+		renderMarkdown("Some **bold** and *italic* text\n", 80))
+
+	assert.Equal(t,
+		"Run HIGHLIGHTls -lNORMAL now\n",
+		renderMarkdown("Run `ls -l` now\n", 80))
+
+	assert.Equal(t,
+		"See the \x1b[4mdocs\x1b[24m (https://example.com)\n",
+		renderMarkdown("See the [docs](https://example.com)\n", 80))
+
+	// not emphasis or links
+	assert.Equal(t, "2 * 3 = 6\n", renderMarkdown("2 * 3 = 6\n", 80))
+	assert.Equal(t, "array[0] is first\n", renderMarkdown("array[0] is first\n", 80))
+
+	// unterminated text is written on Reset
+	assert.Equal(t, "no newline", renderMarkdown("no newline", 80))
+}
+
+func TestMarkdownWriterBlocks(t *testing.T) {
+	assert.Equal(t,
+		"HIGHLIGHT\x1b[1mTitle\x1b[22m\x1b[23m\x1b[24mNORMAL\nBody\n",
+		renderMarkdown("## Title\nBody\n", 80))
+
+	assert.Equal(t,
+		"• one\n• two\n  1. nested\n",
+		renderMarkdown("- one\n* two\n  1. nested\n", 80))
+
+	assert.Equal(t,
+		"\x1b[2m│\x1b[22m quoted\n",
+		renderMarkdown("> quoted\n", 80))
+
+	assert.Equal(t,
+		"\x1b[2m──────────\x1b[22m\n",
+		renderMarkdown("---\n", 10))
+}
+
+func TestMarkdownWriterWrap(t *testing.T) {
+	assert.Equal(t,
+		"the quick brown\nfox jumps over\nthe lazy dog\n",
+		renderMarkdown("the quick brown fox jumps over the lazy dog\n", 16))
+
+	// wrapped list items line up with the item text
+	assert.Equal(t,
+		"• the quick\n  brown fox\n",
+		renderMarkdown("- the quick brown fox\n", 12))
+}
+
+func TestMarkdownWriterTable(t *testing.T) {
+	table := "| Name | Size |\n|------|-----:|\n| a.txt | 10 |\n| b | 2000 |\n"
+
+	assert.Equal(t,
+		"\x1b[1mName\x1b[22m  │ \x1b[1mSize\x1b[22m\n"+
+			"──────┼─────\n"+
+			"a.txt │ 10\n"+
+			"b     │ 2000\n",
+		renderMarkdown(table, 80))
+
+	// too wide to align
+	assert.Equal(t,
+		"Name | Size\na.txt | 10\nb | 2000\n",
+		renderMarkdown(table, 10))
+}
+
+func TestMarkdownWriterCodeBlock(t *testing.T) {
+	out := renderMarkdown("Before\n```\nfoo()\n```\nAfter **x**\n", 80)
+
+	// code is handled by StyleCodeblocksWriter, the fence isn't printed
+	assert.Contains(t, out, "foo")
+	assert.NotContains(t, out, "```")
+	// markdown after the block is rendered again
+	assert.Contains(t, out, "After \x1b[1mx\x1b[22m\n")
+}
+
+func TestMarkdownWriterRender(t *testing.T) {
+	writer := NewMarkdownWriter(new(bytes.Buffer), 80, "NORMAL", "HIGHLIGHT", "")
+	out := writer.Render("Intro **text**\n```go\nfmt.Println(\"a very long line\")\n```\n", 20)
+
+	assert.Contains(t, out, "Intro \x1b[1mtext\x1b[22m\n")
+	assert.Contains(t, out, "[1] go")
+	assert.Contains(t, out, "Println")
+	// the in-place highlighting of code lines is resolved
+	assert.NotContains(t, out, "\r")
+	assert.NotRegexp(t, "\x1b\\[[0-9]*A", out)
+}
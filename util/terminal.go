@@ -0,0 +1,704 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// Terminal is a model of a VT100/xterm screen: a grid of characters, the
+// cursor, and the lines that scrolled off the top. Output written to it is
+// interpreted like a terminal would, so carriage return progress bars, cursor
+// movement and line redraws leave the text the user actually saw. Colors and
+// other attributes are ignored, we only keep the text.
+//
+// Supported: printing with wrapping and wide characters, CR, LF, BS, tabs,
+// cursor movement, erasing, inserting and deleting characters and lines,
+// scroll regions, saving the cursor, and the alternate screen. Other escape
+// sequences are skipped.
+
+const (
+	termGround = iota
+	termEscape
+	termCharset // ESC ( and friends, followed by one more byte
+	termCSI
+	termString // OSC, DCS, etc, ended by BEL or ST
+	termStringEscape
+)
+
+type terminalCell struct {
+	text  string // "" for a blank cell
+	width int    // 0 for the right half of a wide character
+}
+
+var blankCell = terminalCell{width: 1}
+
+type terminalLine struct {
+	cells []terminalCell
+	// the line continues on the next one because the text wrapped
+	wrapped bool
+}
+
+type terminalScreen struct {
+	lines         []*terminalLine
+	row, col      int
+	savedRow      int
+	savedCol      int
+	top, bottom   int // scroll region, inclusive
+	pendingWrap   bool
+	hasScrollback bool
+}
+
+type Terminal struct {
+	width, height int
+	maxScrollback int
+	scrollback    []*terminalLine
+
+	screen *terminalScreen
+	// the normal screen while the alternate screen is shown
+	mainScreen *terminalScreen
+
+	state    int
+	sequence []byte // the escape sequence being parsed
+	partial  []byte // an incomplete UTF-8 character
+	mutex    sync.Mutex
+}
+
+// NewTerminal returns a terminal of the given size, keeping up to
+// maxScrollback lines that scroll off the top
+func NewTerminal(width, height, maxScrollback int) *Terminal {
+	this := &Terminal{
+		width:         max(width, 1),
+		height:        max(height, 1),
+		maxScrollback: maxScrollback,
+	}
+	this.screen = this.newScreen(true)
+	return this
+}
+
+func (this *Terminal) newLine() *terminalLine {
+	line := &terminalLine{cells: make([]terminalCell, this.width)}
+	for i := range line.cells {
+		line.cells[i] = blankCell
+	}
+	return line
+}
+
+func (this *Terminal) newScreen(hasScrollback bool) *terminalScreen {
+	screen := &terminalScreen{
+		lines:         make([]*terminalLine, this.height),
+		bottom:        this.height - 1,
+		hasScrollback: hasScrollback,
+	}
+	for i := range screen.lines {
+		screen.lines[i] = this.newLine()
+	}
+	return screen
+}
+
+// Reset clears the screen and scrollback
+func (this *Terminal) Reset() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.reset()
+}
+
+func (this *Terminal) reset() {
+	this.scrollback = nil
+	this.screen = this.newScreen(true)
+	this.mainScreen = nil
+	this.state = termGround
+	this.sequence = nil
+	this.partial = nil
+}
+
+// Resize changes the size of the screen, lines are cut or padded to the new
+// width, and if it gets shorter lines above the cursor go to the scrollback
+func (this *Terminal) Resize(width, height int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	width = max(width, 1)
+	height = max(height, 1)
+	this.width = width
+
+	for _, screen := range []*terminalScreen{this.screen, this.mainScreen} {
+		if screen == nil {
+			continue
+		}
+		for _, line := range screen.lines {
+			line.resize(width)
+		}
+		for len(screen.lines) > height {
+			if screen.row > 0 {
+				if screen.hasScrollback {
+					this.addScrollback(screen.lines[0])
+				}
+				screen.lines = screen.lines[1:]
+				screen.row--
+			} else {
+				screen.lines = screen.lines[:len(screen.lines)-1]
+			}
+		}
+		for len(screen.lines) < height {
+			screen.lines = append(screen.lines, this.newLine())
+		}
+		screen.top = 0
+		screen.bottom = height - 1
+		screen.row = min(screen.row, height-1)
+		screen.col = min(screen.col, width-1)
+		screen.savedRow = min(screen.savedRow, height-1)
+		screen.savedCol = min(screen.savedCol, width-1)
+		screen.pendingWrap = false
+	}
+	this.height = height
+}
+
+func (this *terminalLine) resize(width int) {
+	if len(this.cells) > width {
+		this.cells = this.cells[:width]
+		// don't leave half a wide character
+		if width > 0 && this.cells[width-1].width == 2 {
+			this.cells[width-1] = blankCell
+		}
+		return
+	}
+	for len(this.cells) < width {
+		this.cells = append(this.cells, blankCell)
+	}
+}
+
+// Size returns the width and height of the screen
+func (this *Terminal) Size() (int, int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.width, this.height
+}
+
+// Cursor returns the cursor position on the screen, from 0
+func (this *Terminal) Cursor() (int, int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.screen.row, this.screen.col
+}
+
+// SetCursor moves the cursor, e.g. to where the real terminal reports it
+func (this *Terminal) SetCursor(row, col int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.moveTo(row, col)
+}
+
+// Screen returns the text of the visible screen, without trailing blank
+// lines or spaces
+func (this *Terminal) Screen() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return linesText(this.screen.lines, false)
+}
+
+// Text returns the scrollback and the normal screen, with lines that wrapped
+// joined back together
+func (this *Terminal) Text() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	screen := this.screen
+	if this.mainScreen != nil {
+		screen = this.mainScreen
+	}
+	lines := append(append([]*terminalLine{}, this.scrollback...), screen.lines...)
+	return linesText(lines, true)
+}
+
+// The text of lines, if join is set lines that wrapped are joined with the
+// next one
+func linesText(lines []*terminalLine, join bool) string {
+	var builder, line strings.Builder
+	for _, l := range lines {
+		for _, cell := range l.cells {
+			switch {
+			case cell.width == 0:
+			case cell.text == "":
+				line.WriteByte(' ')
+			default:
+				line.WriteString(cell.text)
+			}
+		}
+		if l.wrapped && join {
+			continue
+		}
+		builder.WriteString(strings.TrimRight(line.String(), " "))
+		builder.WriteByte('\n')
+		line.Reset()
+	}
+	builder.WriteString(line.String())
+	return strings.TrimRight(builder.String(), " \n")
+}
+
+func (this *Terminal) addScrollback(line *terminalLine) {
+	if this.maxScrollback <= 0 {
+		return
+	}
+	this.scrollback = append(this.scrollback, line)
+	if len(this.scrollback) > this.maxScrollback {
+		this.scrollback = this.scrollback[len(this.scrollback)-this.maxScrollback:]
+	}
+}
+
+func (this *Terminal) Write(p []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	data := p
+	if len(this.partial) > 0 {
+		data = append(this.partial, p...)
+		this.partial = nil
+	}
+
+	for i := 0; i < len(data); {
+		b := data[i]
+		if this.state != termGround || b < 0x80 {
+			this.parseByte(b)
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size == 1 {
+			if !utf8.FullRune(data[i:]) {
+				// the rest of the character is in the next write
+				this.partial = append([]byte{}, data[i:]...)
+				break
+			}
+		}
+		this.print(r)
+		i += size
+	}
+
+	return len(p), nil
+}
+
+func (this *Terminal) parseByte(b byte) {
+	switch this.state {
+	case termGround:
+		switch b {
+		case 0x1b:
+			this.state = termEscape
+			this.sequence = this.sequence[:0]
+		case '\r':
+			this.moveTo(this.screen.row, 0)
+		case '\n', '\v', '\f':
+			this.lineFeed()
+		case '\b':
+			this.moveTo(this.screen.row, this.screen.col-1)
+		case '\t':
+			this.moveTo(this.screen.row, (this.screen.col/8+1)*8)
+		default:
+			if b >= 0x20 && b != 0x7f {
+				this.print(rune(b))
+			}
+		}
+
+	case termEscape:
+		this.state = termGround
+		this.escape(b)
+
+	case termCharset:
+		this.state = termGround
+
+	case termCSI:
+		if b == 0x1b {
+			// an escape interrupts the sequence
+			this.state = termEscape
+			return
+		}
+		this.sequence = append(this.sequence, b)
+		if b >= 0x40 && b <= 0x7e {
+			this.state = termGround
+			this.csi(this.sequence)
+		}
+
+	case termString:
+		switch b {
+		case 0x07:
+			this.state = termGround
+		case 0x1b:
+			this.state = termStringEscape
+		}
+
+	case termStringEscape:
+		if b == '\\' {
+			this.state = termGround
+		} else {
+			this.state = termString
+		}
+	}
+}
+
+func (this *Terminal) escape(b byte) {
+	screen := this.screen
+	switch b {
+	case '[':
+		this.state = termCSI
+	case ']', 'P', 'X', '^', '_':
+		this.state = termString
+	case '(', ')', '*', '+', '#', '%':
+		this.state = termCharset
+	case '7':
+		screen.savedRow, screen.savedCol = screen.row, screen.col
+	case '8':
+		this.moveTo(screen.savedRow, screen.savedCol)
+	case 'D':
+		this.lineFeed()
+	case 'E':
+		this.moveTo(screen.row, 0)
+		this.lineFeed()
+	case 'M':
+		screen.pendingWrap = false
+		if screen.row == screen.top {
+			this.scrollDown(1)
+		} else if screen.row > 0 {
+			screen.row--
+		}
+	case 'c':
+		this.reset()
+	}
+}
+
+func (this *Terminal) csi(sequence []byte) {
+	final := sequence[len(sequence)-1]
+	body := string(sequence[:len(sequence)-1])
+	private := ""
+	if len(body) > 0 && strings.ContainsRune("?<=>", rune(body[0])) {
+		private = body[:1]
+		body = body[1:]
+	}
+	// intermediate bytes, e.g. the space in CSI 2 q, aren't used by anything
+	// we handle
+	intermediate := strings.IndexFunc(body, func(r rune) bool { return r >= 0x20 && r <= 0x2f })
+	if intermediate >= 0 {
+		if final != 'h' && final != 'l' {
+			return
+		}
+		body = body[:intermediate]
+	}
+
+	params := []int{}
+	if body != "" {
+		for _, field := range strings.Split(body, ";") {
+			// ignore sub-parameters like 4:3
+			field, _, _ = strings.Cut(field, ":")
+			n, _ := strconv.Atoi(field)
+			params = append(params, n)
+		}
+	}
+	// the first parameter, or 1 if it's missing or 0
+	count := 1
+	if len(params) > 0 && params[0] > 0 {
+		count = params[0]
+	}
+	param := func(i int) int {
+		if i < len(params) {
+			return params[i]
+		}
+		return 0
+	}
+
+	if private == "?" {
+		if final == 'h' || final == 'l' {
+			for _, mode := range params {
+				if mode == 1049 || mode == 1047 || mode == 47 {
+					this.altScreen(final == 'h', mode == 1049)
+				}
+			}
+		}
+		return
+	}
+	if private != "" {
+		return
+	}
+
+	screen := this.screen
+	switch final {
+	case 'A':
+		this.moveTo(max(screen.row-count, min(screen.top, screen.row)), screen.col)
+	case 'B':
+		this.moveTo(min(screen.row+count, max(screen.bottom, screen.row)), screen.col)
+	case 'C', 'a':
+		this.moveTo(screen.row, screen.col+count)
+	case 'D':
+		this.moveTo(screen.row, screen.col-count)
+	case 'E':
+		this.moveTo(screen.row+count, 0)
+	case 'F':
+		this.moveTo(screen.row-count, 0)
+	case 'G', '`':
+		this.moveTo(screen.row, count-1)
+	case 'H', 'f':
+		row := 1
+		if param(0) > 0 {
+			row = param(0)
+		}
+		col := 1
+		if param(1) > 0 {
+			col = param(1)
+		}
+		this.moveTo(row-1, col-1)
+	case 'd':
+		this.moveTo(count-1, screen.col)
+	case 'e':
+		this.moveTo(screen.row+count, screen.col)
+	case 'J':
+		this.eraseDisplay(param(0))
+	case 'K':
+		this.eraseLine(param(0))
+	case '@':
+		this.insertCells(count)
+	case 'P':
+		this.deleteCells(count)
+	case 'X':
+		line := screen.lines[screen.row]
+		for i := screen.col; i < min(screen.col+count, this.width); i++ {
+			line.cells[i] = blankCell
+		}
+		screen.pendingWrap = false
+	case 'L':
+		if screen.row >= screen.top && screen.row <= screen.bottom {
+			this.insertLines(screen.row, count)
+		}
+	case 'M':
+		if screen.row >= screen.top && screen.row <= screen.bottom {
+			this.deleteLines(screen.row, count)
+		}
+	case 'S':
+		this.scrollUp(count)
+	case 'T':
+		this.scrollDown(count)
+	case 'r':
+		top := max(param(0), 1) - 1
+		bottom := this.height - 1
+		if param(1) > 0 {
+			bottom = min(param(1), this.height) - 1
+		}
+		if top < bottom {
+			screen.top, screen.bottom = top, bottom
+			this.moveTo(0, 0)
+		}
+	case 's':
+		screen.savedRow, screen.savedCol = screen.row, screen.col
+	case 'u':
+		this.moveTo(screen.savedRow, screen.savedCol)
+	}
+}
+
+func (this *Terminal) moveTo(row, col int) {
+	screen := this.screen
+	screen.row = max(0, min(row, this.height-1))
+	screen.col = max(0, min(col, this.width-1))
+	screen.pendingWrap = false
+}
+
+func (this *Terminal) print(r rune) {
+	screen := this.screen
+	width := runewidth.RuneWidth(r)
+	if width > this.width {
+		return
+	}
+
+	if width == 0 {
+		// a combining character goes with the previous one
+		col := screen.col
+		if !screen.pendingWrap {
+			col--
+		}
+		line := screen.lines[screen.row]
+		for col > 0 && line.cells[col].width == 0 {
+			col--
+		}
+		if col >= 0 && line.cells[col].text != "" {
+			line.cells[col].text += string(r)
+		}
+		return
+	}
+
+	if screen.pendingWrap || screen.col+width > this.width {
+		screen.lines[screen.row].wrapped = true
+		screen.col = 0
+		screen.pendingWrap = false
+		this.lineFeed()
+	}
+
+	line := screen.lines[screen.row]
+	this.clearWide(line, screen.col)
+	if width == 2 {
+		this.clearWide(line, screen.col+1)
+	}
+	line.cells[screen.col] = terminalCell{text: string(r), width: width}
+	if width == 2 {
+		line.cells[screen.col+1] = terminalCell{width: 0}
+	}
+
+	screen.col += width
+	if screen.col >= this.width {
+		screen.col = this.width - 1
+		screen.pendingWrap = true
+	}
+}
+
+// Blank the other half of a wide character that's partly overwritten
+func (this *Terminal) clearWide(line *terminalLine, col int) {
+	if col >= this.width {
+		return
+	}
+	cell := line.cells[col]
+	if cell.width == 2 && col+1 < this.width {
+		line.cells[col+1] = blankCell
+	} else if cell.width == 0 && col > 0 {
+		line.cells[col-1] = blankCell
+	}
+}
+
+func (this *Terminal) lineFeed() {
+	screen := this.screen
+	screen.pendingWrap = false
+	if screen.row == screen.bottom {
+		this.scrollUp(1)
+	} else if screen.row < this.height-1 {
+		screen.row++
+	}
+}
+
+func (this *Terminal) scrollUp(n int) {
+	screen := this.screen
+	if screen.top == 0 && screen.hasScrollback {
+		for i := 0; i < min(n, screen.bottom+1); i++ {
+			this.addScrollback(screen.lines[i])
+		}
+	}
+	this.deleteLines(screen.top, n)
+}
+
+func (this *Terminal) scrollDown(n int) {
+	this.insertLines(this.screen.top, n)
+}
+
+// Insert blank lines at row, pushing lines down and off the bottom of the
+// scroll region
+func (this *Terminal) insertLines(row, n int) {
+	screen := this.screen
+	n = min(n, screen.bottom-row+1)
+	lines := screen.lines
+	copy(lines[row+n:screen.bottom+1], lines[row:screen.bottom+1-n])
+	for i := row; i < row+n; i++ {
+		lines[i] = this.newLine()
+	}
+	screen.pendingWrap = false
+}
+
+// Delete lines at row, pulling lines up and blank lines in at the bottom of
+// the scroll region
+func (this *Terminal) deleteLines(row, n int) {
+	screen := this.screen
+	n = min(n, screen.bottom-row+1)
+	lines := screen.lines
+	copy(lines[row:screen.bottom+1-n], lines[row+n:screen.bottom+1])
+	for i := screen.bottom + 1 - n; i <= screen.bottom; i++ {
+		lines[i] = this.newLine()
+	}
+	screen.pendingWrap = false
+}
+
+func (this *Terminal) insertCells(n int) {
+	screen := this.screen
+	line := screen.lines[screen.row]
+	n = min(n, this.width-screen.col)
+	copy(line.cells[screen.col+n:], line.cells[screen.col:this.width-n])
+	for i := screen.col; i < screen.col+n; i++ {
+		line.cells[i] = blankCell
+	}
+	line.wrapped = false
+	screen.pendingWrap = false
+}
+
+func (this *Terminal) deleteCells(n int) {
+	screen := this.screen
+	line := screen.lines[screen.row]
+	n = min(n, this.width-screen.col)
+	copy(line.cells[screen.col:], line.cells[screen.col+n:])
+	for i := this.width - n; i < this.width; i++ {
+		line.cells[i] = blankCell
+	}
+	line.wrapped = false
+	screen.pendingWrap = false
+}
+
+func (this *Terminal) eraseLine(mode int) {
+	screen := this.screen
+	line := screen.lines[screen.row]
+	from, to := screen.col, this.width
+	switch mode {
+	case 1:
+		from, to = 0, screen.col+1
+	case 2:
+		from = 0
+	}
+	for i := from; i < to; i++ {
+		line.cells[i] = blankCell
+	}
+	if to == this.width {
+		line.wrapped = false
+	}
+	screen.pendingWrap = false
+}
+
+func (this *Terminal) eraseDisplay(mode int) {
+	screen := this.screen
+	switch mode {
+	case 0:
+		this.eraseLine(0)
+		for i := screen.row + 1; i < this.height; i++ {
+			screen.lines[i] = this.newLine()
+		}
+	case 1:
+		this.eraseLine(1)
+		for i := 0; i < screen.row; i++ {
+			screen.lines[i] = this.newLine()
+		}
+	case 2:
+		for i := range screen.lines {
+			screen.lines[i] = this.newLine()
+		}
+	case 3:
+		this.scrollback = nil
+	}
+	screen.pendingWrap = false
+}
+
+// Switch to or from the alternate screen, which has no scrollback and is
+// discarded when we switch back
+func (this *Terminal) altScreen(on, saveCursor bool) {
+	if on == (this.mainScreen != nil) {
+		return
+	}
+
+	if on {
+		main := this.screen
+		if saveCursor {
+			main.savedRow, main.savedCol = main.row, main.col
+		}
+		this.mainScreen = main
+		this.screen = this.newScreen(false)
+		this.screen.row, this.screen.col = main.row, main.col
+		return
+	}
+
+	this.screen = this.mainScreen
+	this.mainScreen = nil
+	if saveCursor {
+		this.moveTo(this.screen.savedRow, this.screen.savedCol)
+	}
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTerminalProgressBar(t *testing.T) {
+	term := NewTerminal(20, 5, 100)
+	term.Write([]byte("$ download\r\n"))
+	for _, progress := range []string{"10%", "50%", "100%"} {
+		term.Write([]byte("\r\x1b[Kfetching " + progress))
+	}
+	term.Write([]byte("\r\ndone\r\n"))
+	assert.Equal(t, "$ download\nfetching 100%\ndone", term.Text())
+
+	// redrawing lines above with cursor up
+	term.Reset()
+	term.Write([]byte("a: waiting\r\nb: waiting\r\n"))
+	term.Write([]byte("\x1b[2A\x1b[2Ka: ok\x1b[2B\r"))
+	assert.Equal(t, "a: ok\nb: waiting", term.Text())
+	row, col := term.Cursor()
+	assert.Equal(t, 2, row)
+	assert.Equal(t, 0, col)
+}
+
+func TestTerminalScrollback(t *testing.T) {
+	term := NewTerminal(10, 3, 2)
+	term.Write([]byte("1\r\n2\r\n3\r\n4\r\n5\r\n6"))
+	assert.Equal(t, "4\n5\n6", term.Screen())
+	// only 2 lines of scrollback are kept
+	assert.Equal(t, "2\n3\n4\n5\n6", term.Text())
+
+	// long lines wrap on screen but are joined in the text
+	term.Reset()
+	term.Write([]byte("0123456789abcdef\r\nnext"))
+	assert.Equal(t, "0123456789\nabcdef\nnext", term.Screen())
+	assert.Equal(t, "0123456789abcdef\nnext", term.Text())
+
+	// a line that exactly fills the width doesn't wrap until the next
+	// character
+	term.Reset()
+	term.Write([]byte("0123456789\r\nx"))
+	assert.Equal(t, "0123456789\nx", term.Text())
+}
+
+func TestTerminalEditing(t *testing.T) {
+	term := NewTerminal(20, 5, 0)
+	// backspace, insert and delete characters, erase to end of line
+	term.Write([]byte("helo\b\b\x1b[1@l"))
+	assert.Equal(t, "hello", term.Screen())
+	term.Write([]byte("\r\x1b[2Pllo world\x1b[6D\x1b[K"))
+	assert.Equal(t, "llo", term.Screen())
+
+	// absolute positioning and clearing the screen
+	term.Write([]byte("\x1b[2J\x1b[3;5Hx\x1b[Hy"))
+	assert.Equal(t, "y\n\n    x", term.Screen())
+
+	// wide characters take two cells, combining characters join the one
+	// before
+	term.Reset()
+	term.Write([]byte("日本e\u0301!"))
+	assert.Equal(t, "日本e\u0301!", term.Screen())
+	_, col := term.Cursor()
+	assert.Equal(t, 6, col)
+
+	// escape sequences and UTF-8 split across writes
+	term.Reset()
+	term.Write([]byte("a\x1b["))
+	term.Write([]byte("31mb\xe6\x97"))
+	term.Write([]byte("\xa5\x1b]0;title\x07c"))
+	assert.Equal(t, "ab日c", term.Screen())
+}
+
+func TestTerminalAltScreen(t *testing.T) {
+	term := NewTerminal(20, 3, 10)
+	term.Write([]byte("$ vim\r\n"))
+	term.Write([]byte("\x1b[?1049h\x1b[H\x1b[2J~\r\n~\r\n~\r\n~"))
+	assert.Equal(t, "~\n~\n~", term.Screen())
+
+	term.Write([]byte("\x1b[?1049l$ "))
+	assert.Equal(t, "$ vim\n$", term.Screen())
+	assert.Equal(t, "$ vim\n$", term.Text())
+}
+
+func TestTerminalScrollRegion(t *testing.T) {
+	term := NewTerminal(10, 4, 10)
+	term.Write([]byte("header\r\n1\r\n2\r\nfooter"))
+	// scroll lines 2-3 only, the header and footer stay
+	term.Write([]byte("\x1b[2;3r\x1b[3;1H\n3"))
+	assert.Equal(t, "header\n2\n3\nfooter", term.Screen())
+	// lines scrolled out of a region aren't scrollback
+	assert.Equal(t, "header\n2\n3\nfooter", term.Text())
+
+	term.Resize(6, 2)
+	assert.Equal(t, "3\nfooter", term.Screen())
+	assert.Equal(t, "header\n2\n3\nfooter", term.Text())
+}
@@ -34,6 +34,9 @@ type CompletionRequest struct {
 	Tools         []ToolDefinition
 	Verbose       bool
 	TokenTimeout  time.Duration
+	// Ask the API to report token usage for streaming requests, not all
+	// OpenAI-compatible servers support this
+	IncludeUsage bool
 }
 
 type FunctionCall struct {
@@ -52,6 +55,16 @@ type CompletionResponse struct {
 	FunctionName       string
 	FunctionParameters string
 	ToolCalls          []*ToolCall
+	FinishReason       string
+	Usage              *Usage
+	// Time from sending a streaming request to receiving the first chunk
+	FirstTokenLatency time.Duration
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 type FunctionDefinition struct {
@@ -260,9 +273,11 @@ type StyleCodeblocksWriter struct {
 	normalColor   string
 	inlineColor   string
 	colorScheme   string
+	formatter     string // chroma formatter, "" to disable highlighting
 	state         int
 	langSuffix    *bytes.Buffer
 	blockBuffer   *bytes.Buffer
+	numBlocks     int // blocks so far, used to label each block [1], [2], ...
 	lock          sync.Mutex
 }
 
@@ -288,9 +303,31 @@ func NewStyleCodeblocksWriter(
 		inlineColor:   highlightColor,
 		terminalWidth: terminalWidth,
 		colorScheme:   colorScheme,
+		formatter:     Color256.ChromaFormatter(),
 	}
 }
 
+// Change the text colors and the code highlighting style
+func (this *StyleCodeblocksWriter) SetColors(normalColor, highlightColor, colorScheme string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if colorScheme == "" {
+		colorScheme = "monokai"
+	}
+	this.normalColor = normalColor
+	this.inlineColor = highlightColor
+	this.colorScheme = colorScheme
+}
+
+// Highlight code for the given color depth, ColorNone disables highlighting
+func (this *StyleCodeblocksWriter) SetColorDepth(depth ColorDepth) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.formatter = depth.ChromaFormatter()
+}
+
 func (this *StyleCodeblocksWriter) SetTerminalWidth(width int) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
@@ -302,6 +339,7 @@ func (this *StyleCodeblocksWriter) Reset() {
 	this.state = STATE_NEWLINE
 	this.langSuffix = nil
 	this.blockBuffer = nil
+	this.numBlocks = 0
 }
 
 // This writer receives bytes in a stream and looks for markdown code
@@ -378,8 +416,15 @@ func (this *StyleCodeblocksWriter) Write(p []byte) (n int, err error) {
 
 		case STATE_THREE_TICKS:
 			if char == '\n' {
+				// replace the fence with a label so the block can be referred to
+				// by number, e.g. to insert it into the command line
 				this.state = STATE_BLOCK_NEWLINE
-				toWrite.WriteByte('\r')
+				this.numBlocks++
+				label := fmt.Sprintf("[%d]", this.numBlocks)
+				if this.langSuffix != nil && this.langSuffix.Len() > 0 {
+					label += " " + strings.TrimSpace(this.langSuffix.String())
+				}
+				toWrite.WriteString(this.inlineColor + label + this.normalColor + "\n")
 				this.blockBuffer = new(bytes.Buffer)
 			} else {
 				// append to suffix
@@ -477,6 +522,11 @@ func lastLine(buff *bytes.Buffer, newlines int) []byte {
 }
 
 func (this *StyleCodeblocksWriter) EndOfCodeLine(w io.Writer) error {
+	if this.formatter == "" {
+		// the line was already written as is
+		return nil
+	}
+
 	temp := new(bytes.Buffer)
 	blockBufferString := this.blockBuffer.String()
 
@@ -484,7 +534,7 @@ func (this *StyleCodeblocksWriter) EndOfCodeLine(w io.Writer) error {
 		temp,
 		blockBufferString,
 		this.langSuffix.String(),
-		"terminal256",
+		this.formatter,
 		this.colorScheme)
 	if err != nil {
 		log.Printf("error highlighting code block: %s", err)
@@ -516,13 +566,47 @@ func (this *StyleCodeblocksWriter) EndOfCodeLine(w io.Writer) error {
 
 func (this *StyleCodeblocksWriter) EndOfCodeBlock(w io.Writer) error {
 	// render block
-	err := quick.Highlight(w, this.blockBuffer.String(), this.langSuffix.String(), "terminal256", "monokai")
+	err := quick.Highlight(w, this.blockBuffer.String(), this.langSuffix.String(), this.formatter, this.colorScheme)
 	if err != nil {
 		log.Printf("error highlighting code block: %s", err)
 	}
 	return err
 }
 
+// Returns the contents of the fenced code blocks in a markdown string, in
+// the same order StyleCodeblocksWriter numbers them. Lines are dedented by
+// the indentation of the opening fence.
+func ExtractCodeBlocks(markdown string) []string {
+	blocks := []string{}
+	var block []string
+	inBlock := false
+	indent := ""
+
+	for _, line := range strings.Split(markdown, "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(trimmed, "```") {
+			if inBlock {
+				blocks = append(blocks, strings.Join(block, "\n"))
+				block = nil
+			} else {
+				indent = line[:len(line)-len(trimmed)]
+			}
+			inBlock = !inBlock
+			continue
+		}
+		if inBlock {
+			block = append(block, strings.TrimPrefix(line, indent))
+		}
+	}
+
+	// an unterminated block at the end of an answer still counts
+	if inBlock && len(block) > 0 {
+		blocks = append(blocks, strings.Join(block, "\n"))
+	}
+
+	return blocks
+}
+
 type StripbackticksWriter struct {
 	Writer io.Writer
 	state  int
@@ -701,37 +785,3 @@ func NewStyledWriter(writer io.Writer, style lipgloss.Style) *StyledWriter {
 		Style:  adjustedStyle,
 	}
 }
-
-// Open a log file named butterfish.log in a temporary directory
-func InitLogging(ctx context.Context) string {
-	logDir := "/var/tmp"
-	_, err := os.Stat(logDir)
-	if err != nil {
-		// Create a temporary directory to hold the log file
-		logDir, err = os.MkdirTemp("", "butterfish")
-		if err != nil {
-			panic(err)
-		}
-	}
-
-	// Create a log file in the temporary directory
-	filename := filepath.Join(logDir, "butterfish.log")
-	logFile, err := os.OpenFile(filename,
-		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
-	if err != nil {
-		panic(err)
-	}
-
-	// Set the log output to the log file
-	log.SetOutput(logFile)
-
-	// Best effort to close the log file when the program exits
-	go func() {
-		<-ctx.Done()
-		if logFile != nil {
-			logFile.Close()
-		}
-	}()
-
-	return filename
-}
@@ -64,7 +64,7 @@ Foo`
 
 	writer.Write([]byte(testStr))
 
-	expected := "Hello\n\rconsole.log('Hi');\r\x1b[38;5;231mconsole.log('Hi');\x1b[0m\nNORMAL\nFoo"
+	expected := "Hello\nHIGHLIGHT[1]NORMAL\nconsole.log('Hi');\r\x1b[38;5;231mconsole.log('Hi');\x1b[0m\nNORMAL\nFoo"
 
 	// assert buffer equals expected
 	assert.Equal(t, expected, buffer.String())
@@ -82,7 +82,7 @@ Foo`
 
 	writer.Write([]byte(testStr))
 
-	expected := "Hello\n\rconsole.log(1);\r\x1b[38;5;148mconsole\x1b[0m\x1b[38;5;231m.\x1b[0m\x1b[38;5;148mlog\x1b[0m\x1b[38;5;231m(\x1b[0m\x1b[38;5;141m1\x1b[0m\x1b[38;5;231m);\x1b[0m\nNORMAL\nFoo"
+	expected := "Hello\nHIGHLIGHT[1] javascriptNORMAL\nconsole.log(1);\r\x1b[38;5;148mconsole\x1b[0m\x1b[38;5;231m.\x1b[0m\x1b[38;5;148mlog\x1b[0m\x1b[38;5;231m(\x1b[0m\x1b[38;5;141m1\x1b[0m\x1b[38;5;231m);\x1b[0m\nNORMAL\nFoo"
 
 	// assert buffer equals expected
 	assert.Equal(t, expected, buffer.String())
@@ -127,8 +127,31 @@ Foo`
 
 	writer.Write([]byte(testStr))
 
-	expected := "Hello\n\n   \r   console.log(1);\r\x1b[38;5;231m   \x1b[0m\x1b[38;5;148mconsole\x1b[0m\x1b[38;5;231m.\x1b[0m\x1b[38;5;148mlog\x1b[0m\x1b[38;5;231m(\x1b[0m\x1b[38;5;141m1\x1b[0m\x1b[38;5;231m);\x1b[0m\n   NORMAL\nFoo"
+	expected := "Hello\n\n   HIGHLIGHT[1] javascriptNORMAL\n   console.log(1);\r\x1b[38;5;231m   \x1b[0m\x1b[38;5;148mconsole\x1b[0m\x1b[38;5;231m.\x1b[0m\x1b[38;5;148mlog\x1b[0m\x1b[38;5;231m(\x1b[0m\x1b[38;5;141m1\x1b[0m\x1b[38;5;231m);\x1b[0m\n   NORMAL\nFoo"
 
 	// assert buffer equals expected
 	assert.Equal(t, expected, buffer.String())
 }
+
+func TestCodeblockNumbering(t *testing.T) {
+	buffer, writer := getStyleCodeblocksWriter()
+
+	writer.Write([]byte("```\nls\n```\nthen\n```bash\npwd\n```\n"))
+	assert.Contains(t, buffer.String(), "HIGHLIGHT[1]NORMAL\n")
+	assert.Contains(t, buffer.String(), "HIGHLIGHT[2] bashNORMAL\n")
+
+	// numbering restarts for the next answer
+	writer.Reset()
+	buffer.Reset()
+	writer.Write([]byte("```\nls\n```\n"))
+	assert.Contains(t, buffer.String(), "HIGHLIGHT[1]NORMAL\n")
+}
+
+func TestExtractCodeBlocks(t *testing.T) {
+	markdown := "Try this:\n```bash\nls -l\n```\nOr:\n  ```\n  cd /tmp\n    pwd\n  ```\n```\nunterminated"
+
+	assert.Equal(t,
+		[]string{"ls -l", "cd /tmp\n  pwd", "unterminated"},
+		ExtractCodeBlocks(markdown))
+	assert.Equal(t, []string{}, ExtractCodeBlocks("no code here"))
+}